@@ -0,0 +1,351 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"pranavdb/page"
+	"slices"
+)
+
+// Row operations for rowFormatHeap files. The exported rowFile methods
+// dispatch here; see heapPage.go for the page layout.
+
+// heapAddr splits a row address into its page's file offset and slot.
+func heapAddr(addr int64) (pageOff int64, slot int, err error) {
+	pageOff = addr &^ (page.PageSize - 1)
+	if pageOff < DataHeaderSize {
+		return 0, 0, fmt.Errorf("row address %d is inside the header", addr)
+	}
+	return pageOff, int(addr & (page.PageSize - 1)), nil
+}
+
+func heapPageOffset(pageNo int) int64 {
+	return DataHeaderSize + int64(pageNo)*page.PageSize
+}
+
+// room is the largest row a page would accept.
+func (hp *heapPage) room() int {
+	room := hp.freeSpace()
+	if hp.emptySlot() < 0 {
+		room -= heapSlotSize
+	}
+	return max(room, 0)
+}
+
+// loadHeapMap builds the free-space map by reading every page. Pages that
+// fail their checksum get no room, so nothing new is written into them.
+func (rw *rowFile) loadHeapMap() error {
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return fmt.Errorf("load free-space map: %w", err)
+	}
+	pages := int((size - DataHeaderSize + page.PageSize - 1) / page.PageSize)
+	rw.heapRoom = make([]int, max(pages, 0))
+	for i := range rw.heapRoom {
+		hp, err := rw.readHeapPage(heapPageOffset(i))
+		if err != nil {
+			continue
+		}
+		rw.heapRoom[i] = hp.room()
+	}
+	return nil
+}
+
+func (rw *rowFile) readHeapPage(pageOff int64) (*heapPage, error) {
+	buf := make([]byte, page.PageSize)
+	if _, err := rw.readAt(walTargetRows, buf, pageOff); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("page at %d is past the end of the file", pageOff)
+		}
+		return nil, fmt.Errorf("read page at %d: %w", pageOff, err)
+	}
+	hp := &heapPage{buf: buf}
+	if !hp.verify() {
+		return nil, fmt.Errorf("%w: page at %d fails its checksum", ErrRowCorrupt, pageOff)
+	}
+	return hp, nil
+}
+
+func (rw *rowFile) writeHeapPage(pageOff int64, hp *heapPage) error {
+	hp.seal()
+	if err := rw.writeAt(walTargetRows, hp.buf, pageOff); err != nil {
+		return fmt.Errorf("write page at %d: %w", pageOff, err)
+	}
+	rw.heapRoom[(pageOff-DataHeaderSize)/page.PageSize] = hp.room()
+	return nil
+}
+
+// heapPlace stores each payload on the first page with room for it, or on
+// new pages at the end of the file, and returns their addresses. Every page
+// it touches is written once, with one write per run of adjacent pages.
+func (rw *rowFile) heapPlace(payloads [][]byte) (addrs []int64, err error) {
+	// the free-space map is updated as rows are placed; put it back if
+	// the pages never make it to disk
+	saved := slices.Clone(rw.heapRoom)
+	defer func() {
+		if err != nil {
+			rw.heapRoom = saved
+		}
+	}()
+
+	dirty := make(map[int]*heapPage)
+	addrs = make([]int64, len(payloads))
+	for k, payload := range payloads {
+		if len(payload) > maxHeapRow {
+			return nil, fmt.Errorf("payload too large (%d bytes, max %d)", len(payload), maxHeapRow)
+		}
+		pageNo := len(rw.heapRoom)
+		for i, room := range rw.heapRoom {
+			if room >= len(payload) {
+				pageNo = i
+				break
+			}
+		}
+		hp := dirty[pageNo]
+		if hp == nil {
+			if pageNo == len(rw.heapRoom) {
+				hp = newHeapPage(make([]byte, page.PageSize))
+				rw.heapRoom = append(rw.heapRoom, 0)
+			} else {
+				p, err := rw.readHeapPage(heapPageOffset(pageNo))
+				if err != nil {
+					return nil, err
+				}
+				hp = p
+			}
+			dirty[pageNo] = hp
+		}
+
+		slot, ok := hp.insert(payload)
+		if !ok {
+			return nil, fmt.Errorf("page %d has no room for %d bytes", pageNo, len(payload))
+		}
+		rw.heapRoom[pageNo] = hp.room()
+		addrs[k] = heapPageOffset(pageNo) + int64(slot)
+	}
+
+	pageNos := make([]int, 0, len(dirty))
+	for pageNo := range dirty {
+		pageNos = append(pageNos, pageNo)
+	}
+	slices.Sort(pageNos)
+	for len(pageNos) > 0 {
+		run := 1
+		for run < len(pageNos) && pageNos[run] == pageNos[0]+run {
+			run++
+		}
+		buf := make([]byte, 0, run*page.PageSize)
+		for _, pageNo := range pageNos[:run] {
+			hp := dirty[pageNo]
+			hp.seal()
+			buf = append(buf, hp.buf...)
+		}
+		if err := rw.writeAt(walTargetRows, buf, heapPageOffset(pageNos[0])); err != nil {
+			return nil, fmt.Errorf("write pages at %d: %w", heapPageOffset(pageNos[0]), err)
+		}
+		pageNos = pageNos[run:]
+	}
+	return addrs, nil
+}
+
+func (rw *rowFile) heapWriteRow(values []any) (int64, error) {
+	addrs, err := rw.heapWriteRows([][]any{values})
+	if err != nil {
+		return 0, fmt.Errorf("WriteRow: %w", err)
+	}
+	return addrs[0], nil
+}
+
+func (rw *rowFile) heapWriteRows(rows [][]any) ([]int64, error) {
+	payloads := make([][]byte, len(rows))
+	for i, values := range rows {
+		payload, err := rw.encodeValues(values)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+		payloads[i] = payload
+	}
+	return rw.heapStore(payloads)
+}
+
+// heapStore places encoded rows and counts them in the header.
+func (rw *rowFile) heapStore(payloads [][]byte) ([]int64, error) {
+	var n int
+	for _, payload := range payloads {
+		n += len(payload)
+	}
+	addrs, err := rw.heapPlace(payloads)
+	if err != nil {
+		return nil, err
+	}
+
+	rw.rowCount += uint64(len(payloads))
+	rw.liveBytes += uint64(n)
+	if err := rw.writeHeader(); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// heapRow loads the page holding the row at addr.
+func (rw *rowFile) heapRow(addr int64) (hp *heapPage, pageOff int64, slot int, err error) {
+	pageOff, slot, err = heapAddr(addr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if hp, err = rw.readHeapPage(pageOff); err != nil {
+		return nil, 0, 0, err
+	}
+	if _, ok := hp.cell(slot); !ok {
+		return nil, 0, 0, fmt.Errorf("row at %d is free", addr)
+	}
+	return hp, pageOff, slot, nil
+}
+
+func (rw *rowFile) heapReadRowAt(addr int64) ([]any, error) {
+	hp, _, slot, err := rw.heapRow(addr)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRowAt: %w", err)
+	}
+	payload, _ := hp.cell(slot)
+	if rw.versioned {
+		v, err := parseVersion(payload)
+		if err != nil {
+			return nil, fmt.Errorf("ReadRowAt: row at %d: %w", addr, err)
+		}
+		if v.deleted {
+			return nil, fmt.Errorf("ReadRowAt: %w: row at %d is deleted", ErrNoRow, addr)
+		}
+		payload = v.body
+	}
+	values, err := rw.decodeValues(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRowAt: decode failed at offset %d: %w", addr, err)
+	}
+	return values, nil
+}
+
+func (rw *rowFile) heapFreeRowAt(addr int64) error {
+	hp, pageOff, slot, err := rw.heapRow(addr)
+	if err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+	payload, _ := hp.cell(slot)
+	n := len(payload)
+	if rw.versioned {
+		v, err := parseVersion(payload)
+		if err != nil {
+			return fmt.Errorf("FreeRowAt: row at %d: %w", addr, err)
+		}
+		payload = v.body // nil for a tombstone, which has no values
+	}
+	if payload != nil {
+		if err := rw.freeOverflow(payload); err != nil {
+			return fmt.Errorf("FreeRowAt: %w", err)
+		}
+	}
+	hp.remove(slot)
+	if err := rw.writeHeapPage(pageOff, hp); err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+
+	rw.dropRow(uint64(n))
+	if err := rw.writeHeader(); err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+	return nil
+}
+
+// heapUpdateRow rewrites the row in its slot when its page has room, and
+// otherwise moves it like the byte-offset format does.
+func (rw *rowFile) heapUpdateRow(addr int64, values []any, moved func(newOffset int64) error) (int64, error) {
+	hp, pageOff, slot, err := rw.heapRow(addr)
+	if err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: %w", err)
+	}
+	payload, err := rw.encodeValues(values)
+	if err != nil {
+		return 0, err
+	}
+	old, _ := hp.cell(slot)
+	old = append([]byte(nil), old...) // replace may overwrite it
+	oldLen := len(old)
+
+	if hp.replace(slot, payload) {
+		if err := rw.freeOverflow(old); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: %w", err)
+		}
+		if err := rw.writeHeapPage(pageOff, hp); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: %w", err)
+		}
+		rw.liveBytes += uint64(len(payload)) - uint64(oldLen)
+		if err := rw.writeHeader(); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: %w", err)
+		}
+		return addr, nil
+	}
+
+	addrs, err := rw.heapStore([][]byte{payload})
+	if err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: %w", err)
+	}
+	newAddr := addrs[0]
+	if moved != nil {
+		if err := moved(newAddr); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: row copied to %d: %w", newAddr, err)
+		}
+	}
+	if err := rw.heapFreeRowAt(addr); err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: row moved to %d: %w", newAddr, err)
+	}
+	return newAddr, nil
+}
+
+// heapCompact packs every live row into consecutive pages of dst and returns
+// the old-to-new address map along with dst's free-space map.
+func (rw *rowFile) heapCompact(dst *os.File) (map[int64]int64, []int, error) {
+	remap := make(map[int64]int64)
+	var room []int
+	out := newHeapPage(make([]byte, page.PageSize))
+	flush := func() error {
+		out.seal()
+		if _, err := dst.WriteAt(out.buf, heapPageOffset(len(room))); err != nil {
+			return err
+		}
+		room = append(room, out.room())
+		out = newHeapPage(out.buf)
+		return nil
+	}
+
+	for i := range rw.heapRoom {
+		hp, err := rw.readHeapPage(heapPageOffset(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		for slot := 0; slot < hp.numSlots(); slot++ {
+			payload, ok := hp.cell(slot)
+			if !ok {
+				continue
+			}
+			if !out.fits(len(payload)) {
+				if err := flush(); err != nil {
+					return nil, nil, err
+				}
+			}
+			newSlot, _ := out.insert(payload)
+			remap[heapPageOffset(i)+int64(slot)] = heapPageOffset(len(room)) + int64(newSlot)
+		}
+	}
+	if out.numSlots() > 0 {
+		if err := flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if rw.versioned {
+		if err := relinkVersions(dst, len(room), remap); err != nil {
+			return nil, nil, err
+		}
+	}
+	return remap, room, nil
+}
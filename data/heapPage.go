@@ -0,0 +1,201 @@
+package data
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"pranavdb/page"
+)
+
+/*
+Heap pages
+
+Files in rowFormatHeap store rows in fixed page.PageSize pages after the
+header. A row's address is its page's file offset plus its slot number;
+pages are page-aligned (DataHeaderSize is one page), so the two never
+collide and an address fits where a byte offset used to.
+
+Page layout:
+[0:4]   uint32 CRC32 of bytes [4:PageSize]
+[4:6]   uint16 slot count
+[6:8]   uint16 cell area start; cells grow down from the end of the page
+[8:..]  slots, each (offset uint16, length uint16); offset 0 marks an empty slot
+
+A slot keeps its number for as long as its row lives, so rows can be moved
+within the page (to defragment it) without changing their address.
+*/
+
+const (
+	heapHeaderSize = 8
+	heapSlotSize   = 4
+
+	// maxHeapRow is the largest payload that fits on an empty heap page.
+	maxHeapRow = page.PageSize - heapHeaderSize - heapSlotSize
+)
+
+type heapPage struct {
+	buf []byte // page.PageSize bytes
+}
+
+// newHeapPage initialises buf as an empty page.
+func newHeapPage(buf []byte) *heapPage {
+	clear(buf)
+	hp := &heapPage{buf: buf}
+	hp.setCellStart(len(buf))
+	return hp
+}
+
+// verify checks the page checksum.
+func (hp *heapPage) verify() bool {
+	return binary.LittleEndian.Uint32(hp.buf[0:4]) == crc32.ChecksumIEEE(hp.buf[4:])
+}
+
+// seal stores the page checksum; call it before writing the page out.
+func (hp *heapPage) seal() {
+	binary.LittleEndian.PutUint32(hp.buf[0:4], crc32.ChecksumIEEE(hp.buf[4:]))
+}
+
+func (hp *heapPage) numSlots() int { return int(binary.LittleEndian.Uint16(hp.buf[4:6])) }
+
+func (hp *heapPage) setNumSlots(n int) { binary.LittleEndian.PutUint16(hp.buf[4:6], uint16(n)) }
+
+func (hp *heapPage) cellStart() int { return int(binary.LittleEndian.Uint16(hp.buf[6:8])) }
+
+func (hp *heapPage) setCellStart(off int) { binary.LittleEndian.PutUint16(hp.buf[6:8], uint16(off)) }
+
+func (hp *heapPage) slot(i int) (off, n int) {
+	at := heapHeaderSize + i*heapSlotSize
+	return int(binary.LittleEndian.Uint16(hp.buf[at:])), int(binary.LittleEndian.Uint16(hp.buf[at+2:]))
+}
+
+func (hp *heapPage) setSlot(i, off, n int) {
+	at := heapHeaderSize + i*heapSlotSize
+	binary.LittleEndian.PutUint16(hp.buf[at:], uint16(off))
+	binary.LittleEndian.PutUint16(hp.buf[at+2:], uint16(n))
+}
+
+// cell returns the row stored in slot i, or false if the slot is empty or
+// out of range.
+func (hp *heapPage) cell(i int) ([]byte, bool) {
+	if i < 0 || i >= hp.numSlots() {
+		return nil, false
+	}
+	off, n := hp.slot(i)
+	if off == 0 || off < heapHeaderSize+hp.numSlots()*heapSlotSize || off+n > len(hp.buf) {
+		return nil, false
+	}
+	return hp.buf[off : off+n], true
+}
+
+// freeSpace returns the bytes available for cells and new slots, counting
+// holes left by removed rows.
+func (hp *heapPage) freeSpace() int {
+	used := heapHeaderSize + hp.numSlots()*heapSlotSize
+	for i := 0; i < hp.numSlots(); i++ {
+		if off, n := hp.slot(i); off != 0 {
+			used += n
+		}
+	}
+	return len(hp.buf) - used
+}
+
+// fits reports whether insert would accept a row of n bytes.
+func (hp *heapPage) fits(n int) bool {
+	need := n
+	if hp.emptySlot() < 0 {
+		need += heapSlotSize
+	}
+	return need <= hp.freeSpace()
+}
+
+func (hp *heapPage) emptySlot() int {
+	for i := 0; i < hp.numSlots(); i++ {
+		if off, _ := hp.slot(i); off == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// insert stores row in an empty slot, or a new one, and returns the slot.
+func (hp *heapPage) insert(row []byte) (int, bool) {
+	if !hp.fits(len(row)) {
+		return 0, false
+	}
+	i := hp.emptySlot()
+	if i < 0 {
+		i = hp.numSlots()
+		// the directory grows into the free space, so make it contiguous first
+		if hp.cellStart()-(heapHeaderSize+i*heapSlotSize) < heapSlotSize+len(row) {
+			hp.compact()
+		}
+		hp.setNumSlots(i + 1)
+		hp.setSlot(i, 0, 0)
+	}
+	hp.place(i, row)
+	return i, true
+}
+
+// replace swaps the row in slot i for row, keeping the slot number.
+func (hp *heapPage) replace(i int, row []byte) bool {
+	_, oldLen := hp.slot(i)
+	if len(row) > hp.freeSpace()+oldLen {
+		return false
+	}
+	hp.setSlot(i, 0, 0)
+	hp.place(i, row)
+	return true
+}
+
+// remove empties slot i. Trailing empty slots are dropped from the directory.
+func (hp *heapPage) remove(i int) {
+	hp.setSlot(i, 0, 0)
+	n := hp.numSlots()
+	for n > 0 {
+		if off, _ := hp.slot(n - 1); off != 0 {
+			break
+		}
+		n--
+		hp.setSlot(n, 0, 0)
+	}
+	hp.setNumSlots(n)
+	if n == 0 {
+		hp.setCellStart(len(hp.buf))
+	}
+}
+
+// place writes row into the cell area for the empty slot i, compacting the
+// page first if its free space is fragmented. The caller has checked that
+// the row fits.
+func (hp *heapPage) place(i int, row []byte) {
+	dirEnd := heapHeaderSize + hp.numSlots()*heapSlotSize
+	if hp.cellStart()-dirEnd < len(row) {
+		hp.compact()
+	}
+	off := hp.cellStart() - len(row)
+	copy(hp.buf[off:], row)
+	hp.setCellStart(off)
+	hp.setSlot(i, off, len(row))
+}
+
+// compact moves the rows to the end of the page so all free space is
+// contiguous. Slot numbers do not change.
+func (hp *heapPage) compact() {
+	n := hp.numSlots()
+	rows := make([][]byte, n)
+	for i := range rows {
+		if row, ok := hp.cell(i); ok {
+			rows[i] = append([]byte(nil), row...)
+		}
+	}
+	end := len(hp.buf)
+	for i, row := range rows {
+		if off, _ := hp.slot(i); off == 0 {
+			continue
+		}
+		end -= len(row)
+		copy(hp.buf[end:], row)
+		hp.setSlot(i, end, len(row))
+	}
+	clear(hp.buf[heapHeaderSize+n*heapSlotSize : end])
+	hp.setCellStart(end)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package data
+
+import (
+	"errors"
+	"os"
+)
+
+// Platforms without syscall.Mmap read through the file.
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
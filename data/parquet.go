@@ -0,0 +1,469 @@
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+/*
+Parquet export
+
+ExportParquet writes a table as a Parquet file: uncompressed, PLAIN-encoded
+values, one data page per column per row group. Column types map as:
+
+	INT        INT32
+	BIGINT     INT64
+	FLOAT      DOUBLE
+	BOOL       BOOLEAN
+	STRING     BYTE_ARRAY (UTF8)
+	BLOB       BYTE_ARRAY
+	DATE       INT32 (DATE, days since the epoch)
+	TIMESTAMP  INT64 (TIMESTAMP, microseconds since the epoch, UTC)
+	UUID       FIXED_LEN_BYTE_ARRAY(16) (UUID)
+	DECIMAL    BYTE_ARRAY (UTF8), since a Parquet DECIMAL column needs one
+	           scale and ours is per value
+
+Nullable columns are OPTIONAL, everything else REQUIRED.
+*/
+
+// ParquetRowGroupSize is the number of rows ExportParquet puts in each row group.
+const ParquetRowGroupSize = 64 * 1024
+
+// Parquet physical types, repetition types, converted types and encodings,
+// as numbered in parquet.thrift.
+const (
+	pqBoolean     = 0
+	pqInt32       = 1
+	pqInt64       = 2
+	pqDouble      = 5
+	pqByteArray   = 6
+	pqFixedLenBA  = 7
+	pqRequired    = 0
+	pqOptional    = 1
+	pqUTF8        = 0
+	pqDate        = 6
+	pqTimestampUS = 10
+	pqPlain       = 0
+	pqRLE         = 3
+)
+
+// pqColumn describes how one schema column is written.
+type pqColumn struct {
+	name      string
+	code      byte // type code without column flags
+	nullable  bool
+	physical  int32
+	converted int32                 // -1 for none
+	logical   func(t *thriftWriter) // writes the LogicalType union, or nil
+	typeLen   int32                 // FIXED_LEN_BYTE_ARRAY length
+}
+
+func parquetColumns(schemaCodes []byte, names []string) ([]pqColumn, error) {
+	if names != nil && len(names) != len(schemaCodes) {
+		return nil, fmt.Errorf("%d column names for %d columns", len(names), len(schemaCodes))
+	}
+	cols := make([]pqColumn, len(schemaCodes))
+	for i, code := range schemaCodes {
+		col := pqColumn{
+			name:      fmt.Sprintf("col%d", i),
+			code:      baseType(code),
+			nullable:  code&TypeFlagNullable != 0,
+			converted: -1,
+		}
+		if names != nil {
+			col.name = names[i]
+		}
+		switch col.code {
+		case TypeCodeInt:
+			col.physical = pqInt32
+		case TypeCodeBigInt:
+			col.physical = pqInt64
+		case TypeCodeFloat:
+			col.physical = pqDouble
+		case TypeCodeBool:
+			col.physical = pqBoolean
+		case TypeCodeString, TypeCodeDecimal:
+			col.physical, col.converted = pqByteArray, pqUTF8
+			col.logical = func(t *thriftWriter) { t.emptyStruct(1) } // STRING
+		case TypeCodeBlob:
+			col.physical = pqByteArray
+		case TypeCodeDate:
+			col.physical, col.converted = pqInt32, pqDate
+			col.logical = func(t *thriftWriter) { t.emptyStruct(6) } // DATE
+		case TypeCodeTimestamp:
+			col.physical, col.converted = pqInt64, pqTimestampUS
+			col.logical = func(t *thriftWriter) { // TIMESTAMP
+				t.beginStruct(8)
+				t.boolField(1, true) // isAdjustedToUTC
+				t.beginStruct(2)     // unit
+				t.emptyStruct(2)     // MICROS
+				t.endStruct()
+				t.endStruct()
+			}
+		case TypeCodeUUID:
+			col.physical, col.typeLen = pqFixedLenBA, 16
+			col.logical = func(t *thriftWriter) { t.emptyStruct(14) } // UUID
+		default:
+			return nil, fmt.Errorf("column %d: type code %d has no Parquet mapping", i, code)
+		}
+		cols[i] = col
+	}
+	return cols, nil
+}
+
+// ExportParquet writes every live row to w as a Parquet file. columnNames
+// names the columns in the Parquet schema; nil names them col0, col1, ...
+// Mutations wait until the export is done.
+func (rw *rowFile) ExportParquet(w io.Writer, columnNames []string) error {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	cols, err := parquetColumns(rw.schemaCodes, columnNames)
+	if err != nil {
+		return fmt.Errorf("ExportParquet: %w", err)
+	}
+
+	pw := &parquetWriter{w: bufio.NewWriter(w), cols: cols}
+	if err := pw.write([]byte("PAR1")); err != nil {
+		return fmt.Errorf("ExportParquet: %w", err)
+	}
+
+	batch := make([][]any, 0, ParquetRowGroupSize)
+	err = rw.scanRows(func(_ int64, values []any) error {
+		batch = append(batch, values)
+		if len(batch) == ParquetRowGroupSize {
+			if err := pw.writeRowGroup(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = pw.writeRowGroup(batch)
+	}
+	if err == nil {
+		err = pw.writeFooter()
+	}
+	if err == nil {
+		err = pw.w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("ExportParquet: %w", err)
+	}
+	return nil
+}
+
+type pqChunk struct {
+	offset, size, numValues int64
+}
+
+type pqRowGroup struct {
+	chunks  []pqChunk
+	numRows int64
+}
+
+type parquetWriter struct {
+	w      *bufio.Writer
+	pos    int64
+	cols   []pqColumn
+	groups []pqRowGroup
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.pos += int64(n)
+	return err
+}
+
+func (pw *parquetWriter) writeRowGroup(rows [][]any) error {
+	group := pqRowGroup{numRows: int64(len(rows))}
+	for i, col := range pw.cols {
+		data, err := encodeParquetPage(col, i, rows)
+		if err != nil {
+			return err
+		}
+
+		// PageHeader with a DataPageHeader
+		var t thriftWriter
+		t.i32Field(1, 0) // DATA_PAGE
+		t.i32Field(2, int32(len(data)))
+		t.i32Field(3, int32(len(data)))
+		t.beginStruct(5)
+		t.i32Field(1, int32(len(rows)))
+		t.i32Field(2, pqPlain)
+		t.i32Field(3, pqRLE)
+		t.i32Field(4, pqRLE)
+		t.endStruct()
+		t.stop()
+
+		chunk := pqChunk{offset: pw.pos, size: int64(len(t.buf) + len(data)), numValues: int64(len(rows))}
+		if err := pw.write(t.buf); err != nil {
+			return err
+		}
+		if err := pw.write(data); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+	}
+	pw.groups = append(pw.groups, group)
+	return nil
+}
+
+// encodeParquetPage returns the body of a version 1 data page for column i:
+// definition levels for OPTIONAL columns, then the non-null values.
+func encodeParquetPage(col pqColumn, i int, rows [][]any) ([]byte, error) {
+	var out []byte
+	if col.nullable {
+		levels := make([]byte, len(rows))
+		for r, row := range rows {
+			if row[i] != nil {
+				levels[r] = 1
+			}
+		}
+		rle := encodeRLELevels(levels)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(rle)))
+		out = append(out, rle...)
+	}
+
+	var bits, nbits int // BOOLEAN values are bit-packed, LSB first
+	for _, row := range rows {
+		v := row[i]
+		if v == nil {
+			continue
+		}
+		switch col.code {
+		case TypeCodeInt:
+			out = binary.LittleEndian.AppendUint32(out, uint32(v.(int32)))
+		case TypeCodeBigInt:
+			out = binary.LittleEndian.AppendUint64(out, uint64(v.(int64)))
+		case TypeCodeFloat:
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(v.(float64)))
+		case TypeCodeBool:
+			if v.(bool) {
+				bits |= 1 << nbits
+			}
+			if nbits++; nbits == 8 {
+				out = append(out, byte(bits))
+				bits, nbits = 0, 0
+			}
+		case TypeCodeString:
+			out = appendByteArray(out, []byte(v.(string)))
+		case TypeCodeDecimal:
+			out = appendByteArray(out, []byte(v.(Decimal).String()))
+		case TypeCodeBlob:
+			out = appendByteArray(out, v.([]byte))
+		case TypeCodeDate:
+			out = binary.LittleEndian.AppendUint32(out, uint32(int32(v.(time.Time).Unix()/86400)))
+		case TypeCodeTimestamp:
+			out = binary.LittleEndian.AppendUint64(out, uint64(v.(time.Time).UnixMicro()))
+		case TypeCodeUUID:
+			u := v.(UUID)
+			out = append(out, u[:]...)
+		default:
+			return nil, fmt.Errorf("column %d: unexpected type code %d", i, col.code)
+		}
+	}
+	if nbits > 0 {
+		out = append(out, byte(bits))
+	}
+	return out, nil
+}
+
+func appendByteArray(out, b []byte) []byte {
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+// encodeRLELevels encodes 0/1 definition levels with the RLE/bit-packing
+// hybrid, using RLE runs only: a varint (run length << 1) then the value in
+// one byte.
+func encodeRLELevels(levels []byte) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		out = append(out, levels[i])
+		i = j
+	}
+	return out
+}
+
+func (pw *parquetWriter) writeFooter() error {
+	var t thriftWriter
+	var numRows int64
+	for _, g := range pw.groups {
+		numRows += g.numRows
+	}
+
+	t.i32Field(1, 1) // version
+
+	// schema: the root, then one leaf per column
+	t.listField(2, thriftStruct, len(pw.cols)+1)
+	t.beginElem()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(pw.cols)))
+	t.endStruct()
+	for _, col := range pw.cols {
+		t.beginElem()
+		t.i32Field(1, col.physical)
+		if col.typeLen > 0 {
+			t.i32Field(2, col.typeLen)
+		}
+		if col.nullable {
+			t.i32Field(3, pqOptional)
+		} else {
+			t.i32Field(3, pqRequired)
+		}
+		t.stringField(4, col.name)
+		if col.converted >= 0 {
+			t.i32Field(6, col.converted)
+		}
+		if col.logical != nil {
+			t.beginStruct(10)
+			col.logical(&t)
+			t.endStruct()
+		}
+		t.endStruct()
+	}
+
+	t.i64Field(3, numRows)
+
+	t.listField(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		t.beginElem()
+		var total int64
+		t.listField(1, thriftStruct, len(g.chunks))
+		for i, c := range g.chunks {
+			col := pw.cols[i]
+			total += c.size
+			t.beginElem()
+			t.i64Field(2, c.offset) // file_offset
+			t.beginStruct(3)        // meta_data
+			t.i32Field(1, col.physical)
+			t.listField(2, thriftI32, 2)
+			t.i32Elem(pqPlain)
+			t.i32Elem(pqRLE)
+			t.listField(3, thriftBinary, 1)
+			t.stringElem(col.name)
+			t.i32Field(4, 0) // UNCOMPRESSED
+			t.i64Field(5, c.numValues)
+			t.i64Field(6, c.size)
+			t.i64Field(7, c.size)
+			t.i64Field(9, c.offset) // data_page_offset
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64Field(2, total)
+		t.i64Field(3, g.numRows)
+		t.endStruct()
+	}
+	t.stringField(6, "pranavdb")
+	t.stop()
+
+	if err := pw.write(t.buf); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(t.buf)))); err != nil {
+		return err
+	}
+	return pw.write([]byte("PAR1"))
+}
+
+// Thrift compact protocol, as much of it as the Parquet footer needs.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	buf    []byte
+	lastID int16
+	stack  []int16 // lastID of each enclosing struct
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) boolField(id int16, v bool) {
+	if v {
+		t.fieldHeader(id, thriftTrue)
+	} else {
+		t.fieldHeader(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.stringElem(s)
+}
+
+func (t *thriftWriter) listField(id int16, elemType byte, n int) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xF0|elemType)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+func (t *thriftWriter) i32Elem(v int32) { t.buf = binary.AppendVarint(t.buf, int64(v)) }
+
+func (t *thriftWriter) stringElem(s string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// beginStruct starts a struct-valued field; beginElem starts a struct list
+// element. Both are closed by endStruct.
+func (t *thriftWriter) beginStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginElem()
+}
+
+func (t *thriftWriter) beginElem() {
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.lastID = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) emptyStruct(id int16) {
+	t.beginStruct(id)
+	t.endStruct()
+}
+
+func (t *thriftWriter) stop() { t.buf = append(t.buf, 0) }
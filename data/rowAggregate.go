@@ -0,0 +1,205 @@
+package data
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+/*
+Aggregates
+
+Aggregate folds one column of every live row into a single value while the
+rows are scanned, so no more than one row is decoded at a time. NULLs are
+skipped, as in SQL:
+
+	COUNT  number of non-NULL values, as int64
+	SUM    INT and BIGINT as int64, FLOAT as float64, DECIMAL as Decimal
+	AVG    SUM / COUNT as float64
+	MIN    smallest value, of the column's Go type; any type but BOOL
+	MAX    largest value, likewise
+
+SUM, AVG, MIN and MAX of a column with no non-NULL values return nil.
+*/
+
+// AggOp is an aggregate function for Aggregate.
+type AggOp int
+
+const (
+	AggCount AggOp = iota
+	AggSum
+	AggMin
+	AggMax
+	AggAvg
+)
+
+func (op AggOp) String() string {
+	switch op {
+	case AggCount:
+		return "COUNT"
+	case AggSum:
+		return "SUM"
+	case AggMin:
+		return "MIN"
+	case AggMax:
+		return "MAX"
+	case AggAvg:
+		return "AVG"
+	}
+	return fmt.Sprintf("AggOp(%d)", int(op))
+}
+
+// Aggregate computes op over column col of every live row; see
+// "Aggregates" above.
+func (rw *rowFile) Aggregate(col int, op AggOp) (any, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	if col < 0 || col >= int(rw.columnCount) {
+		return nil, fmt.Errorf("Aggregate: column %d out of range (%d columns)", col, rw.columnCount)
+	}
+	code := baseType(rw.schemaCodes[col])
+	if !aggSupported(op, code) {
+		return nil, fmt.Errorf("Aggregate: %s of %s column %d not supported", op, codeToTypeName[code], col)
+	}
+
+	var (
+		count  int64
+		sumInt int64
+		sumF   float64
+		sumDec Decimal
+		best   any
+	)
+	err := rw.scanRows(func(offset int64, values []any) error {
+		v := values[col]
+		if v == nil {
+			return nil
+		}
+		count++
+		switch op {
+		case AggSum, AggAvg:
+			switch n := v.(type) {
+			case int32:
+				return addInt(&sumInt, int64(n), col)
+			case int64:
+				return addInt(&sumInt, n, col)
+			case float64:
+				sumF += n
+			case Decimal:
+				sumDec = addDecimal(sumDec, n)
+			}
+		case AggMin, AggMax:
+			if best == nil {
+				best = v
+				return nil
+			}
+			c := compareValues(v, best)
+			if (op == AggMin && c < 0) || (op == AggMax && c > 0) {
+				best = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Aggregate: %w", err)
+	}
+
+	if op == AggCount {
+		return count, nil
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	switch op {
+	case AggMin, AggMax:
+		return best, nil
+	case AggSum:
+		switch code {
+		case TypeCodeFloat:
+			return sumF, nil
+		case TypeCodeDecimal:
+			return sumDec, nil
+		}
+		return sumInt, nil
+	}
+	// AggAvg
+	switch code {
+	case TypeCodeFloat:
+		return sumF / float64(count), nil
+	case TypeCodeDecimal:
+		avg, _ := new(big.Rat).SetFrac(sumDec.Unscaled, new(big.Int).Mul(pow10(sumDec.Scale), big.NewInt(count))).Float64()
+		return avg, nil
+	}
+	return float64(sumInt) / float64(count), nil
+}
+
+func aggSupported(op AggOp, code byte) bool {
+	switch op {
+	case AggCount:
+		return true
+	case AggSum, AggAvg:
+		switch code {
+		case TypeCodeInt, TypeCodeBigInt, TypeCodeFloat, TypeCodeDecimal:
+			return true
+		}
+	case AggMin, AggMax:
+		return code != TypeCodeBool
+	}
+	return false
+}
+
+func addInt(sum *int64, n int64, col int) error {
+	if (n > 0 && *sum > math.MaxInt64-n) || (n < 0 && *sum < math.MinInt64-n) {
+		return fmt.Errorf("SUM of column %d overflows int64", col)
+	}
+	*sum += n
+	return nil
+}
+
+func pow10(n uint8) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// rescale returns d's unscaled value at scale (which must be >= d.Scale).
+func rescale(d Decimal, scale uint8) *big.Int {
+	u := d.Unscaled
+	if u == nil {
+		u = new(big.Int)
+	}
+	return new(big.Int).Mul(u, pow10(scale-d.Scale))
+}
+
+// addDecimal returns a + b at the larger of their scales.
+func addDecimal(a, b Decimal) Decimal {
+	scale := max(a.Scale, b.Scale)
+	return Decimal{Unscaled: new(big.Int).Add(rescale(a, scale), rescale(b, scale)), Scale: scale}
+}
+
+// compareValues orders two decoded values of the same column type.
+func compareValues(a, b any) int {
+	switch x := a.(type) {
+	case int32:
+		return cmp.Compare(x, b.(int32))
+	case int64:
+		return cmp.Compare(x, b.(int64))
+	case float64:
+		return cmp.Compare(x, b.(float64))
+	case string:
+		return strings.Compare(x, b.(string))
+	case []byte:
+		return bytes.Compare(x, b.([]byte))
+	case time.Time:
+		return x.Compare(b.(time.Time))
+	case Decimal:
+		y := b.(Decimal)
+		scale := max(x.Scale, y.Scale)
+		return rescale(x, scale).Cmp(rescale(y, scale))
+	case UUID:
+		y := b.(UUID)
+		return bytes.Compare(x[:], y[:])
+	}
+	return 0
+}
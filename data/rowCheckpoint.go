@@ -0,0 +1,133 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Checkpointer
+
+The WAL checkpoints itself once it grows past walCheckpointSize, which under
+a light write load can take a long time, leaving a long log to replay after
+a crash. StartCheckpointer adds a goroutine that checkpoints every interval
+as well; Checkpoint takes one on demand. Either does nothing while the log
+is empty.
+
+A checkpoint syncs the row file and its side files, truncates the log, then
+records itself in the header and syncs again:
+
+bytes 1036..1043 -> checkpoints taken over the file's life (uint64)
+bytes 1044..1051 -> time of the last one, Unix nanoseconds (int64)
+
+The record is written straight to the file rather than through the log. A
+crash before it is synced loses only the record, not the checkpoint.
+*/
+
+const checkpointSize = 16
+
+func putCheckpoint(b []byte, count uint64, at int64) {
+	binary.LittleEndian.PutUint64(b[0:8], count)
+	binary.LittleEndian.PutUint64(b[8:16], uint64(at))
+}
+
+func readCheckpoint(b []byte) (count uint64, at int64) {
+	return binary.LittleEndian.Uint64(b[0:8]), int64(binary.LittleEndian.Uint64(b[8:16]))
+}
+
+// recordCheckpoint counts a checkpoint just taken and writes it to the header.
+func (rw *rowFile) recordCheckpoint() error {
+	rw.checkpoints++
+	rw.checkpointAt = time.Now().UnixNano()
+	b := make([]byte, checkpointSize)
+	putCheckpoint(b, rw.checkpoints, rw.checkpointAt)
+	if _, err := rw.file.WriteAt(b, checkpointOffset); err != nil {
+		return fmt.Errorf("record checkpoint: %w", err)
+	}
+	return rw.file.Sync()
+}
+
+// Checkpoint syncs the files and truncates the WAL now; see "Checkpointer"
+// above.
+func (rw *rowFile) Checkpoint() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return fmt.Errorf("Checkpoint: file not open")
+	}
+	if rw.readOnly {
+		return fmt.Errorf("Checkpoint: %w", ErrReadOnly)
+	}
+	return rw.checkpoint()
+}
+
+// LastCheckpoint returns how many checkpoints the file has recorded and when
+// the last one was taken; the time is zero before the first.
+func (rw *rowFile) LastCheckpoint() (count uint64, at time.Time) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	if rw.checkpoints == 0 {
+		return 0, time.Time{}
+	}
+	return rw.checkpoints, time.Unix(0, rw.checkpointAt)
+}
+
+// checkpointer runs Checkpoint on a timer.
+type checkpointer struct {
+	err  error // first error hit by a background checkpoint
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (c *checkpointer) run(rw *rowFile, interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		if err := rw.Checkpoint(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+}
+
+// StartCheckpointer checkpoints the file every interval from a background
+// goroutine until StopCheckpointer or Close.
+func (rw *rowFile) StartCheckpointer(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("StartCheckpointer: interval must be positive")
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.readOnly {
+		return fmt.Errorf("StartCheckpointer: %w", ErrReadOnly)
+	}
+	if rw.checkpointer != nil {
+		return errors.New("checkpointer already running")
+	}
+	c := &checkpointer{stop: make(chan struct{}), done: make(chan struct{})}
+	rw.checkpointer = c
+	go c.run(rw, interval)
+	return nil
+}
+
+// StopCheckpointer stops the background checkpoints and returns the first
+// error any of them hit.
+func (rw *rowFile) StopCheckpointer() error {
+	rw.mu.Lock()
+	c := rw.checkpointer
+	rw.checkpointer = nil
+	rw.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.done
+	return c.err
+}
@@ -5,28 +5,168 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
+	"time"
 )
 
 
 const (
-	TypeCodeInt    byte = 1
-	TypeCodeFloat  byte = 2
-	TypeCodeString byte = 3
+	TypeCodeInt       byte = 1
+	TypeCodeFloat     byte = 2
+	TypeCodeString    byte = 3
+	TypeCodeBool      byte = 4
+	TypeCodeBigInt    byte = 5
+	TypeCodeDate      byte = 6
+	TypeCodeTimestamp byte = 7
+	TypeCodeDecimal   byte = 8
+	TypeCodeBlob      byte = 9
+	TypeCodeUUID      byte = 10
+
+	// TypeFlagNullable is OR-ed into a column's type code when the column
+	// accepts nil. Schema strings mark such columns with a "?" suffix.
+	TypeFlagNullable byte = 0x80
+
+	// TypeFlagCompressed is OR-ed into a STRING or BLOB column's type code
+	// when its values are stored compressed; schema strings use a "~"
+	// suffix. See rowCompress.go.
+	TypeFlagCompressed byte = 0x40
 )
 
 var typeNameToCode = map[string]byte{
-	"INT":    TypeCodeInt,
-	"FLOAT":  TypeCodeFloat,
-	"STRING": TypeCodeString,
+	"INT":       TypeCodeInt,
+	"FLOAT":     TypeCodeFloat,
+	"STRING":    TypeCodeString,
+	"BOOL":      TypeCodeBool,
+	"BOOLEAN":   TypeCodeBool,
+	"BIGINT":    TypeCodeBigInt,
+	"INT64":     TypeCodeBigInt,
+	"DATE":      TypeCodeDate,
+	"TIMESTAMP": TypeCodeTimestamp,
+	"DECIMAL":   TypeCodeDecimal,
+	"BLOB":      TypeCodeBlob,
+	"UUID":      TypeCodeUUID,
 }
 
 var codeToTypeName = map[byte]string{
-	TypeCodeInt:    "int",
-	TypeCodeFloat:  "float",
-	TypeCodeString: "string",
+	TypeCodeInt:       "int",
+	TypeCodeFloat:     "float",
+	TypeCodeString:    "string",
+	TypeCodeBool:      "bool",
+	TypeCodeBigInt:    "bigint",
+	TypeCodeDate:      "date",
+	TypeCodeTimestamp: "timestamp",
+	TypeCodeDecimal:   "decimal",
+	TypeCodeBlob:      "blob",
+	TypeCodeUUID:      "uuid",
 }
 
 // this file contains the code to encode and decode
+//
+// When the schema has a nullable column, every payload starts with a null
+// bitmap of ceil(columns/8) bytes; bit i (LSB first) set means column i is
+// NULL and has no encoded value. Schemas without nullable columns have no
+// bitmap, so their rows are laid out exactly as before.
+//
+// Column encodings:
+//
+//	INT        any Go integer in int32 range -> 4 bytes, decodes as int32
+//	FLOAT      float64 (or float32) -> 8 bytes
+//	STRING     string -> uint16 length + bytes
+//	BOOL       bool -> 1 byte
+//	BIGINT     any Go integer in int64 range -> 8 bytes, decodes as int64
+//	DATE       time.Time -> int32 days since 1970-01-01, decodes as UTC midnight
+//	TIMESTAMP  time.Time -> int64 Unix seconds + uint32 nanoseconds, decodes as UTC
+//	DECIMAL    Decimal -> scale byte, sign byte, uint16 length + magnitude bytes
+//	BLOB       []byte -> uint16 length + bytes, decodes as a copy
+//	UUID       UUID (or [16]byte) -> 16 bytes, decodes as UUID
+//
+// A STRING or BLOB moved to the overflow file is stored as a length of
+// 0xFFFF, the uint32 value length and the uint64 first overflow page; see
+// rowOverflow.go.
+
+// ErrTypeMismatch is returned when a value does not match its column's type,
+// including nil for a column that is not nullable.
+type ErrTypeMismatch struct {
+	Column   int    // position in the schema
+	Expected string // column type name, e.g. "int"
+	Got      string // Go type of the value, e.g. "float64", or "nil"
+}
+
+func (e *ErrTypeMismatch) Error() string {
+	return fmt.Sprintf("column %d: expected %s, got %s", e.Column, e.Expected, e.Got)
+}
+
+// ErrOutOfRange is returned when a value has an accepted Go type but does
+// not fit its column, e.g. an int64 beyond int32 for an INT column.
+type ErrOutOfRange struct {
+	Column int
+	Type   string // column type name
+	Value  any
+}
+
+func (e *ErrOutOfRange) Error() string {
+	return fmt.Sprintf("column %d: %v out of %s range", e.Column, e.Value, e.Type)
+}
+
+func typeMismatch(column int, code byte, val any) error {
+	got := "nil"
+	if val != nil {
+		got = fmt.Sprintf("%T", val)
+	}
+	return &ErrTypeMismatch{Column: column, Expected: codeToTypeName[baseType(code)], Got: got}
+}
+
+// intValue converts any Go integer to int64. fits is false for a uint64
+// beyond math.MaxInt64.
+func intValue(val any) (v int64, ok, fits bool) {
+	switch n := val.(type) {
+	case int:
+		return int64(n), true, true
+	case int8:
+		return int64(n), true, true
+	case int16:
+		return int64(n), true, true
+	case int32:
+		return int64(n), true, true
+	case int64:
+		return n, true, true
+	case uint:
+		return int64(n), true, uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true, true
+	case uint16:
+		return int64(n), true, true
+	case uint32:
+		return int64(n), true, true
+	case uint64:
+		return int64(n), true, n <= math.MaxInt64
+	}
+	return 0, false, false
+}
+
+// hasNullable reports whether any column in the schema is nullable.
+func hasNullable(schemaCodes []byte) bool {
+	for _, code := range schemaCodes {
+		if code&TypeFlagNullable != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func nullBitmapSize(columns int) int { return (columns + 7) / 8 }
+
+// EncodeRow encodes values as a row payload under the given type codes,
+// keeping every value inline; DecodeRow reverses it. Rowfiles encode rows
+// this way, apart from values they move to the overflow file.
+func EncodeRow(schemaCodes []byte, values []any) ([]byte, error) {
+	return encodeRow(schemaCodes, values)
+}
+
+// DecodeRow decodes a payload written by EncodeRow.
+func DecodeRow(schemaCodes []byte, payload []byte) ([]any, error) {
+	return decodeRow(payload, schemaCodes)
+}
 
 func encodeRow(schemaCodes []byte, values []any) ([]byte, error) {
 	if len(schemaCodes) != len(values) {
@@ -35,44 +175,175 @@ func encodeRow(schemaCodes []byte, values []any) ([]byte, error) {
 
 	out := make([]byte, 0, 128)
 
+	// reserve the null bitmap; bits are set as NULLs are found
+	var nulls []byte
+	if hasNullable(schemaCodes) {
+		out = append(out, make([]byte, nullBitmapSize(len(schemaCodes)))...)
+		nulls = out[:nullBitmapSize(len(schemaCodes))]
+	}
+
 	for i, code := range schemaCodes {
 		val := values[i]
-		switch code {
+		if val == nil {
+			if code&TypeFlagNullable == 0 {
+				return nil, typeMismatch(i, code, nil)
+			}
+			nulls[i/8] |= 1 << (i % 8)
+			continue
+		}
+		if code&TypeFlagCompressed != 0 {
+			sv, err := storedValue(i, code, val)
+			if err != nil {
+				return nil, err
+			}
+			if ref, ok := sv.(overflowRef); ok {
+				out = append(out, ref.flag())
+				out = appendOverflowRef(out, ref)
+				continue
+			}
+			s := sv.(storedBytes)
+			if len(s.b) >= overflowMarker {
+				return nil, fmt.Errorf("encodeRow: field %d value too large (%d > %d)", i, len(s.b), overflowMarker-1)
+			}
+			out = append(out, s.flag())
+			out = binary.LittleEndian.AppendUint16(out, uint16(len(s.b)))
+			out = append(out, s.b...)
+			continue
+		}
+		switch baseType(code) {
 		case TypeCodeInt:
-			vi, ok := val.(int)
+			vi, ok, fits := intValue(val)
 			if !ok {
-				return nil, fmt.Errorf("encodeRow: field %d expected int, got %T", i, val)
+				return nil, typeMismatch(i, code, val)
 			}
-			if vi < math.MinInt32 || vi > math.MaxInt32 {
-				return nil, fmt.Errorf("encodeRow: field %d int out of int32 range", i)
+			if !fits || vi < math.MinInt32 || vi > math.MaxInt32 {
+				return nil, &ErrOutOfRange{Column: i, Type: "int", Value: val}
 			}
 			b := make([]byte, 4)
 			binary.LittleEndian.PutUint32(b, uint32(int32(vi)))
 			out = append(out, b...)
 
 		case TypeCodeFloat:
-			fv, ok := val.(float64)
-			if !ok {
-				return nil, fmt.Errorf("encodeRow: field %d expected float64, got %T", i, val)
+			var fv float64
+			switch v := val.(type) {
+			case float64:
+				fv = v
+			case float32:
+				fv = float64(v)
+			default:
+				return nil, typeMismatch(i, code, val)
 			}
 			b := make([]byte, 8)
 			binary.LittleEndian.PutUint64(b, math.Float64bits(fv))
 			out = append(out, b...)
 
 		case TypeCodeString:
+			if ref, ok := val.(overflowRef); ok {
+				out = appendOverflowRef(out, ref)
+				continue
+			}
 			s, ok := val.(string)
 			if !ok {
-				return nil, fmt.Errorf("encodeRow: field %d expected string, got %T", i, val)
+				return nil, typeMismatch(i, code, val)
 			}
 			sb := []byte(s)
-			if len(sb) > math.MaxUint16 {
-				return nil, fmt.Errorf("encodeRow: field %d string too large (%d > %d)", i, len(sb), math.MaxUint16)
+			if len(sb) >= overflowMarker {
+				return nil, fmt.Errorf("encodeRow: field %d string too large (%d > %d)", i, len(sb), overflowMarker-1)
 			}
 			lenb := make([]byte, 2)
 			binary.LittleEndian.PutUint16(lenb, uint16(len(sb)))
 			out = append(out, lenb...)
 			out = append(out, sb...)
 
+		case TypeCodeBool:
+			bv, ok := val.(bool)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			if bv {
+				out = append(out, 1)
+			} else {
+				out = append(out, 0)
+			}
+
+		case TypeCodeBigInt:
+			iv, ok, fits := intValue(val)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			if !fits {
+				return nil, &ErrOutOfRange{Column: i, Type: "bigint", Value: val}
+			}
+			out = binary.LittleEndian.AppendUint64(out, uint64(iv))
+
+		case TypeCodeDate:
+			t, ok := val.(time.Time)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			// the calendar date as written, whatever the location
+			y, m, d := t.Date()
+			days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+			if days < math.MinInt32 || days > math.MaxInt32 {
+				return nil, &ErrOutOfRange{Column: i, Type: "date", Value: val}
+			}
+			out = binary.LittleEndian.AppendUint32(out, uint32(int32(days)))
+
+		case TypeCodeTimestamp:
+			t, ok := val.(time.Time)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			out = binary.LittleEndian.AppendUint64(out, uint64(t.Unix()))
+			out = binary.LittleEndian.AppendUint32(out, uint32(t.Nanosecond()))
+
+		case TypeCodeDecimal:
+			dv, ok := val.(Decimal)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			var mag []byte
+			var sign byte
+			if dv.Unscaled != nil {
+				mag = dv.Unscaled.Bytes()
+				if dv.Unscaled.Sign() < 0 {
+					sign = 1
+				}
+			}
+			if len(mag) > math.MaxUint16 {
+				return nil, fmt.Errorf("encodeRow: field %d decimal too large", i)
+			}
+			out = append(out, dv.Scale, sign)
+			out = binary.LittleEndian.AppendUint16(out, uint16(len(mag)))
+			out = append(out, mag...)
+
+		case TypeCodeBlob:
+			if ref, ok := val.(overflowRef); ok {
+				out = appendOverflowRef(out, ref)
+				continue
+			}
+			bv, ok := val.([]byte)
+			if !ok {
+				return nil, typeMismatch(i, code, val)
+			}
+			if len(bv) >= overflowMarker {
+				return nil, fmt.Errorf("encodeRow: field %d blob too large (%d > %d)", i, len(bv), overflowMarker-1)
+			}
+			out = binary.LittleEndian.AppendUint16(out, uint16(len(bv)))
+			out = append(out, bv...)
+
+		case TypeCodeUUID:
+			var u UUID
+			switch v := val.(type) {
+			case UUID:
+				u = v
+			case [16]byte:
+				u = v
+			default:
+				return nil, typeMismatch(i, code, val)
+			}
+			out = append(out, u[:]...)
+
 		default:
 			return nil, fmt.Errorf("encodeRow: unknown type code %d at pos %d", code, i)
 		}
@@ -84,8 +355,34 @@ func encodeRow(schemaCodes []byte, values []any) ([]byte, error) {
 func decodeRow(payload []byte, schemaCodes []byte) ([]any, error) {
 	out := make([]any, 0, len(schemaCodes))
 	offset := 0
+
+	var nulls []byte
+	if hasNullable(schemaCodes) {
+		offset = nullBitmapSize(len(schemaCodes))
+		if offset > len(payload) {
+			return nil, errors.New("decodeRow: null bitmap out of bounds")
+		}
+		nulls = payload[:offset]
+	}
+
 	for i, code := range schemaCodes {
-		switch code {
+		if nulls != nil && nulls[i/8]&(1<<(i%8)) != 0 {
+			if code&TypeFlagNullable == 0 {
+				return nil, fmt.Errorf("decodeRow: field %d is NULL but not nullable", i)
+			}
+			out = append(out, nil)
+			continue
+		}
+		if code&TypeFlagCompressed != 0 {
+			v, n, err := decodeCompressed(code, payload[offset:])
+			if err != nil {
+				return nil, fmt.Errorf("decodeRow: field %d: %w", i, err)
+			}
+			out = append(out, v)
+			offset += n
+			continue
+		}
+		switch baseType(code) {
 		case TypeCodeInt:
 			// 4 bytes -> int32
 			if offset+4 > len(payload) {
@@ -112,6 +409,15 @@ func decodeRow(payload []byte, schemaCodes []byte) ([]any, error) {
 				return nil, fmt.Errorf("decodeRow: field %d string length out of bounds", i)
 			}
 			strLen := binary.LittleEndian.Uint16(payload[offset : offset+2])
+			if strLen == overflowMarker {
+				ref, err := readOverflowRef(payload[offset:])
+				if err != nil {
+					return nil, fmt.Errorf("decodeRow: field %d: %w", i, err)
+				}
+				out = append(out, ref)
+				offset += overflowRefSize
+				continue
+			}
 			offset += 2
 			if offset+int(strLen) > len(payload) {
 				return nil, fmt.Errorf("decodeRow: field %d string bytes out of bounds", i)
@@ -120,6 +426,83 @@ func decodeRow(payload []byte, schemaCodes []byte) ([]any, error) {
 			out = append(out, s)
 			offset += int(strLen)
 
+		case TypeCodeBool:
+			if offset+1 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d bool out of bounds", i)
+			}
+			out = append(out, payload[offset] != 0)
+			offset++
+
+		case TypeCodeBigInt:
+			if offset+8 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d bigint out of bounds", i)
+			}
+			out = append(out, int64(binary.LittleEndian.Uint64(payload[offset:offset+8])))
+			offset += 8
+
+		case TypeCodeDate:
+			if offset+4 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d date out of bounds", i)
+			}
+			days := int32(binary.LittleEndian.Uint32(payload[offset : offset+4]))
+			out = append(out, time.Unix(int64(days)*86400, 0).UTC())
+			offset += 4
+
+		case TypeCodeTimestamp:
+			if offset+12 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d timestamp out of bounds", i)
+			}
+			sec := int64(binary.LittleEndian.Uint64(payload[offset : offset+8]))
+			nsec := binary.LittleEndian.Uint32(payload[offset+8 : offset+12])
+			out = append(out, time.Unix(sec, int64(nsec)).UTC())
+			offset += 12
+
+		case TypeCodeDecimal:
+			// scale, sign, 2-byte magnitude length, magnitude
+			if offset+4 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d decimal header out of bounds", i)
+			}
+			scale, sign := payload[offset], payload[offset+1]
+			magLen := int(binary.LittleEndian.Uint16(payload[offset+2 : offset+4]))
+			offset += 4
+			if offset+magLen > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d decimal bytes out of bounds", i)
+			}
+			unscaled := new(big.Int).SetBytes(payload[offset : offset+magLen])
+			if sign != 0 {
+				unscaled.Neg(unscaled)
+			}
+			out = append(out, Decimal{Unscaled: unscaled, Scale: scale})
+			offset += magLen
+
+		case TypeCodeBlob:
+			if offset+2 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d blob length out of bounds", i)
+			}
+			blobLen := int(binary.LittleEndian.Uint16(payload[offset : offset+2]))
+			if blobLen == overflowMarker {
+				ref, err := readOverflowRef(payload[offset:])
+				if err != nil {
+					return nil, fmt.Errorf("decodeRow: field %d: %w", i, err)
+				}
+				out = append(out, ref)
+				offset += overflowRefSize
+				continue
+			}
+			offset += 2
+			if offset+blobLen > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d blob bytes out of bounds", i)
+			}
+			out = append(out, append([]byte(nil), payload[offset:offset+blobLen]...))
+			offset += blobLen
+
+		case TypeCodeUUID:
+			if offset+16 > len(payload) {
+				return nil, fmt.Errorf("decodeRow: field %d uuid out of bounds", i)
+			}
+			out = append(out, UUID(payload[offset:offset+16]))
+			offset += 16
+
 		default:
 			return nil, fmt.Errorf("decodeRow: unknown type code %d at pos %d", code, i)
 		}
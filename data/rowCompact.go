@@ -0,0 +1,313 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"pranavdb/filelock"
+)
+
+// Compact rewrites the live rows back to back into a fresh file, which then
+// replaces the original, so space held by freed rows is returned to the file
+// system. It returns a map from each live row's old offset to its new one;
+// anything that stores row offsets (such as an index) must be updated with
+// it. The RowID table and tombstones are updated here, so RowIDs stay valid.
+//
+// The new file is written and synced beside the original before being
+// renamed over it, so a crash leaves either the old file or the new one.
+// The RowID table is rewritten after the rename; a crash between the two
+// leaves it holding pre-compaction offsets.
+func (rw *rowFile) Compact() (map[int64]int64, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return nil, fmt.Errorf("Compact: file not open")
+	}
+	if rw.readOnly {
+		return nil, fmt.Errorf("Compact: %w", ErrReadOnly)
+	}
+	if rw.txn != nil {
+		return nil, fmt.Errorf("Compact: rowfile is in a transaction")
+	}
+	// logged writes are addressed in the old file, so none may be left to
+	// replay over the new one
+	if err := rw.checkpoint(); err != nil {
+		return nil, fmt.Errorf("Compact: %w", err)
+	}
+	path := rw.path
+	tmpPath := path + ".compact"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Compact: create %s: %w", tmpPath, err)
+	}
+	fail := func(err error) (map[int64]int64, error) {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("Compact: %w", err)
+	}
+	if err := filelock.Lock(tmp, filelock.Exclusive); err != nil {
+		return fail(err)
+	}
+
+	remap, heapRoom, err := rw.writeCompacted(tmp)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fail(err)
+	}
+
+	rw.unmap()
+	rw.file.Close()
+	rw.file = tmp
+	rw.firstFreePage = 0
+	rw.heapRoom = heapRoom
+	if rw.mmap {
+		if err := rw.remap(); err != nil {
+			rw.mmap = false
+			return remap, fmt.Errorf("Compact: remap: %w", err)
+		}
+	}
+	if err := rw.remapRowIDs(remap); err != nil {
+		return remap, fmt.Errorf("Compact: %w", err)
+	}
+	if err := rw.rewriteTombstones(remap); err != nil {
+		return remap, fmt.Errorf("Compact: %w", err)
+	}
+	return remap, nil
+}
+
+// writeCompacted writes the live rows back to back into dst, then a header
+// with the same schema and counts and an empty free list, and syncs it.
+func (rw *rowFile) writeCompacted(dst *os.File) (remap map[int64]int64, heapRoom []int, err error) {
+	if rw.format == rowFormatHeap {
+		remap, heapRoom, err = rw.heapCompact(dst)
+	} else {
+		remap, err = rw.copyBlocks(dst)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the header goes last
+	compacted := &rowFile{
+		file:        dst,
+		schemaCodes: rw.schemaCodes,
+		columnCount: rw.columnCount,
+		format:      rw.format,
+		rowCount:    rw.rowCount,
+		liveBytes:   rw.liveBytes,
+	}
+	if err := compacted.writeHeader(); err != nil {
+		return nil, nil, err
+	}
+	return remap, heapRoom, dst.Sync()
+}
+
+// CopyTo writes a compacted copy of the rowfile to path: the live rows back
+// to back under a fresh free list, with the RowID table remapped to match,
+// so RowIDs and tombstones carry over. The overflow file is copied as is. Reads of the
+// source carry on while the copy is made; mutations wait for it.
+func (rw *rowFile) CopyTo(path string) error {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	if rw.file == nil {
+		return fmt.Errorf("CopyTo: file not open")
+	}
+	if src, err := rw.file.Stat(); err == nil {
+		if dst, err := os.Stat(path); err == nil && os.SameFile(src, dst) {
+			return fmt.Errorf("CopyTo: %s is the source file", path)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("CopyTo: create %s: %w", path, err)
+	}
+	defer f.Close()
+	// lock before truncating so a file open in another process is left alone
+	if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	remap, _, err := rw.writeCompacted(f)
+	if err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+
+	// an old log beside path would replay over the copy
+	wal, err := openWAL(path, true)
+	if err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	wal.Close()
+	if err := copySidecar(rw.ids, path, openRowIDs, func(table []byte) { remapTable(table, remap) }); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	if err := copySidecar(rw.ovf, path, openOverflow, nil); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	if err := copySidecar(rw.tmb, path, openTombstones, func(table []byte) { remapTombstones(table, remap) }); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	return nil
+}
+
+// copySidecar copies src (which may be nil, for a read-only file without
+// one) to the sidecar of rowPath that open creates, passing the contents
+// through edit if it is not nil. Only small files should be edited, as they
+// are read whole.
+func copySidecar(src *os.File, rowPath string, open func(string, bool) (*os.File, error), edit func([]byte)) error {
+	dst, err := open(rowPath, true)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if src == nil {
+		return nil
+	}
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if edit == nil {
+		if _, err := io.Copy(dst, io.NewSectionReader(src, 0, info.Size())); err != nil {
+			return fmt.Errorf("copy %s: %w", src.Name(), err)
+		}
+		return dst.Sync()
+	}
+	buf := make([]byte, info.Size())
+	if _, err := src.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("read %s: %w", src.Name(), err)
+	}
+	edit(buf)
+	if _, err := dst.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("write %s: %w", dst.Name(), err)
+	}
+	return dst.Sync()
+}
+
+// Truncate deletes every row, leaving the file as just its header with the
+// same schema and format, and shrinks the overflow and tombstone files to
+// nothing. RowIDs are never reused, so the RowID table keeps its length
+// with every entry cleared.
+//
+// The row file is cut before the header is rewritten, so a crash between
+// the two loses no more than the counts: no row survives, and a free list
+// pointing past the end is rebuilt by the next open.
+func (rw *rowFile) Truncate() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return fmt.Errorf("Truncate: file not open")
+	}
+	if rw.readOnly {
+		return fmt.Errorf("Truncate: %w", ErrReadOnly)
+	}
+	// the log holds writes past the new end of the file
+	if err := rw.checkpoint(); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+	if err := rw.unmap(); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+
+	if err := rw.file.Truncate(DataHeaderSize); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+	rw.firstFreePage, rw.rowCount, rw.liveBytes = 0, 0, 0
+	rw.heapRoom = nil
+	if err := rw.writeHeader(); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+	if err := rw.file.Sync(); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+
+	if err := rw.clearRowIDs(); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+	if err := rw.ovf.Truncate(0); err != nil {
+		return fmt.Errorf("Truncate: overflow file: %w", err)
+	}
+	rw.ovfFree = 0
+	clear(rw.tombs)
+	if err := rw.rewriteTombstones(nil); err != nil {
+		return fmt.Errorf("Truncate: %w", err)
+	}
+
+	if rw.mmap {
+		if err := rw.remap(); err != nil {
+			rw.mmap = false
+			return fmt.Errorf("Truncate: remap: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyBlocks writes the live blocks of a byte-offset format file back to back
+// into dst.
+func (rw *rowFile) copyBlocks(dst *os.File) (map[int64]int64, error) {
+	remap := make(map[int64]int64)
+	next := int64(DataHeaderSize)
+	err := rw.scanBlocks(func(offset int64, block []byte, free bool) error {
+		if free {
+			return nil
+		}
+		if _, err := dst.WriteAt(block, next); err != nil {
+			return err
+		}
+		remap[offset] = next
+		next += int64(len(block))
+		return nil
+	})
+	return remap, err
+}
+
+// scanBlocks calls fn for every block after the header, in file order, with
+// the block's raw bytes (length prefix, payload and any padding).
+func (rw *rowFile) scanBlocks(fn func(offset int64, block []byte, free bool) error) error {
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return err
+	}
+
+	lenBuf := make([]byte, freeRowSize)
+	for offset := int64(DataHeaderSize); offset < size; {
+		n, err := rw.readAt(walTargetRows, lenBuf, offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read block at %d: %w", offset, err)
+		}
+		if n < 2 {
+			return fmt.Errorf("truncated block at %d", offset)
+		}
+
+		var blockLen int
+		free := binary.LittleEndian.Uint16(lenBuf[0:2]) == 0xFFFF
+		if free {
+			if n < freeRowSize {
+				return fmt.Errorf("truncated free block at %d", offset)
+			}
+			blockLen = 2 + int(binary.LittleEndian.Uint16(lenBuf[10:12]))
+		} else {
+			blockLen = blockSize(int(binary.LittleEndian.Uint16(lenBuf[0:2])))
+		}
+		if offset+int64(blockLen) > size {
+			return fmt.Errorf("block at %d runs past end of file", offset)
+		}
+
+		block := make([]byte, blockLen)
+		if _, err := rw.readAt(walTargetRows, block, offset); err != nil {
+			return fmt.Errorf("read block at %d: %w", offset, err)
+		}
+		if err := fn(offset, block, free); err != nil {
+			return err
+		}
+		offset += int64(blockLen)
+	}
+	return nil
+}
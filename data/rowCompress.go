@@ -0,0 +1,146 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+Column compression
+
+A STRING or BLOB column whose type code carries TypeFlagCompressed (schema
+strings mark it with a "~" suffix, e.g. "string~") stores each value behind
+a one-byte flag: compressNone, or compressDeflate when the value was
+DEFLATE-compressed because that made it smaller. After the flag comes the
+usual uint16 length and bytes, or an overflow reference to the stored
+(possibly compressed) bytes.
+*/
+
+const (
+	compressNone    byte = 0
+	compressDeflate byte = 1
+
+	// compressMin is the shortest value worth trying to compress.
+	compressMin = 64
+)
+
+// storedBytes is a compressed column's value as it is stored.
+type storedBytes struct {
+	b        []byte
+	deflated bool
+}
+
+func (s storedBytes) flag() byte {
+	if s.deflated {
+		return compressDeflate
+	}
+	return compressNone
+}
+
+// baseType strips the column flags from a type code.
+func baseType(code byte) byte {
+	return code &^ (TypeFlagNullable | TypeFlagCompressed)
+}
+
+func hasCompressed(schemaCodes []byte) bool {
+	for _, code := range schemaCodes {
+		if code&TypeFlagCompressed != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var deflaters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// compressValue returns b as a compressed column stores it: deflated when
+// that is shorter, as is otherwise.
+func compressValue(b []byte) storedBytes {
+	if len(b) < compressMin {
+		return storedBytes{b: b}
+	}
+	var buf bytes.Buffer
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(b); err != nil || w.Close() != nil || buf.Len() >= len(b) {
+		return storedBytes{b: b}
+	}
+	return storedBytes{b: buf.Bytes(), deflated: true}
+}
+
+// decodeCompressed decodes a compressed column's value from the start of b
+// and returns it with the bytes it took. Overflowed values come back as an
+// overflowRef for decodeValues to read.
+func decodeCompressed(code byte, b []byte) (any, int, error) {
+	if len(b) < 3 {
+		return nil, 0, fmt.Errorf("compressed value out of bounds")
+	}
+	flag := b[0]
+	if flag != compressNone && flag != compressDeflate {
+		return nil, 0, fmt.Errorf("%w: unknown compression flag %d", ErrRowCorrupt, flag)
+	}
+	n := int(binary.LittleEndian.Uint16(b[1:3]))
+	if n == overflowMarker {
+		ref, err := readOverflowRef(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		ref.deflated = flag == compressDeflate
+		return ref, 1 + overflowRefSize, nil
+	}
+	if 3+n > len(b) {
+		return nil, 0, fmt.Errorf("compressed value bytes out of bounds")
+	}
+	v, err := columnValue(code, b[3:3+n], flag == compressDeflate)
+	return v, 3 + n, err
+}
+
+// columnValue turns stored bytes back into a STRING or BLOB value.
+func columnValue(code byte, b []byte, deflated bool) (any, error) {
+	if deflated {
+		var err error
+		if b, err = inflateValue(b); err != nil {
+			return nil, err
+		}
+	} else if baseType(code) == TypeCodeBlob {
+		b = append([]byte(nil), b...)
+	}
+	if baseType(code) == TypeCodeString {
+		return string(b), nil
+	}
+	return b, nil
+}
+
+func inflateValue(b []byte) ([]byte, error) {
+	out, err := io.ReadAll(flate.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: inflate value: %v", ErrRowCorrupt, err)
+	}
+	return out, nil
+}
+
+// storedValue converts a STRING or BLOB value of compressed column i to its
+// stored form; values already converted pass through.
+func storedValue(i int, code byte, val any) (any, error) {
+	switch v := val.(type) {
+	case string:
+		if baseType(code) == TypeCodeString {
+			return compressValue([]byte(v)), nil
+		}
+	case []byte:
+		if baseType(code) == TypeCodeBlob {
+			return compressValue(v), nil
+		}
+	case storedBytes, overflowRef:
+		return v, nil
+	}
+	return nil, typeMismatch(i, code, val)
+}
@@ -1,34 +1,108 @@
 package data
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"pranavdb/filelock"
 	"strings"
+	"sync"
 )
 
 const (
 	DataHeaderSize = 4096
 	SchemaReserve  = 1000 // bytes reserved for 1-byte type codes (max columns)
+
+	// freeRowSize is the smallest slot a row occupies, so that freeing it
+	// never writes free-node metadata past its end.
+	freeRowSize = 12
+
+	// row statistics follow the schema area in the header
+	rowCountOffset   = 10 + SchemaReserve  // uint64 live rows
+	liveBytesOffset  = rowCountOffset + 8  // uint64 live payload bytes
+	rowFormatOffset  = liveBytesOffset + 8 // uint8 row format
+	versionedOffset  = rowFormatOffset + 1 // uint8 1 for versioned files, see rowVersions.go
+	lastTxOffset     = versionedOffset + 1 // uint64 last committed transaction ID
+	checkpointOffset = lastTxOffset + 8    // last checkpoint, see rowCheckpoint.go
+
+	// Row formats. Files written before the format byte existed read as
+	// rowFormatPlain.
+	rowFormatPlain = 0 // length-prefixed rows at byte offsets
+	rowFormatHeap  = 2 // rows in checksummed slotted pages, see heapPage.go
 )
 
+// ErrRowCorrupt is returned when a row's page fails its checksum, e.g. after
+// a torn write, or its bytes cannot be a row.
+var ErrRowCorrupt = errors.New("row is corrupt")
+
+// ErrReadOnly is returned when a write is attempted on a rowfile opened with
+// OpenRowfileReadOnly.
+var ErrReadOnly = errors.New("rowfile is open read-only")
+
+// ErrVersioned is returned by the offset-based mutations (WriteRow,
+// UpdateRowAt, FreeRowAt, ...) on a versioned rowfile, whose rows may only
+// change through the RowID methods.
+var ErrVersioned = errors.New("rowfile is versioned; use the RowID methods")
+
 
 
 // rowFile manages the table file header and schema codes.
+//
+// A rowFile is safe for concurrent use. Mutations (WriteRow, FreeRowAt,
+// UpdateRowAt, the RowID methods, Compact, Close) hold mu exclusively, so
+// each sees the free list and header the previous one left; reads hold it
+// shared and run alongside each other. A row offset is only meaningful
+// until the next mutation that could free or move the row.
 type rowFile struct {
+	mu            sync.RWMutex
 	file          *os.File
+	path          string // file's path; after Compact, file was opened under another name
 	firstFreePage uint64 // head of free list (byte offset), 0 means none
 	schemaCodes   []byte // len(schemaCodes) == columnCount
 	columnCount   uint16
+	format        byte     // rowFormat* constant
+	rowCount      uint64   // live rows
+	liveBytes     uint64   // payload bytes of live rows
+	ids           *os.File // RowID table, see rowIDs.go
+	ovf           *os.File // overflow values, see rowOverflow.go
+	ovfFree       uint64   // head of the overflow page free list
+	heapRoom      []int    // rowFormatHeap: free-space map, largest row each page accepts
+	wal           *os.File // write-ahead log, see rowWAL.go
+	walSize       int64
+	pending       []walWrite // writes of the mutation being logged
+	inTx          bool
+	txn           *rowTxn        // open transaction, see rowTxn.go
+	readOnly      bool           // opened with OpenRowfileReadOnly under a shared lock
+	mmap          bool           // serve reads from mapped, see rowMmap.go
+	mapped        []byte         // read-only mapping of file, nil when off
+	versioned     bool           // rows carry version headers, see rowVersions.go
+	lastTx        uint64         // versioned: last committed transaction ID
+	snapshots     map[uint64]int // versioned: open snapshots by transaction ID
+	tmb           *os.File       // tombstones, see rowTombstones.go
+	tombs         map[int64]tombstone
+	checkpoints   uint64        // checkpoints taken over the file's life
+	checkpointAt  int64         // Unix nanoseconds of the last one
+	checkpointer  *checkpointer // background checkpoints, if started
 }
 func (rf *rowFile) GetFirstFreePage() uint64 {
-    return rf.firstFreePage
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return rf.firstFreePage
 }
 
-// NewRowfile creates a new/truncated row file and writes the header.
-// schemaStr is comma-separated type names, e.g. "int,string,float".
+// NewRowfile creates a new/truncated row file and writes the header. Rows
+// are stored in slotted heap pages (rowFormatHeap); files written in the
+// older byte-offset formats can still be opened.
+// schemaStr is comma-separated type names, e.g. "int,string,float"; a
+// trailing "?" makes a column nullable, e.g. "int,string?,float".
 func NewRowfile(filepath string, schemaStr string) (*rowFile, error) {
+	return newRowfile(filepath, schemaStr, false)
+}
+
+func newRowfile(filepath string, schemaStr string, versioned bool) (*rowFile, error) {
 	codes, count, err := parseSchemaString(schemaStr)
 	if err != nil {
 		return nil, err
@@ -37,48 +111,141 @@ func NewRowfile(filepath string, schemaStr string) (*rowFile, error) {
 		return nil, fmt.Errorf("too many columns: %d (max %d)", count, SchemaReserve)
 	}
 
-	f, err := os.Create(filepath) // creates/truncates
+	// lock before truncating so a file open in another process is left alone
+	f, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("create rowfile: %w", err)
 	}
+	if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock rowfile: %w", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncate rowfile: %w", err)
+	}
 
 	rf := &rowFile{
 		file:          f,
+		path:          filepath,
 		firstFreePage: 0,
 		schemaCodes:   append([]byte(nil), codes...),
 		columnCount:   count,
+		format:        rowFormatHeap,
+		versioned:     versioned,
 	}
 
 	if err := rf.writeHeader(); err != nil {
 		f.Close()
 		return nil, fmt.Errorf("write header: %w", err)
 	}
+	if rf.ids, err = openRowIDs(filepath, true); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if rf.ovf, err = openOverflow(filepath, true); err != nil {
+		rf.Close()
+		return nil, err
+	}
+	if rf.tmb, err = openTombstones(filepath, true); err != nil {
+		rf.Close()
+		return nil, err
+	}
+	rf.tombs = make(map[int64]tombstone)
+	if rf.wal, err = openWAL(filepath, true); err != nil {
+		rf.Close()
+		return nil, err
+	}
 	return rf, nil
 }
 
 // OpenRowfile opens an existing row file and reads header into memory.
 func OpenRowfile(filepath string) (*rowFile, error) {
-	f, err := os.OpenFile(filepath, os.O_RDWR, 0)
+	return openRowfile(filepath, false)
+}
+
+// OpenRowfileReadOnly opens an existing row file under a shared lock, so any
+// number of readers can use it while no writer can. Mutations fail with
+// ErrReadOnly.
+func OpenRowfileReadOnly(filepath string) (*rowFile, error) {
+	return openRowfile(filepath, true)
+}
+
+func openRowfile(filepath string, readOnly bool) (*rowFile, error) {
+	flag, mode := os.O_RDWR, filelock.Exclusive
+	if readOnly {
+		flag, mode = os.O_RDONLY, filelock.Shared
+	}
+	f, err := os.OpenFile(filepath, flag, 0)
 	if err != nil {
 		return nil, fmt.Errorf("open rowfile: %w", err)
 	}
+	// advisory lock; released when the file is closed
+	if err := filelock.Lock(f, mode); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock rowfile: %w", err)
+	}
+
+	rf := &rowFile{file: f, path: filepath, readOnly: readOnly}
+	if readOnly {
+		// files from before RowIDs have no table; every lookup is ErrNoRow
+		if rf.ids, err = os.Open(filepath + ".rid"); err != nil && !os.IsNotExist(err) {
+			f.Close()
+			return nil, fmt.Errorf("open row ID table: %w", err)
+		}
+		if rf.ovf, err = os.Open(filepath + ".ovf"); err != nil && !os.IsNotExist(err) {
+			rf.Close()
+			return nil, fmt.Errorf("open overflow file: %w", err)
+		}
+		if rf.tmb, err = os.Open(filepath + ".tmb"); err != nil && !os.IsNotExist(err) {
+			rf.Close()
+			return nil, fmt.Errorf("open tombstone file: %w", err)
+		}
+		// only a writer can replay the log of a crashed one
+		if info, err := os.Stat(filepath + ".wal"); err == nil && info.Size() > 0 {
+			rf.Close()
+			return nil, fmt.Errorf("rowfile WAL needs recovery; open read-write first")
+		}
+	} else {
+		if rf.ids, err = openRowIDs(filepath, false); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if rf.ovf, err = openOverflow(filepath, false); err != nil {
+			rf.Close()
+			return nil, err
+		}
+		if rf.tmb, err = openTombstones(filepath, false); err != nil {
+			rf.Close()
+			return nil, err
+		}
+		if rf.wal, err = openWAL(filepath, false); err != nil {
+			rf.Close()
+			return nil, err
+		}
+		// finish any mutation a crash interrupted before trusting the header
+		if err := rf.recoverWAL(); err != nil {
+			rf.Close()
+			return nil, err
+		}
+	}
 
 	header := make([]byte, DataHeaderSize)
 	n, err := f.ReadAt(header, 0)
 	if err != nil {
-		f.Close()
+		rf.Close()
 		return nil, fmt.Errorf("read header: %w", err)
 	}
 	// need at least 10 bytes of metadata (2 + 8)
 	if n < 10 {
-		f.Close()
+		rf.Close()
 		return nil, fmt.Errorf("header too small: read %d bytes", n)
 	}
 
 	// Read column count (first)
 	colCount := binary.LittleEndian.Uint16(header[0:2])
 	if int(colCount) > SchemaReserve {
-		f.Close()
+		rf.Close()
 		return nil, fmt.Errorf("invalid columnCount in header: %d", colCount)
 	}
 
@@ -87,7 +254,7 @@ func OpenRowfile(filepath string) (*rowFile, error) {
 
 	// Ensure we have enough bytes to slice schema area
 	if n < 10+int(colCount) {
-		f.Close()
+		rf.Close()
 		return nil, fmt.Errorf("header truncated: expected at least %d bytes, got %d", 10+int(colCount), n)
 	}
 
@@ -95,18 +262,64 @@ func OpenRowfile(filepath string) (*rowFile, error) {
 	schemaBuf := make([]byte, colCount)
 	copy(schemaBuf, header[10:10+int(colCount)])
 
-	return &rowFile{
-		file:          f,
-		firstFreePage: firstFree,
-		schemaCodes:   schemaBuf,
-		columnCount:   colCount,
-	}, nil
+	rf.firstFreePage = firstFree
+	rf.schemaCodes = schemaBuf
+	rf.columnCount = colCount
+	rf.format = header[rowFormatOffset]
+	if rf.format != rowFormatPlain && rf.format != rowFormatHeap {
+		rf.Close()
+		return nil, fmt.Errorf("unsupported row format %d", rf.format)
+	}
+	rf.versioned = header[versionedOffset] == 1
+	rf.lastTx = binary.LittleEndian.Uint64(header[lastTxOffset:])
+	rf.checkpoints, rf.checkpointAt = readCheckpoint(header[checkpointOffset:])
+	rf.rowCount = binary.LittleEndian.Uint64(header[rowCountOffset:])
+	rf.liveBytes = binary.LittleEndian.Uint64(header[liveBytesOffset:])
+	if err := rf.loadOverflow(); err != nil {
+		rf.Close()
+		return nil, err
+	}
+	if err := rf.loadTombstones(); err != nil {
+		rf.Close()
+		return nil, err
+	}
+	if rf.format == rowFormatPlain && rf.rowCount == 0 && rf.liveBytes == 0 {
+		// written before the header kept counts, or empty
+		if err := rf.countRows(); err != nil {
+			rf.Close()
+			return nil, err
+		}
+		if rf.rowCount > 0 && !readOnly {
+			if err := rf.logged(rf.writeHeader); err != nil {
+				rf.Close()
+				return nil, err
+			}
+		}
+	}
+	if rf.format == rowFormatHeap {
+		if err := rf.loadHeapMap(); err != nil {
+			rf.Close()
+			return nil, err
+		}
+	} else if !readOnly {
+		if err := rf.checkFreeList(); err != nil {
+			rf.Close()
+			return nil, err
+		}
+	}
+	return rf, nil
 }
 
 // writeHeader persists header (columnCount, firstFreePage, schema codes).
 // bytes 0..1   -> columnCount (uint16)
 // bytes 2..9   -> firstFreePage (uint64)
 // bytes 10..(10+SchemaReserve-1) -> schema fixed area (we copy schemaCodes into start of it)
+// bytes 1010..1017 -> rowCount (uint64)
+// bytes 1018..1025 -> liveBytes (uint64)
+// byte  1026       -> row format
+// byte  1027       -> versioned flag
+// bytes 1028..1035 -> last transaction ID (uint64)
+// bytes 1036..1051 -> last checkpoint (see rowCheckpoint.go)
 func (rw *rowFile) writeHeader() error {
 	header := make([]byte, DataHeaderSize)
 
@@ -119,7 +332,16 @@ func (rw *rowFile) writeHeader() error {
 	// copy schema codes into fixed schema area starting at offset 10
 	copy(header[10:10+SchemaReserve], rw.schemaCodes)
 
-	if _, err := rw.file.WriteAt(header, 0); err != nil {
+	binary.LittleEndian.PutUint64(header[rowCountOffset:], rw.rowCount)
+	binary.LittleEndian.PutUint64(header[liveBytesOffset:], rw.liveBytes)
+	header[rowFormatOffset] = rw.format
+	if rw.versioned {
+		header[versionedOffset] = 1
+	}
+	binary.LittleEndian.PutUint64(header[lastTxOffset:], rw.lastTx)
+	putCheckpoint(header[checkpointOffset:], rw.checkpoints, rw.checkpointAt)
+
+	if err := rw.writeAt(walTargetRows, header, 0); err != nil {
 		return fmt.Errorf("writeHeader: %w", err)
 	}
 	return nil
@@ -161,48 +383,53 @@ func (rw *rowFile) readHeader() error {
 	rw.columnCount = colCount
 	rw.firstFreePage = firstFree
 	rw.schemaCodes = schemaBuf
+	rw.rowCount = binary.LittleEndian.Uint64(header[rowCountOffset:])
+	rw.liveBytes = binary.LittleEndian.Uint64(header[liveBytesOffset:])
+	rw.format = header[rowFormatOffset]
+	rw.versioned = header[versionedOffset] == 1
+	rw.lastTx = binary.LittleEndian.Uint64(header[lastTxOffset:])
+	rw.checkpoints, rw.checkpointAt = readCheckpoint(header[checkpointOffset:])
 
 	return nil
 }
 
 
-// allocatePage finds a free slot large enough to fit 'size' bytes (length-prefix + payload),
+// blockSize is the number of bytes a row with the given payload length
+// occupies. Rows only ever fill their block exactly (see allocatePage), so
+// the block a row lives in can always be found from its length field.
+func blockSize(payloadLen int) int {
+	return max(2+payloadLen, freeRowSize)
+}
+
+// allocatePage finds a free slot for a block of 'size' bytes (length-prefix + payload),
 // or appends at EOF. Free-node layout on disk:
 // [0:2]   uint16 marker = 0xFFFF
 // [2:10]  uint64 nextFreeOffset
-// [10:12] uint16 originalPayloadLen
+// [10:12] uint16 capacity (block size - 2)
+//
+// The smallest free block that fits is used (best-fit). A block with room to
+// spare is split: the tail becomes a new free block. Blocks whose leftover is
+// too small to hold a free node are skipped, so a reused block never has
+// bytes after the row that nothing accounts for.
 func (rw *rowFile) allocatePage(size int) (int64, error) {
-	var prevOffset uint64 = 0
+	var prevOffset, bestOffset, bestPrev, bestNext uint64
+	bestAvail := -1
 	currOffset := rw.firstFreePage
-	// Traverse free list (first-fit)
+	// Traverse free list, remembering the best fit
 	for currOffset != 0 {
-		header := make([]byte, 12)
-		if _, err := rw.file.ReadAt(header, int64(currOffset)); err != nil {
-			return 0, err
+		nextFree, capacity, err := rw.readFreeRowAt(int64(currOffset))
+		if err != nil {
+			return 0, fmt.Errorf("corrupted free page at offset %d: %w", currOffset, err)
 		}
 
-		marker := binary.LittleEndian.Uint16(header[0:2])
-		if marker != 0xFFFF {
-			return 0, fmt.Errorf("corrupted free page at offset %d", currOffset)
-		}
-
-		nextFree := binary.LittleEndian.Uint64(header[2:10])
-		payloadLen := int(binary.LittleEndian.Uint16(header[10:12]))
-
-		// Total size available = 2 (header len field) + payload
-		if 2+payloadLen >= size {
-			if prevOffset == 0 {
-				// First node in list
-				rw.firstFreePage = nextFree
-			} else {
-				// Patch "next" pointer of previous node to skip current
-				tmp := make([]byte, 8)
-				binary.LittleEndian.PutUint64(tmp, nextFree)
-				if _, err := rw.file.WriteAt(tmp, int64(prevOffset)+2); err != nil {
-					return 0, err
-				}
+		// Total size available = 2 (header len field) + capacity
+		avail := 2 + int(capacity)
+		fits := avail == size || avail-size >= freeRowSize
+		if fits && (bestAvail < 0 || avail < bestAvail) {
+			bestOffset, bestPrev, bestNext, bestAvail = currOffset, prevOffset, nextFree, avail
+			if avail == size {
+				break // exact fit, nothing better to find
 			}
-			return int64(currOffset), nil
 		}
 
 		// Advance to next node
@@ -210,62 +437,219 @@ func (rw *rowFile) allocatePage(size int) (int64, error) {
 		currOffset = nextFree
 	}
 
-	// No free slot fits → append at EOF
-	info, err := rw.file.Stat()
-	if err != nil {
+	if bestAvail < 0 {
+		// No free slot fits → append at EOF
+		return rw.size(walTargetRows)
+	}
+
+	// unlink the chosen block
+	if err := rw.setNextFree(bestPrev, bestNext); err != nil {
 		return 0, err
 	}
-	return info.Size(), nil
+
+	// split off the unused tail as a new free block at the head of the list
+	if rest := bestAvail - size; rest > 0 {
+		tail := int64(bestOffset) + int64(size)
+		if err := rw.writeFreeRow(tail, rw.firstFreePage, uint16(rest-2)); err != nil {
+			return 0, err
+		}
+		rw.firstFreePage = uint64(tail)
+	}
+
+	if err := rw.writeHeader(); err != nil {
+		return 0, err
+	}
+	return int64(bestOffset), nil
+}
+
+// setNextFree points the free node at prevOffset (or the list head, when
+// prevOffset is 0) at next.
+func (rw *rowFile) setNextFree(prevOffset, next uint64) error {
+	if prevOffset == 0 {
+		rw.firstFreePage = next
+		return nil
+	}
+	// Patch "next" pointer of previous node
+	tmp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tmp, next)
+	if err := rw.writeAt(walTargetRows, tmp, int64(prevOffset)+2); err != nil {
+		return err
+	}
+	return nil
 }
 
+// writeFreeRow writes a free node (marker, next pointer, capacity) at offset.
+// The marker goes last, so the block only reads as free once its metadata
+// is in place.
+func (rw *rowFile) writeFreeRow(offset int64, next uint64, capacity uint16) error {
+	node := make([]byte, freeRowSize)
+	binary.LittleEndian.PutUint64(node[2:10], next)
+	binary.LittleEndian.PutUint16(node[10:12], capacity)
+	if err := rw.writeAt(walTargetRows, node[2:], offset+2); err != nil {
+		return err
+	}
+	return rw.markFree(offset)
+}
 
+// markFree writes the free marker at offset.
+func (rw *rowFile) markFree(offset int64) error {
+	return rw.writeAt(walTargetRows, []byte{0xFF, 0xFF}, offset)
+}
 
+// WriteRow encodes values according to the schema and stores the row,
+// reusing a free slot when one fits. Nullable columns accept nil.
 func (rw *rowFile) WriteRow(values []any) (int64, error) {
-	// encode payload according to current schema codes
-	payload, err := encodeRow(rw.schemaCodes, values)
-	if err != nil {
-		return 0, err
+	if rw.versioned {
+		return 0, fmt.Errorf("WriteRow: %w", ErrVersioned)
 	}
+	var offset int64
+	err := rw.logged(func() (err error) {
+		offset, err = rw.writeRow(values)
+		return err
+	})
+	return offset, err
+}
 
-	// payload must fit in uint16
-	if len(payload) > math.MaxUint16 {
-		return 0, fmt.Errorf("WriteRow: payload too large (%d bytes, max %d)", len(payload), math.MaxUint16)
+func (rw *rowFile) writeRow(values []any) (int64, error) {
+	if rw.format == rowFormatHeap {
+		return rw.heapWriteRow(values)
+	}
+
+	// encode payload according to current schema codes
+	row, err := rw.encodeStored(values)
+	if err != nil {
+		return 0, fmt.Errorf("WriteRow: %w", err)
 	}
-	payloadLen := uint16(len(payload))
+	return rw.writeStored(row)
+}
 
-	// prepare buffer: 2 bytes length + payload
-	buf := make([]byte, 2+len(payload))
-	binary.LittleEndian.PutUint16(buf[0:2], payloadLen)
-	copy(buf[2:], payload)
+// writeStored stores a row already encoded by encodeStored.
+func (rw *rowFile) writeStored(row []byte) (int64, error) {
+	// prepare buffer: 2 bytes length + payload, padded so the slot can
+	// later hold free-node metadata
+	buf := make([]byte, blockSize(len(row)-2))
+	copy(buf, row)
 
 	// allocate append offset or reuse free
-	offset, err := rw.allocatePage(2 + len(payload))
+	offset, err := rw.allocatePage(len(buf))
 	if err != nil {
 		return 0, fmt.Errorf("WriteRow: allocatePage: %w", err)
 	}
 
 	// write to file
-	n, err := rw.file.WriteAt(buf, offset)
-	if err != nil {
+	if err := rw.writeAt(walTargetRows, buf, offset); err != nil {
 		return 0, fmt.Errorf("WriteRow: write failed at offset %d: %w", offset, err)
 	}
-	if n != len(buf) {
-		return 0, fmt.Errorf("WriteRow: short write at offset %d: wrote %d of %d", offset, n, len(buf))
+
+	rw.rowCount++
+	rw.liveBytes += uint64(len(row) - 2)
+	if err := rw.writeHeader(); err != nil {
+		return 0, fmt.Errorf("WriteRow: %w", err)
 	}
 
 	return offset, nil
 }
 
+// WriteRows stores a batch of rows and returns their offsets, in order. It
+// encodes every row first, so a row that does not match the schema fails
+// the batch before anything is written, then writes the rows with as few
+// writes as possible and updates the header once. The batch is logged as
+// one mutation, so after a crash either every row is there or none is.
+func (rw *rowFile) WriteRows(rows [][]any) ([]int64, error) {
+	if rw.versioned {
+		return nil, fmt.Errorf("WriteRows: %w", ErrVersioned)
+	}
+	var offsets []int64
+	err := rw.logged(func() (err error) {
+		offsets, err = rw.writeRows(rows)
+		return err
+	})
+	return offsets, err
+}
+
+func (rw *rowFile) writeRows(rows [][]any) ([]int64, error) {
+	if rw.format == rowFormatHeap {
+		offsets, err := rw.heapWriteRows(rows)
+		if err != nil {
+			return nil, fmt.Errorf("WriteRows: %w", err)
+		}
+		return offsets, nil
+	}
+
+	// byte-offset formats: the whole batch goes in one block at EOF
+	var buf []byte
+	var liveBytes uint64
+	sizes := make([]int, len(rows))
+	for i, values := range rows {
+		row, err := rw.encodeStored(values)
+		if err != nil {
+			return nil, fmt.Errorf("WriteRows: row %d: %w", i, err)
+		}
+		sizes[i] = blockSize(len(row) - 2)
+		buf = append(buf, row...)
+		buf = append(buf, make([]byte, sizes[i]-len(row))...)
+		liveBytes += uint64(len(row) - 2)
+	}
+
+	end, err := rw.size(walTargetRows)
+	if err != nil {
+		return nil, fmt.Errorf("WriteRows: %w", err)
+	}
+	if err := rw.writeAt(walTargetRows, buf, end); err != nil {
+		return nil, fmt.Errorf("WriteRows: write failed at offset %d: %w", end, err)
+	}
+
+	offsets := make([]int64, len(rows))
+	next := end
+	for i, size := range sizes {
+		offsets[i] = next
+		next += int64(size)
+	}
+	rw.rowCount += uint64(len(rows))
+	rw.liveBytes += liveBytes
+	if err := rw.writeHeader(); err != nil {
+		return nil, fmt.Errorf("WriteRows: %w", err)
+	}
+	return offsets, nil
+}
+
+// encodeStored encodes values as a row is stored: the 2-byte length and the
+// payload.
+func (rw *rowFile) encodeStored(values []any) ([]byte, error) {
+	payload, err := rw.encodeValues(values)
+	if err != nil {
+		return nil, err
+	}
+	n := len(payload)
+	// the length must fit in uint16 and not collide with the free marker
+	if n >= 0xFFFF {
+		return nil, fmt.Errorf("payload too large (%d bytes, max %d)", n, 0xFFFF-1)
+	}
+
+	out := binary.LittleEndian.AppendUint16(make([]byte, 0, 2+n), uint16(n))
+	return append(out, payload...), nil
+}
+
 // ReadRowAt reads a row starting at the given file offset (offset points to the 2-byte length),
 // decodes it according to the in-memory schema, and returns the values slice.
+// NULL columns are returned as nil.
 func (rw *rowFile) ReadRowAt(offset int64) ([]any, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.readRowAt(offset)
+}
+
+func (rw *rowFile) readRowAt(offset int64) ([]any, error) {
 	if rw.file == nil {
 		return nil, fmt.Errorf("ReadRowAt: file not open")
 	}
+	if rw.format == rowFormatHeap {
+		return rw.heapReadRowAt(offset)
+	}
 
 	// read 2-byte payload length
 	lenBuf := make([]byte, 2)
-	if _, err := rw.file.ReadAt(lenBuf, offset); err != nil {
+	if _, err := rw.readAt(walTargetRows, lenBuf, offset); err != nil {
 		return nil, fmt.Errorf("ReadRowAt: read length failed at offset %d: %w", offset, err)
 	}
 	payloadLen := binary.LittleEndian.Uint16(lenBuf)
@@ -282,39 +666,135 @@ func (rw *rowFile) ReadRowAt(offset int64) ([]any, error) {
 		return []any{}, nil
 	}
 	payload := make([]byte, payloadLen)
-	if _, err := rw.file.ReadAt(payload, offset+2); err != nil {
+	if _, err := rw.readAt(walTargetRows, payload, offset+2); err != nil {
 		return nil, fmt.Errorf("ReadRowAt: read payload failed at offset %d: %w", offset+2, err)
 	}
 
 	// decode according to current schema
-	values, err := decodeRow(payload, rw.schemaCodes)
+	values, err := rw.decodeValues(payload)
 	if err != nil {
 		return nil, fmt.Errorf("ReadRowAt: decode failed at offset %d: %w", offset, err)
 	}
 	return values, nil
 }
 
+// UpdateRowAt replaces the row at offset and returns where it now lives.
+// A row that still fits its block is rewritten in place, and any room left
+// over that can hold a free node is freed. Otherwise the new row is written
+// elsewhere and the old slot freed, as one logged mutation.
+func (rw *rowFile) UpdateRowAt(offset int64, values []any) (int64, error) {
+	if rw.versioned {
+		return 0, fmt.Errorf("UpdateRowAt: %w", ErrVersioned)
+	}
+	var newOffset int64
+	err := rw.logged(func() (err error) {
+		newOffset, err = rw.updateRow(offset, values, nil)
+		return err
+	})
+	return newOffset, err
+}
+
+// updateRow implements UpdateRowAt inside a logged mutation. When the row
+// moves, moved is called with its new offset after the new copy is written
+// and before the old one is freed.
+func (rw *rowFile) updateRow(offset int64, values []any, moved func(newOffset int64) error) (int64, error) {
+	if rw.file == nil {
+		return 0, fmt.Errorf("UpdateRowAt: file not open")
+	}
+	if _, ok := rw.tombs[offset]; ok {
+		return 0, fmt.Errorf("UpdateRowAt: %w: row at %d is deleted", ErrNoRow, offset)
+	}
+	if rw.format == rowFormatHeap {
+		return rw.heapUpdateRow(offset, values, moved)
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := rw.readAt(walTargetRows, lenBuf, offset); err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: read length failed at offset %d: %w", offset, err)
+	}
+	oldLen := binary.LittleEndian.Uint16(lenBuf)
+	if oldLen == 0xFFFF {
+		return 0, fmt.Errorf("UpdateRowAt: row at %d is free", offset)
+	}
+
+	row, err := rw.encodeStored(values)
+	if err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: %w", err)
+	}
+
+	oldSize, newSize := blockSize(int(oldLen)), blockSize(len(row)-2)
+	if rest := oldSize - newSize; rest == 0 || rest >= freeRowSize {
+		if err := rw.freeRowOverflow(offset, lenBuf); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: %w", err)
+		}
+		buf := make([]byte, newSize)
+		copy(buf, row)
+		if err := rw.writeAt(walTargetRows, buf, offset); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: write failed at offset %d: %w", offset, err)
+		}
+		rw.liveBytes += uint64(len(row)-2) - uint64(oldLen)
+		if err := rw.writeHeader(); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: %w", err)
+		}
+		if rest > 0 {
+			tail := offset + int64(newSize)
+			if err := rw.freeSpan(tail, tail+int64(rest)); err != nil {
+				return 0, fmt.Errorf("UpdateRowAt: failed to free tail at %d: %w", tail, err)
+			}
+		}
+		return offset, nil
+	}
+
+	newOffset, err := rw.writeStored(row)
+	if err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: %w", err)
+	}
+	if moved != nil {
+		if err := moved(newOffset); err != nil {
+			return 0, fmt.Errorf("UpdateRowAt: row copied to %d: %w", newOffset, err)
+		}
+	}
+	if err := rw.freeRowAt(offset); err != nil {
+		return 0, fmt.Errorf("UpdateRowAt: row moved to %d: %w", newOffset, err)
+	}
+	return newOffset, nil
+}
+
 /*
 Free row management
 
 On free, row layout becomes:
 [0:2]   uint16 marker = 0xFFFF
 [2:10]  uint64 nextFreeHead (previous free-list head)
-[10:12] uint16 originalPayloadLen
+[10:12] uint16 capacity (block size - 2)
 [12:..] (unused)
 
 firstFreePage in header points to the most-recently freed row.
 */
 
-// FreeRowAt marks a row free and pushes it to the free list.
+// FreeRowAt marks a row free and pushes it to the free list, first merging
+// it with any free blocks on either side.
 func (rw *rowFile) FreeRowAt(offset int64) error {
+	if rw.versioned {
+		return fmt.Errorf("FreeRowAt: %w", ErrVersioned)
+	}
+	return rw.logged(func() error { return rw.freeRowAt(offset) })
+}
+
+func (rw *rowFile) freeRowAt(offset int64) error {
 	if rw.file == nil {
 		return fmt.Errorf("FreeRowAt: file not open")
 	}
+	if err := rw.dropTombstone(offset); err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+	if rw.format == rowFormatHeap {
+		return rw.heapFreeRowAt(offset)
+	}
 
 	// Read the existing payload length so we know how much space this row occupied.
 	lenBuf := make([]byte, 2)
-	if _, err := rw.file.ReadAt(lenBuf, offset); err != nil {
+	if _, err := rw.readAt(walTargetRows, lenBuf, offset); err != nil {
 		return fmt.Errorf("FreeRowAt: failed to read existing length at %d: %w", offset, err)
 	}
 	oldLen := binary.LittleEndian.Uint16(lenBuf)
@@ -324,36 +804,227 @@ func (rw *rowFile) FreeRowAt(offset int64) error {
 		return fmt.Errorf("FreeRowAt: row at offset %d already freed", offset)
 	}
 
-	// Build free-node metadata: nextFreeHead then original length.
-	meta := make([]byte, 8+2)
-	binary.LittleEndian.PutUint64(meta[0:8], rw.firstFreePage)
-	binary.LittleEndian.PutUint16(meta[8:10], oldLen)
+	if err := rw.freeRowOverflow(offset, lenBuf); err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+	rw.dropRow(uint64(oldLen))
+	if err := rw.freeSpan(offset, offset+int64(blockSize(int(oldLen)))); err != nil {
+		return fmt.Errorf("FreeRowAt: %w", err)
+	}
+	return nil
+}
+
+// freeRowOverflow frees the overflowed values of the row at offset, whose
+// length field is lenBuf.
+func (rw *rowFile) freeRowOverflow(offset int64, lenBuf []byte) error {
+	if !rw.mayOverflow() {
+		return nil
+	}
+	payload := make([]byte, binary.LittleEndian.Uint16(lenBuf))
+	if _, err := rw.readAt(walTargetRows, payload, offset+2); err != nil {
+		return fmt.Errorf("read row at %d: %w", offset, err)
+	}
+	return rw.freeOverflow(payload)
+}
+
+// freeSpan pushes the block [start, end) onto the free list, merged with any
+// free blocks directly before and after it.
+func (rw *rowFile) freeSpan(start, end int64) error {
+	// 1) merge with free blocks directly before and after this one
+	row := start
+	before, after, err := rw.freeNeighbours(start, end)
+	if err != nil {
+		return err
+	}
+	if after != nil && after.end-start-2 <= math.MaxUint16 {
+		if err := rw.unlinkFree(after.offset); err != nil {
+			return err
+		}
+		end = after.end
+	}
+	if before != nil && end-before.offset-2 <= math.MaxUint16 {
+		if err := rw.unlinkFree(before.offset); err != nil {
+			return err
+		}
+		start = before.offset
+	}
 
-	// 1) write free marker (0xFFFF) into the 2-byte length field
-	marker := make([]byte, 2)
-	binary.LittleEndian.PutUint16(marker, 0xFFFF)
-	if _, err := rw.file.WriteAt(marker, offset); err != nil {
-		return fmt.Errorf("FreeRowAt: failed to write free marker at %d: %w", offset, err)
+	// 2) turn the merged span into one free node
+	if err := rw.writeFreeRow(start, rw.firstFreePage, uint16(end-start-2)); err != nil {
+		return fmt.Errorf("failed to write free node at %d: %w", start, err)
 	}
 
-	// 2) write metadata (next pointer + original length) at offset+2
-	if _, err := rw.file.WriteAt(meta, offset+2); err != nil {
-		return fmt.Errorf("FreeRowAt: failed to write free metadata at %d: %w", offset+2, err)
+	// a row merged into the block before it still needs its own marker, so
+	// freeing it again is caught
+	if start != row {
+		if err := rw.markFree(row); err != nil {
+			return fmt.Errorf("failed to mark row at %d free: %w", row, err)
+		}
 	}
 
 	// 3) update in-memory free head and persist header
-	rw.firstFreePage = uint64(offset)
+	rw.firstFreePage = uint64(start)
 	if err := rw.writeHeader(); err != nil {
-		return fmt.Errorf("FreeRowAt: failed to persist header after freeing: %w", err)
+		return fmt.Errorf("failed to persist header after freeing: %w", err)
+	}
+	return nil
+}
+
+// freeBlock is a free-list node and the end of the span it covers.
+type freeBlock struct {
+	offset, end int64
+}
+
+// freeNeighbours walks the free list for the free blocks that end at start
+// and begin at end, if any.
+func (rw *rowFile) freeNeighbours(start, end int64) (before, after *freeBlock, err error) {
+	for curr := rw.firstFreePage; curr != 0; {
+		next, capacity, err := rw.readFreeRowAt(int64(curr))
+		if err != nil {
+			return nil, nil, err
+		}
+		b := &freeBlock{offset: int64(curr), end: int64(curr) + 2 + int64(capacity)}
+		if b.end == start {
+			before = b
+		}
+		if b.offset == end {
+			after = b
+		}
+		curr = next
+	}
+	return before, after, nil
+}
+
+// unlinkFree removes the free block at target from the free list.
+func (rw *rowFile) unlinkFree(target int64) error {
+	var prev uint64
+	for curr := rw.firstFreePage; curr != 0; {
+		next, _, err := rw.readFreeRowAt(int64(curr))
+		if err != nil {
+			return err
+		}
+		if int64(curr) == target {
+			return rw.setNextFree(prev, next)
+		}
+		prev, curr = curr, next
+	}
+	return fmt.Errorf("free block %d not on the free list", target)
+}
+
+// checkFreeList walks the free list of a byte-offset format file. If a node
+// is not a free block that fits in the file, or the list loops, the list and
+// the row counts are rebuilt from a scan of the blocks. Files whose blocks
+// cannot be walked (written before rows were padded) get an empty free list
+// instead: the space leaks until Compact, but no live row is handed out.
+func (rw *rowFile) checkFreeList() error {
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return fmt.Errorf("checkFreeList: %w", err)
 	}
+	maxNodes := size / freeRowSize
+	for curr, n := rw.firstFreePage, int64(0); curr != 0; n++ {
+		next, capacity, err := rw.readFreeRowAt(int64(curr))
+		if err != nil || curr < DataHeaderSize || int64(curr)+2+int64(capacity) > size || n > maxNodes {
+			return rw.logged(rw.rebuildFreeList)
+		}
+		curr = next
+	}
+	return nil
+}
 
+// rebuildFreeList links every free block into a new free list and recounts
+// the live rows.
+func (rw *rowFile) rebuildFreeList() error {
+	var head, rows, live uint64
+	next := make([]byte, 8)
+	err := rw.scanBlocks(func(offset int64, block []byte, free bool) error {
+		if !free {
+			rows++
+			live += uint64(binary.LittleEndian.Uint16(block[0:2]))
+			return nil
+		}
+		binary.LittleEndian.PutUint64(next, head)
+		head = uint64(offset)
+		return rw.writeAt(walTargetRows, next, offset+2)
+	})
+	if err != nil {
+		rw.pending = nil // drop the relinked nodes
+		rw.firstFreePage = 0
+		return rw.writeHeader()
+	}
+	rw.firstFreePage, rw.rowCount, rw.liveBytes = head, rows, live
+	return rw.writeHeader()
+}
+
+// dropRow takes a freed row of n payload bytes off the counts, which never
+// go below zero whatever the header said.
+func (rw *rowFile) dropRow(n uint64) {
+	if rw.rowCount > 0 {
+		rw.rowCount--
+	}
+	rw.liveBytes -= min(rw.liveBytes, n)
+}
+
+// countRows counts the live rows of a byte-offset file whose header has no
+// counts. Files from before the counts sized a reused block by the row
+// written into it, not the space it had, so a block may be followed by the
+// leftover tail of a longer row; the walk steps over such bytes one at a
+// time until they start a row that decodes to exactly its length.
+func (rw *rowFile) countRows() error {
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return fmt.Errorf("count rows: %w", err)
+	}
+	var rows, live uint64
+	head := make([]byte, freeRowSize)
+	for offset := int64(DataHeaderSize); offset+2 <= size; {
+		n, err := rw.readAt(walTargetRows, head, offset)
+		if err != nil && n < 2 {
+			return fmt.Errorf("count rows: read at %d: %w", offset, err)
+		}
+		length := int64(binary.LittleEndian.Uint16(head[0:2]))
+		if length == 0xFFFF && n == freeRowSize {
+			if end := offset + 2 + int64(binary.LittleEndian.Uint16(head[10:12])); end <= size {
+				offset = end
+				continue
+			}
+		} else if offset+2+length <= size && rw.isRow(offset, int(length)) {
+			rows++
+			live += uint64(length)
+			offset += 2 + length
+			continue
+		}
+		offset++
+	}
+	rw.rowCount, rw.liveBytes = rows, live
 	return nil
 }
 
+// isRow reports whether the length bytes of a row stored at offset are
+// followed by a payload that decodes to exactly length bytes.
+func (rw *rowFile) isRow(offset int64, length int) bool {
+	payload := make([]byte, length)
+	if _, err := rw.readAt(walTargetRows, payload, offset+2); err != nil {
+		return false
+	}
+	values, err := decodeRow(payload, rw.schemaCodes)
+	if err != nil {
+		return false
+	}
+	again, err := encodeRow(rw.schemaCodes, values)
+	return err == nil && bytes.Equal(again, payload)
+}
+
 // ReadFreeRowAt reads metadata for a *known-free* row at offset.
-func (rw *rowFile) ReadFreeRowAt(offset int64) (nextFreeHead uint64, origPayloadLen uint16, err error) {
+func (rw *rowFile) ReadFreeRowAt(offset int64) (nextFreeHead uint64, capacity uint16, err error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.readFreeRowAt(offset)
+}
+
+func (rw *rowFile) readFreeRowAt(offset int64) (nextFreeHead uint64, capacity uint16, err error) {
 	header := make([]byte, 12) // marker(2) + next(8) + len(2)
-	_, err = rw.file.ReadAt(header, offset)
+	_, err = rw.readAt(walTargetRows, header, offset)
 	if err != nil {
 		return 0, 0, fmt.Errorf("ReadFreeRowAt: %w", err)
 	}
@@ -365,9 +1036,9 @@ func (rw *rowFile) ReadFreeRowAt(offset int64) (nextFreeHead uint64, origPayload
 	}
 
 	nextFreeHead = binary.LittleEndian.Uint64(header[2:10])
-	origPayloadLen = binary.LittleEndian.Uint16(header[10:12])
+	capacity = binary.LittleEndian.Uint16(header[10:12])
 
-	return nextFreeHead, origPayloadLen, nil
+	return nextFreeHead, capacity, nil
 }
 
 // --- Schema helpers ---
@@ -384,25 +1055,59 @@ func parseSchemaString(schema string) ([]byte, uint16, error) {
 	out := make([]byte, 0, len(parts))
 	for i, p := range parts {
 		name := strings.ToUpper(strings.TrimSpace(p))
+		// trailing "?" marks the column nullable, e.g. "string?", and "~"
+		// compressed, e.g. "string~"; they may come in either order
+		var nullable, compressed bool
+		for {
+			if s, ok := strings.CutSuffix(name, "?"); ok && !nullable {
+				name, nullable = strings.TrimSpace(s), true
+			} else if s, ok := strings.CutSuffix(name, "~"); ok && !compressed {
+				name, compressed = strings.TrimSpace(s), true
+			} else {
+				break
+			}
+		}
 		if name == "" {
 			return nil, 0, fmt.Errorf("empty type at position %d", i)
 		}
 		code, ok := typeNameToCode[name]
 		if !ok {
-			return nil, 0, fmt.Errorf("unsupported type %q at position %d (supported: int,string,float)", p, i)
+			return nil, 0, fmt.Errorf("unsupported type %q at position %d (supported: int,float,string,bool,bigint,date,timestamp,decimal,blob,uuid, with ? for nullable and ~ for compressed)", p, i)
+		}
+		if nullable {
+			code |= TypeFlagNullable
+		}
+		if compressed {
+			if b := baseType(code); b != TypeCodeString && b != TypeCodeBlob {
+				return nil, 0, fmt.Errorf("type %q at position %d cannot be compressed (only string and blob)", p, i)
+			}
+			code |= TypeFlagCompressed
 		}
 		out = append(out, code)
 	}
 	return out, uint16(len(out)), nil
 }
 
+// ParseSchema returns the type code of each column of a schema string, as
+// NewRowfile takes.
+func ParseSchema(schema string) ([]byte, error) {
+	codes, _, err := parseSchemaString(schema)
+	return codes, err
+}
+
 func SchemaStringFromCodes(codes []byte) string {
 	if len(codes) == 0 {
 		return ""
 	}
 	parts := make([]string, 0, len(codes))
 	for _, c := range codes {
-		if nm, ok := codeToTypeName[c]; ok {
+		if nm, ok := codeToTypeName[baseType(c)]; ok {
+			if c&TypeFlagCompressed != 0 {
+				nm += "~"
+			}
+			if c&TypeFlagNullable != 0 {
+				nm += "?"
+			}
 			parts = append(parts, nm)
 		} else {
 			parts = append(parts, fmt.Sprintf("unknown(%d)", c))
@@ -419,10 +1124,42 @@ func (rw *rowFile) GetSchemaCodes() []byte {
 
 func (rw *rowFile) GetColumnCount() uint16 { return rw.columnCount }
 
+// RowCount returns the number of live rows, kept in the header.
+func (rw *rowFile) RowCount() uint64 {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.rowCount
+}
+
+// LiveBytes returns the total stored payload size of the live rows, kept
+// in the header.
+func (rw *rowFile) LiveBytes() uint64 {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.liveBytes
+}
+
 func (rw *rowFile) Close() error {
+	// the checkpointer takes mu, so it must stop first
+	stopErr := rw.StopCheckpointer()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
 	if rw.file == nil {
-		return nil
+		return stopErr
+	}
+	err := errors.Join(stopErr, rw.checkpoint(), rw.unmap())
+	if rw.wal != nil {
+		rw.wal.Close()
+	}
+	if rw.ids != nil {
+		rw.ids.Close()
+	}
+	if rw.ovf != nil {
+		rw.ovf.Close()
+	}
+	if rw.tmb != nil {
+		rw.tmb.Close()
 	}
-	return rw.file.Close()
+	return errors.Join(err, rw.file.Close())
 }
 
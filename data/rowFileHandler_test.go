@@ -0,0 +1,57 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test_rows.dat was written before the header kept row counts: three rows,
+// the second in a reused block with 4 bytes of an older row after it.
+func TestCountsOfOldFile(t *testing.T) {
+	b, err := os.ReadFile("../test_rows.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rows.dat")
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	check := func(rw *rowFile, rows, live uint64) {
+		t.Helper()
+		if got := rw.RowCount(); got != rows {
+			t.Errorf("RowCount %d, want %d", got, rows)
+		}
+		if got := rw.LiveBytes(); got != live {
+			t.Errorf("LiveBytes %d, want %d", got, live)
+		}
+	}
+
+	rw, err := OpenRowfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rw, 3, 19+15+37)
+	if err := rw.FreeRowAt(4096); err != nil {
+		t.Fatal(err)
+	}
+	check(rw, 2, 15+37)
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rw, err = OpenRowfile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	check(rw, 2, 15+37)
+	if got, err := rw.ReadRowAt(4117); err != nil || got[0] != int32(99) {
+		t.Fatalf("ReadRowAt(4117) = %v, %v", got, err)
+	}
+	for _, off := range []int64{4117, 4138} {
+		if err := rw.FreeRowAt(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(rw, 0, 0)
+}
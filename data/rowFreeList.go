@@ -0,0 +1,113 @@
+package data
+
+import (
+	"fmt"
+	"math/bits"
+	"pranavdb/page"
+)
+
+// FreeListStats describes the space a rowfile holds for reuse, to judge when
+// Compact is worth running. In a byte-offset format file each free block
+// counts, including its 2-byte marker; in a heap file each page with room
+// for a row counts as one block of that room.
+type FreeListStats struct {
+	Blocks    int
+	FreeBytes int64
+	// Histogram[i] counts blocks of 2^i to 2^(i+1)-1 bytes.
+	Histogram [17]int
+}
+
+// FreeListStats walks the free list (or a heap file's free-space map) and
+// summarizes it.
+func (rw *rowFile) FreeListStats() (FreeListStats, error) {
+	var stats FreeListStats
+	err := rw.FreeNodes(func(offset int64, size int) error {
+		stats.Blocks++
+		stats.FreeBytes += int64(size)
+		stats.Histogram[bits.Len(uint(size))-1]++
+		return nil
+	})
+	return stats, err
+}
+
+// FreeNodes calls fn with the offset and size in bytes of each free block,
+// in free-list order, as counted by FreeListStats. It stops at the first
+// error fn returns. fn must not modify the file.
+func (rw *rowFile) FreeNodes(fn func(offset int64, size int) error) error {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.freeNodes(fn)
+}
+
+func (rw *rowFile) freeNodes(fn func(offset int64, size int) error) error {
+	if rw.file == nil {
+		return fmt.Errorf("FreeNodes: file not open")
+	}
+
+	if rw.format == rowFormatHeap {
+		for i, room := range rw.heapRoom {
+			if room == 0 {
+				continue
+			}
+			if err := fn(heapPageOffset(i), room); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return fmt.Errorf("FreeNodes: %w", err)
+	}
+	maxNodes := size / freeRowSize
+	for curr, n := rw.firstFreePage, int64(0); curr != 0; n++ {
+		if n > maxNodes {
+			return fmt.Errorf("FreeNodes: free list loops at %d", curr)
+		}
+		next, capacity, err := rw.readFreeRowAt(int64(curr))
+		if err != nil {
+			return fmt.Errorf("FreeNodes: node at %d: %w", curr, err)
+		}
+		if err := fn(int64(curr), 2+int(capacity)); err != nil {
+			return err
+		}
+		curr = next
+	}
+	return nil
+}
+
+// FragmentationReport reports the file's live and free space and estimates
+// what Compact would reclaim.
+func (rw *rowFile) FragmentationReport() (page.FragmentationReport, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	var report page.FragmentationReport
+	err := rw.freeNodes(func(offset int64, size int) error {
+		report.FreeBytes += int64(size)
+		report.LargestFree = max(report.LargestFree, int64(size))
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("FragmentationReport: %w", err)
+	}
+
+	size, err := rw.size(walTargetRows)
+	if err != nil {
+		return report, fmt.Errorf("FragmentationReport: %w", err)
+	}
+	report.FileBytes = size
+	report.LiveBytes = int64(rw.liveBytes)
+
+	// what the live rows would take back to back, from the counts alone
+	var compacted int64
+	if rw.format == rowFormatHeap {
+		perPage := int64(page.PageSize - heapHeaderSize)
+		used := int64(rw.liveBytes) + int64(rw.rowCount)*heapSlotSize
+		compacted = (used + perPage - 1) / perPage * page.PageSize
+	} else {
+		compacted = int64(rw.liveBytes) + 2*int64(rw.rowCount)
+	}
+	report.Reclaimable = max(size-DataHeaderSize-compacted, 0)
+	return report, nil
+}
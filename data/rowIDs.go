@@ -0,0 +1,215 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+Row IDs
+
+A RowID names a row for as long as it lives, however often UpdateRow or
+Compact moves it, so indexes can store RowIDs instead of byte offsets.
+
+The mapping lives beside the row file in "<rowfile>.rid": entry i (8 bytes,
+little-endian) holds the current offset of RowID i+1, or 0 once the row is
+deleted. IDs are never reused.
+*/
+
+// RowID is a stable identifier for a row.
+type RowID uint64
+
+// ErrNoRow is returned for a RowID that was never issued or has been deleted.
+var ErrNoRow = errors.New("no such row")
+
+const rowIDEntrySize = 8
+
+func openRowIDs(rowPath string, truncate bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(rowPath+".rid", flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open row ID table: %w", err)
+	}
+	return f, nil
+}
+
+// InsertRow writes a row and returns its new RowID.
+func (rw *rowFile) InsertRow(values []any) (RowID, error) {
+	var id RowID
+	err := rw.logged(func() (err error) {
+		id, err = rw.insertRow(values)
+		return err
+	})
+	return id, err
+}
+
+func (rw *rowFile) insertRow(values []any) (RowID, error) {
+	var offset int64
+	var err error
+	if rw.versioned {
+		offset, err = rw.writeVersion(0, values, false)
+	} else {
+		offset, err = rw.writeRow(values)
+	}
+	if err != nil {
+		return 0, err
+	}
+	size, err := rw.size(walTargetIDs)
+	if err != nil {
+		return 0, fmt.Errorf("InsertRow: %w", err)
+	}
+	id := RowID(size/rowIDEntrySize + 1)
+	if err := rw.setRowOffset(id, offset); err != nil {
+		return 0, fmt.Errorf("InsertRow: %w", err)
+	}
+	return id, nil
+}
+
+// ReadRow reads the row with the given RowID.
+func (rw *rowFile) ReadRow(id RowID) ([]any, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	offset, err := rw.rowOffset(id)
+	if err != nil {
+		return nil, err
+	}
+	return rw.readRowAt(offset)
+}
+
+// UpdateRow replaces the row with the given RowID. The RowID stays the same
+// even when the row has to move; the move and the table update are logged
+// as one mutation.
+func (rw *rowFile) UpdateRow(id RowID, values []any) error {
+	return rw.logged(func() error {
+		if rw.versioned {
+			return rw.replaceVersion(id, values, false)
+		}
+		offset, err := rw.rowOffset(id)
+		if err != nil {
+			return err
+		}
+		_, err = rw.updateRow(offset, values, func(newOffset int64) error {
+			return rw.setRowOffset(id, newOffset)
+		})
+		return err
+	})
+}
+
+// DeleteRow frees the row with the given RowID. The RowID is not reused.
+func (rw *rowFile) DeleteRow(id RowID) error {
+	return rw.logged(func() error {
+		if rw.versioned {
+			return rw.replaceVersion(id, nil, true)
+		}
+		offset, err := rw.rowOffset(id)
+		if err != nil {
+			return err
+		}
+		if err := rw.setRowOffset(id, 0); err != nil {
+			return fmt.Errorf("DeleteRow: %w", err)
+		}
+		return rw.freeRowAt(offset)
+	})
+}
+
+// RowOffset returns the current byte offset of the row with the given RowID.
+func (rw *rowFile) RowOffset(id RowID) (int64, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.rowOffset(id)
+}
+
+func (rw *rowFile) rowOffset(id RowID) (int64, error) {
+	if id == 0 {
+		return 0, fmt.Errorf("RowOffset: %w: RowID 0", ErrNoRow)
+	}
+	entry := make([]byte, rowIDEntrySize)
+	n, err := rw.readAt(walTargetIDs, entry, int64(id-1)*rowIDEntrySize)
+	if n < rowIDEntrySize {
+		return 0, fmt.Errorf("RowOffset: %w: RowID %d", ErrNoRow, id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("RowOffset: %w", err)
+	}
+	offset := int64(binary.LittleEndian.Uint64(entry))
+	if offset == 0 {
+		return 0, fmt.Errorf("RowOffset: %w: RowID %d", ErrNoRow, id)
+	}
+	return offset, nil
+}
+
+func (rw *rowFile) setRowOffset(id RowID, offset int64) error {
+	entry := binary.LittleEndian.AppendUint64(nil, uint64(offset))
+	if err := rw.writeAt(walTargetIDs, entry, int64(id-1)*rowIDEntrySize); err != nil {
+		return fmt.Errorf("write row ID table: %w", err)
+	}
+	return nil
+}
+
+// remapRowIDs rewrites every table entry that remap moves, after Compact.
+func (rw *rowFile) remapRowIDs(remap map[int64]int64) error {
+	info, err := rw.ids.Stat()
+	if err != nil {
+		return err
+	}
+	table := make([]byte, info.Size())
+	if _, err := rw.ids.ReadAt(table, 0); err != nil {
+		return fmt.Errorf("read row ID table: %w", err)
+	}
+	remapTable(table, remap)
+	if _, err := rw.ids.WriteAt(table, 0); err != nil {
+		return fmt.Errorf("write row ID table: %w", err)
+	}
+	return rw.ids.Sync()
+}
+
+// remapTable rewrites the entries of a RowID table that remap moves.
+func remapTable(table []byte, remap map[int64]int64) {
+	for i := 0; i+rowIDEntrySize <= len(table); i += rowIDEntrySize {
+		old := int64(binary.LittleEndian.Uint64(table[i:]))
+		if newOffset, ok := remap[old]; ok {
+			binary.LittleEndian.PutUint64(table[i:], uint64(newOffset))
+		}
+	}
+}
+
+// clearRowIDsAt clears every table entry naming one of offsets.
+func (rw *rowFile) clearRowIDsAt(offsets map[int64]bool) error {
+	size, err := rw.size(walTargetIDs)
+	if err != nil {
+		return err
+	}
+	table := make([]byte, size)
+	if _, err := rw.readAt(walTargetIDs, table, 0); err != nil {
+		return fmt.Errorf("read row ID table: %w", err)
+	}
+	for i := 0; i+rowIDEntrySize <= len(table); i += rowIDEntrySize {
+		if offsets[int64(binary.LittleEndian.Uint64(table[i:]))] {
+			if err := rw.setRowOffset(RowID(i/rowIDEntrySize+1), 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearRowIDs zeroes every table entry in place, so the IDs stay issued.
+func (rw *rowFile) clearRowIDs() error {
+	info, err := rw.ids.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 64<<10)
+	for off := int64(0); off < info.Size(); off += int64(len(zeros)) {
+		n := min(int64(len(zeros)), info.Size()-off)
+		if _, err := rw.ids.WriteAt(zeros[:n], off); err != nil {
+			return fmt.Errorf("clear row ID table: %w", err)
+		}
+	}
+	return rw.ids.Sync()
+}
@@ -0,0 +1,60 @@
+package data
+
+import "fmt"
+
+// SetMmap serves row file reads from a read-only memory mapping instead of a
+// ReadAt call each, which mostly helps large scans. The mapping is redone as
+// the file grows; reads past its end, and writes, still go to the file.
+// It fails on platforms without mmap.
+func (rw *rowFile) SetMmap(enabled bool) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.mmap = enabled
+	if !enabled {
+		return rw.unmap()
+	}
+	if err := rw.remap(); err != nil {
+		rw.mmap = false
+		return fmt.Errorf("SetMmap: %w", err)
+	}
+	return nil
+}
+
+// remap maps the whole file, replacing any earlier mapping.
+func (rw *rowFile) remap() error {
+	if err := rw.unmap(); err != nil {
+		return err
+	}
+	info, err := rw.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	m, err := mmapFile(rw.file, int(info.Size()))
+	if err != nil {
+		return err
+	}
+	rw.mapped = m
+	return nil
+}
+
+func (rw *rowFile) unmap() error {
+	if rw.mapped == nil {
+		return nil
+	}
+	m := rw.mapped
+	rw.mapped = nil
+	return munmapFile(m)
+}
+
+// growMap remaps once the file has grown past the mapping by a quarter of
+// its size, so appends do not remap every time.
+func (rw *rowFile) growMap(end int64) error {
+	mapped := int64(len(rw.mapped))
+	if !rw.mmap || end-mapped < max(mapped/4, DataHeaderSize) {
+		return nil
+	}
+	return rw.remap()
+}
@@ -0,0 +1,344 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"pranavdb/page"
+	"slices"
+)
+
+/*
+Overflow storage
+
+A STRING or BLOB value too large to keep in its row is stored in the
+overflow file "<rowfile>.ovf" instead, and the row holds a reference in its
+place: a uint16 length of 0xFFFF (never a real inline length), then the
+value's uint32 length and the uint64 number of its first overflow page.
+
+Values only overflow when they have to: when they are longer than an inline
+length allows, or, largest first, until the row fits the format's row size
+limit. Rows that fit are stored exactly as before.
+
+Overflow file layout, in page.PageSize pages:
+page 0      [0:8]   uint64 first free page, 0 means none
+page n > 0  [0:8]   uint64 next page of the value, 0 ends it
+            [8:10]  uint16 bytes used
+            [10:..] value bytes
+
+Freeing or replacing a row puts its values' pages on the free list. The file
+never shrinks; Compact leaves it alone, as references don't move with rows.
+*/
+
+const (
+	overflowMarker   = 0xFFFF
+	overflowRefSize  = 2 + 4 + 8
+	overflowPageHead = 10
+	overflowPageData = page.PageSize - overflowPageHead
+)
+
+// overflowRef stands in for an overflowed value between the row codec and
+// the overflow file.
+type overflowRef struct {
+	length    uint32
+	firstPage uint64
+	deflated  bool // compressed column: the stored bytes are deflated
+}
+
+func (ref overflowRef) flag() byte {
+	return storedBytes{deflated: ref.deflated}.flag()
+}
+
+func appendOverflowRef(out []byte, ref overflowRef) []byte {
+	out = binary.LittleEndian.AppendUint16(out, overflowMarker)
+	out = binary.LittleEndian.AppendUint32(out, ref.length)
+	return binary.LittleEndian.AppendUint64(out, ref.firstPage)
+}
+
+func readOverflowRef(b []byte) (overflowRef, error) {
+	if len(b) < overflowRefSize {
+		return overflowRef{}, fmt.Errorf("overflow reference out of bounds")
+	}
+	return overflowRef{
+		length:    binary.LittleEndian.Uint32(b[2:6]),
+		firstPage: binary.LittleEndian.Uint64(b[6:14]),
+	}, nil
+}
+
+func openOverflow(rowPath string, truncate bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(rowPath+".ovf", flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open overflow file: %w", err)
+	}
+	return f, nil
+}
+
+// loadOverflow reads the head of the overflow free list.
+func (rw *rowFile) loadOverflow() error {
+	rw.ovfFree = 0
+	if rw.ovf == nil {
+		return nil
+	}
+	head := make([]byte, 8)
+	n, err := rw.readAt(walTargetOverflow, head, 0)
+	if n < len(head) {
+		return nil // no page freed yet
+	}
+	if err != nil {
+		return fmt.Errorf("read overflow header: %w", err)
+	}
+	rw.ovfFree = binary.LittleEndian.Uint64(head)
+	return nil
+}
+
+func overflowPageOffset(pageNo uint64) int64 {
+	return int64(pageNo) * page.PageSize
+}
+
+// mayOverflow reports whether the schema has a column that can overflow.
+func (rw *rowFile) mayOverflow() bool {
+	for _, code := range rw.schemaCodes {
+		if c := baseType(code); c == TypeCodeString || c == TypeCodeBlob {
+			return true
+		}
+	}
+	return false
+}
+
+// overflowable returns the bytes of a value that could be moved to the
+// overflow file.
+func overflowable(code byte, val any) ([]byte, bool) {
+	switch v := val.(type) {
+	case string:
+		return []byte(v), baseType(code) == TypeCodeString
+	case []byte:
+		return v, baseType(code) == TypeCodeBlob
+	case storedBytes:
+		return v.b, true
+	}
+	return nil, false
+}
+
+// maxPayload is the largest encoded row the file's format can store.
+func (rw *rowFile) maxPayload() int {
+	switch rw.format {
+	case rowFormatHeap:
+		if rw.versioned {
+			return maxHeapRow - versionHeaderSize
+		}
+		return maxHeapRow
+	}
+	return 0xFFFF - 1
+}
+
+// encodeValues encodes a row for this file, moving STRING and BLOB values
+// to the overflow file when they don't fit inline.
+func (rw *rowFile) encodeValues(values []any) ([]byte, error) {
+	if len(values) != len(rw.schemaCodes) || !rw.mayOverflow() {
+		return encodeRow(rw.schemaCodes, values)
+	}
+	vals, cloned := values, false
+	spill := func(i int, b []byte) error {
+		if !cloned {
+			vals, cloned = slices.Clone(values), true
+		}
+		ref, err := rw.writeOverflow(b)
+		if err != nil {
+			return err
+		}
+		if s, ok := vals[i].(storedBytes); ok {
+			ref.deflated = s.deflated
+		}
+		vals[i] = ref
+		return nil
+	}
+
+	// compress first, so the sizes below are the stored ones
+	if hasCompressed(rw.schemaCodes) {
+		vals, cloned = slices.Clone(values), true
+		for i, code := range rw.schemaCodes {
+			if code&TypeFlagCompressed == 0 || vals[i] == nil {
+				continue
+			}
+			sv, err := storedValue(i, code, vals[i])
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = sv
+		}
+	}
+
+	for i, code := range rw.schemaCodes {
+		if b, ok := overflowable(code, vals[i]); ok && len(b) >= overflowMarker {
+			if err := spill(i, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for {
+		payload, err := encodeRow(rw.schemaCodes, vals)
+		if err != nil || len(payload) <= rw.maxPayload() {
+			return payload, err
+		}
+		largest, largestLen := -1, 0
+		for i, code := range rw.schemaCodes {
+			if b, ok := overflowable(code, vals[i]); ok && len(b) > largestLen {
+				largest, largestLen = i, len(b)
+			}
+		}
+		if largestLen <= overflowRefSize-2 {
+			return payload, nil // nothing left that a reference would shrink
+		}
+		b, _ := overflowable(rw.schemaCodes[largest], vals[largest])
+		if err := spill(largest, b); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeValues decodes a row of this file, reading back overflowed values.
+func (rw *rowFile) decodeValues(payload []byte) ([]any, error) {
+	values, err := decodeRow(payload, rw.schemaCodes)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		ref, ok := v.(overflowRef)
+		if !ok {
+			continue
+		}
+		b, err := rw.readOverflow(ref)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", i, err)
+		}
+		if values[i], err = columnValue(rw.schemaCodes[i], b, ref.deflated); err != nil {
+			return nil, fmt.Errorf("field %d: %w", i, err)
+		}
+	}
+	return values, nil
+}
+
+// writeOverflow stores b in a chain of overflow pages. The chain is written
+// from its end, so each page knows its successor when it is written.
+func (rw *rowFile) writeOverflow(b []byte) (overflowRef, error) {
+	if uint64(len(b)) > 1<<32-1 {
+		return overflowRef{}, fmt.Errorf("value too large (%d bytes)", len(b))
+	}
+	buf := make([]byte, page.PageSize)
+	var next uint64
+	for end := len(b); end > 0; {
+		start := (end - 1) / overflowPageData * overflowPageData
+		pageNo, err := rw.allocOverflowPage()
+		if err != nil {
+			return overflowRef{}, err
+		}
+		clear(buf)
+		binary.LittleEndian.PutUint64(buf[0:8], next)
+		binary.LittleEndian.PutUint16(buf[8:10], uint16(end-start))
+		copy(buf[overflowPageHead:], b[start:end])
+		if err := rw.writeAt(walTargetOverflow, buf, overflowPageOffset(pageNo)); err != nil {
+			return overflowRef{}, fmt.Errorf("write overflow page %d: %w", pageNo, err)
+		}
+		next, end = pageNo, start
+	}
+	return overflowRef{length: uint32(len(b)), firstPage: next}, nil
+}
+
+// allocOverflowPage takes a page off the free list, or a new one at the end
+// of the file.
+func (rw *rowFile) allocOverflowPage() (uint64, error) {
+	if rw.ovfFree == 0 {
+		size, err := rw.size(walTargetOverflow)
+		if err != nil {
+			return 0, err
+		}
+		return max(uint64((size+page.PageSize-1)/page.PageSize), 1), nil
+	}
+	pageNo := rw.ovfFree
+	next := make([]byte, 8)
+	if _, err := rw.readAt(walTargetOverflow, next, overflowPageOffset(pageNo)); err != nil {
+		return 0, fmt.Errorf("read free overflow page %d: %w", pageNo, err)
+	}
+	return pageNo, rw.setOverflowFree(binary.LittleEndian.Uint64(next))
+}
+
+func (rw *rowFile) setOverflowFree(pageNo uint64) error {
+	rw.ovfFree = pageNo
+	head := binary.LittleEndian.AppendUint64(nil, pageNo)
+	if err := rw.writeAt(walTargetOverflow, head, 0); err != nil {
+		return fmt.Errorf("write overflow header: %w", err)
+	}
+	return nil
+}
+
+// overflowPages returns the pages of ref's chain, checking them against the
+// value length so a damaged chain can't loop.
+func (rw *rowFile) overflowPages(ref overflowRef, fn func(pageNo uint64, data []byte) error) error {
+	buf := make([]byte, page.PageSize)
+	left := int(ref.length)
+	for pageNo := ref.firstPage; left > 0; {
+		if pageNo == 0 {
+			return fmt.Errorf("%w: overflow chain ends %d bytes short", ErrRowCorrupt, left)
+		}
+		if _, err := rw.readAt(walTargetOverflow, buf, overflowPageOffset(pageNo)); err != nil {
+			return fmt.Errorf("read overflow page %d: %w", pageNo, err)
+		}
+		used := int(binary.LittleEndian.Uint16(buf[8:10]))
+		if used == 0 || used > overflowPageData || used > left {
+			return fmt.Errorf("%w: overflow page %d holds %d bytes", ErrRowCorrupt, pageNo, used)
+		}
+		if err := fn(pageNo, buf[overflowPageHead:overflowPageHead+used]); err != nil {
+			return err
+		}
+		left -= used
+		pageNo = binary.LittleEndian.Uint64(buf[0:8])
+	}
+	return nil
+}
+
+func (rw *rowFile) readOverflow(ref overflowRef) ([]byte, error) {
+	out := make([]byte, 0, ref.length)
+	err := rw.overflowPages(ref, func(_ uint64, data []byte) error {
+		out = append(out, data...)
+		return nil
+	})
+	return out, err
+}
+
+// freeOverflow puts the pages of every value the row payload overflowed on
+// the free list.
+func (rw *rowFile) freeOverflow(payload []byte) error {
+	if !rw.mayOverflow() {
+		return nil
+	}
+	values, err := decodeRow(payload, rw.schemaCodes)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		ref, ok := v.(overflowRef)
+		if !ok {
+			continue
+		}
+		var last uint64
+		if err := rw.overflowPages(ref, func(pageNo uint64, _ []byte) error {
+			last = pageNo
+			return nil
+		}); err != nil {
+			return err
+		}
+		// splice the whole chain onto the front of the free list
+		next := binary.LittleEndian.AppendUint64(nil, rw.ovfFree)
+		if err := rw.writeAt(walTargetOverflow, next, overflowPageOffset(last)); err != nil {
+			return fmt.Errorf("free overflow page %d: %w", last, err)
+		}
+		if err := rw.setOverflowFree(ref.firstPage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// scanRows calls fn with every live row in file order, decoded according to
+// the schema, skipping tombstoned rows; a versioned file yields the newest
+// version of each row, in RowID order. It stops at the first error fn
+// returns.
+func (rw *rowFile) scanRows(fn func(offset int64, values []any) error) error {
+	if rw.file == nil {
+		return fmt.Errorf("scan: file not open")
+	}
+	if rw.versioned {
+		return rw.scanVersions(rw.lastTx, func(_ RowID, addr int64, values []any) error {
+			return fn(addr, values)
+		})
+	}
+	if rw.format == rowFormatHeap {
+		for i := range rw.heapRoom {
+			pageOff := heapPageOffset(i)
+			hp, err := rw.readHeapPage(pageOff)
+			if err != nil {
+				return fmt.Errorf("scan: %w", err)
+			}
+			for slot := 0; slot < hp.numSlots(); slot++ {
+				payload, ok := hp.cell(slot)
+				if !ok {
+					continue
+				}
+				addr := pageOff + int64(slot)
+				if _, ok := rw.tombs[addr]; ok {
+					continue
+				}
+				values, err := rw.decodeValues(payload)
+				if err != nil {
+					return fmt.Errorf("scan: decode failed at offset %d: %w", addr, err)
+				}
+				if err := fn(addr, values); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return rw.scanBlocks(func(offset int64, block []byte, free bool) error {
+		if _, ok := rw.tombs[offset]; free || ok {
+			return nil
+		}
+		lenBuf := block[0:2]
+		payload := block[2 : 2+int(binary.LittleEndian.Uint16(lenBuf))]
+		values, err := rw.decodeValues(payload)
+		if err != nil {
+			return fmt.Errorf("scan: decode failed at offset %d: %w", offset, err)
+		}
+		return fn(offset, values)
+	})
+}
+
+// ScanWhere calls fn, in file order, with every live row for which pred
+// returns true; a nil pred matches every row. Rows are filtered inside the
+// scan, so rejected rows never reach the caller. It stops at the first error
+// fn returns. Mutations wait until the scan is done, so pred and fn must not
+// modify the file.
+func (rw *rowFile) ScanWhere(pred func(values []any) bool, fn func(offset int64, values []any) error) error {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.scanRows(func(offset int64, values []any) error {
+		if pred != nil && !pred(values) {
+			return nil
+		}
+		return fn(offset, values)
+	})
+}
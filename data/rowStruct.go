@@ -0,0 +1,206 @@
+package data
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+/*
+Struct mapping
+
+Rows map to Go structs through `db` field tags naming a column by its
+position in the schema, since the file stores no column names:
+
+	type Event struct {
+		ID      int32   `db:"0"`
+		Name    string  `db:"1"`
+		Comment *string `db:"2"` // nullable column
+	}
+
+Untagged fields and fields tagged "-" are ignored. Numbers convert to any
+numeric field type they fit, and a NULL leaves a pointer field nil or any
+other field at its zero value. When writing, a nil pointer field and any
+column no field maps to are written as NULL.
+*/
+
+// structField is a tagged field and the column it maps to.
+type structField struct {
+	index  []int
+	column int
+}
+
+var structFieldCache sync.Map // reflect.Type -> []structField
+
+func structFields(t reflect.Type) ([]structField, error) {
+	if cached, ok := structFieldCache.Load(t); ok {
+		return cached.([]structField), nil
+	}
+	var fields []structField
+	for _, f := range reflect.VisibleFields(t) {
+		tag, ok := f.Tag.Lookup("db")
+		if !ok || tag == "-" || !f.IsExported() {
+			continue
+		}
+		column, err := strconv.Atoi(tag)
+		if err != nil || column < 0 {
+			return nil, fmt.Errorf("field %s: db tag %q is not a column position", f.Name, tag)
+		}
+		fields = append(fields, structField{index: f.Index, column: column})
+	}
+	structFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+// structValue returns the struct v points to.
+func structValue(v any) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%T is not a non-nil pointer to a struct", v)
+	}
+	return rv.Elem(), nil
+}
+
+// WriteStruct writes the struct v (or *v) as a row; see "Struct mapping"
+// above. The values are checked against the schema as WriteRow does.
+func (rw *rowFile) WriteStruct(v any) (int64, error) {
+	sv := reflect.ValueOf(v)
+	if sv.Kind() == reflect.Pointer && !sv.IsNil() {
+		sv = sv.Elem()
+	}
+	if sv.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("WriteStruct: %T is not a struct", v)
+	}
+	fields, err := structFields(sv.Type())
+	if err != nil {
+		return 0, fmt.Errorf("WriteStruct: %w", err)
+	}
+
+	values := make([]any, rw.columnCount)
+	mapped := make([]bool, rw.columnCount)
+	for _, f := range fields {
+		if f.column >= len(values) {
+			return 0, fmt.Errorf("WriteStruct: column %d out of range (%d columns)", f.column, len(values))
+		}
+		if mapped[f.column] {
+			return 0, fmt.Errorf("WriteStruct: column %d is tagged on two fields", f.column)
+		}
+		mapped[f.column] = true
+		values[f.column] = fieldValue(sv.FieldByIndex(f.index))
+	}
+	return rw.WriteRow(values)
+}
+
+// basicTypes are the types named types of each basic kind are converted to
+// before encoding, e.g. a string-based enum to string.
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:    reflect.TypeFor[bool](),
+	reflect.Int:     reflect.TypeFor[int](),
+	reflect.Int8:    reflect.TypeFor[int8](),
+	reflect.Int16:   reflect.TypeFor[int16](),
+	reflect.Int32:   reflect.TypeFor[int32](),
+	reflect.Int64:   reflect.TypeFor[int64](),
+	reflect.Uint:    reflect.TypeFor[uint](),
+	reflect.Uint8:   reflect.TypeFor[uint8](),
+	reflect.Uint16:  reflect.TypeFor[uint16](),
+	reflect.Uint32:  reflect.TypeFor[uint32](),
+	reflect.Uint64:  reflect.TypeFor[uint64](),
+	reflect.Float32: reflect.TypeFor[float32](),
+	reflect.Float64: reflect.TypeFor[float64](),
+	reflect.String:  reflect.TypeFor[string](),
+}
+
+// fieldValue returns a struct field as the value to encode.
+func fieldValue(field reflect.Value) any {
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return nil
+		}
+		field = field.Elem()
+	}
+	t := field.Type()
+	if basic, ok := basicTypes[t.Kind()]; ok && t != basic {
+		return field.Convert(basic).Interface()
+	}
+	for _, target := range []reflect.Type{reflect.TypeFor[[]byte](), reflect.TypeFor[[16]byte]()} {
+		if t != target && t != reflect.TypeFor[UUID]() && t.ConvertibleTo(target) && t.Kind() == target.Kind() {
+			return field.Convert(target).Interface()
+		}
+	}
+	return field.Interface()
+}
+
+// ReadRowInto reads the row at offset into the struct dest points to; see
+// "Struct mapping" above.
+func (rw *rowFile) ReadRowInto(offset int64, dest any) error {
+	sv, err := structValue(dest)
+	if err != nil {
+		return fmt.Errorf("ReadRowInto: %w", err)
+	}
+	values, err := rw.ReadRowAt(offset)
+	if err != nil {
+		return err
+	}
+	fields, err := structFields(sv.Type())
+	if err != nil {
+		return fmt.Errorf("ReadRowInto: %w", err)
+	}
+	for _, f := range fields {
+		if f.column >= len(values) {
+			return fmt.Errorf("ReadRowInto: column %d out of range (%d columns)", f.column, len(values))
+		}
+		field := sv.FieldByIndex(f.index)
+		if err := setField(field, values[f.column]); err != nil {
+			return fmt.Errorf("ReadRowInto: column %d into field %s: %w", f.column, sv.Type().FieldByIndex(f.index).Name, err)
+		}
+	}
+	return nil
+}
+
+// setField stores a decoded column value in field.
+func setField(field reflect.Value, val any) error {
+	if val == nil {
+		field.SetZero()
+		return nil
+	}
+	if field.Kind() == reflect.Pointer {
+		elem := reflect.New(field.Type().Elem())
+		if err := setField(elem.Elem(), val); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+		return nil
+	}
+	switch {
+	case v.CanInt() && field.CanInt():
+		if field.OverflowInt(v.Int()) {
+			return fmt.Errorf("%v overflows %s", val, field.Type())
+		}
+		field.SetInt(v.Int())
+	case v.CanInt() && field.CanUint():
+		if v.Int() < 0 || field.OverflowUint(uint64(v.Int())) {
+			return fmt.Errorf("%v overflows %s", val, field.Type())
+		}
+		field.SetUint(uint64(v.Int()))
+	case v.CanInt() && field.CanFloat():
+		field.SetFloat(float64(v.Int()))
+	case v.CanFloat() && field.CanFloat():
+		if field.OverflowFloat(v.Float()) {
+			return fmt.Errorf("%v overflows %s", val, field.Type())
+		}
+		field.SetFloat(v.Float())
+	case v.Type().ConvertibleTo(field.Type()) && v.Kind() == field.Kind():
+		// named types over the same kind, e.g. a string-based enum
+		field.Set(v.Convert(field.Type()))
+	default:
+		return fmt.Errorf("cannot store %T in %s", val, field.Type())
+	}
+	return nil
+}
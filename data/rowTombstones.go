@@ -0,0 +1,235 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+Tombstones
+
+SoftDeleteRow and TombstoneRowAt mark a row deleted without freeing it:
+scans skip it from then on, but ReadRowAt (and ReadRow, for its RowID)
+still return it, so a backup or reader that already holds its offset can
+finish. Purge frees the rows tombstoned before a given time. Until then a
+tombstoned row still counts in RowCount and LiveBytes, and cannot be
+updated. FreeRowAt and DeleteRow free a tombstoned row at once.
+
+Tombstones live beside the row file in "<rowfile>.tmb", written through
+the WAL like the row file; entry i (16 bytes, little-endian) is
+
+[0:8]   uint64 row offset, 0 once the entry is purged
+[8:16]  int64 deletion time, Unix nanoseconds
+
+Compact and Truncate rewrite the file without its purged entries.
+Versioned files keep their own tombstones (see rowVersions.go) and reject
+these methods with ErrVersioned.
+*/
+
+const tombstoneEntrySize = 16
+
+// tombstone is the in-memory form of a tombstone entry.
+type tombstone struct {
+	at    int64 // deletion time, Unix nanoseconds
+	entry int64 // byte offset of the entry in the tombstone file
+}
+
+func openTombstones(rowPath string, truncate bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(rowPath+".tmb", flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open tombstone file: %w", err)
+	}
+	return f, nil
+}
+
+// loadTombstones reads the tombstone file into rw.tombs.
+func (rw *rowFile) loadTombstones() error {
+	rw.tombs = make(map[int64]tombstone)
+	if rw.tmb == nil {
+		return nil
+	}
+	size, err := rw.size(walTargetTombstones)
+	if err != nil {
+		return fmt.Errorf("load tombstones: %w", err)
+	}
+	buf := make([]byte, size)
+	if _, err := rw.readAt(walTargetTombstones, buf, 0); err != nil {
+		return fmt.Errorf("load tombstones: %w", err)
+	}
+	for off := 0; off+tombstoneEntrySize <= len(buf); off += tombstoneEntrySize {
+		row := int64(binary.LittleEndian.Uint64(buf[off:]))
+		if row == 0 {
+			continue
+		}
+		rw.tombs[row] = tombstone{
+			at:    int64(binary.LittleEndian.Uint64(buf[off+8:])),
+			entry: int64(off),
+		}
+	}
+	return nil
+}
+
+// remapTombstones rewrites the entries of a tombstone file that remap moves.
+func remapTombstones(buf []byte, remap map[int64]int64) {
+	for off := 0; off+tombstoneEntrySize <= len(buf); off += tombstoneEntrySize {
+		if row, ok := remap[int64(binary.LittleEndian.Uint64(buf[off:]))]; ok {
+			binary.LittleEndian.PutUint64(buf[off:], uint64(row))
+		}
+	}
+}
+
+// TombstoneRowAt soft-deletes the row at offset; see "Tombstones" above.
+func (rw *rowFile) TombstoneRowAt(offset int64) error {
+	if rw.versioned {
+		return fmt.Errorf("TombstoneRowAt: %w", ErrVersioned)
+	}
+	return rw.logged(func() error {
+		if err := rw.tombstoneRow(offset); err != nil {
+			return fmt.Errorf("TombstoneRowAt: %w", err)
+		}
+		return nil
+	})
+}
+
+// SoftDeleteRow soft-deletes the row with the given RowID. The RowID keeps
+// reading the row until Purge frees it.
+func (rw *rowFile) SoftDeleteRow(id RowID) error {
+	if rw.versioned {
+		return fmt.Errorf("SoftDeleteRow: %w", ErrVersioned)
+	}
+	return rw.logged(func() error {
+		offset, err := rw.rowOffset(id)
+		if err != nil {
+			return err
+		}
+		if err := rw.tombstoneRow(offset); err != nil {
+			return fmt.Errorf("SoftDeleteRow: %w", err)
+		}
+		return nil
+	})
+}
+
+func (rw *rowFile) tombstoneRow(offset int64) error {
+	if _, ok := rw.tombs[offset]; ok {
+		return fmt.Errorf("row at %d is already deleted", offset)
+	}
+	// only a readable row can be tombstoned
+	if _, err := rw.readRowAt(offset); err != nil {
+		return err
+	}
+	entry, err := rw.size(walTargetTombstones)
+	if err != nil {
+		return err
+	}
+	t := tombstone{at: time.Now().UnixNano(), entry: entry}
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(offset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(t.at))
+	if err := rw.writeAt(walTargetTombstones, buf, entry); err != nil {
+		return fmt.Errorf("write tombstone: %w", err)
+	}
+	rw.tombs[offset] = t
+	return nil
+}
+
+// dropTombstone clears the tombstone of the row at offset, if it has one,
+// when the row is freed.
+func (rw *rowFile) dropTombstone(offset int64) error {
+	t, ok := rw.tombs[offset]
+	if !ok {
+		return nil
+	}
+	if err := rw.writeAt(walTargetTombstones, make([]byte, 8), t.entry); err != nil {
+		return fmt.Errorf("clear tombstone: %w", err)
+	}
+	delete(rw.tombs, offset)
+	return nil
+}
+
+// Tombstoned reports whether the row at offset is soft-deleted, and when.
+func (rw *rowFile) Tombstoned(offset int64) (deletedAt time.Time, ok bool) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	t, ok := rw.tombs[offset]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, t.at), true
+}
+
+// Purge frees every row tombstoned before olderThan, clears the RowIDs that
+// named them, and returns how many were freed. It is logged as a single
+// mutation.
+func (rw *rowFile) Purge(olderThan time.Time) (int, error) {
+	if rw.versioned {
+		return 0, fmt.Errorf("Purge: %w", ErrVersioned)
+	}
+	var purged int
+	err := rw.logged(func() error {
+		cutoff := olderThan.UnixNano()
+		doomed := make(map[int64]bool)
+		for offset, t := range rw.tombs {
+			if t.at < cutoff {
+				doomed[offset] = true
+			}
+		}
+		if len(doomed) == 0 {
+			return nil
+		}
+		if err := rw.clearRowIDsAt(doomed); err != nil {
+			return err
+		}
+		for offset := range doomed {
+			if err := rw.freeRowAt(offset); err != nil {
+				return err
+			}
+		}
+		purged = len(doomed)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Purge: %w", err)
+	}
+	return purged, nil
+}
+
+// rewriteTombstones replaces the tombstone file with the live entries, with
+// their offsets moved by remap when it is not nil. It runs outside the WAL,
+// after a checkpoint, like remapRowIDs.
+func (rw *rowFile) rewriteTombstones(remap map[int64]int64) error {
+	if rw.tmb == nil {
+		return nil
+	}
+	tombs := rw.tombs
+	rw.tombs = make(map[int64]tombstone, len(tombs))
+	buf := make([]byte, 0, len(tombs)*tombstoneEntrySize)
+	for offset, t := range tombs {
+		if remap != nil {
+			offset = remap[offset]
+		}
+		t.entry = int64(len(buf))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.at))
+		rw.tombs[offset] = t
+	}
+	if err := writeSidecar(rw.tmb, buf); err != nil {
+		return err
+	}
+	return rw.tmb.Sync()
+}
+
+// writeSidecar replaces the contents of f with b.
+func writeSidecar(f *os.File, b []byte) error {
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("write %s: %w", f.Name(), err)
+	}
+	if err := f.Truncate(int64(len(b))); err != nil {
+		return fmt.Errorf("truncate %s: %w", f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"pranavdb/txn"
+)
+
+/*
+Transactions
+
+A rowfile joins a txn.Txn by keeping the WAL's pending writes across
+mutations: from BeginTxn on, logged holds each mutation's writes instead of
+committing them, and reads see them as they see a single mutation's. Each
+held write also keeps the bytes it replaces, which the transaction log
+needs to undo it. A mutation that fails inside the transaction drops only
+its own writes.
+
+BeginTxn checkpoints first, so the WAL holds nothing the transaction log
+could find overwritten when it redoes the transaction's writes. ApplyTxn,
+and EndTxn on commit, write the held changes to the files without syncing
+them: the transaction log makes them durable. EndTxn on rollback drops them
+and puts back the in-memory state from the start of the transaction.
+*/
+
+var (
+	_ txn.Participant = (*rowFile)(nil)
+	_ txn.Viewer      = (*rowFile)(nil)
+)
+
+// rowTxn is the in-memory state of a rowfile when its transaction began.
+type rowTxn struct {
+	firstFree, rows, live, ovfFree, lastTx uint64
+
+	id uint64 // versioned: the ID its versions carry, 0 until the first; see rowVersions.go
+}
+
+// BeginTxn starts holding the file's writes back for a txn.Txn; see
+// "Transactions" above.
+func (rw *rowFile) BeginTxn() error {
+	if rw.readOnly {
+		return ErrReadOnly
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.txn != nil {
+		return errors.New("BeginTxn: rowfile is already in a transaction")
+	}
+	if err := rw.checkpoint(); err != nil {
+		return fmt.Errorf("BeginTxn: %w", err)
+	}
+	rw.txn = &rowTxn{firstFree: rw.firstFreePage, rows: rw.rowCount, live: rw.liveBytes, ovfFree: rw.ovfFree, lastTx: rw.lastTx}
+	rw.inTx = true
+	return nil
+}
+
+// ViewTxn opens a Snapshot for a txn.Log's View. Only a versioned file keeps
+// the rows a view may need after they are rewritten.
+func (rw *rowFile) ViewTxn() (io.Closer, error) {
+	s, err := rw.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("ViewTxn: %w", err)
+	}
+	return s, nil
+}
+
+// BatchInsertRow records an InsertRow of values in b, to run when b
+// commits. A write that needs the new RowID, such as an index entry, goes in
+// the same op through b.Add.
+func (rw *rowFile) BatchInsertRow(b *txn.WriteBatch, values []any) {
+	b.Add(func() error {
+		_, err := rw.InsertRow(values)
+		return err
+	}, rw)
+}
+
+// BatchUpdateRow records an UpdateRow in b, to run when b commits.
+func (rw *rowFile) BatchUpdateRow(b *txn.WriteBatch, id RowID, values []any) {
+	b.Add(func() error { return rw.UpdateRow(id, values) }, rw)
+}
+
+// BatchDeleteRow records a DeleteRow in b, to run when b commits.
+func (rw *rowFile) BatchDeleteRow(b *txn.WriteBatch, id RowID) {
+	b.Add(func() error { return rw.DeleteRow(id) }, rw)
+}
+
+// TxnWrites returns the writes held since BeginTxn.
+func (rw *rowFile) TxnWrites() ([]txn.Write, error) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	if rw.txn == nil {
+		return nil, errors.New("TxnWrites: rowfile is not in a transaction")
+	}
+	writes := make([]txn.Write, len(rw.pending))
+	for i, w := range rw.pending {
+		writes[i] = txn.Write{
+			Path:    rw.targetPath(w.target),
+			Off:     w.off,
+			Data:    w.data,
+			Before:  w.before,
+			OldSize: w.oldSize,
+		}
+	}
+	return writes, nil
+}
+
+// keepBefore records in w what it is about to replace.
+func (rw *rowFile) keepBefore(w *walWrite) error {
+	size, err := rw.size(w.target)
+	if err != nil {
+		return err
+	}
+	w.oldSize = size
+	if end := min(w.off+int64(len(w.data)), size); end > w.off {
+		w.before = make([]byte, end-w.off)
+		if _, err := rw.readAt(w.target, w.before, w.off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyTxn writes the held changes to the files, keeping the transaction
+// open.
+func (rw *rowFile) ApplyTxn() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.txn == nil {
+		return errors.New("ApplyTxn: rowfile is not in a transaction")
+	}
+	writes := rw.pending
+	rw.pending = nil
+	if err := rw.apply(writes); err != nil {
+		return fmt.Errorf("ApplyTxn: %w", err)
+	}
+	return nil
+}
+
+// EndTxn stops holding writes back, applying them if commit is set and
+// otherwise dropping them.
+func (rw *rowFile) EndTxn(commit bool) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	t := rw.txn
+	if t == nil {
+		return errors.New("EndTxn: rowfile is not in a transaction")
+	}
+	writes := rw.pending
+	rw.pending, rw.inTx, rw.txn = nil, false, nil
+
+	if commit {
+		if err := rw.apply(writes); err != nil {
+			return fmt.Errorf("EndTxn: %w", err)
+		}
+		return nil
+	}
+
+	// the log has undone any write ApplyTxn made, so the files are as they
+	// were at BeginTxn
+	rw.firstFreePage, rw.rowCount, rw.liveBytes, rw.ovfFree, rw.lastTx = t.firstFree, t.rows, t.live, t.ovfFree, t.lastTx
+	if rw.format == rowFormatHeap {
+		if err := rw.loadHeapMap(); err != nil {
+			return fmt.Errorf("EndTxn: %w", err)
+		}
+	}
+	if err := rw.loadTombstones(); err != nil {
+		return fmt.Errorf("EndTxn: %w", err)
+	}
+	return nil
+}
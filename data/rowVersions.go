@@ -0,0 +1,498 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"pranavdb/page"
+)
+
+/*
+Row versions
+
+A versioned rowfile (NewVersionedRowfile) never overwrites a row. Every
+InsertRow, UpdateRow and DeleteRow is a transaction with the next
+transaction ID, and writes a new version of the row that links back to the
+one it replaces; the RowID table points at the newest. A delete writes a
+tombstone version with no values. Each heap cell starts with
+
+[0:8]   uint64 transaction ID that wrote the version
+[8:16]  uint64 address of the previous version, 0 for none
+[16]    flags, versionDeleted for a tombstone
+[17:..] the encoded row, absent in a tombstone
+
+Transaction IDs only grow along a chain, so the version a reader sees as of
+transaction T is the first one at or below T; a Snapshot pins T. The last
+committed ID is kept in the file header.
+
+Inside a txn.Txn (rowTxn.go) every mutation writes under one transaction
+ID, taken by the first, and a row written twice keeps only the later
+version, which replaces the earlier one in the chain. Until the
+transaction commits its ID is above every snapshot's: Snapshot pins the ID
+before it, so readers see only committed versions while the writer goes
+on, and CollectVersions keeps what they see. Snapshot.Scan reads the
+RowID table a batch at a time and calls fn with no lock held, so a long
+scan does not hold writers up either.
+
+Old versions stay until CollectVersions frees those no open snapshot can
+see. Until then RowCount counts every stored version, tombstones included,
+and RowOffset of a deleted row returns its tombstone.
+
+The offset-based mutations (WriteRow, UpdateRowAt, FreeRowAt, ...) fail
+with ErrVersioned on a versioned file. Reads by offset return the version
+stored there, and scans see the newest version of each row, in RowID order.
+*/
+
+const (
+	versionHeaderSize = 17
+
+	versionDeleted byte = 1 << 0
+
+	// collectBatch is the number of RowIDs CollectVersions handles per
+	// logged mutation.
+	collectBatch = 256
+
+	// snapshotScanBatch is the number of RowIDs Snapshot.Scan reads per
+	// hold of the lock.
+	snapshotScanBatch = 1024
+)
+
+type rowVersion struct {
+	tx      uint64
+	prev    int64
+	deleted bool
+	body    []byte // encoded row; nil in a tombstone
+}
+
+func parseVersion(payload []byte) (rowVersion, error) {
+	if len(payload) < versionHeaderSize {
+		return rowVersion{}, fmt.Errorf("%w: version header truncated", ErrRowCorrupt)
+	}
+	v := rowVersion{
+		tx:      binary.LittleEndian.Uint64(payload[0:8]),
+		prev:    int64(binary.LittleEndian.Uint64(payload[8:16])),
+		deleted: payload[16]&versionDeleted != 0,
+	}
+	if !v.deleted {
+		v.body = payload[versionHeaderSize:]
+	}
+	return v, nil
+}
+
+func appendVersion(tx uint64, prev int64, deleted bool, body []byte) []byte {
+	out := make([]byte, versionHeaderSize, versionHeaderSize+len(body))
+	binary.LittleEndian.PutUint64(out[0:8], tx)
+	binary.LittleEndian.PutUint64(out[8:16], uint64(prev))
+	if deleted {
+		out[16] = versionDeleted
+	}
+	return append(out, body...)
+}
+
+// NewVersionedRowfile creates a new/truncated row file like NewRowfile whose
+// rows keep their earlier versions for snapshot reads; see "Row versions"
+// above.
+func NewVersionedRowfile(filepath string, schemaStr string) (*rowFile, error) {
+	return newRowfile(filepath, schemaStr, true)
+}
+
+// Versioned reports whether the file was created with NewVersionedRowfile.
+func (rw *rowFile) Versioned() bool {
+	return rw.versioned
+}
+
+// LastTxID returns the ID of the last committed transaction.
+func (rw *rowFile) LastTxID() uint64 {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.committedTx()
+}
+
+// committedTx returns the ID of the last committed transaction, which is
+// below that of an open txn.Txn once the transaction has written a version.
+func (rw *rowFile) committedTx() uint64 {
+	if rw.txn != nil && rw.txn.id != 0 {
+		return rw.txn.id - 1
+	}
+	return rw.lastTx
+}
+
+// versionTx returns the transaction ID for a new version: a new one per
+// mutation, or the one an open txn.Txn shares across its mutations.
+func (rw *rowFile) versionTx() uint64 {
+	if rw.txn == nil {
+		rw.lastTx++
+		return rw.lastTx
+	}
+	if rw.txn.id == 0 {
+		rw.lastTx++
+		rw.txn.id = rw.lastTx
+	}
+	return rw.txn.id
+}
+
+// writeVersion stores a new version linked to prev in a new transaction, or
+// a tombstone if deleted.
+func (rw *rowFile) writeVersion(prev int64, values []any, deleted bool) (int64, error) {
+	var body []byte
+	if !deleted {
+		var err error
+		if body, err = rw.encodeValues(values); err != nil {
+			return 0, err
+		}
+	}
+	addrs, err := rw.heapStore([][]byte{appendVersion(rw.versionTx(), prev, deleted, body)})
+	if err != nil {
+		return 0, err
+	}
+	return addrs[0], nil
+}
+
+func (rw *rowFile) readVersion(addr int64) (rowVersion, error) {
+	hp, _, slot, err := rw.heapRow(addr)
+	if err != nil {
+		return rowVersion{}, err
+	}
+	payload, _ := hp.cell(slot)
+	v, err := parseVersion(payload)
+	if err != nil {
+		return rowVersion{}, fmt.Errorf("row at %d: %w", addr, err)
+	}
+	return v, nil
+}
+
+// replaceVersion writes a new version of the row with the given RowID, or
+// a tombstone if deleted.
+func (rw *rowFile) replaceVersion(id RowID, values []any, deleted bool) error {
+	offset, err := rw.rowOffset(id)
+	if err != nil {
+		return err
+	}
+	current, err := rw.readVersion(offset)
+	if err != nil {
+		return err
+	}
+	if current.deleted {
+		return fmt.Errorf("%w: RowID %d is deleted", ErrNoRow, id)
+	}
+	prev := offset
+	if rw.txn != nil && rw.txn.id != 0 && current.tx == rw.txn.id {
+		// written earlier in this transaction, so no one else can see it
+		prev = current.prev
+	}
+	newOffset, err := rw.writeVersion(prev, values, deleted)
+	if err != nil {
+		return err
+	}
+	if prev != offset {
+		if err := rw.heapFreeRowAt(offset); err != nil {
+			return err
+		}
+	}
+	return rw.setRowOffset(id, newOffset)
+}
+
+// visibleVersion walks the chain starting at addr to the version a reader
+// as of transaction tx sees. ok is false when the row did not exist yet or
+// was deleted by then.
+func (rw *rowFile) visibleVersion(addr int64, tx uint64) (v rowVersion, at int64, ok bool, err error) {
+	for addr != 0 {
+		next, err := rw.readVersion(addr)
+		if err != nil {
+			return rowVersion{}, 0, false, err
+		}
+		if v.tx != 0 && next.tx >= v.tx {
+			return rowVersion{}, 0, false, fmt.Errorf("%w: version chain does not go back in time at %d", ErrRowCorrupt, addr)
+		}
+		if v = next; v.tx <= tx {
+			return v, addr, !v.deleted, nil
+		}
+		addr = v.prev
+	}
+	return rowVersion{}, 0, false, nil
+}
+
+// scanVersions calls fn, in RowID order, with every row visible as of
+// transaction tx, and the address of the version seen.
+func (rw *rowFile) scanVersions(tx uint64, fn func(id RowID, addr int64, values []any) error) error {
+	_, err := rw.scanVersionRange(tx, 1, -1, fn)
+	return err
+}
+
+// scanVersionRange is scanVersions over n RowIDs from first, or all of them
+// if n < 0. It reports whether the table goes on past them.
+func (rw *rowFile) scanVersionRange(tx uint64, first RowID, n int, fn func(id RowID, addr int64, values []any) error) (more bool, err error) {
+	if rw.ids == nil {
+		return false, nil // no RowID table, so no rows
+	}
+	size, err := rw.size(walTargetIDs)
+	if err != nil {
+		return false, fmt.Errorf("scan: %w", err)
+	}
+	end := size
+	if n >= 0 {
+		end = min(size, int64(first-1+RowID(n))*rowIDEntrySize)
+	}
+	table := make([]byte, 64<<10)
+	for base := int64(first-1) * rowIDEntrySize; base < end; base += int64(len(table)) {
+		chunk := table[:min(int64(len(table)), end-base)]
+		if _, err := rw.readAt(walTargetIDs, chunk, base); err != nil {
+			return false, fmt.Errorf("scan: read row ID table: %w", err)
+		}
+		for i := 0; i+rowIDEntrySize <= len(chunk); i += rowIDEntrySize {
+			id := RowID((base+int64(i))/rowIDEntrySize + 1)
+			v, at, ok, err := rw.visibleVersion(int64(binary.LittleEndian.Uint64(chunk[i:])), tx)
+			if err != nil {
+				return false, fmt.Errorf("scan: RowID %d: %w", id, err)
+			}
+			if !ok {
+				continue
+			}
+			values, err := rw.decodeValues(v.body)
+			if err != nil {
+				return false, fmt.Errorf("scan: decode failed at offset %d: %w", at, err)
+			}
+			if err := fn(id, at, values); err != nil {
+				return false, err
+			}
+		}
+	}
+	return end < size, nil
+}
+
+// Snapshot is a consistent view of a versioned rowfile as of one
+// transaction: later inserts, updates and deletes are invisible to it, and
+// the versions it sees are kept from CollectVersions until it is released.
+type Snapshot struct {
+	rw       *rowFile
+	tx       uint64
+	released bool
+}
+
+// Snapshot opens a view of the rows as of the last committed transaction.
+// It must be released with Release.
+func (rw *rowFile) Snapshot() (*Snapshot, error) {
+	if !rw.versioned {
+		return nil, errors.New("Snapshot: rowfile is not versioned")
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.snapshots == nil {
+		rw.snapshots = make(map[uint64]int)
+	}
+	tx := rw.committedTx()
+	rw.snapshots[tx]++
+	return &Snapshot{rw: rw, tx: tx}, nil
+}
+
+// TxID returns the transaction the snapshot sees the rows as of.
+func (s *Snapshot) TxID() uint64 { return s.tx }
+
+// Release lets CollectVersions reclaim the versions only s could see.
+// Further calls do nothing.
+func (s *Snapshot) Release() {
+	s.rw.mu.Lock()
+	defer s.rw.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if s.rw.snapshots[s.tx]--; s.rw.snapshots[s.tx] == 0 {
+		delete(s.rw.snapshots, s.tx)
+	}
+}
+
+// Close releases the snapshot, so it can serve as a txn.Log's view of the
+// file.
+func (s *Snapshot) Close() error {
+	s.Release()
+	return nil
+}
+
+// ReadRow reads the row with the given RowID as the snapshot sees it.
+func (s *Snapshot) ReadRow(id RowID) ([]any, error) {
+	s.rw.mu.RLock()
+	defer s.rw.mu.RUnlock()
+	if s.released {
+		return nil, errors.New("ReadRow: snapshot released")
+	}
+	offset, err := s.rw.rowOffset(id)
+	if err != nil {
+		return nil, err
+	}
+	v, at, ok, err := s.rw.visibleVersion(offset, s.tx)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRow: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("ReadRow: %w: RowID %d as of transaction %d", ErrNoRow, id, s.tx)
+	}
+	values, err := s.rw.decodeValues(v.body)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRow: decode failed at offset %d: %w", at, err)
+	}
+	return values, nil
+}
+
+// Scan calls fn, in RowID order, with every row the snapshot sees. It stops
+// at the first error fn returns. fn is called with no lock held, so it may
+// write to the file.
+func (s *Snapshot) Scan(fn func(id RowID, values []any) error) error {
+	type row struct {
+		id     RowID
+		values []any
+	}
+	var rows []row
+	for first := RowID(1); ; first += snapshotScanBatch {
+		rows = rows[:0]
+		more, err := func() (bool, error) {
+			s.rw.mu.RLock()
+			defer s.rw.mu.RUnlock()
+			if s.released {
+				return false, errors.New("Scan: snapshot released")
+			}
+			return s.rw.scanVersionRange(s.tx, first, snapshotScanBatch, func(id RowID, _ int64, values []any) error {
+				rows = append(rows, row{id, values})
+				return nil
+			})
+		}()
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := fn(r.id, r.values); err != nil {
+				return err
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// CollectVersions frees the row versions no open snapshot (and no new one)
+// can see: everything older than the version visible to the oldest
+// snapshot, and the whole chain of a row deleted before it, whose RowID
+// then reads as never issued. It returns the number of versions freed. The
+// work is logged in batches of RowIDs, so a crash part way leaves the
+// batches done so far.
+func (rw *rowFile) CollectVersions() (int, error) {
+	if !rw.versioned {
+		return 0, errors.New("CollectVersions: rowfile is not versioned")
+	}
+	freed := 0
+	for first := RowID(1); ; first += collectBatch {
+		var done bool
+		err := rw.logged(func() error {
+			n, more, err := rw.collectVersions(first, collectBatch)
+			freed += n
+			done = !more
+			return err
+		})
+		if err != nil {
+			return freed, fmt.Errorf("CollectVersions: %w", err)
+		}
+		if done {
+			return freed, nil
+		}
+	}
+}
+
+// collectVersions collects the chains of n RowIDs from first, and reports
+// whether the table has more.
+func (rw *rowFile) collectVersions(first RowID, n int) (freed int, more bool, err error) {
+	horizon := rw.committedTx()
+	for tx := range rw.snapshots {
+		horizon = min(horizon, tx)
+	}
+	size, err := rw.size(walTargetIDs)
+	if err != nil {
+		return 0, false, err
+	}
+	last := RowID(size / rowIDEntrySize)
+	for id := first; id < first+RowID(n) && id <= last; id++ {
+		newest, err := rw.rowOffset(id)
+		if errors.Is(err, ErrNoRow) {
+			continue
+		}
+		if err != nil {
+			return freed, false, err
+		}
+		k, err := rw.collectChain(id, newest, horizon)
+		freed += k
+		if err != nil {
+			return freed, false, fmt.Errorf("RowID %d: %w", id, err)
+		}
+	}
+	return freed, first+RowID(n) <= last, nil
+}
+
+func (rw *rowFile) collectChain(id RowID, newest int64, horizon uint64) (int, error) {
+	// find the version visible at the horizon; everything before it goes
+	v, at, _, err := rw.visibleVersion(newest, horizon)
+	if err != nil || at == 0 {
+		return 0, err // only versions newer than the horizon
+	}
+	freed := 0
+	for addr := v.prev; addr != 0; freed++ {
+		old, err := rw.readVersion(addr)
+		if err != nil {
+			return freed, err
+		}
+		if err := rw.heapFreeRowAt(addr); err != nil {
+			return freed, err
+		}
+		addr = old.prev
+	}
+
+	if v.deleted && at == newest {
+		// deleted before any snapshot: the row is gone for everyone
+		if err := rw.setRowOffset(id, 0); err != nil {
+			return freed, err
+		}
+		return freed + 1, rw.heapFreeRowAt(at)
+	}
+	if v.prev != 0 {
+		return freed, rw.setVersionPrev(at, 0)
+	}
+	return freed, nil
+}
+
+// setVersionPrev rewrites the previous-version link of the version at addr.
+func (rw *rowFile) setVersionPrev(addr int64, prev int64) error {
+	hp, pageOff, slot, err := rw.heapRow(addr)
+	if err != nil {
+		return err
+	}
+	payload, _ := hp.cell(slot)
+	binary.LittleEndian.PutUint64(payload[8:16], uint64(prev))
+	return rw.writeHeapPage(pageOff, hp)
+}
+
+// relinkVersions rewrites the previous-version links in the first pages of
+// a compacted copy with their new addresses.
+func relinkVersions(dst *os.File, pages int, remap map[int64]int64) error {
+	buf := make([]byte, page.PageSize)
+	for i := 0; i < pages; i++ {
+		pageOff := heapPageOffset(i)
+		if _, err := dst.ReadAt(buf, pageOff); err != nil {
+			return fmt.Errorf("read page at %d: %w", pageOff, err)
+		}
+		hp := &heapPage{buf: buf}
+		for slot := 0; slot < hp.numSlots(); slot++ {
+			payload, ok := hp.cell(slot)
+			if !ok || len(payload) < versionHeaderSize {
+				continue
+			}
+			if prev := int64(binary.LittleEndian.Uint64(payload[8:16])); prev != 0 {
+				binary.LittleEndian.PutUint64(payload[8:16], uint64(remap[prev]))
+			}
+		}
+		hp.seal()
+		if _, err := dst.WriteAt(buf, pageOff); err != nil {
+			return fmt.Errorf("write page at %d: %w", pageOff, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"pranavdb/internal/failpoint"
+)
+
+/*
+Write-ahead log
+
+Every mutation (WriteRow, FreeRowAt, UpdateRowAt, the RowID methods, ...)
+collects the writes it would make to the row file and the RowID table, then
+commits them as one record in "<rowfile>.wal":
+
+[0:4]  uint32 body length
+[4:8]  uint32 CRC32 of the body
+[8:..] body: entries of (target uint8, offset uint64, length uint32, bytes)
+
+The record is synced before any of its writes reach the files, so after a
+crash OpenRowfile can replay every complete record and the files end up as
+if each mutation happened entirely or not at all. A torn last record fails
+its checksum and is ignored. Writes are full images of the bytes written,
+so replaying a record twice is harmless.
+
+The log is truncated at a checkpoint, after the files are synced: when it
+grows past walCheckpointSize, on Compact, on Close, and whenever Checkpoint
+or the background checkpointer asks (see rowCheckpoint.go).
+*/
+
+const (
+	walTargetRows       byte = 0 // the row file
+	walTargetIDs        byte = 1 // the RowID table
+	walTargetOverflow   byte = 2 // the overflow file
+	walTargetTombstones byte = 3 // the tombstone file
+
+	walRecordHeader   = 8
+	walCheckpointSize = 4 << 20
+)
+
+type walWrite struct {
+	target byte
+	off    int64
+	data   []byte
+
+	// inside a transaction, what the write replaced; see rowTxn.go
+	before  []byte
+	oldSize int64
+}
+
+func openWAL(rowPath string, truncate bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(rowPath+".wal", flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open rowfile WAL: %w", err)
+	}
+	return f, nil
+}
+
+func (rw *rowFile) targetFile(target byte) *os.File {
+	switch target {
+	case walTargetIDs:
+		return rw.ids
+	case walTargetOverflow:
+		return rw.ovf
+	case walTargetTombstones:
+		return rw.tmb
+	}
+	return rw.file
+}
+
+// targetPath returns the path of the target file. The row file's handle
+// may carry the name it was compacted under, so its path is kept apart.
+func (rw *rowFile) targetPath(target byte) string {
+	if target == walTargetRows {
+		return rw.path
+	}
+	return rw.targetFile(target).Name()
+}
+
+// logged runs a mutation, holding mu, so that its writes are committed
+// through the WAL as one record. If the mutation fails nothing is written,
+// and the in-memory state it changed is put back. Mutations
+// call each other's unexported forms, never logged again. Inside a
+// transaction the writes are held until it ends; see rowTxn.go.
+func (rw *rowFile) logged(mutate func() error) error {
+	if rw.readOnly {
+		return ErrReadOnly
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	firstFree, rows, live, ovfFree, lastTx := rw.firstFreePage, rw.rowCount, rw.liveBytes, rw.ovfFree, rw.lastTx
+	held := len(rw.pending) // writes of earlier mutations in an open txn, see rowTxn.go
+	rw.inTx = true
+	err := mutate()
+	writes := rw.pending[held:]
+	if rw.txn == nil {
+		rw.pending, rw.inTx = nil, false
+		if err == nil {
+			err = rw.commit(writes)
+		}
+	} else if err != nil {
+		rw.pending = rw.pending[:held]
+	}
+	if err != nil {
+		rw.firstFreePage, rw.rowCount, rw.liveBytes, rw.ovfFree, rw.lastTx = firstFree, rows, live, ovfFree, lastTx
+		if rw.txn != nil && rw.txn.id > lastTx {
+			rw.txn.id = 0 // taken by the failed mutation
+		}
+		if len(writes) > 0 && rw.format == rowFormatHeap {
+			// pages written during the mutation changed the free-space map
+			if rerr := rw.loadHeapMap(); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+		}
+		if len(writes) > 0 {
+			if rerr := rw.loadTombstones(); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// writeAt writes b at off in the target file, or queues it when a mutation
+// is being logged.
+func (rw *rowFile) writeAt(target byte, b []byte, off int64) error {
+	if !rw.inTx {
+		_, err := rw.targetFile(target).WriteAt(b, off)
+		return err
+	}
+	w := walWrite{target: target, off: off, data: append([]byte(nil), b...)}
+	if rw.txn != nil {
+		if err := rw.keepBefore(&w); err != nil {
+			return err
+		}
+	}
+	rw.pending = append(rw.pending, w)
+	return nil
+}
+
+// readAt reads from the target file as the current mutation's queued writes
+// would leave it.
+func (rw *rowFile) readAt(target byte, b []byte, off int64) (n int, err error) {
+	if target == walTargetRows && off >= 0 && off+int64(len(b)) <= int64(len(rw.mapped)) {
+		n = copy(b, rw.mapped[off:])
+	} else {
+		n, err = rw.targetFile(target).ReadAt(b, off)
+	}
+	if len(rw.pending) == 0 {
+		return n, err
+	}
+	clear(b[n:])
+	for _, w := range rw.pending {
+		if w.target != target {
+			continue
+		}
+		lo, hi := max(off, w.off), min(off+int64(len(b)), w.off+int64(len(w.data)))
+		if lo >= hi {
+			continue
+		}
+		copy(b[lo-off:hi-off], w.data[lo-w.off:])
+		n = max(n, int(hi-off))
+	}
+	if n == len(b) {
+		err = nil
+	}
+	return n, err
+}
+
+// size returns the target file's size, counting queued writes past its end.
+func (rw *rowFile) size(target byte) (int64, error) {
+	info, err := rw.targetFile(target).Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	for _, w := range rw.pending {
+		if w.target == target {
+			size = max(size, w.off+int64(len(w.data)))
+		}
+	}
+	return size, nil
+}
+
+// commit logs writes as one record, syncs the log, then applies them.
+func (rw *rowFile) commit(writes []walWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	body := make([]byte, 0, 64)
+	for _, w := range writes {
+		body = append(body, w.target)
+		body = binary.LittleEndian.AppendUint64(body, uint64(w.off))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(w.data)))
+		body = append(body, w.data...)
+	}
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	if _, err := rw.wal.WriteAt(record, rw.walSize); err != nil {
+		return fmt.Errorf("append WAL record: %w", err)
+	}
+	if err := rw.wal.Sync(); err != nil {
+		return fmt.Errorf("sync WAL: %w", err)
+	}
+	rw.walSize += int64(len(record))
+	if err := failpoint.Inject("after-wal-sync"); err != nil {
+		return err
+	}
+
+	if err := rw.apply(writes); err != nil {
+		return err
+	}
+	if rw.walSize >= walCheckpointSize {
+		return rw.checkpoint()
+	}
+	return nil
+}
+
+// apply makes logged writes to their files.
+func (rw *rowFile) apply(writes []walWrite) error {
+	var end int64
+	for _, w := range writes {
+		if _, err := rw.targetFile(w.target).WriteAt(w.data, w.off); err != nil {
+			return fmt.Errorf("apply WAL record: %w", err)
+		}
+		if w.target == walTargetRows {
+			end = max(end, w.off+int64(len(w.data)))
+		}
+	}
+	if err := rw.growMap(end); err != nil {
+		return fmt.Errorf("remap rowfile: %w", err)
+	}
+	return nil
+}
+
+// checkpoint syncs the files, empties the log and records the checkpoint in
+// the header.
+func (rw *rowFile) checkpoint() error {
+	if rw.wal == nil || rw.walSize == 0 {
+		return nil
+	}
+	if err := rw.file.Sync(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := rw.ids.Sync(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := rw.ovf.Sync(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := rw.tmb.Sync(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := rw.wal.Truncate(0); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	rw.walSize = 0
+	if err := rw.recordCheckpoint(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+// recoverWAL replays the complete records in the log, then checkpoints.
+// It runs before the header is read.
+func (rw *rowFile) recoverWAL() error {
+	buf, err := io.ReadAll(io.NewSectionReader(rw.wal, 0, 1<<62))
+	if err != nil {
+		return fmt.Errorf("read WAL: %w", err)
+	}
+	for len(buf) >= walRecordHeader {
+		n := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if walRecordHeader+n > len(buf) {
+			break // torn record
+		}
+		body := buf[walRecordHeader : walRecordHeader+n]
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[4:8]) {
+			break
+		}
+		for len(body) > 0 {
+			if len(body) < 13 {
+				return fmt.Errorf("WAL record entry truncated")
+			}
+			target, off := body[0], int64(binary.LittleEndian.Uint64(body[1:9]))
+			size := int(binary.LittleEndian.Uint32(body[9:13]))
+			if 13+size > len(body) {
+				return fmt.Errorf("WAL record entry truncated")
+			}
+			if _, err := rw.targetFile(target).WriteAt(body[13:13+size], off); err != nil {
+				return fmt.Errorf("replay WAL: %w", err)
+			}
+			body = body[13+size:]
+		}
+		buf = buf[walRecordHeader+n:]
+	}
+	if err := rw.file.Sync(); err != nil {
+		return fmt.Errorf("recover WAL: %w", err)
+	}
+	if err := rw.ids.Sync(); err != nil {
+		return fmt.Errorf("recover WAL: %w", err)
+	}
+	if err := rw.ovf.Sync(); err != nil {
+		return fmt.Errorf("recover WAL: %w", err)
+	}
+	if err := rw.tmb.Sync(); err != nil {
+		return fmt.Errorf("recover WAL: %w", err)
+	}
+	if err := rw.wal.Truncate(0); err != nil {
+		return fmt.Errorf("recover WAL: %w", err)
+	}
+	rw.walSize = 0
+	return nil
+}
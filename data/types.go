@@ -0,0 +1,72 @@
+package data
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Decimal is the Go value of a DECIMAL column: Unscaled × 10^-Scale.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    uint8
+}
+
+// ParseDecimal parses a plain decimal string such as "-12.340".
+func ParseDecimal(s string) (Decimal, error) {
+	digits := strings.TrimSpace(s)
+	var scale int
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		scale = len(digits) - dot - 1
+		digits = digits[:dot] + digits[dot+1:]
+	}
+	if scale > 255 {
+		return Decimal{}, fmt.Errorf("decimal %q has more than 255 fractional digits", s)
+	}
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	return Decimal{Unscaled: unscaled, Scale: uint8(scale)}, nil
+}
+
+func (d Decimal) String() string {
+	if d.Unscaled == nil {
+		return "0"
+	}
+	digits := new(big.Int).Abs(d.Unscaled).String()
+	sign := ""
+	if d.Unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if d.Scale == 0 {
+		return sign + digits
+	}
+	if pad := int(d.Scale) + 1 - len(digits); pad > 0 {
+		digits = strings.Repeat("0", pad) + digits
+	}
+	point := len(digits) - int(d.Scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// UUID is the Go value of a UUID column.
+type UUID [16]byte
+
+// ParseUUID parses the canonical 8-4-4-4-12 hex form.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	raw := strings.ReplaceAll(s, "-", "")
+	if len(raw) != 32 {
+		return u, fmt.Errorf("invalid UUID %q", s)
+	}
+	if _, err := hex.Decode(u[:], []byte(raw)); err != nil {
+		return u, fmt.Errorf("invalid UUID %q: %w", s, err)
+	}
+	return u, nil
+}
+
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
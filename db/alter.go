@@ -0,0 +1,352 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"pranavdb/data"
+	"slices"
+	"strings"
+)
+
+/*
+Schema changes
+
+AddColumn and DropColumn change a table's schema without touching its
+rows. A rowfile's columns are fixed when it is created, so each change
+starts a new rowfile, a segment, for the rows written from then on, and
+the rows already written stay where they are:
+
+	<table>.rows    segment 0, the rows written under the first schema
+	<table>.rows.N  segment N, the rows written under a later one
+
+Columns have IDs, never reused, and the table metadata lists the IDs of
+the columns each segment holds, so a row read from an old segment is
+mapped onto the current schema: a column added since reads as its Default,
+and a column dropped since is skipped. A column dropped and added again
+under the same name is a new column, and does not bring its old values
+back.
+
+Index values name a row by a reference, the segment's number in the top
+16 bits and the row's RowID in the rest, and Update moves a row from an
+old segment into the current one. Rows are so rewritten lazily, as they
+change, rather than all at once by the schema change. A segment left with
+no rows is dropped by the next schema change or OpenTable.
+
+The new metadata is the commit point: a change that fails before it is
+written leaves the old schema in place, with at most an unlisted segment
+file that the next change truncates.
+*/
+
+// refShift is where a row reference's segment number starts.
+const refShift = 48
+
+// segment is one of a table's rowfiles.
+type segment struct {
+	num  uint16
+	rows rowStore
+	cols []int // each stored column's position in the schema, or -1 once dropped
+}
+
+// segmentPath returns the rowfile of segment num of the table at path.
+func segmentPath(path string, num uint16) string {
+	if num == 0 {
+		return path + ".rows"
+	}
+	return fmt.Sprintf("%s.rows.%d", path, num)
+}
+
+// rowRef returns the reference to row id of segment num.
+func rowRef(num uint16, id data.RowID) uint64 {
+	return uint64(num)<<refShift | uint64(id)
+}
+
+// setMeta makes m the table's metadata. t.segments must match its segment
+// list.
+func (t *Table) setMeta(m *tableMeta) {
+	t.meta, t.schema = m, &m.schema
+	t.codes = t.current().rows.GetSchemaCodes()
+	pos := make(map[uint32]int, len(m.colIDs))
+	for i, id := range m.colIDs {
+		pos[id] = i
+	}
+	for i, seg := range t.segments {
+		seg.cols = make([]int, len(m.segments[i].cols))
+		for j, id := range m.segments[i].cols {
+			if p, ok := pos[id]; ok {
+				seg.cols[j] = p
+			} else {
+				seg.cols[j] = -1
+			}
+		}
+	}
+	for _, ix := range t.indexes {
+		ix.column = m.schema.Column(ix.name)
+	}
+}
+
+// current returns the segment rows are written to.
+func (t *Table) current() *segment {
+	return t.segments[len(t.segments)-1]
+}
+
+// segmentOf returns the segment and RowID ref refers to.
+func (t *Table) segmentOf(ref uint64) (*segment, data.RowID, error) {
+	num := uint16(ref >> refShift)
+	for _, seg := range t.segments {
+		if seg.num == num {
+			return seg, data.RowID(ref & (1<<refShift - 1)), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("row reference %#x: no segment %d", ref, num)
+}
+
+// readRow reads the row ref refers to, under the current schema.
+func (t *Table) readRow(ref uint64) ([]any, error) {
+	seg, id, err := t.segmentOf(ref)
+	if err != nil {
+		return nil, err
+	}
+	values, err := seg.rows.ReadRow(id)
+	if err != nil || seg == t.current() {
+		return values, err
+	}
+	row := make([]any, len(t.schema.Columns))
+	for i, c := range t.schema.Columns {
+		row[i] = c.Default
+	}
+	for i, v := range values {
+		if p := seg.cols[i]; p >= 0 {
+			row[p] = v
+		}
+	}
+	return row, nil
+}
+
+// insertRow writes row to the current segment. Called in a transaction.
+func (t *Table) insertRow(row []any) (uint64, error) {
+	seg := t.current()
+	id, err := seg.rows.InsertRow(row)
+	if err != nil {
+		return 0, err
+	}
+	if id >= 1<<refShift {
+		return 0, fmt.Errorf("segment %d is out of RowIDs", seg.num)
+	}
+	return rowRef(seg.num, id), nil
+}
+
+// updateRow replaces the row ref refers to and returns its reference,
+// which changes if the row moves to the current segment. Called in a
+// transaction.
+func (t *Table) updateRow(ref uint64, row []any) (uint64, error) {
+	seg, id, err := t.segmentOf(ref)
+	if err != nil {
+		return 0, err
+	}
+	if seg == t.current() {
+		return ref, seg.rows.UpdateRow(id, row)
+	}
+	if err := seg.rows.DeleteRow(id); err != nil {
+		return 0, err
+	}
+	return t.insertRow(row)
+}
+
+// deleteRow deletes the row ref refers to. Called in a transaction.
+func (t *Table) deleteRow(ref uint64) error {
+	seg, id, err := t.segmentOf(ref)
+	if err != nil {
+		return err
+	}
+	return seg.rows.DeleteRow(id)
+}
+
+// normalizeDefaults checks each column's default can be stored and
+// replaces it with the value it reads back as, e.g. an int32 for an int
+// column.
+func normalizeDefaults(s *Schema) error {
+	for i, c := range s.Columns {
+		if c.Default == nil {
+			continue
+		}
+		b, err := encodeDefault(c)
+		if err != nil {
+			return err
+		}
+		if s.Columns[i].Default, err = decodeDefault(c, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddColumn adds col as the schema's last column. Existing rows read it as
+// col.Default, which a column that is not nullable must have; see "Schema
+// changes" above.
+func (t *Table) AddColumn(col Column) error {
+	codes, err := data.ParseSchema(col.Type)
+	if err != nil {
+		return fmt.Errorf("AddColumn: column %q: %w", col.Name, err)
+	}
+	if len(codes) == 1 && codes[0]&data.TypeFlagNullable == 0 && col.Default == nil {
+		return fmt.Errorf("AddColumn: column %q is not nullable and has no default", col.Name)
+	}
+	if col.AutoIncrement {
+		return fmt.Errorf("AddColumn: column %q: existing rows cannot be numbered", col.Name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.meta.clone()
+	m.schema.Columns = append(m.schema.Columns, col)
+	m.colIDs = append(m.colIDs, m.nextID)
+	m.nextID++
+	if err := m.schema.validate(); err != nil {
+		return fmt.Errorf("AddColumn: %w", err)
+	}
+	if err := normalizeDefaults(&m.schema); err != nil {
+		return fmt.Errorf("AddColumn: %w", err)
+	}
+	if err := t.changeSchema(m); err != nil {
+		return fmt.Errorf("AddColumn: %w", err)
+	}
+	return nil
+}
+
+// DropColumn removes column name, and its index if it has one. Primary key
+// columns cannot be dropped. See "Schema changes" above.
+func (t *Table) DropColumn(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	col := t.schema.Column(name)
+	switch {
+	case col < 0:
+		return fmt.Errorf("DropColumn: no column %q", name)
+	case slices.Contains(t.schema.PrimaryKey, col):
+		return fmt.Errorf("DropColumn: column %q is part of the primary key", name)
+	}
+	m := t.meta.clone()
+	m.schema.Columns = slices.Delete(m.schema.Columns, col, col+1)
+	m.colIDs = slices.Delete(m.colIDs, col, col+1)
+	for i, k := range m.schema.PrimaryKey {
+		if k > col {
+			m.schema.PrimaryKey[i]--
+		}
+	}
+	m.schema.Indexes = slices.DeleteFunc(m.schema.Indexes, func(n string) bool {
+		return strings.EqualFold(n, name)
+	})
+	if err := t.changeSchema(m); err != nil {
+		return fmt.Errorf("DropColumn: %w", err)
+	}
+	return nil
+}
+
+// changeSchema moves the table to the schema of m, whose segment list it
+// fills in: a new segment for rows written from now on, after the old ones
+// that still have rows. Called with mu held.
+func (t *Table) changeSchema(m *tableMeta) error {
+	cur := t.current()
+	if cur.num == math.MaxUint16 {
+		return errors.New("too many schema changes")
+	}
+	num := cur.num + 1
+	m.schema.Version++
+	rows, err := data.NewRowfile(segmentPath(t.path, num), m.schema.rowSchema())
+	if err != nil {
+		return err
+	}
+	keep, drop, metas := t.partition(false)
+	m.segments = metas
+	m.segments = append(m.segments, segmentMeta{num: num, cols: slices.Clone(m.colIDs)})
+	if err := writeMeta(t.path+".tbl", m); err != nil {
+		return errors.Join(fmt.Errorf("write metadata: %w", err), rows.Close(), removeSegment(t.path, num))
+	}
+
+	var dropIndexes []*secondary
+	t.indexes = slices.DeleteFunc(t.indexes, func(ix *secondary) bool {
+		if m.schema.Column(ix.name) >= 0 {
+			return false
+		}
+		dropIndexes = append(dropIndexes, ix)
+		return true
+	})
+	t.segments = append(keep, &segment{num: num, rows: rows})
+	t.setMeta(m)
+	return t.removeDropped(drop, dropIndexes)
+}
+
+// dropEmptySegments drops the segments before the current one that have
+// no rows left.
+func (t *Table) dropEmptySegments() error {
+	keep, drop, metas := t.partition(true)
+	if len(drop) == 0 {
+		return nil
+	}
+	m := t.meta.clone()
+	m.segments = metas
+	if err := writeMeta(t.path+".tbl", m); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	t.segments = keep
+	t.setMeta(m)
+	return t.removeDropped(drop, nil)
+}
+
+// partition divides the segments into those with rows, which are kept,
+// and the empty ones, which are dropped, returning the metadata of those
+// kept. With keepCurrent the current segment is kept either way.
+func (t *Table) partition(keepCurrent bool) (keep, drop []*segment, metas []segmentMeta) {
+	for i, seg := range t.segments {
+		if seg.rows.RowCount() == 0 && !(keepCurrent && seg == t.current()) {
+			drop = append(drop, seg)
+			continue
+		}
+		keep = append(keep, seg)
+		metas = append(metas, t.meta.segments[i])
+	}
+	return keep, drop, metas
+}
+
+// removeDropped closes and deletes the files of segments and indexes the
+// metadata no longer lists. The log is checkpointed first, so that neither
+// it nor recovery writes to them again.
+func (t *Table) removeDropped(segs []*segment, indexes []*secondary) error {
+	if len(segs) == 0 && len(indexes) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, seg := range segs {
+		errs = append(errs, seg.rows.Close())
+	}
+	for _, ix := range indexes {
+		errs = append(errs, ix.tree.Close())
+	}
+	if err := t.log.Checkpoint(); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, seg := range segs {
+		errs = append(errs, removeSegment(t.path, seg.num))
+	}
+	for _, ix := range indexes {
+		if err := os.Remove(indexPath(t.path, ix.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// segmentFiles are the suffixes of a segment's rowfile and its side files.
+var segmentFiles = []string{"", ".rid", ".ovf", ".tmb", ".wal", ".compact"}
+
+// removeSegment deletes the rowfile of segment num and its side files.
+func removeSegment(path string, num uint16) error {
+	p := segmentPath(path, num)
+	for _, suffix := range segmentFiles {
+		if err := os.Remove(p + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"pranavdb/data"
+)
+
+/*
+Auto-increment
+
+A table may have one AutoIncrement column, an int or bigint that is not
+nullable. Insert fills a nil value in it with the table's next number,
+counting from 1; a row given a number of its own moves the count past it,
+so later rows are numbered after it. The column is not made unique by
+this: it is when it is the primary key, as it usually is.
+
+The count is kept in memory. The metadata records a limit above every
+number handed out, raised autoReserve numbers at a time, so only one
+insert in autoReserve writes the metadata, and the count restarts from the
+limit on OpenTable. Numbers are never handed out twice, even by inserts
+that fail or are lost in a crash, but such numbers, and those reserved
+when the table was last closed, are skipped. Update moves the count past a
+number it writes, as Insert does.
+*/
+
+// autoReserve is how far past the next number the limit is raised.
+const autoReserve = 1024
+
+// checkAuto checks column col of s can be an auto-increment column.
+func checkAuto(s *Schema, col int) error {
+	c := s.Columns[col]
+	for i, other := range s.Columns[:col] {
+		if other.AutoIncrement {
+			return fmt.Errorf("columns %q and %q are both auto-increment", s.Columns[i].Name, c.Name)
+		}
+	}
+	codes, err := data.ParseSchema(c.Type)
+	if err != nil {
+		return fmt.Errorf("column %q: %w", c.Name, err)
+	}
+	if b := baseType(codes[0]); len(codes) != 1 || b != data.TypeCodeInt && b != data.TypeCodeBigInt ||
+		codes[0]&data.TypeFlagNullable != 0 {
+		return fmt.Errorf("auto-increment column %q must be an int or bigint that is not nullable", c.Name)
+	}
+	if c.Default != nil {
+		return fmt.Errorf("auto-increment column %q has a default", c.Name)
+	}
+	return nil
+}
+
+// autoColumn returns the position of the auto-increment column, or -1.
+func (s *Schema) autoColumn() int {
+	for i, c := range s.Columns {
+		if c.AutoIncrement {
+			return i
+		}
+	}
+	return -1
+}
+
+// fillAuto fills in the auto-increment column of row, a copy of which it
+// returns, and the number the column holds; see "Auto-increment" above.
+// Called with mu held.
+func (t *Table) fillAuto(row []any, col int) ([]any, int64, error) {
+	name := t.schema.Columns[col].Name
+	code := t.codes[col]
+	maxN := autoMax(code)
+	row = append([]any(nil), row...)
+	if row[col] != nil {
+		n, err := t.noteAuto(row[col], col)
+		return row, n, err
+	}
+	n := t.autoNext
+	if n < 1 || n > maxN {
+		return nil, 0, fmt.Errorf("auto-increment column %q has run out of numbers", name)
+	}
+	if err := t.reserveAuto(maxN); err != nil {
+		return nil, 0, err
+	}
+	t.autoNext++
+	if baseType(code) == data.TypeCodeInt {
+		row[col] = int32(n)
+	} else {
+		row[col] = n
+	}
+	return row, n, nil
+}
+
+// noteAuto moves the count past v, a number given to the auto-increment
+// column col by an insert or update, and returns it. Called with mu held.
+func (t *Table) noteAuto(v any, col int) (int64, error) {
+	n, ok := intValue(v)
+	if !ok {
+		return 0, fmt.Errorf("column %q: %w", t.schema.Columns[col].Name, keyMismatch(t.codes[col], v))
+	}
+	maxN := autoMax(t.codes[col])
+	if n >= t.autoNext && t.autoNext > 0 {
+		t.autoNext = min(n, maxN) + 1
+	}
+	return n, t.reserveAuto(maxN)
+}
+
+// autoMax returns the largest number an auto-increment column of type code
+// is given. It stays below math.MaxInt64, which the limit must exceed.
+func autoMax(code byte) int64 {
+	if baseType(code) == data.TypeCodeInt {
+		return math.MaxInt32
+	}
+	return math.MaxInt64 - 1
+}
+
+// reserveAuto raises the limit in the metadata above the next number, if
+// it is not already and there is one. Called with mu held.
+func (t *Table) reserveAuto(maxN int64) error {
+	if t.autoNext < t.meta.autoLimit || t.autoNext > maxN {
+		return nil
+	}
+	m := t.meta.clone()
+	m.autoLimit = t.autoNext + min(autoReserve, math.MaxInt64-t.autoNext)
+	if err := writeMeta(t.path+".tbl", m); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	t.setMeta(m)
+	return nil
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+Catalog
+
+The catalog, "<dir>/CATALOG", lists the database's tables with their
+statistics (see "Statistics" in stats.go):
+
+	magic "BPCT", version (uint32)
+	table count (uint32), then per table: its name as a uint16 length and
+	    the bytes, and its statistics as a uint32 length, 0 if it has none,
+	    and the bytes
+	CRC-32 (IEEE) of everything before it
+
+Version 1 catalogs hold only the names.
+
+It is replaced whole, like the table metadata, and is the point at which
+CreateTable and DropTable take effect. CreateTable writes the table's files
+and then the catalog naming it; DropTable writes the catalog without the
+table and then deletes its files. A failure or crash on either side of the
+catalog write leaves files of a table the catalog does not name, which
+CreateTable deletes before it starts and Open deletes on the way in. Only
+files named as a table names its own are deleted (see "Tables" in
+table.go), so other files kept in the directory are left alone.
+
+A directory from before the catalog existed gets one listing its tables'
+.tbl files.
+*/
+
+var catalogMagic = [4]byte{'B', 'P', 'C', 'T'}
+
+const catalogVersion = 2 // 2: statistics
+
+func (d *DB) catalogPath() string {
+	return filepath.Join(d.dir, "CATALOG")
+}
+
+func encodeCatalog(names []string, stats map[string]*TableStats) ([]byte, error) {
+	b := append([]byte(nil), catalogMagic[:]...)
+	b = binary.LittleEndian.AppendUint32(b, catalogVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(names)))
+	for _, name := range names {
+		b = appendString(b, name)
+		var st []byte
+		if s, ok := stats[name]; ok {
+			var err error
+			if st, err = encodeStats(s); err != nil {
+				return nil, fmt.Errorf("table %q: %w", name, err)
+			}
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(st)))
+		b = append(b, st...)
+	}
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+func decodeCatalog(b []byte) ([]string, map[string]*TableStats, error) {
+	if len(b) < 16 || !bytes.Equal(b[:4], catalogMagic[:]) {
+		return nil, nil, errors.New("not a catalog file")
+	}
+	body := b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, nil, errors.New("catalog checksum mismatch")
+	}
+	version := binary.LittleEndian.Uint32(body[4:8])
+	if version < 1 || version > catalogVersion {
+		return nil, nil, fmt.Errorf("unsupported catalog version %d", version)
+	}
+	n := int(binary.LittleEndian.Uint32(body[8:12]))
+	r := &metaReader{b: body[12:]}
+	var names []string
+	stats := make(map[string]*TableStats)
+	for i := 0; i < n && !r.bad; i++ {
+		name := r.str()
+		names = append(names, name)
+		if version < 2 {
+			continue
+		}
+		if st := r.next(int(r.u32())); len(st) > 0 && !r.bad {
+			s, err := decodeStats(st)
+			if err != nil {
+				return nil, nil, fmt.Errorf("catalog: table %q: %w", name, err)
+			}
+			stats[name] = s
+		}
+	}
+	if r.bad {
+		return nil, nil, errors.New("catalog truncated")
+	}
+	if len(r.b) != 0 {
+		return nil, nil, errors.New("catalog: trailing bytes")
+	}
+	return names, stats, nil
+}
+
+// loadCatalog reads the catalog, creating it if the directory has none,
+// and deletes the files of tables it does not name.
+func (d *DB) loadCatalog() error {
+	b, err := os.ReadFile(d.catalogPath())
+	switch {
+	case err == nil:
+		if d.catalog, d.stats, err = decodeCatalog(b); err != nil {
+			return err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		paths, err := filepath.Glob(filepath.Join(d.dir, "*.tbl"))
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if name := strings.TrimSuffix(filepath.Base(p), ".tbl"); validName(name) {
+				d.catalog = append(d.catalog, name)
+			}
+		}
+		slices.Sort(d.catalog)
+		if err := d.writeCatalog(d.catalog); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return d.removeOrphans()
+}
+
+// writeCatalog replaces the catalog with names, which must be sorted, and
+// the statistics of those tables. Statistics of tables no longer named are
+// dropped.
+func (d *DB) writeCatalog(names []string) error {
+	b, err := encodeCatalog(names, d.stats)
+	if err == nil {
+		err = writeFileAtomic(d.catalogPath(), b)
+	}
+	if err != nil {
+		return fmt.Errorf("write catalog: %w", err)
+	}
+	d.catalog = names
+	maps.DeleteFunc(d.stats, func(name string, _ *TableStats) bool { return !d.inCatalog(name) })
+	return nil
+}
+
+// inCatalog reports whether the catalog names table name.
+func (d *DB) inCatalog(name string) bool {
+	_, ok := slices.BinarySearch(d.catalog, name)
+	return ok
+}
+
+// removeOrphans deletes the files of tables the catalog does not name.
+func (d *DB) removeOrphans() error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := tableFile(e.Name())
+		if !ok || d.inCatalog(name) || e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
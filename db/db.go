@@ -0,0 +1,356 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pranavdb/filelock"
+	"pranavdb/index"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Databases
+
+A DB is a directory of tables, listed in its catalog (see catalog.go).
+Each table's files are named after it, as "<dir>/<table>.tbl" and so on
+(see "Tables" in table.go), so a table name follows the rules of a column
+name. The directory is locked by its "LOCK" file while a DB has it open.
+
+Open opens every table in the catalog, so each recovers from its
+transaction log before Open returns, and starts the background work its
+Options ask for: a checkpointer on each table's log and a vacuumer over
+the tables (see vacuum.go). The DB keeps one Table per name open, shared
+by every caller of OpenTable. Close stops the background work, then closes
+every table, taking a last checkpoint of each. A table closed by itself is
+forgotten and reopened by the next OpenTable.
+
+With Options.MemoryBudget set, the page caches of every table's
+primary-key and index trees share one memory budget (see "Memory budget"
+in index/memoryBudget.go); rowfile segments keep no page buffers and are
+not charged.
+*/
+
+// ErrNoTable is returned for a table the database does not have.
+var ErrNoTable = errors.New("no such table")
+
+// ErrTableExists is returned by CreateTable for a name already in use.
+var ErrTableExists = errors.New("table already exists")
+
+// ErrClosed is returned by the methods of a closed DB.
+var ErrClosed = errors.New("database is closed")
+
+// DB is a directory of tables; see "Databases" above.
+type DB struct {
+	dir  string
+	lock *os.File
+
+	mu      sync.Mutex
+	catalog []string               // table names, sorted
+	stats   map[string]*TableStats // by table name, see Table.Analyze
+	tables  map[string]*Table      // open tables, by name
+	closed  bool
+
+	opts   Options
+	vacuum *vacuumer           // nil unless opts.VacuumInterval is set
+	budget *index.MemoryBudget // nil unless opts.MemoryBudget is set
+}
+
+// Options configures Open. The zero value runs no background work.
+type Options struct {
+	// CheckpointInterval, if positive, is how often each open table's
+	// transaction log is checkpointed in the background, on top of the
+	// checkpoints commits take once the log grows large.
+	CheckpointInterval time.Duration
+
+	// VacuumInterval, if positive, is how often the open tables are
+	// vacuumed in the background; see Table.Vacuum.
+	VacuumInterval time.Duration
+
+	// MemoryBudget, if positive, is the most memory in bytes the page
+	// caches of all the tables' primary-key and index trees hold together.
+	// Rowfiles are not charged. It must be at least page.PageSize.
+	MemoryBudget int64
+}
+
+// TableOptions configures DB.CreateTable.
+type TableOptions struct {
+	// IfNotExists makes CreateTable open the table if it exists already,
+	// whatever its schema, rather than fail with ErrTableExists.
+	IfNotExists bool
+}
+
+// Open opens the database in directory dir, creating it if need be; see
+// "Databases" above.
+func Open(dir string, opts Options) (*DB, error) {
+	var budget *index.MemoryBudget
+	if opts.MemoryBudget > 0 {
+		var err error
+		if budget, err = index.NewMemoryBudget(opts.MemoryBudget); err != nil {
+			return nil, fmt.Errorf("open database: %w", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := filelock.Lock(lock, filelock.Exclusive); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("lock database: %w", err)
+	}
+	d := &DB{dir: dir, lock: lock, tables: make(map[string]*Table), stats: make(map[string]*TableStats), opts: opts, budget: budget}
+	if err := d.loadCatalog(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	for _, name := range d.catalog {
+		if _, err := d.openTable(name); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("open database: table %q: %w", name, err)
+		}
+	}
+	if opts.VacuumInterval > 0 {
+		d.vacuum = &vacuumer{stop: make(chan struct{}), done: make(chan struct{})}
+		go d.vacuum.run(d, opts.VacuumInterval)
+	}
+	return d, nil
+}
+
+// tablePath returns the path prefix of the files of table name.
+func (d *DB) tablePath(name string) string {
+	return filepath.Join(d.dir, name)
+}
+
+// Tables returns the names of the database's tables, sorted.
+func (d *DB) Tables() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return slices.Clone(d.catalog), nil
+}
+
+// CreateTable creates table name with the given schema and opens it. The
+// table exists once its catalog entry is written; if anything fails before
+// then, its files are deleted again.
+func (d *DB) CreateTable(name string, schema Schema, opts TableOptions) (*Table, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("CreateTable: invalid table name %q", name)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.inCatalog(name) {
+		if opts.IfNotExists {
+			return d.openTable(name)
+		}
+		return nil, fmt.Errorf("CreateTable: %q: %w", name, ErrTableExists)
+	}
+	// left over from a create or drop cut short
+	if err := d.removeFiles(name); err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	t, err := CreateTable(d.tablePath(name), schema)
+	if err != nil {
+		return nil, errors.Join(err, d.removeFiles(name))
+	}
+	if err := d.startTable(t); err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", errors.Join(err, t.close(), d.removeFiles(name)))
+	}
+	names := append(slices.Clone(d.catalog), name)
+	slices.Sort(names)
+	if err := d.writeCatalog(names); err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", errors.Join(err, t.close(), d.removeFiles(name)))
+	}
+	t.db, t.name = d, name
+	d.tables[name] = t
+	return t, nil
+}
+
+// OpenTable returns table name, opening it if it is not open already.
+func (d *DB) OpenTable(name string) (*Table, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if !d.inCatalog(name) {
+		return nil, fmt.Errorf("OpenTable: %q: %w", name, ErrNoTable)
+	}
+	return d.openTable(name)
+}
+
+// openTable opens table name, which is in the catalog. Called with mu
+// held.
+func (d *DB) openTable(name string) (*Table, error) {
+	if t, ok := d.tables[name]; ok {
+		return t, nil
+	}
+	t, err := OpenTable(d.tablePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.startTable(t); err != nil {
+		return nil, errors.Join(err, t.close())
+	}
+	t.db, t.name, t.stats = d, name, d.stats[name]
+	d.tables[name] = t
+	return t, nil
+}
+
+// startTable starts the background work the options ask for on t.
+func (d *DB) startTable(t *Table) error {
+	if d.budget != nil {
+		if err := t.pk.SetPageCache(index.CacheOptions{Budget: d.budget}); err != nil {
+			return err
+		}
+		for _, ix := range t.indexes {
+			if err := ix.tree.SetPageCache(index.CacheOptions{Budget: d.budget}); err != nil {
+				return err
+			}
+		}
+	}
+	if d.opts.CheckpointInterval > 0 {
+		return t.log.StartCheckpointer(d.opts.CheckpointInterval)
+	}
+	return nil
+}
+
+// saveStats stores the statistics of t, a table of the database, in the
+// catalog.
+func (d *DB) saveStats(t *Table, st *TableStats) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.tables[t.name] != t {
+		return fmt.Errorf("table %q was closed", t.name)
+	}
+	old, had := d.stats[t.name]
+	d.stats[t.name] = st
+	if err := d.writeCatalog(d.catalog); err != nil {
+		if had {
+			d.stats[t.name] = old
+		} else {
+			delete(d.stats, t.name)
+		}
+		return err
+	}
+	return nil
+}
+
+// DropTable deletes table name, closing it first if it is open. The table
+// is gone once the catalog no longer names it; files a failure leaves
+// behind after that are deleted by the next Open.
+func (d *DB) DropTable(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if !d.inCatalog(name) {
+		return fmt.Errorf("DropTable: %q: %w", name, ErrNoTable)
+	}
+	var err error
+	if t, ok := d.tables[name]; ok {
+		delete(d.tables, name)
+		err = t.close()
+	}
+	names := slices.DeleteFunc(slices.Clone(d.catalog), func(n string) bool { return n == name })
+	if werr := d.writeCatalog(names); werr != nil {
+		return fmt.Errorf("DropTable: %w", errors.Join(werr, err))
+	}
+	if err := errors.Join(err, d.removeFiles(name)); err != nil {
+		return fmt.Errorf("DropTable: %w", err)
+	}
+	return nil
+}
+
+// removeFiles deletes every file of table name.
+func (d *DB) removeFiles(name string) error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if table, ok := tableFile(e.Name()); !ok || table != name || e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableFile returns the table a file called file belongs to, going by the
+// names a table gives its files (see "Tables" in table.go), or false if it
+// is not named like one of them.
+func tableFile(file string) (string, bool) {
+	name, suffix, ok := strings.Cut(file, ".")
+	if !ok || !validName(name) {
+		return "", false
+	}
+	switch suffix {
+	case "tbl", "tbl.tmp", "pk", "log":
+		return name, true
+	}
+	if column, ok := strings.CutPrefix(suffix, "idx."); ok {
+		return name, validName(column)
+	}
+	rest, ok := strings.CutPrefix(suffix, "rows")
+	if !ok {
+		return "", false
+	}
+	// a later segment's number
+	if num, ok := strings.CutPrefix(rest, "."); ok {
+		if rest = strings.TrimLeft(num, "0123456789"); len(rest) == len(num) {
+			rest = "." + num
+		}
+	}
+	return name, slices.Contains(segmentFiles, rest)
+}
+
+// forget drops t from the open tables, when it is closed by itself.
+func (d *DB) forget(t *Table) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tables[t.name] == t {
+		delete(d.tables, t.name)
+	}
+}
+
+// Close stops the background work, closes every open table and unlocks the
+// directory. It returns the first error a background vacuum hit, if any.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+	// the vacuumer takes mu, so it stops before mu is held again
+	errs := []error{d.stopVacuum()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, t := range d.tables {
+		if err := t.close(); err != nil {
+			errs = append(errs, fmt.Errorf("table %q: %w", name, err))
+		}
+	}
+	clear(d.tables)
+	errs = append(errs, filelock.Unlock(d.lock), d.lock.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Every tree of a table shares the database's memory budget, whether the
+// table was created, reopened or given an index later.
+func TestMemoryBudget(t *testing.T) {
+	dir := t.TempDir()
+	schema := Schema{
+		Columns: []Column{{Name: "id", Type: "int"}, {Name: "a", Type: "string"}, {Name: "b", Type: "int"}},
+		Indexes: []string{"a"},
+	}
+	opts := Options{MemoryBudget: 16 * 4096}
+	probe := map[string]any{"a": "x1", "b": int64(7)} // a value to look up in each index
+
+	// checkTrees reads every row through each tree twice and checks the
+	// second reads hit a cache within the budget.
+	checkTrees := func(d *DB, tb *Table) {
+		t.Helper()
+		for range 2 {
+			for i := range 500 {
+				if _, err := tb.Get(int64(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ix := range tb.indexes {
+				if _, err := tb.GetByIndex(ix.name, probe[ix.name]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if tb.pk.Stats().Hits == 0 {
+			t.Error("primary key tree has no cache")
+		}
+		for _, ix := range tb.indexes {
+			if ix.tree.Stats().Hits == 0 {
+				t.Errorf("index %q has no cache", ix.name)
+			}
+		}
+		if used := d.budget.Used(); used == 0 || used > d.budget.Limit() {
+			t.Errorf("budget used %d of %d", used, d.budget.Limit())
+		}
+	}
+
+	d, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := d.CreateTable("t", schema, TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 500 {
+		if err := tb.Insert([]any{int64(i), fmt.Sprint("x", i%3), int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTrees(d, tb)
+	if err := tb.CreateIndex("b"); err != nil {
+		t.Fatal(err)
+	}
+	checkTrees(d, tb)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if used := d.budget.Used(); used != 0 {
+		t.Errorf("closed database still charges %d bytes", used)
+	}
+
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if tb, err = d.OpenTable("t"); err != nil {
+		t.Fatal(err)
+	}
+	checkTrees(d, tb)
+}
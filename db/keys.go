@@ -0,0 +1,187 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"pranavdb/data"
+	"pranavdb/tree"
+	"time"
+)
+
+/*
+Index keys
+
+Every index of a table is a DiskTree[tree.StringKey, uint64]: a column value
+is encoded into bytes whose order, compared as a string, is the order of the
+values, so one tree type serves every key column type.
+
+	int, bigint  int64 big-endian with the sign bit flipped
+	float        float64 bits big-endian; negatives have every bit
+	             flipped, others only the sign bit
+	string, blob the bytes with each 0x00 escaped as 0x00 0xFF, then
+	             0x00 0x01
+	bool         one byte, 0 or 1
+	date         days since 1970-01-01 as for int
+	timestamp    Unix seconds as for int, then nanoseconds as a big-endian
+	             uint32
+	uuid         the 16 bytes
+
+int and bigint share an encoding, so a key may be given as any Go integer
+whatever its column's width. Decimal columns cannot be keys. The string
+terminator keeps a key that is a prefix of another sorting before it, and
+makes every encoding end where it can be told to, so keys can be followed
+by more bytes (see "Secondary indexes" in secondary.go). A value of a
+nullable column is preceded by a byte, 1, or stands for NULL as a single 0
+byte, so NULLs sort first.
+
+A composite primary key is its columns' encodings one after another. Each
+ends where it can be told to, so the keys compare column by column, as a
+tuple, and two keys are equal only if every column is.
+*/
+
+// keyable reports whether a column of type code can be indexed.
+func keyable(code byte) bool {
+	return baseType(code) != data.TypeCodeDecimal
+}
+
+// baseType strips the nullable and compressed flags from a type code.
+func baseType(code byte) byte {
+	return code &^ (data.TypeFlagNullable | data.TypeFlagCompressed)
+}
+
+// appendKey appends the key encoding of v, a value of a column of type
+// code; see "Index keys" above.
+func appendKey(b []byte, code byte, v any) ([]byte, error) {
+	if code&data.TypeFlagNullable != 0 {
+		if v == nil {
+			return append(b, 0), nil
+		}
+		b = append(b, 1)
+	}
+	switch baseType(code) {
+	case data.TypeCodeInt, data.TypeCodeBigInt:
+		n, ok := intValue(v)
+		if !ok {
+			break
+		}
+		return appendInt(b, n), nil
+	case data.TypeCodeFloat:
+		var f float64
+		switch x := v.(type) {
+		case float64:
+			f = x
+		case float32:
+			f = float64(x)
+		default:
+			return nil, keyMismatch(code, v)
+		}
+		if f == 0 {
+			f = 0 // -0 equals 0, so they must share a key
+		}
+		bits := math.Float64bits(f)
+		if bits>>63 != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(b, bits), nil
+	case data.TypeCodeString:
+		if s, ok := v.(string); ok {
+			return appendBytes(b, []byte(s)), nil
+		}
+	case data.TypeCodeBlob:
+		if p, ok := v.([]byte); ok {
+			return appendBytes(b, p), nil
+		}
+	case data.TypeCodeBool:
+		if x, ok := v.(bool); ok {
+			if x {
+				return append(b, 1), nil
+			}
+			return append(b, 0), nil
+		}
+	case data.TypeCodeDate:
+		if t, ok := v.(time.Time); ok {
+			sec := t.Unix()
+			days := sec / 86400
+			if sec%86400 < 0 {
+				days--
+			}
+			return appendInt(b, days), nil
+		}
+	case data.TypeCodeTimestamp:
+		if t, ok := v.(time.Time); ok {
+			b = appendInt(b, t.Unix())
+			return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond())), nil
+		}
+	case data.TypeCodeUUID:
+		switch u := v.(type) {
+		case data.UUID:
+			return append(b, u[:]...), nil
+		case [16]byte:
+			return append(b, u[:]...), nil
+		}
+	default:
+		return nil, fmt.Errorf("type %s cannot be a key", data.SchemaStringFromCodes([]byte{code}))
+	}
+	return nil, keyMismatch(code, v)
+}
+
+func keyMismatch(code byte, v any) error {
+	got := "nil"
+	if v != nil {
+		got = fmt.Sprintf("%T", v)
+	}
+	return fmt.Errorf("key: expected %s, got %s", data.SchemaStringFromCodes([]byte{code}), got)
+}
+
+func appendInt(b []byte, n int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(n)^(1<<63))
+}
+
+func appendBytes(b, p []byte) []byte {
+	for _, c := range p {
+		b = append(b, c)
+		if c == 0 {
+			b = append(b, 0xFF)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// encodeKey returns the index key for v in a column of type code.
+func encodeKey(code byte, v any) (tree.StringKey, error) {
+	b, err := appendKey(nil, code, v)
+	if err != nil {
+		return "", err
+	}
+	return tree.StringKey(b), nil
+}
+
+// intValue converts any Go integer to int64, as the rowfile accepts them.
+func intValue(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
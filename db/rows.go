@@ -0,0 +1,235 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/index"
+	"pranavdb/tree"
+	"slices"
+	"strings"
+)
+
+/*
+Index scans
+
+ScanIndex walks the primary key index or a secondary index between two
+bounds and reads each row it names, returning the rows one at a time
+through Rows. A bound is a value of the index's column; on a composite
+primary key it is a []any of the values of its leading columns, and bounds
+every key that starts with them.
+
+Bounds are compared as encoded keys (see "Index keys" in keys.go). Because
+every encoding ends where it can be told to, the keys at or above a bound
+b are exactly those >= enc(b), and the keys at or below it those <= enc(b)
+or starting with it, which takes in the rest of a composite key and a
+secondary entry's row reference. So the scan seeks to the low bound, skips
+keys starting with it if it is open, and stops at the first key past the
+high bound.
+
+Like Scan, Rows holds the table's lock only inside Next, so the caller may
+write to the table between rows. After a write, Next finds its place again
+by seeking past the last key it returned rather than trusting the cursor.
+*/
+
+// Range bounds an index scan; see "Index scans" above. A nil bound leaves
+// that end open, so NULL cannot be a bound.
+type Range struct {
+	Low, High         any
+	LowOpen, HighOpen bool // exclude keys equal to the bound
+}
+
+// Rows iterates over the rows of an index scan:
+//
+//	rows, err := t.ScanIndex("", db.Range{})
+//	...
+//	defer rows.Close()
+//	for rows.Next() {
+//		row := rows.Row()
+//		...
+//	}
+//	if err := rows.Err(); err != nil {
+//		...
+//	}
+type Rows struct {
+	t         *Table
+	ix        *secondary // nil for the primary key
+	c         *index.Cursor[tree.StringKey, uint64]
+	low, high string
+	rng       Range
+
+	started bool
+	done    bool
+	key     tree.StringKey // of the current row
+	ref     uint64         // the current row's reference
+	writes  uint64         // t.writes when key was read
+	row     []any
+	err     error
+}
+
+// ScanIndex returns the rows whose key in the index on column lies in r, in
+// key order. column "" or a primary key column names the primary key index;
+// any other column must have a secondary index.
+func (t *Table) ScanIndex(column string, r Range) (*Rows, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("ScanIndex: %w", ErrTableClosed)
+	}
+	rows, err := t.scanIndex(column, r)
+	if err != nil {
+		return nil, fmt.Errorf("ScanIndex: %w", err)
+	}
+	return rows, nil
+}
+
+// scanIndex is ScanIndex with mu held.
+func (t *Table) scanIndex(column string, r Range) (*Rows, error) {
+	rows := &Rows{t: t, rng: r}
+	tr := t.pk
+	encode := t.pkPrefix
+	if col := t.schema.Column(column); column != "" && !slices.Contains(t.schema.PrimaryKey, col) {
+		if col < 0 {
+			return nil, fmt.Errorf("no column %q", column)
+		}
+		if rows.ix = t.indexOn(col); rows.ix == nil {
+			return nil, fmt.Errorf("column %q is not indexed", column)
+		}
+		tr = rows.ix.tree
+		encode = func(v any) ([]byte, error) { return appendKey(nil, t.codes[col], v) }
+	}
+	for _, b := range []struct {
+		v   any
+		enc *string
+	}{{r.Low, &rows.low}, {r.High, &rows.high}} {
+		if b.v == nil {
+			continue
+		}
+		k, err := encode(b.v)
+		if err != nil {
+			return nil, err
+		}
+		*b.enc = string(k)
+	}
+	rows.c = tr.NewCursor()
+	return rows, nil
+}
+
+// pkPrefix encodes a bound on the primary key: a value of its only column,
+// or a []any of the values of its leading columns.
+func (t *Table) pkPrefix(v any) ([]byte, error) {
+	cols := t.schema.PrimaryKey
+	values, ok := v.([]any)
+	if len(cols) == 1 || !ok {
+		values = []any{v}
+	}
+	if len(values) > len(cols) {
+		return nil, fmt.Errorf("key: %d values for a %d-column key", len(values), len(cols))
+	}
+	var b []byte
+	for i, v := range values {
+		var err error
+		if b, err = appendKey(b, t.codes[cols[i]], v); err != nil {
+			return nil, fmt.Errorf("column %q: %w", t.schema.Columns[cols[i]].Name, err)
+		}
+	}
+	return b, nil
+}
+
+// Next moves to the next row and reports whether there is one.
+func (r *Rows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	return r.next()
+}
+
+// next is Next with the table's lock held.
+func (r *Rows) next() bool {
+	if r.done {
+		return false
+	}
+	t := r.t
+	if t.closed {
+		return r.finish(ErrTableClosed)
+	}
+	if r.ix != nil && !slices.Contains(t.indexes, r.ix) {
+		return r.finish(errors.New("index dropped during scan"))
+	}
+	c := r.c
+	var ok bool
+	switch {
+	case !r.started:
+		r.started = true
+		if r.rng.Low != nil {
+			ok = c.Seek(tree.StringKey(r.low))
+		} else {
+			ok = c.First()
+		}
+		for ok && r.rng.LowOpen && strings.HasPrefix(string(c.Key()), r.low) {
+			ok = c.Next()
+		}
+	case t.writes != r.writes:
+		// the cursor holds a copy of its leaf, which the write may have
+		// changed; see "Index scans" above
+		if ok = c.Seek(r.key); ok && c.Key() == r.key {
+			ok = c.Next()
+		}
+	default:
+		ok = c.Next()
+	}
+	if !ok {
+		return r.finish(c.Err())
+	}
+	if r.rng.High != nil && r.pastHigh(string(c.Key())) {
+		return r.finish(nil)
+	}
+	row, err := t.readRow(c.Value())
+	if err != nil {
+		return r.finish(err)
+	}
+	r.key, r.ref, r.writes, r.row = c.Key(), c.Value(), t.writes, row
+	return true
+}
+
+// pastHigh reports whether key lies beyond the high bound.
+func (r *Rows) pastHigh(key string) bool {
+	if r.rng.HighOpen {
+		return key >= r.high
+	}
+	return key > r.high && !strings.HasPrefix(key, r.high)
+}
+
+// finish ends the scan with err. Called with the table locked.
+func (r *Rows) finish(err error) bool {
+	r.done, r.row = true, nil
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	if cerr := r.c.Close(); cerr != nil && r.err == nil {
+		r.err = cerr
+	}
+	return false
+}
+
+// Row returns the current row. It is the caller's to keep.
+func (r *Rows) Row() []any {
+	return r.row
+}
+
+// Err returns the error that ended the scan, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close ends the scan early. It is safe to call after Next returns false.
+func (r *Rows) Close() error {
+	if r.done {
+		return nil
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	r.finish(nil)
+	return r.err
+}
@@ -0,0 +1,437 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"pranavdb/data"
+	"slices"
+	"strings"
+)
+
+// Column is one column of a table: its name and its rowfile type name, with
+// the "?" (nullable) and "~" (compressed) suffixes the rowfile accepts, e.g.
+// "string?".
+type Column struct {
+	Name string
+	Type string
+
+	// Default is the value rows written before the column was added read
+	// back with; see AddColumn. nil stands for NULL.
+	Default any
+
+	// AutoIncrement numbers the rows: Insert fills a nil value with the
+	// next number; see "Auto-increment" in autoinc.go.
+	AutoIncrement bool
+}
+
+// Schema describes a table's columns, which of them make up the primary key
+// and which have secondary indexes.
+type Schema struct {
+	Columns    []Column
+	PrimaryKey []int    // indexes into Columns in key order; none means the first column
+	Indexes    []string // indexed columns, see CreateIndex
+	Version    int      // 1 when created, counting schema changes; set by the table
+}
+
+// Column returns the position of the column called name, or -1.
+func (s *Schema) Column(name string) int {
+	for i, c := range s.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyColumns returns the primary key's columns.
+func (s *Schema) keyColumns() []int {
+	if len(s.PrimaryKey) == 0 {
+		return []int{0}
+	}
+	return s.PrimaryKey
+}
+
+// isKey reports whether column col is the whole primary key, which needs
+// no secondary index.
+func (s *Schema) isKey(col int) bool {
+	key := s.keyColumns()
+	return len(key) == 1 && key[0] == col
+}
+
+// rowSchema returns the schema string the table's rowfile is created with.
+func (s *Schema) rowSchema() string {
+	types := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		types[i] = c.Type
+	}
+	return strings.Join(types, ",")
+}
+
+// validate checks the parts of the schema the rowfile does not: column
+// names and the primary key's and indexes' columns. Column types are
+// checked when the rowfile is created.
+func (s *Schema) validate() error {
+	if len(s.Columns) == 0 {
+		return errors.New("schema has no columns")
+	}
+	for i, c := range s.Columns {
+		if !validName(c.Name) {
+			return fmt.Errorf("column %d: invalid name %q", i, c.Name)
+		}
+		if strings.ContainsAny(c.Type, ",") {
+			return fmt.Errorf("column %q: invalid type %q", c.Name, c.Type)
+		}
+		if s.Column(c.Name) != i {
+			return fmt.Errorf("duplicate column name %q", c.Name)
+		}
+		if c.AutoIncrement {
+			if err := checkAuto(s, i); err != nil {
+				return err
+			}
+		}
+	}
+	key := s.keyColumns()
+	for i, col := range key {
+		if col < 0 || col >= len(s.Columns) {
+			return fmt.Errorf("primary key column %d out of range", col)
+		}
+		if slices.Contains(key[:i], col) {
+			return fmt.Errorf("column %q repeated in primary key", s.Columns[col].Name)
+		}
+	}
+	for i, name := range s.Indexes {
+		col := s.Column(name)
+		switch {
+		case col < 0:
+			return fmt.Errorf("index on unknown column %q", name)
+		case s.isKey(col):
+			return fmt.Errorf("index on primary key column %q", name)
+		}
+		for _, other := range s.Indexes[:i] {
+			if s.Column(other) == col {
+				return fmt.Errorf("column %q indexed twice", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validName reports whether name can name a column: letters, digits and
+// underscores, not starting with a digit. Index file names include it.
+func validName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Table metadata
+
+A table's schema is kept in "<table>.tbl", along with what the rowfiles do
+not store: column names and defaults, and which columns each of the
+table's segments holds (see "Schema changes" in alter.go).
+
+	magic "BPTB", version (uint32)
+	schema version (uint32), next column ID (uint32), auto-increment
+	    limit (uint64)
+	column count (uint16), key column count (uint16), then each primary
+	    key column's position (uint16)
+	per column: ID (uint32), name, type, then a flags byte: 1 if the
+	    default follows, encoded as a one-column row, and 2 if the column
+	    is auto-increment
+	index count (uint16), then each indexed column's name
+	segment count (uint16), then per segment: number (uint16), column
+	    count (uint16) and the ID (uint32) of each column it holds
+	CRC-32 (IEEE) of everything before it
+
+Names, types and defaults are a uint16 length and the bytes. Only the
+current version is read.
+
+Integers are little-endian. The file is written whole to a temporary file
+and renamed over the old one, so a crash leaves either schema in place.
+*/
+
+var metaMagic = [4]byte{'B', 'P', 'T', 'B'}
+
+const metaVersion = 1
+
+// Column flags in the table metadata.
+const (
+	colHasDefault    = 1
+	colAutoIncrement = 2
+)
+
+// tableMeta is what the metadata file holds: the schema, and how the
+// table's segments store its columns.
+type tableMeta struct {
+	schema   Schema
+	colIDs   []uint32 // ID of each column of schema, never reused
+	nextID   uint32
+	segments []segmentMeta
+
+	// autoLimit bounds the auto-increment numbers handed out so far; see
+	// "Auto-increment" in autoinc.go.
+	autoLimit int64
+}
+
+// segmentMeta describes one of a table's rowfiles.
+type segmentMeta struct {
+	num  uint16
+	cols []uint32 // IDs of the columns its rows hold, in order
+}
+
+// clone returns a deep copy of m, to change without touching m.
+func (m *tableMeta) clone() *tableMeta {
+	c := *m
+	c.schema.Columns = slices.Clone(m.schema.Columns)
+	c.schema.PrimaryKey = slices.Clone(m.schema.PrimaryKey)
+	c.schema.Indexes = slices.Clone(m.schema.Indexes)
+	c.colIDs = slices.Clone(m.colIDs)
+	c.segments = slices.Clone(m.segments)
+	return &c
+}
+
+func encodeMeta(m *tableMeta) ([]byte, error) {
+	s := &m.schema
+	b := append([]byte(nil), metaMagic[:]...)
+	b = binary.LittleEndian.AppendUint32(b, metaVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(s.Version))
+	b = binary.LittleEndian.AppendUint32(b, m.nextID)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.autoLimit))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s.Columns)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s.PrimaryKey)))
+	for _, col := range s.PrimaryKey {
+		b = binary.LittleEndian.AppendUint16(b, uint16(col))
+	}
+	for i, c := range s.Columns {
+		b = binary.LittleEndian.AppendUint32(b, m.colIDs[i])
+		b = appendString(b, c.Name)
+		b = appendString(b, c.Type)
+		var flags byte
+		if c.AutoIncrement {
+			flags |= colAutoIncrement
+		}
+		if c.Default == nil {
+			b = append(b, flags)
+			continue
+		}
+		def, err := encodeDefault(c)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, flags|colHasDefault)
+		b = appendString(b, string(def))
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s.Indexes)))
+	for _, name := range s.Indexes {
+		b = appendString(b, name)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.segments)))
+	for _, seg := range m.segments {
+		b = binary.LittleEndian.AppendUint16(b, seg.num)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(seg.cols)))
+		for _, id := range seg.cols {
+			b = binary.LittleEndian.AppendUint32(b, id)
+		}
+	}
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// encodeDefault encodes column c's default as a one-column row.
+func encodeDefault(c Column) ([]byte, error) {
+	b, err := encodeValue(c.Type, c.Default)
+	if err != nil {
+		return nil, fmt.Errorf("column %q: default: %w", c.Name, err)
+	}
+	return b, nil
+}
+
+// decodeDefault decodes a default written by encodeDefault.
+func decodeDefault(c Column, b []byte) (any, error) {
+	v, err := decodeValue(c.Type, b)
+	if err != nil {
+		return nil, fmt.Errorf("column %q: default: %w", c.Name, err)
+	}
+	return v, nil
+}
+
+// encodeValue encodes v, a value of a column of type typ, as a one-column
+// row.
+func encodeValue(typ string, v any) ([]byte, error) {
+	codes, err := data.ParseSchema(typ)
+	if err != nil {
+		return nil, err
+	}
+	return data.EncodeRow(codes, []any{v})
+}
+
+// decodeValue decodes a value written by encodeValue.
+func decodeValue(typ string, b []byte) (any, error) {
+	codes, err := data.ParseSchema(typ)
+	if err != nil {
+		return nil, err
+	}
+	v, err := data.DecodeRow(codes, b)
+	if err != nil {
+		return nil, err
+	}
+	return v[0], nil
+}
+
+// metaReader reads the fields of a metadata file in turn, remembering the
+// first that is cut short.
+type metaReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *metaReader) next(n int) []byte {
+	if r.bad || len(r.b) < n {
+		r.bad = true
+		return make([]byte, n)
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *metaReader) u16() uint16 { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *metaReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *metaReader) u64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+func (r *metaReader) str() string { return string(r.next(int(r.u16()))) }
+
+func decodeMeta(b []byte) (*tableMeta, error) {
+	if len(b) < 16 || !bytes.Equal(b[:4], metaMagic[:]) {
+		return nil, errors.New("not a table metadata file")
+	}
+	body := b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, errors.New("table metadata checksum mismatch")
+	}
+	r := &metaReader{b: body[4:]}
+	if version := r.u32(); version != metaVersion {
+		return nil, fmt.Errorf("unsupported table metadata version %d", version)
+	}
+	m := &tableMeta{}
+	s := &m.schema
+	s.Version = int(r.u32())
+	m.nextID = r.u32()
+	m.autoLimit = int64(r.u64())
+	n := int(r.u16())
+	k := int(r.u16())
+	for i := 0; i < k && !r.bad; i++ {
+		s.PrimaryKey = append(s.PrimaryKey, int(r.u16()))
+	}
+	if len(s.PrimaryKey) == 0 {
+		return nil, errors.New("table metadata: no primary key")
+	}
+	for i := 0; i < n && !r.bad; i++ {
+		id := r.u32()
+		c := Column{Name: r.str(), Type: r.str()}
+		flags := r.next(1)[0]
+		c.AutoIncrement = flags&colAutoIncrement != 0
+		if flags&colHasDefault != 0 {
+			def := r.next(int(r.u16()))
+			if r.bad {
+				break
+			}
+			var err error
+			if c.Default, err = decodeDefault(c, def); err != nil {
+				return nil, err
+			}
+		}
+		s.Columns = append(s.Columns, c)
+		m.colIDs = append(m.colIDs, id)
+	}
+	n = int(r.u16())
+	for i := 0; i < n && !r.bad; i++ {
+		s.Indexes = append(s.Indexes, r.str())
+	}
+	n = int(r.u16())
+	for i := 0; i < n && !r.bad; i++ {
+		seg := segmentMeta{num: r.u16()}
+		cols := int(r.u16())
+		for j := 0; j < cols && !r.bad; j++ {
+			seg.cols = append(seg.cols, r.u32())
+		}
+		m.segments = append(m.segments, seg)
+	}
+	if r.bad {
+		return nil, errors.New("table metadata truncated")
+	}
+	if len(r.b) != 0 {
+		return nil, errors.New("table metadata: trailing bytes")
+	}
+	// rows are written to the last segment, which must hold every column
+	if len(m.segments) == 0 || !slices.Equal(m.segments[len(m.segments)-1].cols, m.colIDs) {
+		return nil, errors.New("table metadata: no segment holds the current columns")
+	}
+	return m, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// writeMeta replaces the metadata file at path; see "Table metadata".
+func writeMeta(path string, m *tableMeta) error {
+	b, err := encodeMeta(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic replaces the file at path with b, writing a temporary
+// file and renaming it over the old one so a crash leaves one or the other.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// sync the directory so the rename itself survives a crash
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func readMeta(path string) (*tableMeta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMeta(b)
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"pranavdb/index"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"strings"
+)
+
+/*
+Secondary indexes
+
+CreateIndex adds a DiskTree over one column, in "<table>.idx.<column>",
+which Insert, Update and Delete keep in step with the rows in the same
+transaction as the rowfile and the primary key.
+
+Column values need not be unique, so an entry's key is the value's key (see
+"Index keys" in keys.go) followed by the row reference (see "Tables" in
+table.go) as a big-endian uint64, and its value is the reference. The
+entries for one value sit together, ordered by reference; GetByIndex seeks
+to the value's key and reads on while keys start with it. NULLs are
+indexed like any other value.
+
+An index is built in one transaction, spilled every indexBuildSpill rows,
+and listed in the table metadata once it commits. If CreateIndex fails or
+crashes before then, it leaves the file unlisted, and the next CreateIndex
+on the column replaces it.
+*/
+
+// indexBuildSpill is how many entries CreateIndex adds between spills.
+const indexBuildSpill = 4096
+
+// secondary is an open secondary index.
+type secondary struct {
+	name   string // the column's name
+	column int    // the column's position, which DropColumn can change
+	tree   *keyTree
+}
+
+// indexPath returns the file of the index on column of the table at path.
+func indexPath(path, column string) string {
+	return path + ".idx." + column
+}
+
+// checkIndexable checks column col can be indexed.
+func (t *Table) checkIndexable(col int) error {
+	if !keyable(t.codes[col]) {
+		c := t.schema.Columns[col]
+		return fmt.Errorf("column %q: type %s cannot be indexed", c.Name, c.Type)
+	}
+	return nil
+}
+
+// createIndexTree creates the empty index file for column col.
+func (t *Table) createIndexTree(col int) (*secondary, error) {
+	if err := t.checkIndexable(col); err != nil {
+		return nil, err
+	}
+	tr, err := index.NewDiskTreeOrdered[tree.StringKey](indexPath(t.path, t.schema.Columns[col].Name), pkOrder, page.Uint64Codec{})
+	if err != nil {
+		return nil, err
+	}
+	// a table being created gets its caches from DB.startTable
+	if t.db != nil && t.db.budget != nil {
+		if err := tr.SetPageCache(index.CacheOptions{Budget: t.db.budget}); err != nil {
+			return nil, errors.Join(err, tr.Close())
+		}
+	}
+	return &secondary{name: t.schema.Columns[col].Name, column: col, tree: tr}, nil
+}
+
+// openIndexes opens the indexes the schema lists.
+func (t *Table) openIndexes() error {
+	for _, name := range t.schema.Indexes {
+		col := t.schema.Column(name)
+		tr, err := index.OpenDiskTreeOrdered[tree.StringKey](indexPath(t.path, t.schema.Columns[col].Name), page.Uint64Codec{})
+		if err != nil {
+			return fmt.Errorf("index %q: %w", name, err)
+		}
+		t.indexes = append(t.indexes, &secondary{name: t.schema.Columns[col].Name, column: col, tree: tr})
+	}
+	return nil
+}
+
+// indexOn returns the index on column col, or nil.
+func (t *Table) indexOn(col int) *secondary {
+	for _, ix := range t.indexes {
+		if ix.column == col {
+			return ix
+		}
+	}
+	return nil
+}
+
+// entryKey returns the key of row's entry in ix.
+func (t *Table) entryKey(ix *secondary, row []any, ref uint64) (tree.StringKey, error) {
+	b, err := appendKey(nil, t.codes[ix.column], row[ix.column])
+	if err != nil {
+		return "", fmt.Errorf("column %q: %w", t.schema.Columns[ix.column].Name, err)
+	}
+	return tree.StringKey(binary.BigEndian.AppendUint64(b, ref)), nil
+}
+
+// indexRow adds row's entries to every index. Called in a transaction.
+func (t *Table) indexRow(row []any, ref uint64) error {
+	for _, ix := range t.indexes {
+		key, err := t.entryKey(ix, row, ref)
+		if err != nil {
+			return err
+		}
+		if err := ix.tree.Insert(key, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexRow removes row's entries from every index. Called in a
+// transaction.
+func (t *Table) unindexRow(row []any, ref uint64) error {
+	for _, ix := range t.indexes {
+		key, err := t.entryKey(ix, row, ref)
+		if err != nil {
+			return err
+		}
+		if err := ix.tree.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexRow moves the entries of a row updated from old to row, and from
+// reference oldRef to ref, in the indexes whose entry changed. Called in a
+// transaction.
+func (t *Table) reindexRow(old, row []any, oldRef, ref uint64) error {
+	for _, ix := range t.indexes {
+		oldKey, err := t.entryKey(ix, old, oldRef)
+		if err != nil {
+			return err
+		}
+		key, err := t.entryKey(ix, row, ref)
+		if err != nil {
+			return err
+		}
+		if key == oldKey {
+			continue
+		}
+		if err := ix.tree.Delete(oldKey); err != nil {
+			return err
+		}
+		if err := ix.tree.Insert(key, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateIndex builds a secondary index on column from the rows already in
+// the table and keeps it up to date from then on; see "Secondary indexes"
+// above.
+func (t *Table) CreateIndex(column string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	col := t.schema.Column(column)
+	switch {
+	case col < 0:
+		return fmt.Errorf("CreateIndex: no column %q", column)
+	case t.schema.isKey(col):
+		return fmt.Errorf("CreateIndex: column %q is the primary key", column)
+	case t.indexOn(col) != nil:
+		return fmt.Errorf("CreateIndex: column %q is already indexed", column)
+	}
+	ix, err := t.createIndexTree(col)
+	if err != nil {
+		return fmt.Errorf("CreateIndex: %w", err)
+	}
+	name := t.schema.Columns[col].Name
+	fail := func(err error) error {
+		return fmt.Errorf("CreateIndex: %w", errors.Join(err, ix.tree.Close()))
+	}
+
+	tx, err := t.log.Begin(ix.tree)
+	if err != nil {
+		return fail(err)
+	}
+	n := 0
+	err = t.pk.Scan(func(_ tree.StringKey, v uint64) error {
+		row, err := t.readRow(v)
+		if err != nil {
+			return err
+		}
+		key, err := t.entryKey(ix, row, v)
+		if err != nil {
+			return err
+		}
+		if err := ix.tree.Insert(key, v); err != nil {
+			return err
+		}
+		if n++; n%indexBuildSpill == 0 {
+			return tx.Spill()
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(errors.Join(err, tx.Rollback()))
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	m := t.meta.clone()
+	m.schema.Indexes = append(m.schema.Indexes, name)
+	if err := writeMeta(t.path+".tbl", m); err != nil {
+		return fail(fmt.Errorf("write metadata: %w", err))
+	}
+	t.setMeta(m)
+	t.indexes = append(t.indexes, ix)
+	return nil
+}
+
+// GetByIndex returns the rows whose column holds value, in index order,
+// looking them up in the column's secondary index.
+func (t *Table) GetByIndex(column string, value any) ([][]any, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	col := t.schema.Column(column)
+	if col < 0 {
+		return nil, fmt.Errorf("GetByIndex: no column %q", column)
+	}
+	ix := t.indexOn(col)
+	if ix == nil {
+		return nil, fmt.Errorf("GetByIndex: column %q is not indexed", column)
+	}
+	b, err := appendKey(nil, t.codes[col], value)
+	if err != nil {
+		return nil, fmt.Errorf("GetByIndex: %w", err)
+	}
+	prefix := string(b)
+
+	var rows [][]any
+	c := ix.tree.NewCursor()
+	for ok := c.Seek(tree.StringKey(prefix)); ok && strings.HasPrefix(string(c.Key()), prefix); ok = c.Next() {
+		row, err := t.readRow(c.Value())
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("GetByIndex: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	if err := errors.Join(c.Err(), c.Close()); err != nil {
+		return nil, fmt.Errorf("GetByIndex: %w", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,314 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"pranavdb/tree"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Statistics
+
+Analyze reads every row of a table once and describes each column: its
+NULL count and minimum and maximum, counted exactly, and an estimate of its
+distinct values and an equi-depth histogram, built from a uniform sample of
+up to statsSampleRows rows (reservoir sampling, so the table need not be
+counted first). Values are ordered by their index keys (see "Index keys" in
+keys.go), so a decimal column, which has none, gets only its NULL count.
+
+The distinct count uses the GEE estimator: with a sample of n of a
+column's N values, d distinct in the sample and f1 of them seen once,
+
+	D = sqrt(N/n)·f1 + (d - f1)
+
+which is exact when the sample is the whole column. A sample with no value
+twice is taken for a unique column, D = N, which GEE would put at
+sqrt(N/n)·n. The histogram divides the sorted sample into up to
+statsBuckets buckets of equal size and keeps the largest value of each, so
+each bound marks off about the same share of the column's values; a value
+common enough to fill several buckets repeats.
+
+The statistics are a snapshot: writes after Analyze do not change them. A
+table opened through a DB keeps its last statistics in the catalog (see
+catalog.go), which carries them across restarts and drops them with the
+table.
+*/
+
+// statsSampleRows is how many rows Analyze samples.
+const statsSampleRows = 8192
+
+// statsBuckets is the most buckets in a column's histogram.
+const statsBuckets = 32
+
+// TableStats describes a table's rows as of its last Analyze.
+type TableStats struct {
+	Analyzed time.Time
+	Rows     uint64 // rows in the table
+	Sampled  uint64 // rows the estimates were built from
+	Columns  []ColumnStats
+}
+
+// ColumnStats describes one column's values; see "Statistics" above.
+type ColumnStats struct {
+	Name     string
+	Type     string
+	Nulls    uint64
+	Min, Max any    // nil if the column holds only NULLs or has no order
+	Distinct uint64 // estimated distinct values other than NULL
+
+	// Histogram holds the upper bound of each bucket of an equi-depth
+	// histogram of the column's values other than NULL, in order.
+	Histogram []any
+}
+
+// Column returns the statistics of the column called name, or nil.
+func (s *TableStats) Column(name string) *ColumnStats {
+	for i := range s.Columns {
+		if strings.EqualFold(s.Columns[i].Name, name) {
+			return &s.Columns[i]
+		}
+	}
+	return nil
+}
+
+// keyedValue is a column value with its index key, by which values sort.
+type keyedValue struct {
+	key string
+	v   any
+}
+
+// Analyze gathers the table's statistics, keeps them for Stats and, for a
+// table opened through a DB, stores them in the catalog.
+func (t *Table) Analyze() (TableStats, error) {
+	st, err := t.analyze()
+	if err != nil {
+		return TableStats{}, fmt.Errorf("Analyze: %w", err)
+	}
+	if t.db != nil {
+		if err := t.db.saveStats(t, st); err != nil {
+			return TableStats{}, fmt.Errorf("Analyze: %w", err)
+		}
+	}
+	t.mu.Lock()
+	t.stats = st
+	t.mu.Unlock()
+	return st.clone(), nil
+}
+
+// Stats returns the statistics of the table's last Analyze, if it has
+// been analyzed.
+func (t *Table) Stats() (TableStats, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats == nil {
+		return TableStats{}, false
+	}
+	return t.stats.clone(), true
+}
+
+// analyze reads the rows and builds the statistics.
+func (t *Table) analyze() (*TableStats, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cols := t.schema.Columns
+	st := &TableStats{Analyzed: time.Now(), Columns: make([]ColumnStats, len(cols))}
+	lo, hi := make([]*keyedValue, len(cols)), make([]*keyedValue, len(cols))
+	var sample [][]any
+	err := t.pk.Scan(func(_ tree.StringKey, ref uint64) error {
+		row, err := t.readRow(ref)
+		if err != nil {
+			return err
+		}
+		st.Rows++
+		for i, v := range row {
+			if v == nil {
+				st.Columns[i].Nulls++
+				continue
+			}
+			if !keyable(t.codes[i]) {
+				continue
+			}
+			b, err := appendKey(nil, t.codes[i], v)
+			if err != nil {
+				return fmt.Errorf("column %q: %w", cols[i].Name, err)
+			}
+			key := string(b)
+			if lo[i] == nil || key < lo[i].key {
+				lo[i] = &keyedValue{key, v}
+			}
+			if hi[i] == nil || key > hi[i].key {
+				hi[i] = &keyedValue{key, v}
+			}
+		}
+		if len(sample) < statsSampleRows {
+			sample = append(sample, row)
+		} else if j := rand.Uint64N(st.Rows); j < statsSampleRows {
+			sample[j] = row
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.Sampled = uint64(len(sample))
+	for i, c := range cols {
+		cs := &st.Columns[i]
+		cs.Name, cs.Type = c.Name, c.Type
+		if lo[i] == nil {
+			continue
+		}
+		cs.Min, cs.Max = lo[i].v, hi[i].v
+		var values []keyedValue
+		for _, row := range sample {
+			if row[i] != nil {
+				b, _ := appendKey(nil, t.codes[i], row[i])
+				values = append(values, keyedValue{string(b), row[i]})
+			}
+		}
+		slices.SortFunc(values, func(a, b keyedValue) int { return strings.Compare(a.key, b.key) })
+		cs.Distinct = estimateDistinct(values, st.Rows-cs.Nulls)
+		cs.Histogram = histogram(values)
+	}
+	return st, nil
+}
+
+// estimateDistinct estimates the distinct values of a column of total
+// values other than NULL from a sorted sample of them; see "Statistics".
+func estimateDistinct(values []keyedValue, total uint64) uint64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	var d, f1 int
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && values[j].key == values[i].key {
+			j++
+		}
+		if d++; j-i == 1 {
+			f1++
+		}
+		i = j
+	}
+	if uint64(n) == total {
+		return uint64(d)
+	}
+	if f1 == n {
+		return total
+	}
+	est := math.Sqrt(float64(total)/float64(n))*float64(f1) + float64(d-f1)
+	return min(uint64(math.Round(est)), total)
+}
+
+// histogram returns the bucket bounds of an equi-depth histogram of a
+// sorted sample.
+func histogram(values []keyedValue) []any {
+	n := len(values)
+	buckets := min(statsBuckets, n)
+	bounds := make([]any, buckets)
+	for i := range bounds {
+		bounds[i] = values[(i+1)*n/buckets-1].v
+	}
+	return bounds
+}
+
+// clone returns a copy of s that shares no slices with it.
+func (s *TableStats) clone() TableStats {
+	c := *s
+	c.Columns = slices.Clone(s.Columns)
+	for i := range c.Columns {
+		c.Columns[i].Histogram = slices.Clone(c.Columns[i].Histogram)
+	}
+	return c
+}
+
+/*
+A table's statistics are stored in the catalog as:
+
+	analyzed (int64 Unix nanoseconds), rows (uint64), sampled (uint64)
+	column count (uint16), then per column: name, type, NULLs (uint64),
+	    distinct (uint64), a byte 1 if min and max follow, then each, and
+	    the bucket count (uint16) and each bound
+
+Values are encoded as a one-column row of the column's type, as defaults
+are in the table metadata, behind a uint32 length.
+*/
+
+func encodeStats(s *TableStats) ([]byte, error) {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(s.Analyzed.UnixNano()))
+	b = binary.LittleEndian.AppendUint64(b, s.Rows)
+	b = binary.LittleEndian.AppendUint64(b, s.Sampled)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s.Columns)))
+	for _, c := range s.Columns {
+		b = appendString(b, c.Name)
+		b = appendString(b, c.Type)
+		b = binary.LittleEndian.AppendUint64(b, c.Nulls)
+		b = binary.LittleEndian.AppendUint64(b, c.Distinct)
+		values := c.Histogram
+		if c.Min == nil {
+			b = append(b, 0)
+		} else {
+			b = append(b, 1)
+			values = append([]any{c.Min, c.Max}, values...)
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(c.Histogram)))
+		for _, v := range values {
+			p, err := encodeValue(c.Type, v)
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %w", c.Name, err)
+			}
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(p)))
+			b = append(b, p...)
+		}
+	}
+	return b, nil
+}
+
+func decodeStats(b []byte) (*TableStats, error) {
+	r := &metaReader{b: b}
+	s := &TableStats{
+		Analyzed: time.Unix(0, int64(r.u64())),
+		Rows:     r.u64(),
+		Sampled:  r.u64(),
+	}
+	n := int(r.u16())
+	for i := 0; i < n && !r.bad; i++ {
+		c := ColumnStats{Name: r.str(), Type: r.str(), Nulls: r.u64(), Distinct: r.u64()}
+		hasRange := r.next(1)[0] == 1
+		values := make([]any, int(r.u16()))
+		if hasRange {
+			values = append(values, nil, nil)
+		}
+		for j := range values {
+			p := r.next(int(r.u32()))
+			if r.bad {
+				break
+			}
+			v, err := decodeValue(c.Type, p)
+			if err != nil {
+				return nil, fmt.Errorf("statistics: column %q: %w", c.Name, err)
+			}
+			values[j] = v
+		}
+		if hasRange {
+			c.Min, c.Max, values = values[0], values[1], values[2:]
+		}
+		if len(values) > 0 {
+			c.Histogram = values
+		}
+		s.Columns = append(s.Columns, c)
+	}
+	if r.bad {
+		return nil, errors.New("statistics truncated")
+	}
+	if len(r.b) != 0 {
+		return nil, errors.New("statistics: trailing bytes")
+	}
+	return s, nil
+}
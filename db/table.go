@@ -0,0 +1,545 @@
+// Package db puts rowfiles and B+ tree indexes together into tables.
+package db
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/data"
+	"pranavdb/index"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"pranavdb/txn"
+	"slices"
+	"sync"
+)
+
+/*
+Tables
+
+A Table keeps its rows in a rowfile and a DiskTree over its primary key,
+and writes both through one transaction log, so callers no longer wire the
+two together by hand. Its files share the table's path as a prefix:
+
+	<table>.tbl   the schema, see "Table metadata" in schema.go
+	<table>.rows  the rowfile, with its own side files; after schema
+	              changes also "<table>.rows.N", see alter.go
+	<table>.pk    the primary key index
+	<table>.idx.* the secondary indexes, see secondary.go
+	<table>.log   the transaction log
+
+The index maps each key (see "Index keys" in keys.go) to a reference to
+the row: its RowID, rather than its byte offset, with the number of the
+rowfile holding it in the top 16 bits (see "Schema changes" in alter.go).
+An update that moves a row within a rowfile changes only the rowfile's
+RowID map, never the index. Insert, InsertRows, Update and Delete each
+run in a txn.Txn over the rowfiles and the indexes, so a failure or a
+crash part way leaves none of them changed.
+
+A primary key may span several columns, whose values Get, Update and
+Delete then take as a []any in key order. Its index key joins theirs (see
+"Index keys"), so a Scan runs in the order of the columns in turn.
+
+A Table is safe for concurrent use; its methods run one at a time.
+*/
+
+// ErrDuplicateKey is returned for a write that would give two rows the same
+// primary key.
+var ErrDuplicateKey = errors.New("duplicate primary key")
+
+// ErrNotFound is returned for a primary key no row has.
+var ErrNotFound = errors.New("row not found")
+
+// ErrTableClosed is returned by Vacuum on a closed table.
+var ErrTableClosed = errors.New("table is closed")
+
+// pkOrder is the order of a table's index trees.
+const pkOrder = 16
+
+// rowStore is the part of a rowfile a Table uses.
+type rowStore interface {
+	txn.Participant
+	InsertRow(values []any) (data.RowID, error)
+	ReadRow(id data.RowID) ([]any, error)
+	UpdateRow(id data.RowID, values []any) error
+	DeleteRow(id data.RowID) error
+	GetSchemaCodes() []byte
+	RowCount() uint64
+	LiveBytes() uint64
+	Compact() (map[int64]int64, error)
+	Close() error
+}
+
+// keyTree is a table index: encoded keys to row references.
+type keyTree = index.DiskTree[tree.StringKey, uint64]
+
+// Table is a rowfile with a primary key index; see "Tables" above.
+type Table struct {
+	mu       sync.Mutex
+	path     string
+	meta     *tableMeta
+	schema   *Schema // &meta.schema
+	codes    []byte  // rowfile type code of each column
+	segments []*segment
+	pk       *keyTree
+	indexes  []*secondary
+	log      *txn.Log
+	writes   uint64 // transactions run, so Scan can tell the index changed
+	autoNext int64  // see "Auto-increment" in autoinc.go
+	stats    *TableStats
+	closed   bool
+
+	db   *DB // the database the table was opened through, if any
+	name string
+}
+
+// CreateTable creates (or truncates) a table at path with the given schema.
+func CreateTable(path string, schema Schema) (*Table, error) {
+	if err := schema.validate(); err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	m := &tableMeta{schema: Schema{
+		Columns:    append([]Column(nil), schema.Columns...),
+		PrimaryKey: append([]int(nil), schema.keyColumns()...),
+		Version:    1,
+	}}
+	s := &m.schema
+	for _, name := range schema.Indexes {
+		s.Indexes = append(s.Indexes, s.Columns[s.Column(name)].Name)
+	}
+	for i := range s.Columns {
+		m.colIDs = append(m.colIDs, uint32(i+1))
+	}
+	m.nextID = uint32(len(s.Columns) + 1)
+	m.segments = []segmentMeta{{num: 0, cols: slices.Clone(m.colIDs)}}
+	if err := normalizeDefaults(s); err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+
+	log, err := txn.Open(path + ".log")
+	if err != nil {
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	rows, err := data.NewRowfile(segmentPath(path, 0), s.rowSchema())
+	if err != nil {
+		log.Close()
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	t := &Table{path: path, segments: []*segment{{num: 0, rows: rows}}, log: log, autoNext: 1}
+	t.setMeta(m)
+	if err := t.checkKey(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	if t.pk, err = index.NewDiskTreeOrdered[tree.StringKey](path+".pk", pkOrder, page.Uint64Codec{}); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("CreateTable: %w", err)
+	}
+	for _, name := range s.Indexes {
+		ix, err := t.createIndexTree(s.Column(name))
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("CreateTable: %w", err)
+		}
+		t.indexes = append(t.indexes, ix)
+	}
+	if err := writeMeta(path+".tbl", m); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("CreateTable: write metadata: %w", err)
+	}
+	return t, nil
+}
+
+// OpenTable opens the table at path, first recovering any transaction a
+// crash interrupted.
+func OpenTable(path string) (*Table, error) {
+	m, err := readMeta(path + ".tbl")
+	if err != nil {
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	if err := m.schema.validate(); err != nil {
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	// the log recovers the files, so it opens before them
+	log, err := txn.Open(path + ".log")
+	if err != nil {
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	t := &Table{path: path, log: log, autoNext: max(m.autoLimit, 1)}
+	for _, sm := range m.segments {
+		rows, err := data.OpenRowfile(segmentPath(path, sm.num))
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("OpenTable: %w", err)
+		}
+		t.segments = append(t.segments, &segment{num: sm.num, rows: rows})
+		if n := len(rows.GetSchemaCodes()); n != len(sm.cols) {
+			t.Close()
+			return nil, fmt.Errorf("OpenTable: rowfile %d has %d columns, schema %d", sm.num, n, len(sm.cols))
+		}
+	}
+	t.setMeta(m)
+	if t.pk, err = index.OpenDiskTreeOrdered[tree.StringKey](path+".pk", page.Uint64Codec{}); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	if err := t.openIndexes(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	if err := t.dropEmptySegments(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("OpenTable: %w", err)
+	}
+	return t, nil
+}
+
+// checkKey checks the primary key columns can be a key.
+func (t *Table) checkKey() error {
+	for _, i := range t.schema.PrimaryKey {
+		col, code := t.schema.Columns[i], t.codes[i]
+		if code&data.TypeFlagNullable != 0 {
+			return fmt.Errorf("primary key column %q is nullable", col.Name)
+		}
+		if !keyable(code) {
+			return fmt.Errorf("primary key column %q: type %s cannot be a key", col.Name, col.Type)
+		}
+	}
+	return nil
+}
+
+// Schema returns a copy of the table's schema.
+func (t *Table) Schema() Schema {
+	s := *t.schema
+	s.Columns = append([]Column(nil), s.Columns...)
+	s.PrimaryKey = append([]int(nil), s.PrimaryKey...)
+	s.Indexes = append([]string(nil), s.Indexes...)
+	return s
+}
+
+// Len returns the number of rows in the table.
+func (t *Table) Len() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var n uint64
+	for _, seg := range t.segments {
+		n += seg.rows.RowCount()
+	}
+	return n
+}
+
+// Close closes the table's files. A table opened through a DB is closed by
+// DB.Close too.
+func (t *Table) Close() error {
+	if t.db != nil {
+		t.db.forget(t)
+	}
+	return t.close()
+}
+
+// close closes the table's files, after stopping any background checkpoints
+// and taking a last checkpoint, so the next open has nothing to recover.
+func (t *Table) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	errs := []error{t.log.StopCheckpointer(), t.log.Checkpoint()}
+	if t.pk != nil {
+		errs = append(errs, t.pk.Close())
+	}
+	for _, ix := range t.indexes {
+		errs = append(errs, ix.tree.Close())
+	}
+	for _, seg := range t.segments {
+		errs = append(errs, seg.rows.Close())
+	}
+	errs = append(errs, t.log.Close())
+	return errors.Join(errs...)
+}
+
+// pkKey returns the index key for a primary key value: the key column's
+// value, or for a composite key a []any of the key columns' values.
+func (t *Table) pkKey(pk any) (tree.StringKey, error) {
+	cols := t.schema.PrimaryKey
+	if len(cols) == 1 {
+		return encodeKey(t.codes[cols[0]], pk)
+	}
+	values, ok := pk.([]any)
+	if !ok || len(values) != len(cols) {
+		return "", fmt.Errorf("key: expected %d values for a composite key, got %T", len(cols), pk)
+	}
+	var b []byte
+	for i, col := range cols {
+		var err error
+		if b, err = appendKey(b, t.codes[col], values[i]); err != nil {
+			return "", fmt.Errorf("column %q: %w", t.schema.Columns[col].Name, err)
+		}
+	}
+	return tree.StringKey(b), nil
+}
+
+// rowKey returns the index key of row, after checking its length.
+func (t *Table) rowKey(row []any) (tree.StringKey, error) {
+	if len(row) != len(t.codes) {
+		return "", fmt.Errorf("row has %d values, table has %d columns", len(row), len(t.codes))
+	}
+	cols := t.schema.PrimaryKey
+	if len(cols) == 1 {
+		return t.pkKey(row[cols[0]])
+	}
+	values := make([]any, len(cols))
+	for i, col := range cols {
+		values[i] = row[col]
+	}
+	return t.pkKey(values)
+}
+
+// lookup returns the row reference the index holds for key.
+func (t *Table) lookup(key tree.StringKey) (ref uint64, found bool, err error) {
+	c := t.pk.NewCursor()
+	if c.Seek(key) && c.Key() == key {
+		ref, found = c.Value(), true
+	}
+	return ref, found, errors.Join(c.Err(), c.Close())
+}
+
+// write runs fn in a transaction over the rowfiles and the indexes. fn may
+// spill the transaction (see txn.Txn.Spill) as it goes.
+func (t *Table) write(fn func(tx *txn.Txn) error) error {
+	parts := []txn.Participant{t.pk}
+	for _, seg := range t.segments {
+		parts = append(parts, seg.rows)
+	}
+	for _, ix := range t.indexes {
+		parts = append(parts, ix.tree)
+	}
+	tx, err := t.log.Begin(parts...)
+	if err != nil {
+		return err
+	}
+	t.writes++
+	if err := fn(tx); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// Insert adds a row. It fails with ErrDuplicateKey if a row with the same
+// primary key exists. A nil value in an auto-increment column is filled in
+// with the next number (see autoinc.go).
+func (t *Table) Insert(row []any) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.insertRows([][]any{row}); err != nil {
+		return fmt.Errorf("Insert: %w", err)
+	}
+	return nil
+}
+
+// InsertRows adds rows, as Insert does, in one transaction: if any of them
+// cannot be added, none is. If the table has an auto-increment column, it
+// returns the number each row holds in it.
+func (t *Table) InsertRows(rows [][]any) ([]int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids, err := t.insertRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("InsertRows: %w", err)
+	}
+	return ids, nil
+}
+
+// insertRows adds rows in one transaction. Called with mu held.
+func (t *Table) insertRows(rows [][]any) ([]int64, error) {
+	fail := func(i int, err error) error {
+		if len(rows) > 1 {
+			return fmt.Errorf("row %d: %w", i+1, err)
+		}
+		return err
+	}
+	auto := t.schema.autoColumn()
+	var ids []int64
+	keys := make([]tree.StringKey, len(rows))
+	rows = slices.Clone(rows)
+	for i, row := range rows {
+		if auto >= 0 && len(row) == len(t.codes) {
+			var id int64
+			var err error
+			if rows[i], id, err = t.fillAuto(row, auto); err != nil {
+				return nil, fail(i, err)
+			}
+			ids = append(ids, id)
+		}
+		var err error
+		if keys[i], err = t.rowKey(rows[i]); err != nil {
+			return nil, fail(i, err)
+		}
+	}
+	err := t.write(func(tx *txn.Txn) error {
+		for i, row := range rows {
+			if _, found, err := t.lookup(keys[i]); err != nil {
+				return fail(i, err)
+			} else if found {
+				return fail(i, ErrDuplicateKey)
+			}
+			ref, err := t.insertRow(row)
+			if err != nil {
+				return fail(i, err)
+			}
+			if err := t.pk.Insert(keys[i], ref); err != nil {
+				return fail(i, err)
+			}
+			if err := t.indexRow(row, ref); err != nil {
+				return fail(i, err)
+			}
+			if err := spillEvery(tx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Get returns the row with primary key pk, or ErrNotFound.
+func (t *Table) Get(pk any) ([]any, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, err := t.pkKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	ref, found, err := t.lookup(key)
+	if err != nil {
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("Get: %w", ErrNotFound)
+	}
+	row, err := t.readRow(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	return row, nil
+}
+
+// Update replaces the row with primary key pk. row may change the primary
+// key, as long as no other row has the new one. A row written before the
+// last schema change is rewritten under the current schema.
+func (t *Table) Update(pk any, row []any) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, err := t.pkKey(pk)
+	if err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	newKey, err := t.rowKey(row)
+	if err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	if auto := t.schema.autoColumn(); auto >= 0 && row[auto] != nil {
+		if _, err := t.noteAuto(row[auto], auto); err != nil {
+			return fmt.Errorf("Update: %w", err)
+		}
+	}
+	ref, found, err := t.lookup(key)
+	if err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("Update: %w", ErrNotFound)
+	}
+	if newKey != key {
+		if _, found, err := t.lookup(newKey); err != nil {
+			return fmt.Errorf("Update: %w", err)
+		} else if found {
+			return fmt.Errorf("Update: %w", ErrDuplicateKey)
+		}
+	}
+	var old []any
+	if len(t.indexes) > 0 {
+		if old, err = t.readRow(ref); err != nil {
+			return fmt.Errorf("Update: %w", err)
+		}
+	}
+	err = t.write(func(*txn.Txn) error {
+		newRef, err := t.updateRow(ref, row)
+		if err != nil {
+			return err
+		}
+		if newKey != key || newRef != ref {
+			if err := t.pk.Delete(key); err != nil {
+				return err
+			}
+			if err := t.pk.Insert(newKey, newRef); err != nil {
+				return err
+			}
+		}
+		return t.reindexRow(old, row, ref, newRef)
+	})
+	if err != nil {
+		return fmt.Errorf("Update: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the row with primary key pk, or fails with ErrNotFound.
+func (t *Table) Delete(pk any) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, err := t.pkKey(pk)
+	if err != nil {
+		return fmt.Errorf("Delete: %w", err)
+	}
+	ref, found, err := t.lookup(key)
+	if err != nil {
+		return fmt.Errorf("Delete: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("Delete: %w", ErrNotFound)
+	}
+	var old []any
+	if len(t.indexes) > 0 {
+		if old, err = t.readRow(ref); err != nil {
+			return fmt.Errorf("Delete: %w", err)
+		}
+	}
+	err = t.write(func(*txn.Txn) error {
+		if err := t.deleteRow(ref); err != nil {
+			return err
+		}
+		if err := t.pk.Delete(key); err != nil {
+			return err
+		}
+		return t.unindexRow(old, ref)
+	})
+	if err != nil {
+		return fmt.Errorf("Delete: %w", err)
+	}
+	return nil
+}
+
+// Scan calls fn for every row in primary key order. Returning an error from
+// fn stops the scan and returns it. The table is not locked while fn runs,
+// so fn may write to it; rows written behind the scan are not seen.
+func (t *Table) Scan(fn func(row []any) error) error {
+	rows, err := t.ScanIndex("", Range{})
+	if err != nil {
+		return fmt.Errorf("Scan: %w", err)
+	}
+	for rows.Next() {
+		if err := fn(rows.Row()); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("Scan: %w", err)
+	}
+	return nil
+}
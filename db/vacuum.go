@@ -0,0 +1,106 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+/*
+Vacuum
+
+Deletes and updates leave freed space in a rowfile, which later inserts
+reuse but the file system never gets back. Vacuum compacts each of a
+table's rowfiles whose live rows fill less than half of it, once at least
+vacuumMinFree bytes are free, and drops segments that schema changes left
+empty (see alter.go). Compaction moves rows but keeps their RowIDs, so the
+indexes are untouched. It rewrites the rowfile outside the transaction log,
+so the log is checkpointed first and no record in it addresses the old
+file.
+
+A DB opened with a VacuumInterval vacuums its open tables from a
+background goroutine; see Options.
+*/
+
+// vacuumMinFree is the free space a rowfile must have before Vacuum
+// compacts it.
+const vacuumMinFree = 64 << 10
+
+// Vacuum returns space freed in the table's rowfiles to the file system;
+// see "Vacuum" above.
+func (t *Table) Vacuum() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("Vacuum: %w", ErrTableClosed)
+	}
+	if err := t.dropEmptySegments(); err != nil {
+		return fmt.Errorf("Vacuum: %w", err)
+	}
+	checkpointed := false
+	for _, seg := range t.segments {
+		info, err := os.Stat(segmentPath(t.path, seg.num))
+		if err != nil {
+			return fmt.Errorf("Vacuum: %w", err)
+		}
+		free := info.Size() - int64(seg.rows.LiveBytes())
+		if free < vacuumMinFree || free < info.Size()/2 {
+			continue
+		}
+		if !checkpointed {
+			if err := t.log.Checkpoint(); err != nil {
+				return fmt.Errorf("Vacuum: %w", err)
+			}
+			checkpointed = true
+		}
+		if _, err := seg.rows.Compact(); err != nil {
+			return fmt.Errorf("Vacuum: segment %d: %w", seg.num, err)
+		}
+	}
+	return nil
+}
+
+// vacuumer vacuums a DB's open tables on a timer.
+type vacuumer struct {
+	err  error // first error hit by a background vacuum
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (v *vacuumer) run(d *DB, interval time.Duration) {
+	defer close(v.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-v.stop:
+			return
+		}
+		d.mu.Lock()
+		tables := slices.Collect(maps.Values(d.tables))
+		d.mu.Unlock()
+		for _, t := range tables {
+			err := t.Vacuum()
+			if err != nil && !errors.Is(err, ErrTableClosed) && v.err == nil {
+				v.err = fmt.Errorf("table %q: %w", t.name, err)
+			}
+		}
+	}
+}
+
+// stopVacuum stops the background vacuums and returns the first error any
+// of them hit.
+func (d *DB) stopVacuum() error {
+	v := d.vacuum
+	if v == nil {
+		return nil
+	}
+	d.vacuum = nil
+	close(v.stop)
+	<-v.done
+	return v.err
+}
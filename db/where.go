@@ -0,0 +1,197 @@
+package db
+
+import (
+	"fmt"
+	"pranavdb/tree"
+	"pranavdb/txn"
+	"slices"
+)
+
+/*
+Writes over a range
+
+UpdateWhere changes every row of an index range that a function picks,
+and DeleteWhere deletes them, as one write: the table stays locked from
+the scan that finds the rows to the commit of the transaction that changes
+them, so no other write comes between, and either every row changes or
+none does.
+
+The rows are all found before any changes, so a row that moves within the
+index is not met again further on. An update is then made in two
+passes: the first rewrites each row and takes the primary keys of those
+whose key changes out of the index, and the second puts their new keys
+in. A key is so checked for duplicates against the table as the statement
+leaves it, and an update that shifts keys, say adding one to each, does not
+trip over the key of a row it has not reached yet.
+*/
+
+// writeSpill is how many rows a write of many spills its transaction
+// after, as their held writes slow every read the transaction makes.
+const writeSpill = 256
+
+// spillEvery spills tx after every writeSpill rows, i counting them from 0.
+func spillEvery(tx *txn.Txn, i int) error {
+	if (i+1)%writeSpill != 0 {
+		return nil
+	}
+	return tx.Spill()
+}
+
+// rowChange is a row UpdateWhere changes or DeleteWhere deletes.
+type rowChange struct {
+	key, newKey tree.StringKey
+	ref, newRef uint64
+	old, row    []any
+}
+
+// UpdateWhere calls fn with each row whose key in the index on column lies
+// in r (see ScanIndex) and replaces the row with the one fn returns, unless
+// that is nil. It returns the number of rows replaced. fn runs with the
+// table locked, so it must not call the table's methods. See "Writes over
+// a range" above.
+func (t *Table) UpdateWhere(column string, r Range, fn func(row []any) ([]any, error)) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, fmt.Errorf("UpdateWhere: %w", ErrTableClosed)
+	}
+	changes, err := t.findChanges(column, r, fn)
+	if err != nil {
+		return 0, fmt.Errorf("UpdateWhere: %w", err)
+	}
+	for i := range changes {
+		if err := t.newKey(&changes[i]); err != nil {
+			return 0, fmt.Errorf("UpdateWhere: %w", err)
+		}
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	err = t.write(func(tx *txn.Txn) error {
+		for i := range changes {
+			ch := &changes[i]
+			var err error
+			if ch.newRef, err = t.updateRow(ch.ref, ch.row); err != nil {
+				return err
+			}
+			if ch.newKey != ch.key || ch.newRef != ch.ref {
+				if err := t.pk.Delete(ch.key); err != nil {
+					return err
+				}
+			}
+			if err := t.reindexRow(ch.old, ch.row, ch.ref, ch.newRef); err != nil {
+				return err
+			}
+			if err := spillEvery(tx, i); err != nil {
+				return err
+			}
+		}
+		for i, ch := range changes {
+			if ch.newKey == ch.key && ch.newRef == ch.ref {
+				continue
+			}
+			if _, found, err := t.lookup(ch.newKey); err != nil {
+				return err
+			} else if found {
+				return ErrDuplicateKey
+			}
+			if err := t.pk.Insert(ch.newKey, ch.newRef); err != nil {
+				return err
+			}
+			if err := spillEvery(tx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("UpdateWhere: %w", err)
+	}
+	return len(changes), nil
+}
+
+// findChanges scans the range and collects the rows fn changes, with their
+// primary keys. Called with mu held.
+func (t *Table) findChanges(column string, r Range, fn func(row []any) ([]any, error)) ([]rowChange, error) {
+	rows, err := t.scanIndex(column, r)
+	if err != nil {
+		return nil, err
+	}
+	var changes []rowChange
+	for rows.next() {
+		ch := rowChange{ref: rows.ref, old: rows.row}
+		ch.row, err = fn(slices.Clone(rows.row))
+		if err == nil && ch.row != nil {
+			ch.key, err = t.rowKey(ch.old)
+		}
+		if err != nil {
+			rows.finish(nil)
+			return nil, err
+		}
+		if ch.row != nil {
+			changes = append(changes, ch)
+		}
+	}
+	return changes, rows.err
+}
+
+// newKey fills in the new primary key of ch and moves the auto-increment
+// count past the new row's number. Called with mu held.
+func (t *Table) newKey(ch *rowChange) error {
+	var err error
+	if ch.newKey, err = t.rowKey(ch.row); err != nil {
+		return err
+	}
+	if auto := t.schema.autoColumn(); auto >= 0 && ch.row[auto] != nil {
+		_, err = t.noteAuto(ch.row[auto], auto)
+	}
+	return err
+}
+
+// DeleteWhere deletes each row whose key in the index on column lies in r
+// (see ScanIndex) and for which fn, if not nil, returns true. It returns
+// the number of rows deleted. Like UpdateWhere, it finds the rows and
+// deletes them as one write, and fn must not call the table's methods.
+func (t *Table) DeleteWhere(column string, r Range, fn func(row []any) (bool, error)) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, fmt.Errorf("DeleteWhere: %w", ErrTableClosed)
+	}
+	changes, err := t.findChanges(column, r, func(row []any) ([]any, error) {
+		if fn == nil {
+			return row, nil
+		}
+		if ok, err := fn(row); !ok || err != nil {
+			return nil, err
+		}
+		return row, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DeleteWhere: %w", err)
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	err = t.write(func(tx *txn.Txn) error {
+		for i, ch := range changes {
+			if err := t.deleteRow(ch.ref); err != nil {
+				return err
+			}
+			if err := t.pk.Delete(ch.key); err != nil {
+				return err
+			}
+			if err := t.unindexRow(ch.old, ch.ref); err != nil {
+				return err
+			}
+			if err := spillEvery(tx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DeleteWhere: %w", err)
+	}
+	return len(changes), nil
+}
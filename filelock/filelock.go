@@ -0,0 +1,33 @@
+// Package filelock provides advisory whole-file locks so two processes cannot
+// open the same database file for writing at once.
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned when the file is already locked in a conflicting mode
+// by another process (or another open handle in this one).
+var ErrLocked = errors.New("file is locked by another process")
+
+// Mode selects the kind of lock to take.
+type Mode int
+
+const (
+	// Exclusive is held by a single read-write opener.
+	Exclusive Mode = iota
+	// Shared may be held by any number of read-only openers at once.
+	Shared
+)
+
+// Lock takes an advisory lock on f without blocking. The lock is released by
+// Unlock or when f is closed.
+func Lock(f *os.File, mode Mode) error {
+	return lock(f, mode)
+}
+
+// Unlock releases a lock taken by Lock.
+func Unlock(f *os.File) error {
+	return unlock(f)
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package filelock
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation syscall.Errno = 33
+)
+
+func lock(f *os.File, mode Mode) error {
+	var flags uint32 = lockfileFailImmediately
+	if mode == Exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		if err == errorLockViolation {
+			return ErrLocked
+		}
+		return err
+	}
+	return nil
+}
+
+func unlock(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
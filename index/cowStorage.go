@@ -0,0 +1,554 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"pranavdb/page"
+	"slices"
+	"sync"
+)
+
+/*
+Copy-on-write storage
+
+A COWTree (see cowTree.go) keeps its index in a copy-on-write file, in the
+LMDB and bbolt pattern: one write transaction at a time, and read
+transactions that never wait for it. The file is a run of blocks of
+page.PageSize bytes:
+
+	block 0, 1   meta slots
+	block 2..    data and page-table blocks, in any order
+
+The IndexFile byte space is cut into logical blocks, shifted so that the
+header fills the tail of logical block 0 and page p is exactly logical
+block p+1, and a page table maps each logical block to the physical block
+holding it; a hole reads as zeros. A write transaction never writes a block
+a committed version can see: its first write to a logical block copies the
+block to a free one, which its later writes reuse.
+
+Commit writes the new page table to free blocks, chained as [next][511
+entries], syncs, then writes the meta record to the slot of the new
+transaction ID's parity and syncs again:
+
+	[0:4]   magic "BPCW"
+	[4:8]   uint32 version
+	[8:16]  uint64 transaction ID
+	[16:24] uint64 size of the IndexFile byte space
+	[24:32] uint64 first page-table block, 0 if none
+	[32:40] uint64 page-table entries
+	[40:44] uint32 CRC32 of [0:40]
+
+A crash at any point leaves the meta of the last commit intact, and Open
+takes the valid meta with the highest ID; every block neither it nor its
+page table names is free.
+
+A version is the page table of one commit. A read transaction pins the
+current version and reads through it, from a read-only mapping of the file
+where the platform has mmap. Blocks a commit replaces, its predecessor's
+page table among them, are freed only once no reader pins an older
+version, so everything a reader can reach stays as it was. The mapping is
+redone, with room to grow, when the file outgrows it, and the old one is
+unmapped when no pinned version needs it any more.
+
+Rewriting the whole page table at each commit keeps the format simple; it
+costs 8 bytes per page per commit.
+*/
+
+var cowMagic = [4]byte{'B', 'P', 'C', 'W'}
+
+const (
+	cowFormat       = 1
+	cowMetaSize     = 44
+	cowTableEntries = page.PageSize/8 - 1
+	cowShift        = page.PageSize - HeaderSize // logical block 0 holds only the header
+)
+
+// cowBlock returns the logical block holding offset off of the IndexFile
+// byte space, and off's position in it.
+func cowBlock(off int64) (uint64, int) {
+	off += cowShift
+	return uint64(off / page.PageSize), int(off % page.PageSize)
+}
+
+// blockOffset returns the file offset of physical block b.
+func blockOffset(b uint64) int64 {
+	return int64(b) * page.PageSize
+}
+
+// cowMap is a read-only mapping of the file.
+type cowMap struct {
+	data []byte
+	refs int // versions alive that read through it
+}
+
+// cowVersion is the page table of one commit.
+type cowVersion struct {
+	tx     uint64
+	size   int64
+	table  []uint64 // physical block of each logical block, 0 for a hole
+	blocks []uint64 // physical blocks holding table
+	m      *cowMap  // nil where mmap is unavailable
+}
+
+// retired is the blocks a commit replaced.
+type retired struct {
+	tx     uint64
+	blocks []uint64
+}
+
+// cowStorage is a copy-on-write file and its committed versions.
+type cowStorage struct {
+	file *os.File
+	w    *cowTxn // the write transaction, reused by each
+
+	mu      sync.Mutex
+	current *cowVersion
+	readers map[*cowVersion]int // pinned versions
+	free    []uint64
+	retired []retired // oldest first
+	nblocks uint64    // physical blocks in the file
+	m       *cowMap
+	noMmap  bool  // the platform cannot map the file
+	err     error // a commit left unsure; see commit
+}
+
+// createCOWStorage starts an empty copy-on-write file in f.
+func createCOWStorage(f *os.File) (*cowStorage, error) {
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	s := &cowStorage{file: f, current: &cowVersion{}, nblocks: 2}
+	s.w = &cowTxn{s: s}
+	return s, nil
+}
+
+// openCOWStorage loads the last commit of the copy-on-write file in f.
+func openCOWStorage(f *os.File) (*cowStorage, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &cowStorage{file: f, nblocks: uint64((info.Size() + page.PageSize - 1) / page.PageSize)}
+	s.w = &cowTxn{s: s}
+	for slot := uint64(0); slot < 2; slot++ {
+		v, err := s.readMeta(slot)
+		if err != nil {
+			continue
+		}
+		if s.current == nil || v.tx > s.current.tx {
+			s.current = v
+		}
+	}
+	if s.current == nil {
+		return nil, errors.New("not a copy-on-write index file, or both meta records are damaged")
+	}
+
+	used := make(map[uint64]bool)
+	for _, b := range slices.Concat(s.current.table, s.current.blocks) {
+		if b >= s.nblocks {
+			return nil, fmt.Errorf("page table names block %d past the end of the file", b)
+		}
+		used[b] = true
+	}
+	for b := s.nblocks - 1; b >= 2; b-- {
+		if !used[b] {
+			s.free = append(s.free, b)
+		}
+	}
+	s.remap()
+	s.current.m = s.m
+	if s.m != nil {
+		s.m.refs++
+	}
+	return s, nil
+}
+
+// readMeta reads the version a meta slot records, with its page table.
+func (s *cowStorage) readMeta(slot uint64) (*cowVersion, error) {
+	meta := make([]byte, cowMetaSize)
+	if _, err := s.file.ReadAt(meta, blockOffset(slot)); err != nil {
+		return nil, err
+	}
+	if [4]byte(meta[0:4]) != cowMagic || binary.LittleEndian.Uint32(meta[4:8]) != cowFormat ||
+		crc32.ChecksumIEEE(meta[:40]) != binary.LittleEndian.Uint32(meta[40:44]) {
+		return nil, errors.New("bad meta record")
+	}
+	v := &cowVersion{
+		tx:   binary.LittleEndian.Uint64(meta[8:16]),
+		size: int64(binary.LittleEndian.Uint64(meta[16:24])),
+	}
+	next, entries := binary.LittleEndian.Uint64(meta[24:32]), binary.LittleEndian.Uint64(meta[32:40])
+	buf := make([]byte, page.PageSize)
+	for next != 0 && uint64(len(v.table)) < entries {
+		if next < 2 || next >= s.nblocks || slices.Contains(v.blocks, next) {
+			return nil, fmt.Errorf("bad page-table block %d", next)
+		}
+		if _, err := s.file.ReadAt(buf, blockOffset(next)); err != nil {
+			return nil, err
+		}
+		v.blocks = append(v.blocks, next)
+		next = binary.LittleEndian.Uint64(buf[0:8])
+		for i := 0; i < cowTableEntries && uint64(len(v.table)) < entries; i++ {
+			v.table = append(v.table, binary.LittleEndian.Uint64(buf[8+8*i:]))
+		}
+	}
+	if uint64(len(v.table)) != entries {
+		return nil, errors.New("page table truncated")
+	}
+	return v, nil
+}
+
+// remap maps the file with room to grow, if the platform can. Called with
+// mu held.
+func (s *cowStorage) remap() {
+	if s.noMmap {
+		return
+	}
+	size := int(blockOffset(s.nblocks))
+	if s.m != nil && size <= len(s.m.data) {
+		return
+	}
+	data, err := mmapFile(s.file, max(2*size, 64*page.PageSize))
+	if err != nil {
+		s.noMmap = true
+		return
+	}
+	old := s.m
+	s.m = &cowMap{data: data}
+	if old != nil && old.refs == 0 {
+		munmapFile(old.data)
+	}
+}
+
+// pin returns the current version, which stays readable until unpin.
+func (s *cowStorage) pin() *cowVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readers == nil {
+		s.readers = make(map[*cowVersion]int)
+	}
+	s.readers[s.current]++
+	return s.current
+}
+
+func (s *cowStorage) unpin(v *cowVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readers[v]--; s.readers[v] > 0 {
+		return
+	}
+	delete(s.readers, v)
+	if v != s.current {
+		s.drop(v)
+	}
+}
+
+// drop lets go of a version no one uses any more. Called with mu held.
+func (s *cowStorage) drop(v *cowVersion) {
+	if v.m == nil {
+		return
+	}
+	if v.m.refs--; v.m.refs == 0 && v.m != s.m {
+		munmapFile(v.m.data)
+	}
+}
+
+// allocate returns a free physical block, growing the file if there is
+// none.
+func (s *cowStorage) allocate() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldest := s.current.tx
+	for v := range s.readers {
+		oldest = min(oldest, v.tx)
+	}
+	for len(s.retired) > 0 && s.retired[0].tx <= oldest {
+		s.free = append(s.free, s.retired[0].blocks...)
+		s.retired = s.retired[1:]
+	}
+	if n := len(s.free); n > 0 {
+		b := s.free[n-1]
+		s.free = s.free[:n-1]
+		return b
+	}
+	s.nblocks++
+	return s.nblocks - 1
+}
+
+// release returns blocks no version can see to the free list.
+func (s *cowStorage) release(blocks []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free = append(s.free, blocks...)
+}
+
+// read reads the IndexFile byte space as table and size describe it, from
+// m if set and otherwise from the file.
+func (s *cowStorage) read(table []uint64, size int64, m *cowMap, p []byte, off int64) (int, error) {
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), size-off))
+	for done := 0; done < n; {
+		lb, in := cowBlock(off + int64(done))
+		chunk := p[done:min(n, done+page.PageSize-in)]
+		var b uint64
+		if lb < uint64(len(table)) {
+			b = table[lb]
+		}
+		switch {
+		case b == 0:
+			clear(chunk)
+		case m != nil:
+			copy(chunk, m.data[blockOffset(b)+int64(in):])
+		default:
+			if _, err := s.file.ReadAt(chunk, blockOffset(b)+int64(in)); err != nil {
+				return done, err
+			}
+		}
+		done += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps and closes the file. No transaction may be open.
+func (s *cowStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.m != nil {
+		err = munmapFile(s.m.data)
+		s.m = nil
+	}
+	return errors.Join(err, s.file.Close())
+}
+
+// cowTxn is the write transaction's view of a cowStorage, the storage the
+// writer's IndexFile runs on.
+type cowTxn struct {
+	s        *cowStorage
+	table    []uint64
+	size     int64
+	fresh    map[uint64]bool // logical blocks copied in this transaction
+	replaced []uint64        // blocks of the committed version it replaced
+	changed  bool
+}
+
+// begin starts a write transaction from the current version.
+func (t *cowTxn) begin() {
+	t.s.mu.Lock()
+	v := t.s.current
+	t.s.mu.Unlock()
+	t.table, t.size = slices.Clone(v.table), v.size
+	t.fresh, t.replaced, t.changed = make(map[uint64]bool), nil, false
+}
+
+// rollback frees the blocks the transaction wrote.
+func (t *cowTxn) rollback() {
+	var blocks []uint64
+	for lb := range t.fresh {
+		if lb < uint64(len(t.table)) {
+			blocks = append(blocks, t.table[lb])
+		}
+	}
+	t.s.release(blocks)
+	t.begin()
+}
+
+// commit makes the transaction the current version; see "Copy-on-write
+// storage" above.
+func (t *cowTxn) commit() error {
+	if !t.changed {
+		return nil
+	}
+	s := t.s
+	var blocks []uint64
+	for i := 0; i < len(t.table); i += cowTableEntries {
+		blocks = append(blocks, s.allocate())
+	}
+	buf := make([]byte, page.PageSize)
+	for i, b := range blocks {
+		clear(buf)
+		if i+1 < len(blocks) {
+			binary.LittleEndian.PutUint64(buf[0:8], blocks[i+1])
+		}
+		for j, e := range t.table[i*cowTableEntries : min(len(t.table), (i+1)*cowTableEntries)] {
+			binary.LittleEndian.PutUint64(buf[8+8*j:], e)
+		}
+		if _, err := s.file.WriteAt(buf, blockOffset(b)); err != nil {
+			s.release(blocks)
+			return fmt.Errorf("write page table: %w", err)
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		s.release(blocks)
+		return err
+	}
+
+	v := &cowVersion{tx: s.current.tx + 1, size: t.size, table: t.table, blocks: blocks}
+	meta := append([]byte(nil), cowMagic[:]...)
+	meta = binary.LittleEndian.AppendUint32(meta, cowFormat)
+	meta = binary.LittleEndian.AppendUint64(meta, v.tx)
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(v.size))
+	var head uint64
+	if len(blocks) > 0 {
+		head = blocks[0]
+	}
+	meta = binary.LittleEndian.AppendUint64(meta, head)
+	meta = binary.LittleEndian.AppendUint64(meta, uint64(len(v.table)))
+	meta = binary.LittleEndian.AppendUint32(meta, crc32.ChecksumIEEE(meta))
+	if _, err := s.file.WriteAt(meta, blockOffset(v.tx%2)); err != nil {
+		// the slot may be torn, but it held the version before the current one
+		s.release(blocks)
+		return fmt.Errorf("write meta: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		// the meta may or may not be on disk, so nothing it names can be
+		// reused until Open finds out
+		s.err = fmt.Errorf("copy-on-write index: commit unsure; reopen to recover: %w", err)
+		return s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.current
+	s.retired = append(s.retired, retired{v.tx, slices.Concat(t.replaced, old.blocks)})
+	s.remap()
+	if v.m = s.m; v.m != nil {
+		v.m.refs++
+	}
+	s.current = v
+	if s.readers[old] == 0 {
+		s.drop(old)
+	}
+	t.table, t.fresh, t.replaced, t.changed = slices.Clone(v.table), make(map[uint64]bool), nil, false
+	return nil
+}
+
+func (t *cowTxn) ReadAt(p []byte, off int64) (int, error) {
+	return t.s.read(t.table, t.size, nil, p, off)
+}
+
+func (t *cowTxn) WriteAt(p []byte, off int64) (int, error) {
+	if err := t.write(p, off); err != nil {
+		return 0, err
+	}
+	t.size = max(t.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+// write writes p at off, each block to the copy the transaction owns.
+func (t *cowTxn) write(p []byte, off int64) error {
+	t.changed = true
+	for done := 0; done < len(p); {
+		lb, in := cowBlock(off + int64(done))
+		chunk := p[done:min(len(p), done+page.PageSize-in)]
+		b, err := t.own(lb, len(chunk) == page.PageSize)
+		if err != nil {
+			return err
+		}
+		if _, err := t.s.file.WriteAt(chunk, blockOffset(b)+int64(in)); err != nil {
+			return err
+		}
+		done += len(chunk)
+	}
+	return nil
+}
+
+// own returns the physical block the transaction writes logical block lb
+// to, copying the committed one to a free block on the first write. whole
+// says the caller overwrites all of it, so nothing need be copied.
+func (t *cowTxn) own(lb uint64, whole bool) (uint64, error) {
+	if lb >= uint64(len(t.table)) {
+		t.table = append(t.table, make([]uint64, lb+1-uint64(len(t.table)))...)
+	}
+	if t.fresh[lb] {
+		return t.table[lb], nil
+	}
+	b, old := t.s.allocate(), t.table[lb]
+	if !whole {
+		buf := make([]byte, page.PageSize)
+		if old != 0 {
+			if _, err := t.s.file.ReadAt(buf, blockOffset(old)); err != nil {
+				t.s.release([]uint64{b})
+				return 0, err
+			}
+		}
+		if _, err := t.s.file.WriteAt(buf, blockOffset(b)); err != nil {
+			t.s.release([]uint64{b})
+			return 0, err
+		}
+	}
+	if old != 0 {
+		t.replaced = append(t.replaced, old)
+	}
+	t.table[lb], t.fresh[lb] = b, true
+	return b, nil
+}
+
+func (t *cowTxn) Size() (int64, error) { return t.size, nil }
+
+func (t *cowTxn) Truncate(size int64) error {
+	t.changed = true
+	if size >= t.size {
+		t.size = size
+		return nil
+	}
+	keep := uint64(0)
+	if size > 0 {
+		lb, _ := cowBlock(size - 1)
+		keep = lb + 1
+	}
+	var blocks []uint64
+	for lb := keep; lb < uint64(len(t.table)); lb++ {
+		switch b := t.table[lb]; {
+		case b == 0:
+		case t.fresh[lb]:
+			blocks = append(blocks, b)
+			delete(t.fresh, lb)
+		default:
+			t.replaced = append(t.replaced, b)
+		}
+	}
+	t.s.release(blocks)
+	if keep < uint64(len(t.table)) {
+		t.table = t.table[:keep]
+	}
+	// zero the cut-off part of the last block, so growing again reads zeros
+	if lb, in := cowBlock(size); in > 0 && lb < uint64(len(t.table)) && t.table[lb] != 0 {
+		if err := t.write(make([]byte, page.PageSize-in), size); err != nil {
+			return err
+		}
+	}
+	t.size = size
+	return nil
+}
+
+// Sync does nothing: commit makes the transaction durable.
+func (t *cowTxn) Sync() error { return nil }
+
+// Close does nothing; the COWTree closes the file.
+func (t *cowTxn) Close() error { return nil }
+
+// cowView is the storage of a read transaction: one pinned version.
+type cowView struct {
+	s *cowStorage
+	v *cowVersion
+}
+
+func (r cowView) ReadAt(p []byte, off int64) (int, error) {
+	return r.s.read(r.v.table, r.v.size, r.v.m, p, off)
+}
+
+func (r cowView) Size() (int64, error)                     { return r.v.size, nil }
+func (r cowView) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (r cowView) Truncate(size int64) error                { return ErrReadOnly }
+func (r cowView) Sync() error                              { return nil }
+func (r cowView) Close() error                             { return nil }
@@ -0,0 +1,161 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"pranavdb/filelock"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"sync"
+)
+
+// COWTree is a B+ tree in a copy-on-write file (see cowStorage.go): one
+// write transaction at a time through Update, and any number of read
+// transactions through View, each reading the tree as of the last commit
+// before it began without waiting for the writer. It is a simpler
+// alternative to a DiskTree under a txn.Log: commits are atomic and crash
+// safe with no log, at the cost of rewriting the page table on each one.
+type COWTree[K tree.Key, V any] struct {
+	store *cowStorage
+	codec *page.IndexPageCodec[K, V]
+
+	mu     sync.Mutex // held by the write transaction
+	writer *DiskTree[K, V]
+}
+
+// NewCOWTree creates (or truncates) a copy-on-write tree file. values
+// encodes leaf values; nil selects the built-in codec for V.
+func NewCOWTree[K tree.Key, V any](filepath string, order int, values page.ValueCodec[V]) (*COWTree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order must be >= 3")
+	}
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+	f, err := lockCOWFile(filepath, os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	store, err := createCOWStorage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to create copy-on-write index file: %w", err)
+	}
+
+	store.w.begin()
+	indexFile := &IndexFile[K, V]{file: store.w, order: order, codec: codec}
+	if err := indexFile.writeHeader(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+	if err := store.w.commit(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+	return &COWTree[K, V]{
+		store:  store,
+		codec:  codec,
+		writer: &DiskTree[K, V]{indexFile: indexFile, order: order},
+	}, nil
+}
+
+// OpenCOWTree opens an existing copy-on-write tree at its last commit.
+func OpenCOWTree[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*COWTree[K, V], error) {
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+	f, err := lockCOWFile(filepath, 0)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openCOWStorage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open copy-on-write index file: %w", err)
+	}
+	store.w.begin()
+	indexFile, err := loadIndexFile[K](store.w, codec, false)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &COWTree[K, V]{
+		store:  store,
+		codec:  codec,
+		writer: &DiskTree[K, V]{indexFile: indexFile, order: indexFile.GetOrder()},
+	}, nil
+}
+
+// lockCOWFile opens a copy-on-write file for writing and locks it.
+func lockCOWFile(filepath string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(filepath, os.O_RDWR|flag, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file: %w", err)
+	}
+	if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock index file: %w", err)
+	}
+	return f, nil
+}
+
+// Update runs fn in the write transaction and commits what it wrote, or
+// rolls it all back if fn or the commit fails. Updates run one at a time;
+// w is only valid inside fn.
+func (t *COWTree[K, V]) Update(fn func(w *DiskTree[K, V]) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.store.err; err != nil {
+		return err
+	}
+	err := t.writer.BatchHeaderWrites(func() error { return fn(t.writer) })
+	if err == nil {
+		err = t.writer.Flush()
+	}
+	if err == nil {
+		if err = t.store.w.commit(); err == nil {
+			return nil
+		}
+		if t.store.err != nil {
+			return err
+		}
+	}
+
+	t.store.w.rollback()
+	idx := t.writer.indexFile
+	if idx.flusher != nil {
+		idx.flusher.discardFrom(0)
+	}
+	if idx.cache != nil {
+		idx.cache.discardFrom(0)
+	}
+	idx.shrinkPending = false
+	if rerr := idx.readHeader(); rerr != nil {
+		return errors.Join(err, fmt.Errorf("Update: reload header: %w", rerr))
+	}
+	idx.updateGauges()
+	return err
+}
+
+// View runs fn in a read transaction over the last commit. r is read-only
+// and only valid inside fn; any number of Views may run at once, alongside
+// an Update.
+func (t *COWTree[K, V]) View(fn func(r *DiskTree[K, V]) error) error {
+	v := t.store.pin()
+	defer t.store.unpin(v)
+	indexFile, err := loadIndexFile[K](cowView{t.store, v}, t.codec, true)
+	if err != nil {
+		return fmt.Errorf("View: %w", err)
+	}
+	return fn(&DiskTree[K, V]{indexFile: indexFile, order: indexFile.GetOrder()})
+}
+
+// Close closes the file. No Update or View may be running.
+func (t *COWTree[K, V]) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.store.Close()
+}
@@ -0,0 +1,258 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/tree"
+	"sort"
+)
+
+/*
+Cursors
+
+A Cursor steps through a DiskTree's pairs in ascending key order, one at a
+time, where Scan and RangeSearch take the whole range in one call. The tree
+may be changed between steps. A cursor works from a copy of its current
+leaf and, on moving to the next one, skips keys up to the last it returned,
+so it never returns a key twice or out of order; writes to a leaf it has
+already reached are not seen.
+
+The leaf page a cursor is positioned on is pinned:
+
+  - the page cache never evicts a pinned page, so a cursor on a hot leaf
+    does not keep re-reading it from the file
+  - freeing a pinned page, when a delete merges its leaf away, is put off
+    until the last pin on it is released. The page cannot be reused for
+    another node in the meantime and keeps its last contents, so the
+    cursor can still follow its leaf link
+
+Close releases the pin; a cursor that has run off the end holds none. While
+a freed page is pinned it is on neither the tree nor the free list, and
+VerifyFile reports it. Cursors hold no lock: like the rest of DiskTree, a
+cursor must not step while another goroutine writes the tree.
+*/
+
+// pin marks a page in use by a cursor.
+func (idx *IndexFile[K, V]) pin(pageID uint64) {
+	idx.pinMu.Lock()
+	defer idx.pinMu.Unlock()
+	if idx.pins == nil {
+		idx.pins = make(map[uint64]int)
+	}
+	idx.pins[pageID]++
+	if idx.cache != nil {
+		idx.cache.pin(pageID)
+	}
+}
+
+// unpin releases a pin, freeing the page if it was freed while pinned.
+func (idx *IndexFile[K, V]) unpin(pageID uint64) error {
+	idx.pinMu.Lock()
+	if idx.pins[pageID]--; idx.pins[pageID] > 0 {
+		idx.pinMu.Unlock()
+		return nil
+	}
+	delete(idx.pins, pageID)
+	if idx.cache != nil {
+		idx.cache.unpin(pageID)
+	}
+	free := idx.freeOnUnpin[pageID]
+	delete(idx.freeOnUnpin, pageID)
+	idx.pinMu.Unlock()
+
+	if free {
+		return idx.freePage(pageID)
+	}
+	return nil
+}
+
+// deferFree reports whether pageID is pinned, noting that it is to be freed
+// once it is not.
+func (idx *IndexFile[K, V]) deferFree(pageID uint64) bool {
+	idx.pinMu.Lock()
+	defer idx.pinMu.Unlock()
+	if idx.pins[pageID] == 0 {
+		return false
+	}
+	if idx.freeOnUnpin == nil {
+		idx.freeOnUnpin = make(map[uint64]bool)
+	}
+	idx.freeOnUnpin[pageID] = true
+	return true
+}
+
+// releasePins frees the pages whose free was put off, for cursors still open
+// at Close.
+func (idx *IndexFile[K, V]) releasePins() error {
+	idx.pinMu.Lock()
+	pending := idx.freeOnUnpin
+	idx.pins, idx.freeOnUnpin = nil, nil
+	idx.pinMu.Unlock()
+
+	for pageID := range pending {
+		if err := idx.freePage(pageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cursor iterates over a DiskTree's pairs; see "Cursors" above.
+type Cursor[K tree.Key, V any] struct {
+	t       *DiskTree[K, V]
+	leaf    *tree.LeafNode[K, V]
+	scratch tree.LeafNode[K, V] // leaves after the first are decoded into this
+	pageID  uint64              // pinned leaf, 0 when not positioned
+	pos     int
+	err     error
+}
+
+// NewCursor returns an unpositioned cursor; call First or Seek to start.
+func (t *DiskTree[K, V]) NewCursor() *Cursor[K, V] {
+	return &Cursor[K, V]{t: t}
+}
+
+// First positions the cursor on the smallest key and reports whether there
+// is one.
+func (c *Cursor[K, V]) First() bool {
+	return c.seek(nil)
+}
+
+// Seek positions the cursor on the smallest key >= key and reports whether
+// there is one.
+func (c *Cursor[K, V]) Seek(key K) bool {
+	return c.seek(&key)
+}
+
+func (c *Cursor[K, V]) seek(key *K) bool {
+	c.err = nil
+	if c.release() != nil {
+		return false
+	}
+	idx := c.t.indexFile
+	pageID := idx.GetRoot()
+	if pageID == 0 {
+		return false
+	}
+	for {
+		idx.pin(pageID)
+		node, err := idx.readNode(pageID)
+		if err != nil {
+			c.err = errors.Join(err, idx.unpin(pageID))
+			return false
+		}
+		if leaf, ok := node.(*tree.LeafNode[K, V]); ok {
+			c.leaf, c.pageID, c.pos = leaf, pageID, 0
+			if key != nil {
+				c.pos = c.t.skipTo(leaf.Pairs, *key, false)
+			}
+			return c.settle(key, false)
+		}
+		if err := idx.unpin(pageID); err != nil {
+			c.err = err
+			return false
+		}
+		interm, ok := node.(*tree.IntermNode[K, V])
+		if !ok || len(interm.Pointers) == 0 {
+			c.err = fmt.Errorf("page %d: expected an internal node", pageID)
+			return false
+		}
+		i := 0
+		if key != nil {
+			i = min(c.t.upperBound(*key, interm.Keys), len(interm.Pointers)-1)
+		}
+		pageID = interm.Pointers[i]
+	}
+}
+
+// Next moves to the next key and reports whether there is one.
+func (c *Cursor[K, V]) Next() bool {
+	if c.pageID == 0 {
+		return false
+	}
+	c.pos++
+	last := c.leaf.Pairs[c.pos-1].K
+	return c.settle(&last, true)
+}
+
+// skipTo returns the index of the first pair past key, or at it unless
+// strict.
+func (t *DiskTree[K, V]) skipTo(pairs []tree.LeafPair[K, V], key K, strict bool) int {
+	return sort.Search(len(pairs), func(i int) bool {
+		if strict {
+			return t.less(key, pairs[i].K)
+		}
+		return !t.less(pairs[i].K, key)
+	})
+}
+
+// settle follows the leaf chain while c.pos is past the end of its leaf, and
+// reports whether it found a pair. In each new leaf it skips to after, as
+// skipTo does; after is nil to take every pair.
+func (c *Cursor[K, V]) settle(after *K, strict bool) bool {
+	idx := c.t.indexFile
+	for c.pos >= len(c.leaf.Pairs) {
+		// the pinned leaf is whole, so its current link is safe to follow
+		if err := idx.readLeafInto(c.pageID, &c.scratch); err != nil {
+			c.err = err
+			c.release()
+			return false
+		}
+		next := c.scratch.GetNextPage()
+		if next == 0 {
+			c.release()
+			return false
+		}
+		idx.pin(next)
+		if err := idx.unpin(c.pageID); err != nil {
+			c.err = err
+		}
+		c.pageID = next
+		if err := idx.readLeafInto(next, &c.scratch); err != nil {
+			c.err = errors.Join(c.err, err)
+			c.release()
+			return false
+		}
+		c.leaf = &c.scratch
+		c.pos = 0
+		if after != nil {
+			c.pos = c.t.skipTo(c.leaf.Pairs, *after, strict)
+		}
+	}
+	return true
+}
+
+// Key returns the key the cursor is positioned on.
+func (c *Cursor[K, V]) Key() K {
+	return c.leaf.Pairs[c.pos].K
+}
+
+// Value returns the value the cursor is positioned on.
+func (c *Cursor[K, V]) Value() V {
+	return c.leaf.Pairs[c.pos].Value
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor[K, V]) Err() error {
+	return c.err
+}
+
+// Close releases the cursor's pin. The cursor can be positioned again.
+func (c *Cursor[K, V]) Close() error {
+	if err := c.release(); err != nil {
+		return err
+	}
+	return c.err
+}
+
+func (c *Cursor[K, V]) release() error {
+	if c.pageID == 0 {
+		return nil
+	}
+	err := c.t.indexFile.unpin(c.pageID)
+	c.pageID, c.leaf = 0, nil
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
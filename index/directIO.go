@@ -0,0 +1,161 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+/*
+Direct and synchronous I/O
+
+Options.Sync opens the index file with O_SYNC, so each write returns only
+once it is on stable storage. Options.Direct opens it with O_DIRECT where
+the platform has it (Linux): reads and writes bypass the OS page cache,
+so latency does not depend on what else the machine caches and memory is
+spent only on the page cache the index keeps itself (SetPageCache).
+
+The kernel takes O_DIRECT transfers only in whole blocks of directAlign
+bytes, from memory aligned the same way. Pages sit HeaderSize bytes off a
+block boundary and the header and free-list updates are smaller than a
+block, so every transfer goes through an aligned buffer: a write of part
+of a block reads the rest of it first. The file keeps its exact size.
+
+A page write therefore also rewrites the tail of the page before it and
+the head of the page after it, unchanged. A write torn by a crash can
+damage those neighbours as well as the page. With SetDoubleWrite the
+whole blocks are staged and restored (see "Double-write buffer"); without
+it, and for the writes a transaction applies, whose log holds only the
+bytes the transaction changed, a torn write is not recoverable.
+
+Both apply to single-file indexes only; segmented indexes always use
+buffered I/O.
+*/
+
+// Options are settings fixed when an index file is opened.
+type Options struct {
+	// ReadOnly opens the file under a shared lock, like OpenIndexFileReadOnly.
+	ReadOnly bool
+	// Sync opens the file with O_SYNC.
+	Sync bool
+	// Direct opens the file with O_DIRECT. It fails on platforms without it.
+	// Page writes rewrite the neighbouring pages' bytes in their blocks; a
+	// torn one is only recoverable with SetDoubleWrite.
+	Direct bool
+}
+
+// ErrDirectIOUnsupported is returned for Options.Direct on platforms without
+// O_DIRECT.
+var ErrDirectIOUnsupported = errors.New("direct I/O is not supported on this platform")
+
+// directAlign is the block size O_DIRECT transfers are aligned to.
+const directAlign = 4096
+
+// openFlags returns the os.OpenFile flags opts adds.
+func (opts Options) openFlags() (int, error) {
+	flag := 0
+	if opts.Sync {
+		flag |= os.O_SYNC
+	}
+	if opts.Direct {
+		if directFlag == 0 {
+			return 0, ErrDirectIOUnsupported
+		}
+		flag |= directFlag
+	}
+	return flag, nil
+}
+
+// storage wraps an opened file of the given size for the I/O opts asks for.
+func (opts Options) storage(f *os.File, size int64) storage {
+	if opts.Direct {
+		return &directStorage{fileStorage: fileStorage{f}, size: size}
+	}
+	return fileStorage{f}
+}
+
+// directStorage is storage on a file opened with O_DIRECT; see "Direct and
+// synchronous I/O" above.
+type directStorage struct {
+	fileStorage
+	mu   sync.Mutex // serializes writes, whose read-modify-write spans neighbouring pages
+	size int64
+}
+
+// alignedBuf returns n bytes of memory aligned to directAlign.
+func alignedBuf(n int) []byte {
+	b := make([]byte, n+directAlign)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % directAlign); rem != 0 {
+		skip = directAlign - rem
+	}
+	return b[skip : skip+n]
+}
+
+// blockSpan returns the block-aligned range covering n bytes at off.
+func blockSpan(off int64, n int) (start, end int64) {
+	start = off - off%directAlign
+	end = off + int64(n)
+	if rem := end % directAlign; rem != 0 {
+		end += directAlign - rem
+	}
+	return start, end
+}
+
+func (d *directStorage) ReadAt(p []byte, off int64) (int, error) {
+	start, end := blockSpan(off, len(p))
+	buf := alignedBuf(int(end - start))
+	n, err := d.File.ReadAt(buf, start)
+	n = copy(p, buf[min(int(off-start), n):n])
+	if n < len(p) {
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+func (d *directStorage) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start, end := blockSpan(off, len(p))
+	buf := alignedBuf(int(end - start))
+	if start < off || end > off+int64(len(p)) {
+		// keep the bytes of the partial blocks around p; past EOF they are zero
+		if _, err := d.File.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err := d.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	newSize := max(d.size, off+int64(len(p)))
+	if end > newSize {
+		// the last block ran past the end of the file; cut it back
+		if err := d.File.Truncate(newSize); err != nil {
+			return 0, err
+		}
+	}
+	d.size = newSize
+	return len(p), nil
+}
+
+func (d *directStorage) Size() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size, nil
+}
+
+func (d *directStorage) Truncate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.File.Truncate(size); err != nil {
+		return err
+	}
+	d.size = size
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build linux
+
+package index
+
+import "syscall"
+
+// directFlag is the open flag for direct I/O.
+const directFlag = syscall.O_DIRECT
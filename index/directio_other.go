@@ -0,0 +1,6 @@
+//go:build !linux
+
+package index
+
+// directFlag is 0 where direct I/O is not available.
+const directFlag = 0
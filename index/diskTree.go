@@ -3,23 +3,29 @@ package index
 import (
 	"errors"
 	"fmt"
+	"io"
+	"pranavdb/internal/failpoint"
+	"pranavdb/page"
 	"pranavdb/tree"
+	"pranavdb/txn"
 )
 
 // DiskTree represents a disk-based B+ tree that stores nodes in an IndexFile
 type DiskTree[K tree.Key, V any] struct {
 	indexFile *IndexFile[K, V]
 	order     int
+	compare   func(a, b K) int // set by the Ordered constructors; nil uses Less and Equal
 }
 
-// NewDiskTree creates a new disk-based B+ tree
-func NewDiskTree[K tree.Key, V any](filepath string, order int) (*DiskTree[K, V], error) {
+// NewDiskTree creates a new disk-based B+ tree. values encodes leaf values;
+// nil selects the built-in codec for V (string and uint64 are built in)
+func NewDiskTree[K tree.Key, V any](filepath string, order int, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
 	if order < 3 {
 		return nil, errors.New("order must be >= 3")
 	}
 
 	// Create the index file
-	indexFile, err := NewIndexFile[K, V](filepath, order)
+	indexFile, err := NewIndexFile[K](filepath, order, values)
 	if err != nil {
 		return nil, err
 	}
@@ -30,10 +36,106 @@ func NewDiskTree[K tree.Key, V any](filepath string, order int) (*DiskTree[K, V]
 	}, nil
 }
 
-// OpenDiskTree opens an existing disk-based B+ tree
-func OpenDiskTree[K tree.Key, V any](filepath string) (*DiskTree[K, V], error) {
+// NewDiskTreeWithOptions creates a disk-based B+ tree with the I/O settings
+// in opts, such as O_SYNC or O_DIRECT
+func NewDiskTreeWithOptions[K tree.Key, V any](filepath string, order int, values page.ValueCodec[V], opts Options) (*DiskTree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order must be >= 3")
+	}
+
+	indexFile, err := NewIndexFileWithOptions[K](filepath, order, values, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     order,
+	}, nil
+}
+
+// NewMemTree creates a B+ tree with the same on-page layout as a DiskTree but
+// kept in RAM, for tests and throwaway caches
+func NewMemTree[K tree.Key, V any](order int, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order must be >= 3")
+	}
+
+	indexFile, err := NewMemIndexFile[K](order, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     order,
+	}, nil
+}
+
+// NewSegmentedDiskTree creates a B+ tree stored in segment files of
+// segmentPages nodes each, "<filepath>.0001" onwards
+func NewSegmentedDiskTree[K tree.Key, V any](filepath string, order int, segmentPages uint32, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order must be >= 3")
+	}
+
+	indexFile, err := NewSegmentedIndexFile[K](filepath, order, segmentPages, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     order,
+	}, nil
+}
+
+// OpenSegmentedDiskTree opens an existing segmented B+ tree
+func OpenSegmentedDiskTree[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	indexFile, err := OpenSegmentedIndexFile[K](filepath, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     indexFile.GetOrder(),
+	}, nil
+}
+
+// OpenDiskTree opens an existing disk-based B+ tree; values must match the
+// codec the tree was written with
+func OpenDiskTree[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
 	// Open the index file
-	indexFile, err := OpenIndexFile[K, V](filepath)
+	indexFile, err := OpenIndexFile[K](filepath, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     indexFile.GetOrder(),
+	}, nil
+}
+
+// OpenDiskTreeWithOptions opens an existing B+ tree as configured by opts,
+// read-only or read-write
+func OpenDiskTreeWithOptions[K tree.Key, V any](filepath string, values page.ValueCodec[V], opts Options) (*DiskTree[K, V], error) {
+	indexFile, err := OpenIndexFileWithOptions[K](filepath, values, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskTree[K, V]{
+		indexFile: indexFile,
+		order:     indexFile.GetOrder(),
+	}, nil
+}
+
+// OpenDiskTreeReadOnly opens an existing tree for lookups only; other
+// read-only openers may share the file but writers are locked out
+func OpenDiskTreeReadOnly[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	indexFile, err := OpenIndexFileReadOnly[K](filepath, values)
 	if err != nil {
 		return nil, err
 	}
@@ -55,17 +157,144 @@ func (t *DiskTree[K, V]) GetOrder() int {
 }
 
 // GetRoot returns the current root page ID
-func (t *DiskTree[K, V]) GetRoot() uint32 {
+func (t *DiskTree[K, V]) GetRoot() uint64 {
 	return t.indexFile.GetRoot()
 }
 
-// Insert inserts a key-value pair into the tree
+// GetKeyCount returns the number of keys in the tree, read from the file header
+func (t *DiskTree[K, V]) GetKeyCount() uint64 {
+	return t.indexFile.GetKeyCount()
+}
+
+// GetHeight returns the number of levels in the tree
+func (t *DiskTree[K, V]) GetHeight() uint32 {
+	return t.indexFile.GetHeight()
+}
+
+// FragmentationReport reports the index file's live and free space
+func (t *DiskTree[K, V]) FragmentationReport() (page.FragmentationReport, error) {
+	return t.indexFile.FragmentationReport()
+}
+
+// Preallocate reserves file space for nPages more nodes ahead of a bulk load
+func (t *DiskTree[K, V]) Preallocate(nPages uint64) error {
+	return t.indexFile.Preallocate(nPages)
+}
+
+// SetDoubleWrite enables or disables torn-page protection for node writes
+func (t *DiskTree[K, V]) SetDoubleWrite(enabled bool) {
+	t.indexFile.SetDoubleWrite(enabled)
+}
+
+// StartFlusher buffers node writes in memory and writes them in the background
+func (t *DiskTree[K, V]) StartFlusher(opts FlushOptions) error {
+	return t.indexFile.StartFlusher(opts)
+}
+
+// SetPageCache keeps up to opts.Pages nodes in memory, within opts.Budget if set, evicted by opts.Policy
+func (t *DiskTree[K, V]) SetPageCache(opts CacheOptions) error {
+	return t.indexFile.SetPageCache(opts)
+}
+
+// Stats returns the node page read, cache and write-back counters
+func (t *DiskTree[K, V]) Stats() CacheStats {
+	return t.indexFile.Stats()
+}
+
+// Metrics returns the page counters of Stats plus allocation and free-list counts
+func (t *DiskTree[K, V]) Metrics() Metrics {
+	return t.indexFile.Metrics()
+}
+
+// PublishExpvar publishes Metrics as the expvar variable name
+func (t *DiskTree[K, V]) PublishExpvar(name string) error {
+	return t.indexFile.PublishExpvar(name)
+}
+
+// Flush writes all buffered nodes to disk
+func (t *DiskTree[K, V]) Flush() error {
+	return t.indexFile.Flush()
+}
+
+// FlushPage writes one buffered node to disk
+func (t *DiskTree[K, V]) FlushPage(pageID uint64) error {
+	return t.indexFile.FlushPage(pageID)
+}
+
+// DirtyPages returns the number of buffered nodes not yet written
+func (t *DiskTree[K, V]) DirtyPages() int {
+	return t.indexFile.DirtyPages()
+}
+
+// BeginTxn starts holding the tree's writes back for a txn.Txn
+func (t *DiskTree[K, V]) BeginTxn() error {
+	return t.indexFile.BeginTxn()
+}
+
+// TxnWrites returns the writes held since BeginTxn
+func (t *DiskTree[K, V]) TxnWrites() ([]txn.Write, error) {
+	return t.indexFile.TxnWrites()
+}
+
+// ApplyTxn writes the changes held since BeginTxn, keeping the transaction open
+func (t *DiskTree[K, V]) ApplyTxn() error {
+	return t.indexFile.ApplyTxn()
+}
+
+// EndTxn applies or drops the writes held since BeginTxn
+func (t *DiskTree[K, V]) EndTxn(commit bool) error {
+	return t.indexFile.EndTxn(commit)
+}
+
+// ViewTxn opens a read-only copy of the tree as of its last commit, for a
+// txn.Log's View.
+func (t *DiskTree[K, V]) ViewTxn() (io.Closer, error) {
+	indexFile, err := t.indexFile.ViewTxn()
+	if err != nil {
+		return nil, err
+	}
+	return &DiskTree[K, V]{indexFile: indexFile, order: t.order, compare: t.compare}, nil
+}
+
+// BatchInsert records an Insert of key and value in b, to run when b
+// commits
+func (t *DiskTree[K, V]) BatchInsert(b *txn.WriteBatch, key K, value V) {
+	b.Add(func() error { return t.Insert(key, value) }, t)
+}
+
+// BatchDelete records a Delete of key in b, to run when b commits
+func (t *DiskTree[K, V]) BatchDelete(b *txn.WriteBatch, key K) {
+	b.Add(func() error { return t.Delete(key) }, t)
+}
+
+// BatchHeaderWrites runs fn with index header writes deferred until it
+// returns, so a run of inserts/deletes costs a single header write. A crash
+// inside fn leaves the on-disk header from before the batch.
+func (t *DiskTree[K, V]) BatchHeaderWrites(fn func() error) error {
+	return t.indexFile.withHeaderBatch(fn)
+}
+
+// Insert inserts a key-value pair into the tree. Keys and values too large
+// for the tree's order fail with ErrKeyTooLarge or ErrValueTooLarge.
 func (t *DiskTree[K, V]) Insert(key K, value V) error {
+	if err := t.checkPairSize(key, value); err != nil {
+		return err
+	}
+	return t.indexFile.withOperation(func() error {
+		return t.insert(key, value)
+	})
+}
+
+// insert does the work of Insert; node and header writes are batched by the caller
+func (t *DiskTree[K, V]) insert(key K, value V) error {
 	rootPageID := t.indexFile.GetRoot()
 
 	if rootPageID == 0 {
 		// First insertion - create root leaf node
-		return t.createFirstRoot(key, value)
+		if err := t.createFirstRoot(key, value); err != nil {
+			return err
+		}
+		return t.indexFile.addKeys(1)
 	}
 
 	// Load root node
@@ -81,11 +310,14 @@ func (t *DiskTree[K, V]) Insert(key K, value V) error {
 	}
 
 	if promotedKey == nil && newRightPageID == 0 {
-		return nil // No split occurred
+		return t.indexFile.addKeys(1) // No split occurred
 	}
 
 	// Root was split - create new root
-	return t.createNewRoot(promotedKey, rootPageID, newRightPageID)
+	if err := t.createNewRoot(promotedKey, rootPageID, newRightPageID); err != nil {
+		return err
+	}
+	return t.indexFile.addKeys(1)
 }
 
 // createFirstRoot creates the first root node (leaf node)
@@ -109,15 +341,18 @@ func (t *DiskTree[K, V]) createFirstRoot(key K, value V) error {
 	}
 
 	// Update root pointer
-	return t.indexFile.SetRoot(rootPageID)
+	if err := t.indexFile.SetRoot(rootPageID); err != nil {
+		return err
+	}
+	return t.indexFile.setHeight(1)
 }
 
 // createNewRoot creates a new root when the old root splits
-func (t *DiskTree[K, V]) createNewRoot(promotedKey *K, leftPageID, rightPageID uint32) error {
+func (t *DiskTree[K, V]) createNewRoot(promotedKey *K, leftPageID, rightPageID uint64) error {
 	// Create internal node
 	interm := &tree.IntermNode[K, V]{
 		Keys:     []K{*promotedKey},
-		Pointers: []uint32{leftPageID, rightPageID},
+		Pointers: []uint64{leftPageID, rightPageID},
 	}
 
 	// Allocate page for new root
@@ -131,12 +366,19 @@ func (t *DiskTree[K, V]) createNewRoot(promotedKey *K, leftPageID, rightPageID u
 		return err
 	}
 
+	if err := failpoint.Inject("before-new-root"); err != nil {
+		return err
+	}
+
 	// Update root pointer
-	return t.indexFile.SetRoot(rootPageID)
+	if err := t.indexFile.SetRoot(rootPageID); err != nil {
+		return err
+	}
+	return t.indexFile.setHeight(t.indexFile.GetHeight() + 1)
 }
 
 // insertRecursive recursively inserts a key-value pair and handles splits
-func (t *DiskTree[K, V]) insertRecursive(key K, value V, node tree.Node[V], pageID uint32) (*K, uint32, error) {
+func (t *DiskTree[K, V]) insertRecursive(key K, value V, node tree.Node[V], pageID uint64) (*K, uint64, error) {
 	// Check if it's a leaf node using type assertion
 	if _, ok := node.(*tree.LeafNode[K, V]); ok {
 		return t.insertIntoLeaf(key, value, node, pageID)
@@ -145,7 +387,7 @@ func (t *DiskTree[K, V]) insertRecursive(key K, value V, node tree.Node[V], page
 }
 
 // insertIntoLeaf handles insertion into a leaf node
-func (t *DiskTree[K, V]) insertIntoLeaf(key K, value V, node tree.Node[V], pageID uint32) (*K, uint32, error) {
+func (t *DiskTree[K, V]) insertIntoLeaf(key K, value V, node tree.Node[V], pageID uint64) (*K, uint64, error) {
 	leaf, ok := node.(*tree.LeafNode[K, V])
 	if !ok {
 		return nil, 0, errors.New("expected leaf node")
@@ -155,12 +397,12 @@ func (t *DiskTree[K, V]) insertIntoLeaf(key K, value V, node tree.Node[V], pageI
 	index := t.leafUpperBound(key, leaf.Pairs)
 
 	// Check for duplicate
-	if index < len(leaf.Pairs) && leaf.Pairs[index].K.Equal(key) {
+	if index < len(leaf.Pairs) && t.equal(leaf.Pairs[index].K, key) {
 		return nil, 0, errors.New("duplicate key")
 	}
 
 	// Insert new key-value
-	newElem := tree.LeafPair[K, V]{key, value}
+	newElem := tree.LeafPair[K, V]{K: key, Value: value}
 	newSlice := insertAt(leaf.Pairs, index, newElem)
 
 	// No split
@@ -207,6 +449,9 @@ func (t *DiskTree[K, V]) insertIntoLeaf(key K, value V, node tree.Node[V], pageI
 	if err := t.indexFile.writeNode(leaf, pageID); err != nil {
 		return nil, 0, err
 	}
+	if err := failpoint.Inject("after-split-left-write"); err != nil {
+		return nil, 0, err
+	}
 	if err := t.indexFile.writeNode(rightLeaf, rightPageID); err != nil {
 		return nil, 0, err
 	}
@@ -217,7 +462,7 @@ func (t *DiskTree[K, V]) insertIntoLeaf(key K, value V, node tree.Node[V], pageI
 }
 
 // insertIntoInternal handles insertion into an internal node
-func (t *DiskTree[K, V]) insertIntoInternal(key K, value V, node tree.Node[V], pageID uint32) (*K, uint32, error) {
+func (t *DiskTree[K, V]) insertIntoInternal(key K, value V, node tree.Node[V], pageID uint64) (*K, uint64, error) {
 	interm, ok := node.(*tree.IntermNode[K, V])
 	if !ok {
 		return nil, 0, errors.New("expected internal node")
@@ -271,6 +516,9 @@ func (t *DiskTree[K, V]) insertIntoInternal(key K, value V, node tree.Node[V], p
 	if err := t.indexFile.writeNode(interm, pageID); err != nil {
 		return nil, 0, err
 	}
+	if err := failpoint.Inject("after-split-internal-left-write"); err != nil {
+		return nil, 0, err
+	}
 
 	// Create right internal node
 	rightInterm := &tree.IntermNode[K, V]{
@@ -331,32 +579,28 @@ func (t *DiskTree[K, V]) RangeSearch(startKey, endKey K) ([]tree.LeafPair[K, V],
 	}
 
 	var results []tree.LeafPair[K, V]
+	var scratch tree.LeafNode[K, V] // later leaves are decoded into this
 	currentLeaf := leftmostLeaf
 
 	// Traverse leaf nodes and collect results
 	for currentLeaf != nil {
 		for _, pair := range currentLeaf.Pairs {
 			// Check if key is in range [startKey, endKey)
-			if !pair.K.Less(startKey) && pair.K.Less(endKey) {
+			if !t.less(pair.K, startKey) && t.less(pair.K, endKey) {
 				results = append(results, pair)
 			}
 			// If we've passed endKey, we're done
-			if !pair.K.Less(endKey) {
+			if !t.less(pair.K, endKey) {
 				return results, nil
 			}
 		}
 
 		// Move to next leaf
 		if currentLeaf.GetNextPage() != 0 {
-			nextLeaf, err := t.indexFile.readNode(currentLeaf.GetNextPage())
-			if err != nil {
+			if err := t.indexFile.readLeafInto(currentLeaf.GetNextPage(), &scratch); err != nil {
 				return nil, fmt.Errorf("failed to load next leaf: %w", err)
 			}
-			nextLeafNode, ok := nextLeaf.(*tree.LeafNode[K, V])
-			if !ok {
-				return nil, errors.New("expected leaf node")
-			}
-			currentLeaf = nextLeafNode
+			currentLeaf = &scratch
 		} else {
 			currentLeaf = nil // No more leaves
 		}
@@ -483,10 +727,11 @@ func (t *DiskTree[K, V]) leafBinarySearch(key K, pairs []tree.LeafPair[K, V]) in
 
 	for left <= right {
 		mid := left + (right-left)/2
-		if pairs[mid].K.Equal(key) {
+		c := t.cmp(pairs[mid].K, key)
+		if c == 0 {
 			return mid
 		}
-		if pairs[mid].K.Less(key) {
+		if c < 0 {
 			left = mid + 1
 		} else {
 			right = mid - 1
@@ -503,7 +748,7 @@ func (t *DiskTree[K, V]) leafUpperBound(key K, pairs []tree.LeafPair[K, V]) int
 
 	for left < right {
 		mid := left + (right-left)/2
-		if pairs[mid].K.Less(key) {
+		if t.less(pairs[mid].K, key) {
 			left = mid + 1
 		} else {
 			right = mid
@@ -519,7 +764,7 @@ func (t *DiskTree[K, V]) upperBound(key K, keys []K) int {
 	for left < right {
 		mid := left + (right-left)/2
 		// if key >= keys[mid] then go right
-		if !key.Less(keys[mid]) { // key >= keys[mid]
+		if !t.less(key, keys[mid]) { // key >= keys[mid]
 			left = mid + 1
 		} else {
 			right = mid
@@ -557,7 +802,7 @@ func (t *DiskTree[K, V]) Print() error {
 
 	type LevelNode struct {
 		node   tree.Node[V]
-		pageID uint32
+		pageID uint64
 		level  int
 	}
 
@@ -614,6 +859,13 @@ func (t *DiskTree[K, V]) Print() error {
 
 // Delete removes a key-value pair from the disk B+ tree.
 func (t *DiskTree[K, V]) Delete(key K) error {
+	return t.indexFile.withOperation(func() error {
+		return t.delete(key)
+	})
+}
+
+// delete does the work of Delete; node and header writes are batched by the caller
+func (t *DiskTree[K, V]) delete(key K) error {
 	// Check empty
 	rootPageID := t.indexFile.GetRoot()
 	if rootPageID == 0 {
@@ -646,16 +898,21 @@ func (t *DiskTree[K, V]) Delete(key K) error {
 				}
 				// Optionally free old root page
 				//tryFreePage(t.indexFile, rootPageID)
-				t.indexFile.freePage(rootPageID)
+				if err := t.indexFile.freePage(rootPageID); err != nil {
+					return err
+				}
+				if err := t.indexFile.setHeight(t.indexFile.GetHeight() - 1); err != nil {
+					return err
+				}
 			}
 		}
 	}
 
-	return nil
+	return t.indexFile.addKeys(-1)
 }
 
 // deleteRecursive deletes key starting at pageID. Returns whether caller (this node) underflows.
-func (t *DiskTree[K, V]) deleteRecursive(key K, pageID uint32) (bool, error) {
+func (t *DiskTree[K, V]) deleteRecursive(key K, pageID uint64) (bool, error) {
 	node, err := t.indexFile.readNode(pageID)
 	if err != nil {
 		return false, err
@@ -667,7 +924,7 @@ func (t *DiskTree[K, V]) deleteRecursive(key K, pageID uint32) (bool, error) {
 	return t.deleteFromInternal(key, node.(*tree.IntermNode[K, V]), pageID)
 }
 
-func (t *DiskTree[K, V]) deleteFromLeaf(key K, leaf *tree.LeafNode[K, V], pageID uint32) (bool, error) {
+func (t *DiskTree[K, V]) deleteFromLeaf(key K, leaf *tree.LeafNode[K, V], pageID uint64) (bool, error) {
 	// Find the key to delete using exact-match binary search
 	index := t.leafBinarySearch(key, leaf.Pairs)
 	if index == -1 {
@@ -689,7 +946,7 @@ func (t *DiskTree[K, V]) deleteFromLeaf(key K, leaf *tree.LeafNode[K, V], pageID
 }
 
 // deleteFromInternal handles deletion from an internal node.
-func (t *DiskTree[K, V]) deleteFromInternal(key K, interm *tree.IntermNode[K, V], pageID uint32) (bool, error) {
+func (t *DiskTree[K, V]) deleteFromInternal(key K, interm *tree.IntermNode[K, V], pageID uint64) (bool, error) {
 	// choose child (use same upperBound semantics used elsewhere)
 	childIndex := t.upperBound(key, interm.Keys)
 	if childIndex >= len(interm.Pointers) {
@@ -714,7 +971,7 @@ func (t *DiskTree[K, V]) deleteFromInternal(key K, interm *tree.IntermNode[K, V]
 }
 
 // handleUnderflow tries borrow from siblings or merges and returns whether this node underflows.
-func (t *DiskTree[K, V]) handleUnderflow(node *tree.IntermNode[K, V], nodePageID uint32, childIndex int) (bool, error) {
+func (t *DiskTree[K, V]) handleUnderflow(node *tree.IntermNode[K, V], nodePageID uint64, childIndex int) (bool, error) {
 	// try borrow from left sibling
 	if childIndex > 0 {
 		leftPageID := node.Pointers[childIndex-1]
@@ -752,7 +1009,7 @@ func (t *DiskTree[K, V]) handleUnderflow(node *tree.IntermNode[K, V], nodePageID
 		}
 		// Remove separator key and pointer for childIndex
 		node.Keys = removeAtK(node.Keys, childIndex-1)
-		node.Pointers = removeAtUint32(node.Pointers, childIndex)
+		node.Pointers = removeAtUint64(node.Pointers, childIndex)
 		// write node
 		if err := t.indexFile.writeNode(node, nodePageID); err != nil {
 			return false, err
@@ -764,7 +1021,7 @@ func (t *DiskTree[K, V]) handleUnderflow(node *tree.IntermNode[K, V], nodePageID
 		}
 		// remove separator key at childIndex and remove right pointer
 		node.Keys = removeAtK(node.Keys, childIndex)
-		node.Pointers = removeAtUint32(node.Pointers, childIndex+1)
+		node.Pointers = removeAtUint64(node.Pointers, childIndex+1)
 		if err := t.indexFile.writeNode(node, nodePageID); err != nil {
 			return false, err
 		}
@@ -781,7 +1038,7 @@ func (t *DiskTree[K, V]) handleUnderflow(node *tree.IntermNode[K, V], nodePageID
 }
 
 // canBorrowFrom checks if the node at page has > minKeys (so can lend)
-func (t *DiskTree[K, V]) canBorrowFrom(pageID uint32) bool {
+func (t *DiskTree[K, V]) canBorrowFrom(pageID uint64) bool {
 	n, err := t.indexFile.readNode(pageID)
 	if err != nil {
 		// if we can't read treat as not borrowable
@@ -799,7 +1056,7 @@ func (t *DiskTree[K, V]) canBorrowFrom(pageID uint32) bool {
 }
 
 // borrowFromLeft borrows one item from left sibling into child at childIndex.
-func (t *DiskTree[K, V]) borrowFromLeft(parent *tree.IntermNode[K, V], parentPageID uint32, childIndex int) error {
+func (t *DiskTree[K, V]) borrowFromLeft(parent *tree.IntermNode[K, V], parentPageID uint64, childIndex int) error {
 	leftPageID := parent.Pointers[childIndex-1]
 	childPageID := parent.Pointers[childIndex]
 
@@ -838,14 +1095,16 @@ func (t *DiskTree[K, V]) borrowFromLeft(parent *tree.IntermNode[K, V], parentPag
 	leftInterm := leftNode.(*tree.IntermNode[K, V])
 	childInterm := childNode.(*tree.IntermNode[K, V])
 
-	// move rightmost key/pointer from leftInterm to front of childInterm
+	// rotate right through the parent: the separator moves down to the
+	// front of childInterm, in front of leftInterm's last pointer, and
+	// leftInterm's last key moves up to replace it
 	bKey := leftInterm.Keys[len(leftInterm.Keys)-1]
 	bPtr := leftInterm.Pointers[len(leftInterm.Pointers)-1]
 	leftInterm.Keys = leftInterm.Keys[:len(leftInterm.Keys)-1]
 	leftInterm.Pointers = leftInterm.Pointers[:len(leftInterm.Pointers)-1]
 
-	childInterm.Keys = insertAt(childInterm.Keys, 0, bKey)
-	childInterm.Pointers = insertAtUint32(childInterm.Pointers, 0, bPtr)
+	childInterm.Keys = insertAt(childInterm.Keys, 0, parent.Keys[childIndex-1])
+	childInterm.Pointers = insertAtUint64(childInterm.Pointers, 0, bPtr)
 
 	// update parent separator
 	parent.Keys[childIndex-1] = bKey
@@ -861,7 +1120,7 @@ func (t *DiskTree[K, V]) borrowFromLeft(parent *tree.IntermNode[K, V], parentPag
 }
 
 // borrowFromRight borrows one item from right sibling into child at childIndex.
-func (t *DiskTree[K, V]) borrowFromRight(parent *tree.IntermNode[K, V], parentPageID uint32, childIndex int) error {
+func (t *DiskTree[K, V]) borrowFromRight(parent *tree.IntermNode[K, V], parentPageID uint64, childIndex int) error {
 	rightPageID := parent.Pointers[childIndex+1]
 	childPageID := parent.Pointers[childIndex]
 
@@ -904,19 +1163,19 @@ func (t *DiskTree[K, V]) borrowFromRight(parent *tree.IntermNode[K, V], parentPa
 	rightInterm := rightNode.(*tree.IntermNode[K, V])
 	childInterm := childNode.(*tree.IntermNode[K, V])
 
-	// move leftmost key/pointer from rightInterm to end of childInterm
+	// rotate left through the parent: the separator moves down to the end
+	// of childInterm, behind rightInterm's first pointer, and rightInterm's
+	// first key moves up to replace it
 	bKey := rightInterm.Keys[0]
 	bPtr := rightInterm.Pointers[0]
 	rightInterm.Keys = rightInterm.Keys[1:]
 	rightInterm.Pointers = rightInterm.Pointers[1:]
 
-	childInterm.Keys = append(childInterm.Keys, bKey)
+	childInterm.Keys = append(childInterm.Keys, parent.Keys[childIndex])
 	childInterm.Pointers = append(childInterm.Pointers, bPtr)
 
-	// update parent separator to reflect new smallest in rightInterm
-	if len(rightInterm.Keys) > 0 {
-		parent.Keys[childIndex] = rightInterm.Keys[0]
-	}
+	// update parent separator
+	parent.Keys[childIndex] = bKey
 
 	// write modified nodes
 	if err := t.indexFile.writeNode(rightInterm, rightPageID); err != nil {
@@ -929,7 +1188,7 @@ func (t *DiskTree[K, V]) borrowFromRight(parent *tree.IntermNode[K, V], parentPa
 }
 
 // mergeLeft merges child at childIndex into left sibling (childIndex-1)
-func (t *DiskTree[K, V]) mergeLeft(parent *tree.IntermNode[K, V], parentPageID uint32, childIndex int) error {
+func (t *DiskTree[K, V]) mergeLeft(parent *tree.IntermNode[K, V], parentPageID uint64, childIndex int) error {
 	leftPageID := parent.Pointers[childIndex-1]
 	childPageID := parent.Pointers[childIndex]
 
@@ -975,8 +1234,7 @@ func (t *DiskTree[K, V]) mergeLeft(parent *tree.IntermNode[K, V], parentPageID u
 			return err
 		}
 		//tryFreePage(t.indexFile, childPageID)
-		t.indexFile.freePage(childPageID)
-		return nil
+		return t.indexFile.freePage(childPageID)
 	}
 
 	// internal nodes: move separator key and child's keys/pointers
@@ -999,12 +1257,11 @@ func (t *DiskTree[K, V]) mergeLeft(parent *tree.IntermNode[K, V], parentPageID u
 		return err
 	}
 	//tryFreePage(t.indexFile, childPageID)
-	t.indexFile.freePage(childPageID)
-	return nil
+	return t.indexFile.freePage(childPageID)
 }
 
 // mergeRight merges right sibling into child at childIndex
-func (t *DiskTree[K, V]) mergeRight(parent *tree.IntermNode[K, V], parentPageID uint32, childIndex int) error {
+func (t *DiskTree[K, V]) mergeRight(parent *tree.IntermNode[K, V], parentPageID uint64, childIndex int) error {
 	childPageID := parent.Pointers[childIndex]
 	rightPageID := parent.Pointers[childIndex+1]
 
@@ -1047,8 +1304,7 @@ func (t *DiskTree[K, V]) mergeRight(parent *tree.IntermNode[K, V], parentPageID
 			return err
 		}
 		//tryFreePage(t.indexFile, rightPageID)
-		t.indexFile.freePage(rightPageID)
-		return nil
+		return t.indexFile.freePage(rightPageID)
 	}
 
 	// internal nodes
@@ -1072,9 +1328,7 @@ func (t *DiskTree[K, V]) mergeRight(parent *tree.IntermNode[K, V], parentPageID
 		return err
 	}
 	//tryFreePage(t.indexFile, rightPageID)
-	t.indexFile.freePage(rightPageID)
-
-	return nil
+	return t.indexFile.freePage(rightPageID)
 }
 
 
@@ -1096,18 +1350,18 @@ func removeAtK[K tree.Key](s []K, i int) []K {
 	return append(s[:i], s[i+1:]...)
 }
 
-func removeAtUint32(s []uint32, i int) []uint32 {
+func removeAtUint64(s []uint64, i int) []uint64 {
 	if i < 0 || i >= len(s) {
 		return s
 	}
 	return append(s[:i], s[i+1:]...)
 }
 
-func insertAtUint32(s []uint32, i int, v uint32) []uint32 {
+func insertAtUint64(s []uint64, i int, v uint64) []uint64 {
 	if i < 0 || i > len(s) {
 		return s
 	}
-	res := make([]uint32, len(s)+1)
+	res := make([]uint64, len(s)+1)
 	copy(res[:i], s[:i])
 	res[i] = v
 	copy(res[i+1:], s[i:])
@@ -0,0 +1,277 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"pranavdb/page"
+)
+
+/*
+Double-write buffer
+
+Page slot 0 is never handed out by allocatePage, so it doubles as a scratch
+area. With double-write enabled every page write goes:
+
+ 1. copy the page into slot 0
+ 2. record (target pageID, crc32 of the page) in the header
+ 3. fsync
+ 4. write the page to its real offset and fsync
+ 5. clear the header record
+
+A crash during step 4 leaves a torn page, but the header record still points
+at a complete copy in slot 0, so recoverDoubleWrite re-applies it on open. A
+crash before step 3 completes leaves a record whose crc does not match slot 0;
+the real page was never touched and the record is discarded.
+
+Under Options.Direct a page write rewrites the whole directAlign blocks the
+page touches, so the tail of the page before it and the head of the page
+after it go to disk again too (see "Direct and synchronous I/O"). Slot 0
+cannot stage such a span, since its own blocks hold the header and page 1,
+so there steps 1 and 4 stage and write the whole span instead, through a
+file beside the index named with doubleWriteSpanSuffix, and the crc in the
+record covers the span. Step 5 removes that file again.
+*/
+
+const (
+	doubleWriteSlot   = 0
+	doubleWriteOffset = 80 // header bytes 80..91: pageID(8) + crc32(4)
+
+	doubleWriteSpanSuffix = ".dwspan"
+)
+
+// SetDoubleWrite turns torn-page protection on or off. It costs two fsyncs
+// per page write, so bulk loads may want to leave it disabled.
+func (idx *IndexFile[K, V]) SetDoubleWrite(enabled bool) {
+	idx.doubleWrite = enabled
+}
+
+// pageOffset returns the file offset of a page slot.
+func pageOffset(pageID uint64) int64 {
+	return int64(HeaderSize) + int64(pageID)*page.PageSize
+}
+
+// writePage writes a full physical page, handing it to the flusher when one is
+// running, and keeps the page cache in step.
+func (idx *IndexFile[K, V]) writePage(pageID uint64, buf []byte) error {
+	var err error
+	if idx.flusher != nil {
+		err = idx.flusher.put(pageID, buf)
+	} else {
+		err = idx.writePageNow(pageID, buf)
+	}
+	if idx.cache != nil {
+		if err == nil && len(buf) == page.PageSize {
+			idx.cache.put(pageID, buf)
+			idx.cache.invalidate()
+		} else {
+			idx.cache.drop(pageID)
+		}
+	}
+	return err
+}
+
+// readPage fills buf from the start of a page, preferring a buffered copy,
+// then a cached one.
+func (idx *IndexFile[K, V]) readPage(pageID uint64, buf []byte) error {
+	idx.counters.reads.Add(1)
+	if idx.cache != nil {
+		if from, to, ok := idx.cache.readAheadRange(pageID); ok {
+			defer idx.readAhead(from, to)
+		}
+	}
+	if idx.flusher != nil && idx.flusher.get(pageID, buf) {
+		idx.counters.hits.Add(1)
+		return nil
+	}
+	if idx.cache != nil {
+		return idx.cachedRead(pageID, buf)
+	}
+	idx.counters.misses.Add(1)
+	_, err := idx.file.ReadAt(buf, pageOffset(pageID))
+	return err
+}
+
+// writePageNow writes a page to the file, staging it through the double-write
+// slot when enabled.
+func (idx *IndexFile[K, V]) writePageNow(pageID uint64, buf []byte) error {
+	if idx.readOnly {
+		return ErrReadOnly
+	}
+	idx.counters.writeBacks.Add(1)
+	if idx.cache != nil {
+		// once written; see "Read-ahead" in prefetch.go
+		defer idx.cache.invalidate()
+	}
+	if !idx.doubleWrite {
+		_, err := idx.file.WriteAt(buf, pageOffset(pageID))
+		return err
+	}
+	if d, ok := idx.file.(*directStorage); ok {
+		return idx.writeSpanNow(d.Name(), pageID, buf)
+	}
+
+	if _, err := idx.file.WriteAt(buf, pageOffset(doubleWriteSlot)); err != nil {
+		return fmt.Errorf("double-write: stage page %d: %w", pageID, err)
+	}
+	if err := idx.writeDoubleWriteRecord(pageID, crc32.ChecksumIEEE(buf)); err != nil {
+		return err
+	}
+	if err := idx.file.Sync(); err != nil {
+		return fmt.Errorf("double-write: sync staged page %d: %w", pageID, err)
+	}
+
+	if _, err := idx.file.WriteAt(buf, pageOffset(pageID)); err != nil {
+		return err
+	}
+	if err := idx.file.Sync(); err != nil {
+		return fmt.Errorf("double-write: sync page %d: %w", pageID, err)
+	}
+	return idx.writeDoubleWriteRecord(0, 0)
+}
+
+// writeSpanNow is writePageNow's double-write under Options.Direct: it stages
+// and writes every block the page touches.
+func (idx *IndexFile[K, V]) writeSpanNow(path string, pageID uint64, buf []byte) error {
+	start, end := blockSpan(pageOffset(pageID), len(buf))
+	span := make([]byte, end-start)
+	if _, err := idx.file.ReadAt(span, start); err != nil && err != io.EOF {
+		return fmt.Errorf("double-write: read blocks of page %d: %w", pageID, err)
+	}
+	copy(span[pageOffset(pageID)-start:], buf)
+
+	if err := stageSpan(path+doubleWriteSpanSuffix, span); err != nil {
+		return fmt.Errorf("double-write: stage page %d: %w", pageID, err)
+	}
+	if err := idx.writeDoubleWriteRecord(pageID, crc32.ChecksumIEEE(span)); err != nil {
+		return err
+	}
+	if err := idx.file.Sync(); err != nil {
+		return fmt.Errorf("double-write: sync staged page %d: %w", pageID, err)
+	}
+
+	if err := idx.writeSpan(pageID, span); err != nil {
+		return err
+	}
+	if err := idx.file.Sync(); err != nil {
+		return fmt.Errorf("double-write: sync page %d: %w", pageID, err)
+	}
+	if err := idx.writeDoubleWriteRecord(0, 0); err != nil {
+		return err
+	}
+	return os.Remove(path + doubleWriteSpanSuffix)
+}
+
+// stageSpan writes span to the file at path and syncs it.
+func stageSpan(path string, span []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(span); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSpan writes the blocks of page pageID from span, leaving out the part
+// past both the page and the end of the file.
+func (idx *IndexFile[K, V]) writeSpan(pageID uint64, span []byte) error {
+	start, _ := blockSpan(pageOffset(pageID), page.PageSize)
+	size, err := idx.file.Size()
+	if err != nil {
+		return err
+	}
+	end := min(start+int64(len(span)), max(size, pageOffset(pageID+1)))
+	_, err = idx.file.WriteAt(span[:end-start], start)
+	return err
+}
+
+func (idx *IndexFile[K, V]) writeDoubleWriteRecord(pageID uint64, checksum uint32) error {
+	rec := make([]byte, 12)
+	binary.LittleEndian.PutUint64(rec[0:8], pageID)
+	binary.LittleEndian.PutUint32(rec[8:12], checksum)
+	if _, err := idx.file.WriteAt(rec, doubleWriteOffset); err != nil {
+		return fmt.Errorf("double-write: write record: %w", err)
+	}
+	return nil
+}
+
+// pendingDoubleWrite returns the page ID recorded in the header, or 0 if none.
+func (idx *IndexFile[K, V]) pendingDoubleWrite() (pageID uint64, checksum uint32, err error) {
+	rec := make([]byte, 12)
+	if _, err := idx.file.ReadAt(rec, doubleWriteOffset); err != nil {
+		return 0, 0, err
+	}
+	return binary.LittleEndian.Uint64(rec[0:8]), binary.LittleEndian.Uint32(rec[8:12]), nil
+}
+
+// recoverDoubleWrite re-applies a staged page or block span left behind by a
+// crash.
+func (idx *IndexFile[K, V]) recoverDoubleWrite() error {
+	pageID, checksum, err := idx.pendingDoubleWrite()
+	if err != nil {
+		return err
+	}
+	// a span staged under Options.Direct; the file may be reopened without it
+	var spanPath string
+	switch f := idx.file.(type) {
+	case fileStorage:
+		spanPath = f.Name() + doubleWriteSpanSuffix
+	case *directStorage:
+		spanPath = f.Name() + doubleWriteSpanSuffix
+	}
+	if pageID == 0 {
+		return removeSpan(spanPath)
+	}
+
+	buf := make([]byte, page.PageSize)
+	if _, err := idx.file.ReadAt(buf, pageOffset(doubleWriteSlot)); err != nil {
+		return fmt.Errorf("read staged page: %w", err)
+	}
+
+	// Only a complete staged copy is trusted; otherwise the target was never written.
+	if crc32.ChecksumIEEE(buf) == checksum {
+		if _, err := idx.file.WriteAt(buf, pageOffset(pageID)); err != nil {
+			return fmt.Errorf("restore page %d: %w", pageID, err)
+		}
+		if err := idx.file.Sync(); err != nil {
+			return err
+		}
+	} else if spanPath != "" {
+		span, err := os.ReadFile(spanPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read staged blocks: %w", err)
+		}
+		if len(span) > 0 && crc32.ChecksumIEEE(span) == checksum {
+			if err := idx.writeSpan(pageID, span); err != nil {
+				return fmt.Errorf("restore blocks of page %d: %w", pageID, err)
+			}
+			if err := idx.file.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := idx.writeDoubleWriteRecord(0, 0); err != nil {
+		return err
+	}
+	return removeSpan(spanPath)
+}
+
+// removeSpan removes the staged span file at path, if there is one.
+func removeSpan(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
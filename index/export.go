@@ -0,0 +1,155 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"pranavdb/page"
+	"pranavdb/tree"
+)
+
+/*
+Sorted export stream
+
+ExportSorted writes every pair in ascending key order:
+
+	magic   [4]byte  "BPXS"
+	version uint8    exportVersion
+	records, each:
+	  length uint32  size of the pair encoding that follows (never 0)
+	  pair   []byte  key + value, encoded as on a leaf page (IndexPageCodec.EncodePair)
+	end     uint32   0
+
+All integers are little-endian. The stream carries no schema; the reader must
+use the same K and V as the writer.
+*/
+
+var exportMagic = [4]byte{'B', 'P', 'X', 'S'}
+
+const exportVersion = 2 // 2: untagged keys
+
+// Scan calls fn for every key-value pair in ascending key order, following
+// the leaf chain. Returning an error from fn stops the scan and returns it.
+func (t *DiskTree[K, V]) Scan(fn func(key K, value V) error) error {
+	rootPageID := t.indexFile.GetRoot()
+	if rootPageID == 0 {
+		return nil
+	}
+
+	root, err := t.indexFile.readNode(rootPageID)
+	if err != nil {
+		return fmt.Errorf("failed to load root node: %w", err)
+	}
+	leaf, err := t.findLeftmostLeaf(root)
+	if err != nil {
+		return err
+	}
+
+	// later leaves are decoded into one scratch leaf, so a long scan does
+	// not allocate a node per page
+	var scratch tree.LeafNode[K, V]
+	for {
+		for _, pair := range leaf.Pairs {
+			if err := fn(pair.K, pair.Value); err != nil {
+				return err
+			}
+		}
+		if leaf.GetNextPage() == 0 {
+			return nil
+		}
+		if err := t.indexFile.readLeafInto(leaf.GetNextPage(), &scratch); err != nil {
+			return fmt.Errorf("failed to load next leaf: %w", err)
+		}
+		leaf = &scratch
+	}
+}
+
+// ExportSorted writes all pairs to w in the sorted export format described
+// above, for offline rebuilds and format migrations.
+func (t *DiskTree[K, V]) ExportSorted(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.Write(exportMagic[:]); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(exportVersion); err != nil {
+		return err
+	}
+
+	codec := t.indexFile.codec
+	lenBuf := make([]byte, 4)
+	err := t.Scan(func(key K, value V) error {
+		pair, err := codec.EncodePair(key, value)
+		if err != nil {
+			return fmt.Errorf("ExportSorted: encode key %v: %w", key, err)
+		}
+		binary.LittleEndian.PutUint32(lenBuf, uint32(len(pair)))
+		if _, err := bw.Write(lenBuf); err != nil {
+			return err
+		}
+		_, err = bw.Write(pair)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(lenBuf, 0)
+	if _, err := bw.Write(lenBuf); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadSortedExport reads a stream written by ExportSorted and calls fn for
+// each pair in the order they were written. values must match the codec of
+// the exporting tree (nil for the built-in one).
+func ReadSortedExport[K tree.Key, V any](r io.Reader, values page.ValueCodec[V], fn func(key K, value V) error) error {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(exportMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("ReadSortedExport: read header: %w", err)
+	}
+	if !bytes.Equal(header[:4], exportMagic[:]) {
+		return errors.New("ReadSortedExport: not a sorted export stream")
+	}
+	if header[4] != exportVersion {
+		return fmt.Errorf("ReadSortedExport: unsupported version %d", header[4])
+	}
+
+	codec := page.NewIndexPageCodecWithValues[K](values)
+	lenBuf := make([]byte, 4)
+	var pair []byte
+	for {
+		if _, err := io.ReadFull(br, lenBuf); err != nil {
+			return fmt.Errorf("ReadSortedExport: read record length: %w", err)
+		}
+		n := binary.LittleEndian.Uint32(lenBuf)
+		if n == 0 {
+			return nil
+		}
+
+		if cap(pair) < int(n) {
+			pair = make([]byte, n)
+		}
+		pair = pair[:n]
+		if _, err := io.ReadFull(br, pair); err != nil {
+			return fmt.Errorf("ReadSortedExport: read record: %w", err)
+		}
+
+		key, value, used, err := codec.DecodePair(pair)
+		if err != nil {
+			return fmt.Errorf("ReadSortedExport: %w", err)
+		}
+		if used != len(pair) {
+			return errors.New("ReadSortedExport: record length mismatch")
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package index
+
+import (
+	"errors"
+	"path/filepath"
+	"pranavdb/internal/failpoint"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"pranavdb/txn"
+	"slices"
+	"testing"
+)
+
+type crashTree = DiskTree[tree.IntKey, uint64]
+
+// openCrashTree opens the tree and transaction log in dir, creating the
+// tree if create is set. The log opens first, so it recovers the tree.
+func openCrashTree(t *testing.T, dir string, create bool) (*txn.Log, *crashTree) {
+	t.Helper()
+	log, err := txn.Open(filepath.Join(dir, "t.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "t.idx")
+	var tr *crashTree
+	if create {
+		tr, err = NewDiskTree[tree.IntKey](path, 4, page.Uint64Codec{})
+	} else {
+		tr, err = OpenDiskTree[tree.IntKey](path, page.Uint64Codec{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log, tr
+}
+
+// apply runs one transaction over tr calling fn for each key in [lo, hi),
+// and commits it.
+func apply(t *testing.T, log *txn.Log, tr *crashTree, lo, hi int, fn func(tree.IntKey) error) {
+	t.Helper()
+	tx, err := log.Begin(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := lo; k < hi; k++ {
+		if err := fn(tree.IntKey(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkKeys checks that the tree in dir, once recovered, holds exactly
+// want and that its file is sound.
+func checkKeys(t *testing.T, dir string, want []int) {
+	t.Helper()
+	log, tr := openCrashTree(t, dir, false)
+	var got []int
+	err := tr.Scan(func(k tree.IntKey, v uint64) error {
+		if v != uint64(k)*10 {
+			t.Errorf("key %d: value %d", k, v)
+		}
+		got = append(got, int(k))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("recovered %d keys, want %d", len(got), len(want))
+	}
+	if err := errors.Join(tr.Close(), log.Close()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := VerifyFile[tree.IntKey](filepath.Join(dir, "t.idx"), page.Uint64Codec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("recovered file: %+v orphans %v", report.Problems, report.OrphanPages)
+	}
+}
+
+func keyRange(lo, hi int) []int {
+	var ks []int
+	for k := lo; k < hi; k++ {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func insertKey(tr *crashTree) func(tree.IntKey) error {
+	return func(k tree.IntKey) error { return tr.Insert(k, uint64(k)*10) }
+}
+
+// A crash partway through splitting nodes, in a transaction that has
+// already spilled writes to the file, recovers to the last commit.
+func TestCrashDuringSplit(t *testing.T) {
+	for _, name := range []string{"after-split-left-write", "after-split-internal-left-write", "before-new-root", "op-flush-page"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			log, tr := openCrashTree(t, dir, true)
+			apply(t, log, tr, 0, 100, insertKey(tr))
+
+			copied := failpoint.CrashCopy(t, dir, name, func() {
+				tx, err := log.Begin(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k := 100; k < 200; k++ {
+					if err := tr.Insert(tree.IntKey(k), uint64(k)*10); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := tx.Spill(); err != nil {
+					t.Fatal(err)
+				}
+				failpoint.Set(name, failpoint.Crash)
+				for k := 200; k < 5000; k++ {
+					if err := tr.Insert(tree.IntKey(k), uint64(k)*10); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+			checkKeys(t, copied, keyRange(0, 100))
+		})
+	}
+}
+
+// A crash while pages move on or off the free list recovers to the last
+// commit, with every page either reachable or free.
+func TestCrashDuringFreeList(t *testing.T) {
+	for _, name := range []string{"after-free-page-write", "after-allocate-page"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			log, tr := openCrashTree(t, dir, true)
+			apply(t, log, tr, 0, 1000, insertKey(tr))
+			// free pages for the allocations below to reuse
+			apply(t, log, tr, 500, 1000, func(k tree.IntKey) error { return tr.Delete(k) })
+
+			copied := failpoint.CrashCopy(t, dir, name, func() {
+				tx, err := log.Begin(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k := 0; k < 100; k++ {
+					if err := tr.Delete(tree.IntKey(k)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := tx.Spill(); err != nil {
+					t.Fatal(err)
+				}
+				failpoint.Set(name, failpoint.Crash)
+				for k := 100; k < 500; k++ {
+					if err := tr.Delete(tree.IntKey(k)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for k := 500; k < 5000; k++ {
+					if err := tr.Insert(tree.IntKey(k), uint64(k)*10); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+			checkKeys(t, copied, keyRange(0, 500))
+		})
+	}
+}
+
+// An operation that fails at a failpoint returns ErrInjected; rolling its
+// transaction back leaves the tree as it was, and the tree stays usable.
+func TestInjectedError(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(tr *crashTree, k tree.IntKey) error
+	}{
+		{"after-split-left-write", func(tr *crashTree, k tree.IntKey) error { return tr.Insert(k+1000, uint64(k+1000)*10) }},
+		{"after-free-page-write", func(tr *crashTree, k tree.IntKey) error { return tr.Delete(k) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			log, tr := openCrashTree(t, dir, true)
+			apply(t, log, tr, 0, 1000, insertKey(tr))
+
+			tx, err := log.Begin(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failpoint.Set(tt.name, failpoint.Error)
+			for k := 0; k < 1000 && err == nil; k++ {
+				err = tt.op(tr, tree.IntKey(k))
+			}
+			failpoint.Reset()
+			if !errors.Is(err, failpoint.ErrInjected) {
+				t.Fatalf("got %v, want ErrInjected", err)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+
+			apply(t, log, tr, 1000, 1100, insertKey(tr))
+			if err := errors.Join(tr.Close(), log.Close()); err != nil {
+				t.Fatal(err)
+			}
+			checkKeys(t, dir, keyRange(0, 1100))
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package index
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FlushOptions configures the background flusher.
+type FlushOptions struct {
+	// Interval between background flushes. Zero means flush only when
+	// MaxDirtyPages is reached or Flush is called.
+	Interval time.Duration
+	// MaxDirtyPages wakes the flusher early once this many distinct pages are
+	// buffered. Zero disables the threshold.
+	MaxDirtyPages int
+	// Budget, if set, charges buffered pages to a shared memory limit and
+	// wakes the flusher when the limit is reached; see memoryBudget.go.
+	Budget *MemoryBudget
+}
+
+// flusher buffers page writes in memory and writes them out in batches.
+// Repeated writes to the same page before a flush are coalesced into one.
+type flusher struct {
+	mu    sync.Mutex
+	dirty map[uint64][]byte
+	err   error // first error hit by a background flush
+
+	opts   FlushOptions
+	budget *MemoryBudget // opts.Budget until the flusher is stopped
+	write  func(pageID uint64, buf []byte) error
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFlusher(opts FlushOptions, write func(uint64, []byte) error) *flusher {
+	f := &flusher{
+		dirty:  make(map[uint64][]byte),
+		opts:   opts,
+		budget: opts.Budget,
+		write:  write,
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if f.budget != nil {
+		f.budget.addFlusher(f)
+	}
+	go f.run()
+	return f
+}
+
+func (f *flusher) run() {
+	defer close(f.done)
+
+	var tick <-chan time.Time
+	if f.opts.Interval > 0 {
+		ticker := time.NewTicker(f.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-f.kick:
+		case <-f.stop:
+			return
+		}
+		if err := f.flush(); err != nil {
+			f.mu.Lock()
+			if f.err == nil {
+				f.err = err
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// put buffers a copy of a page, replacing any earlier buffered version.
+func (f *flusher) put(pageID uint64, buf []byte) error {
+	f.mu.Lock()
+	if f.err != nil {
+		f.mu.Unlock()
+		return f.err
+	}
+
+	old, replaced := f.dirty[pageID]
+	f.dirty[pageID] = append(old[:0], buf...)
+	if f.opts.MaxDirtyPages > 0 && len(f.dirty) >= f.opts.MaxDirtyPages {
+		f.wake()
+	}
+	budget := f.budget
+	if budget != nil && !replaced {
+		budget.charge(1)
+	}
+	f.mu.Unlock()
+
+	if budget != nil && !replaced && budget.enforce() {
+		// nothing left to evict; make room by writing this buffer out
+		return f.flush()
+	}
+	return nil
+}
+
+// wake asks the background goroutine to flush now.
+func (f *flusher) wake() {
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+// forget drops a buffered page once it is written or no longer wanted.
+func (f *flusher) forget(pageID uint64) {
+	delete(f.dirty, pageID)
+	if f.budget != nil {
+		f.budget.charge(-1)
+	}
+}
+
+// get copies the buffered version of a page into buf, if there is one.
+func (f *flusher) get(pageID uint64, buf []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.dirty[pageID]
+	if ok {
+		copy(buf, data)
+	}
+	return ok
+}
+
+// buffered returns which of the pages from..to are buffered.
+func (f *flusher) buffered(from, to uint64) map[uint64]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make(map[uint64]bool)
+	for id := range f.dirty {
+		if id >= from && id <= to {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// discardFrom drops buffered pages at or past pageID, e.g. because the file
+// is about to be truncated below them.
+func (f *flusher) discardFrom(pageID uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := range f.dirty {
+		if id >= pageID {
+			f.forget(id)
+		}
+	}
+}
+
+// flush writes all buffered pages in page order. The lock is held for the
+// whole flush so readers never see a page that is half way to disk.
+func (f *flusher) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pageIDs := make([]uint64, 0, len(f.dirty))
+	for id := range f.dirty {
+		pageIDs = append(pageIDs, id)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+
+	for _, id := range pageIDs {
+		if err := f.write(id, f.dirty[id]); err != nil {
+			return err
+		}
+		f.forget(id)
+	}
+	return nil
+}
+
+// flushPage writes one buffered page, if it is buffered.
+func (f *flusher) flushPage(pageID uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.dirty[pageID]
+	if !ok {
+		return nil
+	}
+	if err := f.write(pageID, data); err != nil {
+		return err
+	}
+	f.forget(pageID)
+	return nil
+}
+
+// failed returns the first error hit by a background flush.
+func (f *flusher) failed() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// close stops the background goroutine and writes whatever is left.
+func (f *flusher) close() error {
+	close(f.stop)
+	<-f.done
+	return errors.Join(f.err, f.flush())
+}
+
+// StartFlusher switches the file to buffered page writes. Node and free-list
+// writes are kept in memory and written out in the background according to
+// opts; reads see buffered pages. Header writes are not delayed.
+func (idx *IndexFile[K, V]) StartFlusher(opts FlushOptions) error {
+	if idx.flusher != nil {
+		return errors.New("flusher already running")
+	}
+	idx.flusher = newFlusher(opts, idx.writePageNow)
+	return nil
+}
+
+// Flush writes every buffered page to the file.
+func (idx *IndexFile[K, V]) Flush() error {
+	if idx.flusher == nil {
+		return nil
+	}
+	if err := idx.flusher.failed(); err != nil {
+		return err
+	}
+	return idx.flusher.flush()
+}
+
+// FlushPage writes one buffered page to the file, leaving the others
+// buffered. It does nothing if the page is not buffered.
+func (idx *IndexFile[K, V]) FlushPage(pageID uint64) error {
+	if idx.flusher == nil {
+		return nil
+	}
+	if err := idx.flusher.failed(); err != nil {
+		return err
+	}
+	return idx.flusher.flushPage(pageID)
+}
+
+// DirtyPages returns the number of pages buffered and not yet written.
+func (idx *IndexFile[K, V]) DirtyPages() int {
+	if idx.flusher == nil {
+		return 0
+	}
+	idx.flusher.mu.Lock()
+	defer idx.flusher.mu.Unlock()
+	return len(idx.flusher.dirty)
+}
+
+// StopFlusher flushes buffered pages and returns to synchronous writes.
+func (idx *IndexFile[K, V]) StopFlusher() error {
+	if idx.flusher == nil {
+		return nil
+	}
+	err := idx.flusher.close()
+	if idx.flusher.budget != nil {
+		idx.flusher.budget.removeFlusher(idx.flusher)
+	}
+	idx.flusher = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Header checksum and backup
+
+The header fields take the first headerFieldsSize bytes of the header
+block; bytes 52..56 hold a crc32 of the other fields (less bytes 40..48,
+which are unused). flushHeader writes
+the fields twice: first to headerBackupOffset, then to offset 0. A crash
+or bad write that tears one copy leaves the other whole, and readHeader
+falls back to the backup when the primary fails its checksum, rewriting
+the primary from it when the file is open for writing.
+
+Files written before the checksum have 0 there and no backup; their header
+is read unchecked.
+*/
+
+const (
+	headerChecksumOffset = 52
+	headerFieldsSize     = 76
+	headerUnusedOffset   = 40 // header bytes 40..47 are unused
+	headerBackupOffset   = HeaderSize / 2
+)
+
+// headerChecksum returns the crc32 of the header fields in b, skipping the
+// unused bytes and the checksum itself.
+func headerChecksum(b []byte) uint32 {
+	sum := crc32.ChecksumIEEE(b[:headerUnusedOffset])
+	sum = crc32.Update(sum, crc32.IEEETable, b[headerUnusedOffset+8:headerChecksumOffset])
+	return crc32.Update(sum, crc32.IEEETable, b[headerChecksumOffset+4:headerFieldsSize])
+}
+
+// checkHeader validates one copy of the header fields.
+func checkHeader(b []byte) error {
+	if magic := binary.LittleEndian.Uint32(b[0:4]); magic != MagicNumber {
+		return fmt.Errorf("invalid magic number: expected %x, got %x", MagicNumber, magic)
+	}
+	sum := binary.LittleEndian.Uint32(b[headerChecksumOffset:])
+	if sum != 0 && sum != headerChecksum(b) {
+		return fmt.Errorf("header checksum mismatch")
+	}
+	return nil
+}
+
+// chooseHeader returns the header copy to trust from a header block, and
+// whether it is the backup.
+func chooseHeader(block []byte) ([]byte, bool, error) {
+	primary := block[:headerFieldsSize]
+	err := checkHeader(primary)
+	if err == nil {
+		return primary, false, nil
+	}
+	backup := block[headerBackupOffset : headerBackupOffset+headerFieldsSize]
+	if binary.LittleEndian.Uint32(backup[headerChecksumOffset:]) == 0 {
+		// no backup was ever written
+		return nil, false, err
+	}
+	if berr := checkHeader(backup); berr != nil {
+		return nil, false, fmt.Errorf("%w; backup header: %v", err, berr)
+	}
+	return backup, true, nil
+}
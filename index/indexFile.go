@@ -2,49 +2,120 @@ package index
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+	"pranavdb/filelock"
+	"pranavdb/internal/failpoint"
 	"pranavdb/page"
 	"pranavdb/tree"
+	"reflect"
+	"sync"
 )
 
 const (
 	MagicNumber = 0x42504C55 // "B+LU"
-	Version     = 1
+	Version     = 9 // 1 is upgraded on open, see indexFileV1.go
 	HeaderSize  = 512
 
 	PageTypeHeader = 0
 	PageTypeNode   = 1
 )
 
+// ErrReadOnly is returned when a write is attempted on a file opened read-only.
+var ErrReadOnly = errors.New("index file is open read-only")
+
+// ErrValueTypeMismatch is returned when a file is opened as a tree of a
+// different value type than the one it was created with.
+var ErrValueTypeMismatch = errors.New("index file value type mismatch")
+
 type IndexFile[K tree.Key, V any] struct {
-	file          *os.File
-	rootPageID    uint32
+	file          storage
+	rootPageID    uint64
 	order         int
-	firstFreePage uint32 // ✅ Keep in-memory free list head
+	firstFreePage uint64 // ✅ Keep in-memory free list head
 	codec         *page.IndexPageCodec[K, V]
+	readOnly      bool // opened with OpenIndexFileReadOnly under a shared lock
+	doubleWrite   bool // stage every page write through the double-write slot
+	flusher       *flusher
+	cache         *pageCache // page cache, if SetPageCache enabled one
+	counters      cacheCounters
+
+	ops *nodeCache[V] // node cache for the operation in progress, if any
+
+	headerBatch int  // nesting depth of open header batches
+	headerDirty bool // header changed while a batch was open
+
+	shrinkPending bool // free tail released; truncate after the next header write
+
+	segmentPages uint32 // pages per segment file, 0 unless segmented (see segments.go)
+
+	views viewSet // open read-only transaction views, see txnView.go
+
+	pinMu       sync.Mutex
+	pins        map[uint64]int  // pin counts by page, see cursor.go
+	freeOnUnpin map[uint64]bool // pinned pages freed while pinned
+
+	// tree statistics persisted in the header
+	keyCount      uint64
+	height        uint32
+	pageCount     uint64 // node pages ever allocated (live + free)
+	freePageCount uint64
 }
 
 type FileHeader struct {
 	MagicNumber    uint32
 	Version        uint32
-	RootPageID     uint32
+	RootPageID     uint64
 	TreeOrder      uint32
-	FirstFreeListID uint32
+	FirstFreeListID uint64
+	KeyCount        uint64
+	TreeHeight      uint32
+	PageCount       uint64
+	FreePageCount   uint64
+	ValueType       uint32 // page.ValueTypeTag of V; 0 in files that predate it
+	Checksum        uint32 // crc32 of the other fields; 0 in files that predate it
+	SegmentPages    uint32 // pages per segment file; 0 for a single file
+}
+
+// NewIndexFile creates (or truncates) an index file. values encodes leaf
+// values; nil selects page.DefaultValueCodec for V.
+func NewIndexFile[K tree.Key, V any](filepath string, order int, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	return NewIndexFileWithOptions[K](filepath, order, values, Options{})
 }
 
-func NewIndexFile[K tree.Key, V any](filepath string, order int) (*IndexFile[K, V], error) {
-	file, err := os.Create(filepath)
+// NewIndexFileWithOptions is NewIndexFile with the I/O settings in opts;
+// opts.ReadOnly is ignored.
+func NewIndexFileWithOptions[K tree.Key, V any](filepath string, order int, values page.ValueCodec[V], opts Options) (*IndexFile[K, V], error) {
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+	flag, err := opts.openFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock before truncating so an open by another process is never clobbered.
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|flag, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create index file: %w", err)
 	}
+	if err := filelock.Lock(file, filelock.Exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock index file: %w", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate index file: %w", err)
+	}
 
 	indexFile := &IndexFile[K, V]{
-		file:          file,
+		file:          opts.storage(file, 0),
 		rootPageID:    0,
 		order:         order,
 		firstFreePage: 0, // no free pages yet
-		codec:         page.NewIndexPageCodec[K, V](),
+		codec:         codec,
 	}
 
 	if err := indexFile.writeHeader(); err != nil {
@@ -55,15 +126,144 @@ func NewIndexFile[K tree.Key, V any](filepath string, order int) (*IndexFile[K,
 	return indexFile, nil
 }
 
-func OpenIndexFile[K tree.Key, V any](filepath string) (*IndexFile[K, V], error) {
-	file, err := os.OpenFile(filepath, os.O_RDWR, 0666)
+// NewMemIndexFile creates an index that lives entirely in memory. It has the
+// same layout as an on-disk file but nothing touches the filesystem and the
+// contents are lost on Close.
+func NewMemIndexFile[K tree.Key, V any](order int, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile := &IndexFile[K, V]{
+		file:  &memStorage{},
+		order: order,
+		codec: codec,
+	}
+
+	if err := indexFile.writeHeader(); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return indexFile, nil
+}
+
+// newPageCodec builds the node codec, failing early when V has no value codec.
+func newPageCodec[K tree.Key, V any](values page.ValueCodec[V]) (*page.IndexPageCodec[K, V], error) {
+	codec := page.NewIndexPageCodecWithValues[K](values)
+	if codec.ValueCodec() == nil {
+		var zero V
+		return nil, fmt.Errorf("no value codec for value type %T", zero)
+	}
+	return codec, nil
+}
+
+// OpenIndexFile opens an existing index file for reading and writing. The
+// file is locked exclusively until Close.
+func OpenIndexFile[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	return OpenIndexFileWithOptions[K](filepath, values, Options{})
+}
+
+// OpenIndexFileWithOptions opens an existing index file as configured by
+// opts: read-only like OpenIndexFileReadOnly, or read-write like
+// OpenIndexFile, with the I/O settings in opts.
+func OpenIndexFileWithOptions[K tree.Key, V any](filepath string, values page.ValueCodec[V], opts Options) (*IndexFile[K, V], error) {
+	if opts.ReadOnly {
+		return openIndexFileReadOnly[K](filepath, values, opts)
+	}
+	indexFile, err := openIndexFile[K](filepath, values, opts)
+	if errors.Is(err, errVersion1) {
+		if err := upgradeV1[K](filepath, values); err != nil {
+			return nil, err
+		}
+		indexFile, err = openIndexFile[K](filepath, values, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Finish any page write that was interrupted by a crash.
+	if err := indexFile.recoverDoubleWrite(); err != nil {
+		indexFile.file.Close()
+		return nil, fmt.Errorf("failed to recover double-write buffer: %w", err)
+	}
+
+	return indexFile, nil
+}
+
+// OpenIndexFileReadOnly opens an index file under a shared lock, so any
+// number of readers can use it while no writer can. Writes fail with
+// ErrReadOnly.
+func OpenIndexFileReadOnly[K tree.Key, V any](filepath string, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	return openIndexFileReadOnly[K](filepath, values, Options{ReadOnly: true})
+}
+
+func openIndexFileReadOnly[K tree.Key, V any](filepath string, values page.ValueCodec[V], opts Options) (*IndexFile[K, V], error) {
+	indexFile, err := openIndexFile[K](filepath, values, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A staged page means the last writer crashed; only a writer can repair it.
+	if pending, _, err := indexFile.pendingDoubleWrite(); err != nil || pending != 0 {
+		indexFile.file.Close()
+		if err == nil {
+			err = fmt.Errorf("page %d needs double-write recovery; open read-write first", pending)
+		}
+		return nil, err
+	}
+
+	return indexFile, nil
+}
+
+// openIndexFile opens, locks and parses the header without touching any page.
+func openIndexFile[K tree.Key, V any](filepath string, values page.ValueCodec[V], opts Options) (*IndexFile[K, V], error) {
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := opts.openFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	flag, mode := os.O_RDWR, filelock.Exclusive
+	if opts.ReadOnly {
+		flag, mode = os.O_RDONLY, filelock.Shared
+	}
+
+	file, err := os.OpenFile(filepath, flag|extra, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
 	}
+	if err := filelock.Lock(file, mode); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock index file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat index file: %w", err)
+	}
+
+	indexFile, err := loadIndexFile[K](opts.storage(file, info.Size()), codec, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if indexFile.segmentPages != 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is the first segment of a segmented index; use OpenSegmentedIndexFile", filepath)
+	}
+	return indexFile, nil
+}
 
+// loadIndexFile parses the header of an opened, locked storage, closing it on
+// failure.
+func loadIndexFile[K tree.Key, V any](file storage, codec *page.IndexPageCodec[K, V], readOnly bool) (*IndexFile[K, V], error) {
 	indexFile := &IndexFile[K, V]{
-		file:  file,
-		codec: page.NewIndexPageCodec[K, V](),
+		file:     file,
+		codec:    codec,
+		readOnly: readOnly,
 	}
 
 	if err := indexFile.readHeader(); err != nil {
@@ -71,62 +271,177 @@ func OpenIndexFile[K tree.Key, V any](filepath string) (*IndexFile[K, V], error)
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
 
+	// Files written before the page count was persisted: derive it from the size.
+	if indexFile.pageCount == 0 {
+		size, err := indexFile.file.Size()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to stat index file: %w", err)
+		}
+		if slots := (size - HeaderSize) / page.PageSize; slots > 1 {
+			indexFile.pageCount = uint64(slots - 1)
+		}
+	}
+	indexFile.updateGauges()
+
 	return indexFile, nil
 }
 
 func (idx *IndexFile[K, V]) Close() error {
+	idx.closeCache()
+	if idx.readOnly {
+		return idx.file.Close()
+	}
+	if err := idx.releasePins(); err != nil {
+		return fmt.Errorf("failed to free pinned pages: %w", err)
+	}
+	if err := idx.StopFlusher(); err != nil {
+		return fmt.Errorf("failed to flush dirty pages: %w", err)
+	}
 	if err := idx.writeHeader(); err != nil {
 		return fmt.Errorf("failed to write final header: %w", err)
 	}
 	return idx.file.Close()
 }
 
+// writeHeader persists the header, or just marks it dirty while a header
+// batch is open.
 func (idx *IndexFile[K, V]) writeHeader() error {
+	if idx.headerBatch > 0 {
+		idx.headerDirty = true
+		return nil
+	}
+	return idx.flushHeader()
+}
+
+// beginHeaderBatch defers header writes until the matching endHeaderBatch.
+// Batches nest; only the outermost end writes the header.
+func (idx *IndexFile[K, V]) beginHeaderBatch() {
+	idx.headerBatch++
+}
+
+// endHeaderBatch closes a batch and writes the header once if anything changed.
+func (idx *IndexFile[K, V]) endHeaderBatch() error {
+	idx.headerBatch--
+	if idx.headerBatch > 0 || !idx.headerDirty {
+		return nil
+	}
+	idx.headerDirty = false
+	return idx.flushHeader()
+}
+
+// withHeaderBatch runs fn with header writes batched, writing the header at
+// most once at the end even if fn fails part way through.
+func (idx *IndexFile[K, V]) withHeaderBatch(fn func() error) error {
+	idx.beginHeaderBatch()
+	err := fn()
+	if endErr := idx.endHeaderBatch(); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+// flushHeader writes the in-memory header fields to disk.
+func (idx *IndexFile[K, V]) flushHeader() error {
+	if idx.readOnly {
+		return ErrReadOnly
+	}
 	header := FileHeader{
 		MagicNumber:    MagicNumber,
 		Version:        Version,
 		RootPageID:     idx.rootPageID,
 		TreeOrder:      uint32(idx.order),
 		FirstFreeListID: idx.firstFreePage,
+		KeyCount:        idx.keyCount,
+		TreeHeight:      idx.height,
+		PageCount:       idx.pageCount,
+		FreePageCount:   idx.freePageCount,
+		ValueType:       page.ValueTypeTag[V](),
+		SegmentPages:    idx.segmentPages,
 	}
 
 	headerBlock := make([]byte, HeaderSize)
 	binary.LittleEndian.PutUint32(headerBlock[0:4], header.MagicNumber)
 	binary.LittleEndian.PutUint32(headerBlock[4:8], header.Version)
-	binary.LittleEndian.PutUint32(headerBlock[8:12], header.RootPageID)
-	binary.LittleEndian.PutUint32(headerBlock[12:16], header.TreeOrder)
-	binary.LittleEndian.PutUint32(headerBlock[16:20], header.FirstFreeListID)
+	binary.LittleEndian.PutUint64(headerBlock[8:16], header.RootPageID)
+	binary.LittleEndian.PutUint64(headerBlock[16:24], header.FirstFreeListID)
+	binary.LittleEndian.PutUint64(headerBlock[24:32], header.KeyCount)
+	binary.LittleEndian.PutUint32(headerBlock[32:36], header.TreeOrder)
+	binary.LittleEndian.PutUint32(headerBlock[36:40], header.TreeHeight)
+	// bytes 40..48 are unused
+	binary.LittleEndian.PutUint32(headerBlock[48:52], header.ValueType)
+	binary.LittleEndian.PutUint32(headerBlock[56:60], header.SegmentPages)
+	binary.LittleEndian.PutUint64(headerBlock[60:68], header.PageCount)
+	binary.LittleEndian.PutUint64(headerBlock[68:76], header.FreePageCount)
+	header.Checksum = headerChecksum(headerBlock)
+	binary.LittleEndian.PutUint32(headerBlock[headerChecksumOffset:], header.Checksum)
+
+	// backup first, so one of the copies is always whole (see headerChecksum.go)
+	copy(headerBlock[headerBackupOffset:], headerBlock[:headerFieldsSize])
+	if _, err := idx.file.WriteAt(headerBlock[headerBackupOffset:], headerBackupOffset); err != nil {
+		return err
+	}
+	if _, err := idx.file.WriteAt(headerBlock[:headerBackupOffset], 0); err != nil {
+		return err
+	}
 
-	_, err := idx.file.WriteAt(headerBlock, 0)
-	return err
+	// give back pages released by releaseFreeTail now that the header no
+	// longer refers to them
+	if idx.shrinkPending {
+		if err := idx.file.Truncate(pageOffset(idx.pageCount + 1)); err != nil {
+			return fmt.Errorf("failed to shrink index file: %w", err)
+		}
+		idx.shrinkPending = false
+	}
+	idx.updateGauges()
+	return nil
 }
 
 func (idx *IndexFile[K, V]) readHeader() error {
-	headerBlock := make([]byte, HeaderSize)
-	_, err := idx.file.ReadAt(headerBlock, 0)
+	block := make([]byte, HeaderSize)
+	_, err := idx.file.ReadAt(block, 0)
+	if err != nil {
+		return err
+	}
+	headerBlock, fromBackup, err := chooseHeader(block)
 	if err != nil {
 		return err
 	}
 
-	magic := binary.LittleEndian.Uint32(headerBlock[0:4])
 	version := binary.LittleEndian.Uint32(headerBlock[4:8])
-	idx.rootPageID = binary.LittleEndian.Uint32(headerBlock[8:12])
-	idx.order = int(binary.LittleEndian.Uint32(headerBlock[12:16]))
-	idx.firstFreePage = binary.LittleEndian.Uint32(headerBlock[16:20])
-
-	if magic != MagicNumber {
-		return fmt.Errorf("invalid magic number: expected %x, got %x", MagicNumber, magic)
-	}
-	if version != Version {
+	switch version {
+	case Version:
+		idx.rootPageID = binary.LittleEndian.Uint64(headerBlock[8:16])
+		idx.firstFreePage = binary.LittleEndian.Uint64(headerBlock[16:24])
+		idx.keyCount = binary.LittleEndian.Uint64(headerBlock[24:32])
+		idx.order = int(binary.LittleEndian.Uint32(headerBlock[32:36]))
+		idx.height = binary.LittleEndian.Uint32(headerBlock[36:40])
+		idx.pageCount = binary.LittleEndian.Uint64(headerBlock[60:68])
+		idx.freePageCount = binary.LittleEndian.Uint64(headerBlock[68:76])
+	case version1:
+		return errVersion1
+	default:
 		return fmt.Errorf("unsupported version: %d", version)
 	}
+	valueType := binary.LittleEndian.Uint32(headerBlock[48:52])
+	idx.segmentPages = binary.LittleEndian.Uint32(headerBlock[56:60])
 
+	if want := page.ValueTypeTag[V](); valueType != 0 && valueType != want {
+		return fmt.Errorf("%w: file was written with value type tag %08x, opened as %v (%08x)", ErrValueTypeMismatch, valueType, reflect.TypeFor[V](), want)
+	}
+
+	// repair a corrupt primary; its double-write record cannot be trusted either
+	if fromBackup && !idx.readOnly {
+		if err := idx.flushHeader(); err != nil {
+			return fmt.Errorf("failed to restore header from backup: %w", err)
+		}
+	}
 	return nil
 }
 
 
 // ✅ Allocate page (reuse free list if possible)
-func (idx *IndexFile[K, V]) allocatePage() (uint32, error) {
+func (idx *IndexFile[K, V]) allocatePage() (uint64, error) {
 	// 1. Read the free list head from header
 	freeHead := idx.firstFreePage
 
@@ -142,67 +457,171 @@ func (idx *IndexFile[K, V]) allocatePage() (uint32, error) {
 		// the logic for making the bool 0 is already written in the write node if that is called the delete gets written to 0
 		// Update the free list head to point to the next free page
 		idx.firstFreePage = nextFree
+		idx.freePageCount--
+		if err := failpoint.Inject("after-allocate-page"); err != nil {
+			return 0, err
+		}
 		err = idx.writeHeader()
 		if err != nil{
 			return 0, err
 		}
 
 		// Return the reused page
+		idx.counters.allocated.Add(1)
 		return freeHead, nil
 	}
 
-	// 3. Otherwise, append a new page at the end
-	info, err := idx.file.Stat()
-	if err != nil {
-		return 0, err
-	}
-	nextPageID := max(uint32((info.Size() - HeaderSize) / page.PageSize),1)
+	// 3. Otherwise, append a new page after the high-water mark. Page 0 is
+	// never used and the file may extend past the mark if it was preallocated.
+	nextPageID := idx.pageCount + 1
 
 	zeroPage := make([]byte, page.PageSize)
-	_, err = idx.file.WriteAt(zeroPage, int64(HeaderSize+int64(nextPageID)*page.PageSize))
+	if idx.cache != nil {
+		idx.cache.drop(nextPageID)
+	}
+	_, err := idx.file.WriteAt(zeroPage, int64(HeaderSize+int64(nextPageID)*page.PageSize))
+	if idx.cache != nil {
+		idx.cache.invalidate()
+	}
 	if err != nil {
 		return 0, err
 	}
+	idx.pageCount++
+	if err := failpoint.Inject("after-allocate-page"); err != nil {
+		return 0, err
+	}
+	if err := idx.writeHeader(); err != nil {
+		return 0, err
+	}
+	idx.counters.allocated.Add(1)
 	return nextPageID, nil
 }
 
 
 
-func (idx *IndexFile[K, V]) freePage(pageID uint32) error {
+func (idx *IndexFile[K, V]) freePage(pageID uint64) error {
 	// build page buffer
 	//fmt.Print("pageid ******************************************************")
 	//fmt.Println(pageID)
-	buf := make([]byte, page.PageSize)
-
-	// mark as deleted
-	buf[0] = 1
-
-	// write next pointer at buf[1:5]
-	binary.LittleEndian.PutUint32(buf[1:5], idx.firstFreePage)
+	// a freed page must not be written back as a node later in the operation
+	idx.evictNode(pageID)
+	if idx.deferFree(pageID) {
+		return nil
+	}
 
 	// write the page buffer to disk at the correct offset
-	offset := int64(HeaderSize) + int64(pageID)*int64(page.PageSize)
-	if _, err := idx.file.WriteAt(buf, offset); err != nil {
+	if err := idx.writeFreePage(pageID, idx.firstFreePage); err != nil {
 		return fmt.Errorf("freePage: write failed for page %d: %w", pageID, err)
 	}
 
+	if err := failpoint.Inject("after-free-page-write"); err != nil {
+		return fmt.Errorf("freePage: %w", err)
+	}
+
 	// update in-memory head and persist header
 	idx.firstFreePage = pageID
+	idx.freePageCount++
+
+	// freeing the last page may leave a free tail that can be given back
+	if pageID == idx.pageCount {
+		if err := idx.releaseFreeTail(); err != nil {
+			return fmt.Errorf("freePage: %w", err)
+		}
+	}
+
 	if err := idx.writeHeader(); err != nil {
 		return fmt.Errorf("freePage: writeHeader failed: %w", err)
 	}
 
+	idx.counters.freed.Add(1)
+	return nil
+}
+
+// writeFreePage writes a free-list page: deleted flag + next pointer.
+func (idx *IndexFile[K, V]) writeFreePage(pageID, next uint64) error {
+	buf := make([]byte, page.PageSize)
+
+	// mark as deleted
+	buf[0] = 1
+
+	// write next pointer at buf[1:9]
+	binary.LittleEndian.PutUint64(buf[1:9], next)
+
+	return idx.writePage(pageID, buf)
+}
+
+// releaseFreeTail takes the run of free pages at the end of the file off the
+// free list and lowers the high-water mark below them. The file is shrunk the
+// next time the header is written, so the header never points past the end.
+func (idx *IndexFile[K, V]) releaseFreeTail() error {
+	// walk the free list, remembering order and links
+	next := make(map[uint64]uint64)
+	var list []uint64
+	for id := idx.firstFreePage; id != 0; id = next[id] {
+		if _, seen := next[id]; seen {
+			return fmt.Errorf("free list cycle at page %d", id)
+		}
+		n, err := idx.readFreeListPointer(id)
+		if err != nil {
+			return err
+		}
+		next[id] = n
+		list = append(list, id)
+	}
+
+	newCount := idx.pageCount
+	for newCount > 0 {
+		if _, free := next[newCount]; !free {
+			break
+		}
+		newCount--
+	}
+	if newCount == idx.pageCount {
+		return nil
+	}
+
+	// relink the pages that stay, rewriting only links that changed
+	var kept []uint64
+	for _, id := range list {
+		if id <= newCount {
+			kept = append(kept, id)
+		}
+	}
+	for i, id := range kept {
+		var link uint64
+		if i+1 < len(kept) {
+			link = kept[i+1]
+		}
+		if next[id] != link {
+			if err := idx.writeFreePage(id, link); err != nil {
+				return err
+			}
+		}
+	}
+
+	idx.firstFreePage = 0
+	if len(kept) > 0 {
+		idx.firstFreePage = kept[0]
+	}
+	idx.freePageCount = uint64(len(kept))
+	idx.pageCount = newCount
+	idx.shrinkPending = true
+	if idx.flusher != nil {
+		idx.flusher.discardFrom(newCount + 1)
+	}
+	if idx.cache != nil {
+		idx.cache.discardFrom(newCount + 1)
+	}
 	return nil
 }
 
 
 // Helper to read next free list pointer from a free page
-func (idx *IndexFile[K, V]) readFreeListPointer(pageID uint32) (uint32, error) {
+func (idx *IndexFile[K, V]) readFreeListPointer(pageID uint64) (uint64, error) {
 	// Buffer for flag + next free page ID
-	buf := make([]byte, 5) // 1 byte for bool + 4 bytes for uint32
-	offset := int64(HeaderSize) + int64(pageID)*page.PageSize
+	buf := make([]byte, 9) // 1 byte for bool + 8 bytes for uint64
 
-	_, err := idx.file.ReadAt(buf, offset)
+	err := idx.readPage(pageID, buf)
 	if err != nil {
 		return 0, err
 	}
@@ -213,46 +632,53 @@ func (idx *IndexFile[K, V]) readFreeListPointer(pageID uint32) (uint32, error) {
 		return 0, fmt.Errorf("page %d is not marked as free", pageID)
 	}
 
-	// Next 4 bytes are the next free page pointer
-	nextFree := binary.LittleEndian.Uint32(buf[1:5])
+	// Next 8 bytes are the next free page pointer
+	nextFree := binary.LittleEndian.Uint64(buf[1:9])
 	return nextFree, nil
 }
 
 
-// writeNode writes a node to a specific page
-func (idx *IndexFile[K, V]) writeNode(node tree.Node[V], pageID uint32) error {
-	// Encode the node
-	data, err := idx.codec.Encode(node)
-	if err != nil {
-		return fmt.Errorf("failed to encode node: %w", err)
-	}
-
-	// Sanity check: encoded payload must fit in page minus 1 byte for Deleted flag
-	if len(data) > page.PageSize-1 {
-		return fmt.Errorf("encoded node size %d exceeds page payload capacity %d", len(data), page.PageSize-1)
+// writeNode writes a node to a specific page. Inside an operation the write
+// is deferred until the operation ends.
+func (idx *IndexFile[K, V]) writeNode(node tree.Node[V], pageID uint64) error {
+	if idx.cacheNode(pageID, node, true) {
+		return nil
 	}
+	return idx.writeNodeNow(node, pageID)
+}
 
-	// Build full physical page buffer: first byte = deleted flag (0), then payload
-	buf := make([]byte, page.PageSize)
+// writeNodeNow encodes a node and writes it to its page immediately.
+func (idx *IndexFile[K, V]) writeNodeNow(node tree.Node[V], pageID uint64) error {
+	// Build full physical page buffer: first byte = deleted flag (0), then
+	// the node encoded straight into the payload. writePage copies or writes
+	// the buffer before returning, so it can go back to the pool.
+	pageBuf := page.GetPageBuffer()
+	defer page.PutPageBuffer(pageBuf)
+	buf := pageBuf[:]
 	buf[0] = 0 // not deleted
-	if len(data) > 0 {
-		copy(buf[1:], data)
+	if err := idx.codec.EncodeInto(buf[1:], node); err != nil {
+		return fmt.Errorf("failed to encode node: %w", err)
 	}
 
 	// Write the full page to disk
-	offset := int64(HeaderSize+ int64(pageID*page.PageSize))
-	if _, err := idx.file.WriteAt(buf, offset); err != nil {
+	if err := idx.writePage(pageID, buf); err != nil {
 		return fmt.Errorf("failed to write node to page %d: %w", pageID, err)
 	}
 	return nil
 }
 
-func (idx *IndexFile[K, V]) readNode(pageID uint32) (tree.Node[V], error) {
-	// Read the full page into buffer
-	buf := make([]byte, page.PageSize)
-	offset := int64(HeaderSize + int64(pageID*page.PageSize))
+func (idx *IndexFile[K, V]) readNode(pageID uint64) (tree.Node[V], error) {
+	if node, ok := idx.cachedNode(pageID); ok {
+		return node, nil
+	}
+
+	// Read the full page into a pooled buffer; the decoded node does not
+	// refer to it, so it goes back to the pool on return
+	pageBuf := page.GetPageBuffer()
+	defer page.PutPageBuffer(pageBuf)
+	buf := pageBuf[:]
 
-	_, err := idx.file.ReadAt(buf, offset)
+	err := idx.readPage(pageID, buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read page %d: %w", pageID, err)
 	}
@@ -273,18 +699,172 @@ func (idx *IndexFile[K, V]) readNode(pageID uint32) (tree.Node[V], error) {
 	if !ok {
 		return nil, fmt.Errorf("decoded object is not a tree node (page %d)", pageID)
 	}
+	idx.cacheNode(pageID, node, false)
 	return node, nil
 }
 
-func (idx *IndexFile[K, V]) SetRoot(pageID uint32) error {
+// readLeafInto reads a leaf page into leaf, reusing the backing array of
+// leaf.Pairs, for walks of the leaf chain that look at one leaf at a time.
+// leaf is scratch space owned by the caller: it must not be a node returned
+// by readNode, and its earlier pairs are overwritten.
+func (idx *IndexFile[K, V]) readLeafInto(pageID uint64, leaf *tree.LeafNode[K, V]) error {
+	if node, ok := idx.cachedNode(pageID); ok {
+		cached, ok := node.(*tree.LeafNode[K, V])
+		if !ok {
+			return fmt.Errorf("page %d: expected a leaf node", pageID)
+		}
+		leaf.Pairs = append(leaf.Pairs[:0], cached.Pairs...)
+		leaf.SetPageID(cached.GetPageID())
+		leaf.SetNextPage(cached.GetNextPage())
+		leaf.SetPrevPage(cached.GetPrevPage())
+		return nil
+	}
+
+	pageBuf := page.GetPageBuffer()
+	defer page.PutPageBuffer(pageBuf)
+	buf := pageBuf[:]
+	if err := idx.readPage(pageID, buf); err != nil {
+		return fmt.Errorf("failed to read page %d: %w", pageID, err)
+	}
+	if buf[0] != 0 {
+		return fmt.Errorf("page %d is marked deleted", pageID)
+	}
+	if err := idx.codec.DecodeLeafInto(buf[1:], leaf); err != nil {
+		return fmt.Errorf("failed to decode leaf from page %d: %w", pageID, err)
+	}
+	return nil
+}
+
+func (idx *IndexFile[K, V]) SetRoot(pageID uint64) error {
 	idx.rootPageID = pageID
 	return idx.writeHeader()
 }
 
-func (idx *IndexFile[K, V]) GetRoot() uint32 {
+func (idx *IndexFile[K, V]) GetRoot() uint64 {
 	return idx.rootPageID
 }
 
 func (idx *IndexFile[K, V]) GetOrder() int {
 	return idx.order
 }
+
+// GetKeyCount returns the number of keys stored in the tree.
+func (idx *IndexFile[K, V]) GetKeyCount() uint64 {
+	return idx.keyCount
+}
+
+// GetHeight returns the tree height (0 for an empty tree, 1 for a lone root leaf).
+func (idx *IndexFile[K, V]) GetHeight() uint32 {
+	return idx.height
+}
+
+// GetPageCount returns the number of node pages allocated in the file, including free ones.
+func (idx *IndexFile[K, V]) GetPageCount() uint64 {
+	return idx.pageCount
+}
+
+// GetFreePageCount returns the number of pages currently on the free list.
+func (idx *IndexFile[K, V]) GetFreePageCount() uint64 {
+	return idx.freePageCount
+}
+
+// FragmentationReport reports live and free pages in bytes. A rebuild of the
+// tree would keep only the header, page 0 and the live pages.
+func (idx *IndexFile[K, V]) FragmentationReport() (page.FragmentationReport, error) {
+	size, err := idx.file.Size()
+	if err != nil {
+		return page.FragmentationReport{}, fmt.Errorf("FragmentationReport: stat failed: %w", err)
+	}
+	live := int64(idx.pageCount - idx.freePageCount)
+	report := page.FragmentationReport{
+		FileBytes:   size,
+		LiveBytes:   live * page.PageSize,
+		FreeBytes:   int64(idx.freePageCount) * page.PageSize,
+		Reclaimable: max(size-HeaderSize-(1+live)*page.PageSize, 0),
+	}
+
+	// longest run of consecutive free page IDs
+	free := make(map[uint64]bool)
+	for id := idx.firstFreePage; id != 0; {
+		if free[id] {
+			return report, fmt.Errorf("FragmentationReport: free list cycle at page %d", id)
+		}
+		free[id] = true
+		next, err := idx.readFreeListPointer(id)
+		if err != nil {
+			return report, fmt.Errorf("FragmentationReport: %w", err)
+		}
+		id = next
+	}
+	var longest int64
+	for id := range free {
+		if free[id-1] {
+			continue
+		}
+		n := int64(1)
+		for free[id+uint64(n)] {
+			n++
+		}
+		longest = max(longest, n)
+	}
+	report.LargestFree = longest * page.PageSize
+	return report, nil
+}
+
+// addKeys adjusts the persisted key count by delta.
+func (idx *IndexFile[K, V]) addKeys(delta int) error {
+	idx.keyCount = uint64(int64(idx.keyCount) + int64(delta))
+	return idx.writeHeader()
+}
+
+// setHeight updates the persisted tree height.
+func (idx *IndexFile[K, V]) setHeight(height uint32) error {
+	idx.height = height
+	return idx.writeHeader()
+}
+
+// Preallocate reserves room for nPages more pages beyond the ones already
+// allocated, so a large bulk load does not grow the file one page at a time.
+// Reserved pages are handed out by allocatePage in order; the call is a no-op
+// when the file is already large enough. A reservation is given back if
+// deletes later free the tail of the file.
+func (idx *IndexFile[K, V]) Preallocate(nPages uint64) error {
+	if nPages == 0 {
+		return nil
+	}
+	end := int64(HeaderSize) + int64(idx.pageCount+1+nPages)*page.PageSize
+
+	size, err := idx.file.Size()
+	if err != nil {
+		return fmt.Errorf("Preallocate: stat failed: %w", err)
+	}
+	if size >= end {
+		return nil
+	}
+	if err := idx.preallocate(size, end-size); err != nil {
+		return fmt.Errorf("Preallocate: %w", err)
+	}
+	return nil
+}
+
+// preallocate reserves [offset, offset+length) in the backing storage.
+func (idx *IndexFile[K, V]) preallocate(offset, length int64) error {
+	if f, ok := idx.file.(fileStorage); ok {
+		return preallocateFile(f.File, offset, length)
+	}
+	return idx.file.Truncate(offset + length)
+}
+
+// zeroFill extends f by writing zeros; used where fallocate is unavailable.
+func zeroFill(f *os.File, offset, length int64) error {
+	chunk := make([]byte, 64*page.PageSize)
+	for length > 0 {
+		n := min(length, int64(len(chunk)))
+		if _, err := f.WriteAt(chunk[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"pranavdb/filelock"
+	"pranavdb/page"
+	"pranavdb/tree"
+)
+
+/*
+Version 1 files
+
+The first index files have a 20-byte header (magic, version, root, order
+and free-list head, each a uint32) and store a node on each page after a
+deleted byte:
+
+	leaf:     1, pageID uint32, count uint16, count × (key, len uint16, string value), next uint32, prev uint32
+	internal: 0, pageID uint32, count uint16, count × key, pointers uint16, pointers × uint32
+
+Each key is a KeyType* byte followed by an int32, a float64, or a uint16
+length and the string bytes. Such a file is never read in place: opening it
+read-write first upgrades it, copying its pairs in key order into a file of
+the current Version that is renamed over it. Read-only opens fail with
+errVersion1.
+*/
+
+const version1 = 1
+
+// errVersion1 is returned by readHeader for a Version 1 file.
+var errVersion1 = errors.New("version 1 index file; open it read-write once to upgrade it")
+
+// upgradeV1 rewrites the Version 1 file at path in the current format.
+func upgradeV1[K tree.Key, V any](path string, values page.ValueCodec[V]) error {
+	var zero V
+	if _, ok := any(zero).(string); !ok {
+		return fmt.Errorf("upgrade %s: version 1 files hold string values, not %T", path, zero)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("upgrade %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+		return fmt.Errorf("upgrade %s: %w", path, err)
+	}
+
+	header := make([]byte, 20)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("upgrade %s: read header: %w", path, err)
+	}
+	if v := binary.LittleEndian.Uint32(header[4:8]); v != version1 {
+		return fmt.Errorf("upgrade %s: version %d is not 1", path, v)
+	}
+	root := binary.LittleEndian.Uint32(header[8:12])
+	order := int(binary.LittleEndian.Uint32(header[12:16]))
+
+	tmp := path + ".upgrade"
+	t, err := NewDiskTreeWithOptions[K](tmp, order, values, Options{})
+	if err != nil {
+		return fmt.Errorf("upgrade %s: %w", path, err)
+	}
+	err = scanV1[K](f, root, func(key K, value string) error {
+		return t.Insert(key, any(value).(V))
+	})
+	if err == nil {
+		err = t.indexFile.file.Sync()
+	}
+	if err = errors.Join(err, t.Close()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("upgrade %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("upgrade %s: %w", path, err)
+	}
+	return nil
+}
+
+// scanV1 calls fn for every pair of the Version 1 tree rooted at root, in
+// key order, following the leaf chain from the leftmost leaf.
+func scanV1[K tree.Key](f *os.File, root uint32, fn func(key K, value string) error) error {
+	if root == 0 {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pages := uint32((info.Size() - HeaderSize) / page.PageSize)
+
+	buf := make([]byte, page.PageSize)
+	read := func(pageID uint32) error {
+		if pageID == 0 || pageID >= pages {
+			return fmt.Errorf("page %d out of range", pageID)
+		}
+		if _, err := f.ReadAt(buf, pageOffset(uint64(pageID))); err != nil {
+			return fmt.Errorf("read page %d: %w", pageID, err)
+		}
+		if buf[0] != 0 {
+			return fmt.Errorf("page %d is marked deleted", pageID)
+		}
+		return nil
+	}
+
+	// descend the first pointers to the leftmost leaf
+	pageID := root
+	for depth := 0; ; depth++ {
+		if err := read(pageID); err != nil {
+			return err
+		}
+		if buf[1] == 1 {
+			break
+		}
+		if depth >= int(pages) {
+			return errors.New("internal nodes form a cycle")
+		}
+		d := buf[2+4:] // past the node type and page ID
+		count := binary.LittleEndian.Uint16(d)
+		d = d[2:]
+		for range count {
+			_, n, err := decodeV1Key[K](d)
+			if err != nil {
+				return fmt.Errorf("page %d: %w", pageID, err)
+			}
+			d = d[n:]
+		}
+		if len(d) < 6 || binary.LittleEndian.Uint16(d) == 0 {
+			return fmt.Errorf("page %d: no child pointers", pageID)
+		}
+		pageID = binary.LittleEndian.Uint32(d[2:6])
+	}
+
+	for visited := uint32(0); ; visited++ {
+		if visited >= pages {
+			return errors.New("leaf chain forms a cycle")
+		}
+		d := buf[2+4:]
+		count := binary.LittleEndian.Uint16(d)
+		d = d[2:]
+		for range count {
+			key, n, err := decodeV1Key[K](d)
+			if err != nil {
+				return fmt.Errorf("page %d: %w", pageID, err)
+			}
+			d = d[n:]
+			if len(d) < 2 || int(binary.LittleEndian.Uint16(d)) > len(d)-2 {
+				return fmt.Errorf("page %d: value runs past the page", pageID)
+			}
+			n = int(binary.LittleEndian.Uint16(d))
+			if err := fn(key, string(d[2:2+n])); err != nil {
+				return err
+			}
+			d = d[2+n:]
+		}
+		if len(d) < 4 {
+			return fmt.Errorf("page %d: no next leaf pointer", pageID)
+		}
+		if pageID = binary.LittleEndian.Uint32(d); pageID == 0 {
+			return nil
+		}
+		if err := read(pageID); err != nil {
+			return err
+		}
+		if buf[1] != 1 {
+			return fmt.Errorf("page %d in the leaf chain is not a leaf", pageID)
+		}
+	}
+}
+
+// decodeV1Key decodes a type-tagged Version 1 key and returns its size.
+func decodeV1Key[K tree.Key](d []byte) (K, int, error) {
+	var zero K
+	if len(d) == 0 {
+		return zero, 0, errors.New("key runs past the page")
+	}
+	var key tree.Key
+	var n int
+	switch d[0] {
+	case page.KeyTypeInt:
+		if len(d) < 5 {
+			return zero, 0, errors.New("int key runs past the page")
+		}
+		key, n = tree.IntKey(int32(binary.LittleEndian.Uint32(d[1:5]))), 5
+	case page.KeyTypeFloat:
+		if len(d) < 9 {
+			return zero, 0, errors.New("float key runs past the page")
+		}
+		key, n = tree.FloatKey(math.Float64frombits(binary.LittleEndian.Uint64(d[1:9]))), 9
+	case page.KeyTypeString:
+		if len(d) < 3 || int(binary.LittleEndian.Uint16(d[1:3])) > len(d)-3 {
+			return zero, 0, errors.New("string key runs past the page")
+		}
+		n = 3 + int(binary.LittleEndian.Uint16(d[1:3]))
+		key = tree.StringKey(d[3:n])
+	default:
+		return zero, 0, fmt.Errorf("unknown key type %d", d[0])
+	}
+	typed, ok := key.(K)
+	if !ok {
+		return zero, 0, fmt.Errorf("key type %T does not match tree key type %T", key, zero)
+	}
+	return typed, n, nil
+}
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"testing"
+)
+
+// test_index.idx is a Version 1 file of order 5 holding twelve int keys with
+// string values. Opening it read-write upgrades it in place.
+func TestOpenVersion1File(t *testing.T) {
+	b, err := os.ReadFile("../test_index.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "t.idx")
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDiskTreeReadOnly[tree.IntKey](path, page.StringCodec{}); !errors.Is(err, errVersion1) {
+		t.Fatalf("read-only open: got %v, want errVersion1", err)
+	}
+	tr, err := OpenDiskTree[tree.IntKey](path, page.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.GetOrder() != 5 || tr.GetKeyCount() != 12 {
+		t.Errorf("order %d with %d keys, want 5 with 12", tr.GetOrder(), tr.GetKeyCount())
+	}
+	for k, want := range map[tree.IntKey]string{1: "one", 12: "twelve", 34: "thirtyfour"} {
+		if v, err := tr.Search(k); err != nil || v != want {
+			t.Errorf("key %d: %q, %v; want %q", k, v, err, want)
+		}
+	}
+	if err := tr.Insert(35, "thirtyfive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyFile[tree.IntKey](path, page.StringCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("upgraded file: %+v orphans %v", report.Problems, report.OrphanPages)
+	}
+	if _, err := os.Stat(path + ".upgrade"); !os.IsNotExist(err) {
+		t.Errorf("upgrade left its temporary file: %v", err)
+	}
+}
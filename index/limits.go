@@ -0,0 +1,49 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/page"
+)
+
+// ErrKeyTooLarge is returned by Insert for a key whose encoding could not fit
+// in a node of the tree's order.
+var ErrKeyTooLarge = errors.New("key too large")
+
+// ErrValueTooLarge is returned by Insert for a value that, together with its
+// key, could not fit in a leaf of the tree's order.
+var ErrValueTooLarge = errors.New("value too large")
+
+// MaxKeySize returns the largest encoded key, in bytes, that Insert accepts.
+func (t *DiskTree[K, V]) MaxKeySize() int {
+	return page.MaxKeySize(t.order)
+}
+
+// MaxPairSize returns the largest encoded key plus value, in bytes, that
+// Insert accepts. Limits are fixed by the page size and the tree order so
+// that a full node always fits in one page.
+func (t *DiskTree[K, V]) MaxPairSize() int {
+	return page.MaxCellSize(t.order)
+}
+
+// checkPairSize rejects a pair that could overflow a page before the tree is
+// touched, so an oversized insert leaves no partial changes behind.
+func (t *DiskTree[K, V]) checkPairSize(key K, value V) error {
+	codec := t.indexFile.codec
+	keySize, err := codec.EncodedKeySize(key)
+	if err != nil {
+		return err
+	}
+	if keySize > t.MaxKeySize() {
+		return fmt.Errorf("%w: %d bytes encoded, limit %d for order %d", ErrKeyTooLarge, keySize, t.MaxKeySize(), t.order)
+	}
+
+	pair, err := codec.EncodePair(key, value)
+	if err != nil {
+		return err
+	}
+	if len(pair) > t.MaxPairSize() {
+		return fmt.Errorf("%w: %d bytes encoded with key, limit %d for order %d", ErrValueTooLarge, len(pair), t.MaxPairSize(), t.order)
+	}
+	return nil
+}
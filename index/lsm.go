@@ -0,0 +1,650 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"pranavdb/filelock"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"sort"
+	"sync"
+)
+
+/*
+LSM trees
+
+An LSMTree takes writes without touching a B+ tree page. Each Put or Delete
+is appended to a write-ahead log and applied to an in-memory memtable; when
+the memtable holds MemtableBytes of log records it is frozen, a new
+memtable and log are started, and a background goroutine writes the frozen
+one out as an immutable DiskTree. Once CompactAt disk trees have piled up
+they are merged into one. A Delete is a tombstone entry that hides older
+versions of its key until a merge of every disk tree drops it.
+
+Reads consult the memtable, then the frozen memtable, then the disk trees
+newest first; the first entry found for a key wins. The files are:
+
+	<path>           manifest: the disk trees in age order (see lsmCompaction.go)
+	<path>.wal       log of the memtable
+	<path>.wal.old   log of the frozen memtable, until its disk tree is in the manifest
+	<path>.NNNNNN    disk trees, numbered in the order they were written
+	<path>.lock      held for as long as the tree is open
+
+A log record is
+
+	[0:4]  uint32 pair length
+	[4:8]  uint32 CRC32 of the pair
+	[8:..] key + entry, encoded as on a leaf page (IndexPageCodec.EncodePair)
+
+and a torn last record fails its checksum and is dropped on open. An entry
+is a flag byte, 1 for a tombstone, followed by the encoded value.
+
+An LSMTree is safe for concurrent use. Scan holds a read lock while it runs,
+so fn must not write to the tree.
+*/
+
+const (
+	lsmRecordHeader        = 8
+	lsmDefaultMemtableSize = 4 << 20
+	lsmDefaultCompactAt    = 4
+)
+
+// LSMOptions configures an LSMTree. Zero values select the defaults.
+type LSMOptions struct {
+	// MemtableBytes is the size of log records the memtable takes before it
+	// is frozen and written to a disk tree. Default 4MB.
+	MemtableBytes int
+	// CompactAt is the number of disk trees that triggers a merge into one.
+	// Default 4.
+	CompactAt int
+	// Memtable selects the memtable implementation. Default MemtableSorted.
+	Memtable MemtableKind
+	// NoSync skips syncing the log after every write. A crash can then lose
+	// the most recent writes, but never leaves a partial one.
+	NoSync bool
+}
+
+func (opts LSMOptions) withDefaults() LSMOptions {
+	if opts.MemtableBytes <= 0 {
+		opts.MemtableBytes = lsmDefaultMemtableSize
+	}
+	if opts.CompactAt < 2 {
+		opts.CompactAt = lsmDefaultCompactAt
+	}
+	return opts
+}
+
+// LSMTree is a log-structured tree; see "LSM trees" above.
+type LSMTree[K tree.Key, V any] struct {
+	path  string
+	order int
+	opts  LSMOptions
+	codec *page.IndexPageCodec[K, lsmEntry[V]]
+	lock  *os.File
+
+	mu      sync.RWMutex
+	flushed *sync.Cond // signalled on mu when frozen is written out
+	mem     memtable[K, V]
+	frozen  memtable[K, V]  // being written to a disk tree, nil if none
+	runs    []*lsmRun[K, V] // disk trees, oldest first
+	nextSeq uint64
+	wal     *os.File
+	walSize int64
+	err     error // first error hit by the background goroutine
+	closed  bool
+
+	workMu sync.Mutex // serializes flushes and merges
+	kick   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// lsmEntry is what the memtable and disk trees store for a key.
+type lsmEntry[V any] struct {
+	value   V
+	deleted bool
+}
+
+// lsmEntryCodec encodes an entry as a tombstone flag and the value.
+type lsmEntryCodec[V any] struct {
+	values page.ValueCodec[V]
+}
+
+func (c lsmEntryCodec[V]) Encode(e lsmEntry[V]) ([]byte, error) {
+	if e.deleted {
+		return []byte{1}, nil
+	}
+	enc, err := c.values.Encode(e.value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0}, enc...), nil
+}
+
+func (c lsmEntryCodec[V]) Decode(data []byte) (lsmEntry[V], error) {
+	if len(data) == 0 {
+		return lsmEntry[V]{}, errors.New("empty LSM entry")
+	}
+	if data[0] == 1 {
+		return lsmEntry[V]{deleted: true}, nil
+	}
+	value, err := c.values.Decode(data[1:])
+	return lsmEntry[V]{value: value}, err
+}
+
+// memtable holds the newest entries sorted by key. Writes come one at a
+// time, under the tree's lock.
+type memtable[K tree.Key, V any] interface {
+	// put adds or replaces the entry for key; size is its log record's length.
+	put(key K, e lsmEntry[V], size int)
+	get(key K) (lsmEntry[V], bool)
+	// size returns the length of the log records behind the entries.
+	size() int
+	len() int
+	iterator() lsmSource[K, V]
+}
+
+// MemtableKind selects the memtable implementation of an LSMTree.
+type MemtableKind int
+
+const (
+	// MemtableSorted keeps entries in a sorted slice: compact and quick to
+	// read, but an insert moves every larger entry along by one.
+	MemtableSorted MemtableKind = iota
+	// MemtableSkipList keeps entries in a skip list (see lsmSkipList.go):
+	// inserts cost O(log n) whatever the size, and readers need no lock
+	// of their own.
+	MemtableSkipList
+)
+
+// newMemtable returns an empty memtable of the configured kind.
+func (l *LSMTree[K, V]) newMemtable() memtable[K, V] {
+	if l.opts.Memtable == MemtableSkipList {
+		return newSkipListMemtable[K, V]()
+	}
+	return &sortedMemtable[K, V]{}
+}
+
+// sortedMemtable is a memtable kept in a sorted slice.
+type sortedMemtable[K tree.Key, V any] struct {
+	pairs []tree.LeafPair[K, lsmEntry[V]]
+	bytes int
+}
+
+// search returns the index of the first pair with a key >= key.
+func (m *sortedMemtable[K, V]) search(key K) int {
+	return sort.Search(len(m.pairs), func(i int) bool {
+		return !m.pairs[i].K.Less(key)
+	})
+}
+
+func (m *sortedMemtable[K, V]) put(key K, e lsmEntry[V], size int) {
+	i := m.search(key)
+	m.bytes += size
+	if i < len(m.pairs) && m.pairs[i].K.Equal(key) {
+		m.pairs[i].Value = e
+		return
+	}
+	m.pairs = insertAt(m.pairs, i, tree.LeafPair[K, lsmEntry[V]]{K: key, Value: e})
+}
+
+func (m *sortedMemtable[K, V]) get(key K) (lsmEntry[V], bool) {
+	i := m.search(key)
+	if i < len(m.pairs) && m.pairs[i].K.Equal(key) {
+		return m.pairs[i].Value, true
+	}
+	return lsmEntry[V]{}, false
+}
+
+func (m *sortedMemtable[K, V]) size() int { return m.bytes }
+
+func (m *sortedMemtable[K, V]) len() int { return len(m.pairs) }
+
+func (m *sortedMemtable[K, V]) iterator() lsmSource[K, V] {
+	return &sortedMemtableIterator[K, V]{m: m}
+}
+
+// sortedMemtableIterator steps through a sortedMemtable the way a Cursor
+// steps through a disk tree.
+type sortedMemtableIterator[K tree.Key, V any] struct {
+	m   *sortedMemtable[K, V]
+	pos int
+}
+
+func (it *sortedMemtableIterator[K, V]) First() bool {
+	it.pos = 0
+	return it.pos < len(it.m.pairs)
+}
+
+func (it *sortedMemtableIterator[K, V]) Seek(key K) bool {
+	it.pos = it.m.search(key)
+	return it.pos < len(it.m.pairs)
+}
+
+func (it *sortedMemtableIterator[K, V]) Next() bool {
+	it.pos++
+	return it.pos < len(it.m.pairs)
+}
+
+func (it *sortedMemtableIterator[K, V]) Key() K { return it.m.pairs[it.pos].K }
+
+func (it *sortedMemtableIterator[K, V]) Value() lsmEntry[V] { return it.m.pairs[it.pos].Value }
+
+func (it *sortedMemtableIterator[K, V]) Close() error { return nil }
+
+// lsmSource is a memtable or disk tree being read in key order.
+type lsmSource[K tree.Key, V any] interface {
+	First() bool
+	Seek(key K) bool
+	Next() bool
+	Key() K
+	Value() lsmEntry[V]
+	Close() error
+}
+
+// NewLSMTree creates an empty LSM tree at path, replacing any there. values
+// encodes values; nil selects the built-in codec for V.
+func NewLSMTree[K tree.Key, V any](path string, order int, values page.ValueCodec[V], opts LSMOptions) (*LSMTree[K, V], error) {
+	if order < 3 {
+		return nil, errors.New("order must be >= 3")
+	}
+	l, err := newLSMTree[K](path, values, opts)
+	if err != nil {
+		return nil, err
+	}
+	l.order = order
+
+	// drop the disk trees of an earlier tree at path, if it can be read
+	if seqs, _, _, err := readLSMManifest(path); err == nil {
+		for _, seq := range seqs {
+			os.Remove(lsmRunPath(path, seq))
+		}
+	}
+	os.Remove(path + ".wal.old")
+	if l.wal, err = os.OpenFile(path+".wal", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
+		l.lock.Close()
+		return nil, fmt.Errorf("open LSM log: %w", err)
+	}
+	l.nextSeq = 1
+	if err := l.writeManifest(); err != nil {
+		l.wal.Close()
+		l.lock.Close()
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// OpenLSMTree opens an existing LSM tree, replaying its logs; values must
+// match the codec the tree was written with.
+func OpenLSMTree[K tree.Key, V any](path string, values page.ValueCodec[V], opts LSMOptions) (l *LSMTree[K, V], err error) {
+	l, err = newLSMTree[K](path, values, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			l.closeFiles()
+		}
+	}()
+
+	seqs, order, nextSeq, err := readLSMManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	l.order, l.nextSeq = order, nextSeq
+	for _, seq := range seqs {
+		t, err := OpenDiskTreeReadOnly[K](lsmRunPath(path, seq), l.codec.ValueCodec())
+		if err != nil {
+			return nil, fmt.Errorf("open LSM disk tree %d: %w", seq, err)
+		}
+		l.runs = append(l.runs, &lsmRun[K, V]{seq: seq, tree: t})
+	}
+
+	// a frozen memtable that was not written out before the tree closed
+	if old, err := os.OpenFile(path+".wal.old", os.O_RDWR, 0666); err == nil {
+		frozen := l.newMemtable()
+		_, err := l.replay(old, frozen)
+		old.Close()
+		if err != nil {
+			return nil, err
+		}
+		l.frozen = frozen
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("open LSM log: %w", err)
+	}
+
+	if l.wal, err = os.OpenFile(path+".wal", os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return nil, fmt.Errorf("open LSM log: %w", err)
+	}
+	if l.walSize, err = l.replay(l.wal, l.mem); err != nil {
+		return nil, err
+	}
+	// drop a torn record so new ones follow the last whole one
+	if err := l.wal.Truncate(l.walSize); err != nil {
+		return nil, fmt.Errorf("open LSM log: %w", err)
+	}
+
+	go l.run()
+	if l.frozen != nil {
+		l.wake()
+	}
+	return l, nil
+}
+
+// newLSMTree sets up an LSMTree and takes its lock, without touching any
+// other file.
+func newLSMTree[K tree.Key, V any](path string, values page.ValueCodec[V], opts LSMOptions) (*LSMTree[K, V], error) {
+	if values == nil {
+		values = page.DefaultValueCodec[V]()
+	}
+	if values == nil {
+		var zero V
+		return nil, fmt.Errorf("no value codec for value type %T", zero)
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LSM lock file: %w", err)
+	}
+	if err := filelock.Lock(lock, filelock.Exclusive); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock LSM tree: %w", err)
+	}
+
+	l := &LSMTree[K, V]{
+		path:  path,
+		opts:  opts.withDefaults(),
+		codec: page.NewIndexPageCodecWithValues[K, lsmEntry[V]](lsmEntryCodec[V]{values}),
+		lock:  lock,
+		kick:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	l.flushed = sync.NewCond(&l.mu)
+	l.mem = l.newMemtable()
+	return l, nil
+}
+
+// replay applies the whole records in a log to m and returns the length
+// they take up.
+func (l *LSMTree[K, V]) replay(f *os.File, m memtable[K, V]) (int64, error) {
+	buf, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		return 0, fmt.Errorf("read LSM log: %w", err)
+	}
+	var used int64
+	for len(buf) >= lsmRecordHeader {
+		n := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if lsmRecordHeader+n > len(buf) {
+			break // torn record
+		}
+		pair := buf[lsmRecordHeader : lsmRecordHeader+n]
+		if crc32.ChecksumIEEE(pair) != binary.LittleEndian.Uint32(buf[4:8]) {
+			break
+		}
+		key, e, _, err := l.codec.DecodePair(pair)
+		if err != nil {
+			return 0, fmt.Errorf("replay LSM log: %w", err)
+		}
+		m.put(key, e, lsmRecordHeader+n)
+		used += int64(lsmRecordHeader + n)
+		buf = buf[lsmRecordHeader+n:]
+	}
+	return used, nil
+}
+
+// Put sets the value for key, replacing any earlier one.
+func (l *LSMTree[K, V]) Put(key K, value V) error {
+	return l.write(key, lsmEntry[V]{value: value})
+}
+
+// Delete removes key. Deleting a key that is not there is not an error.
+func (l *LSMTree[K, V]) Delete(key K) error {
+	return l.write(key, lsmEntry[V]{deleted: true})
+}
+
+// write logs an entry, adds it to the memtable and freezes the memtable once
+// it is full.
+func (l *LSMTree[K, V]) write(key K, e lsmEntry[V]) error {
+	pair, err := l.encodePair(key, e)
+	if err != nil {
+		return err
+	}
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(pair)))
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(pair))
+	record = append(record, pair...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New("LSM tree is closed")
+	}
+	if l.err != nil {
+		return l.err
+	}
+	if _, err := l.wal.WriteAt(record, l.walSize); err != nil {
+		return fmt.Errorf("append LSM log record: %w", err)
+	}
+	if !l.opts.NoSync {
+		if err := l.wal.Sync(); err != nil {
+			return fmt.Errorf("sync LSM log: %w", err)
+		}
+	}
+	l.walSize += int64(len(record))
+	l.mem.put(key, e, len(record))
+
+	if l.mem.size() >= l.opts.MemtableBytes {
+		return l.freeze()
+	}
+	return nil
+}
+
+// encodePair encodes a log record's pair, rejecting pairs that would not fit
+// in a disk tree of the tree's order.
+func (l *LSMTree[K, V]) encodePair(key K, e lsmEntry[V]) ([]byte, error) {
+	keySize, err := l.codec.EncodedKeySize(key)
+	if err != nil {
+		return nil, err
+	}
+	if limit := page.MaxKeySize(l.order); keySize > limit {
+		return nil, fmt.Errorf("%w: %d bytes encoded, limit %d for order %d", ErrKeyTooLarge, keySize, limit, l.order)
+	}
+	pair, err := l.codec.EncodePair(key, e)
+	if err != nil {
+		return nil, err
+	}
+	if limit := page.MaxCellSize(l.order); len(pair) > limit {
+		return nil, fmt.Errorf("%w: %d bytes encoded with key, limit %d for order %d", ErrValueTooLarge, len(pair), limit, l.order)
+	}
+	return pair, nil
+}
+
+// freeze hands the memtable to the background goroutine and starts a new
+// one with a new log. It waits for an earlier frozen memtable to be written
+// out first. Called with mu held.
+func (l *LSMTree[K, V]) freeze() error {
+	for l.frozen != nil && l.err == nil {
+		l.flushed.Wait()
+	}
+	if l.err != nil {
+		return l.err
+	}
+	if err := l.wal.Sync(); err != nil {
+		return fmt.Errorf("sync LSM log: %w", err)
+	}
+	if err := l.wal.Close(); err != nil {
+		return fmt.Errorf("close LSM log: %w", err)
+	}
+	if err := os.Rename(l.path+".wal", l.path+".wal.old"); err != nil {
+		return fmt.Errorf("rotate LSM log: %w", err)
+	}
+	wal, err := os.OpenFile(l.path+".wal", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("rotate LSM log: %w", err)
+	}
+	l.wal, l.walSize = wal, 0
+	l.frozen, l.mem = l.mem, l.newMemtable()
+	l.wake()
+	return nil
+}
+
+// Search returns the value stored for key.
+func (l *LSMTree[K, V]) Search(key K) (V, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var zero V
+
+	for _, m := range []memtable[K, V]{l.mem, l.frozen} {
+		if m == nil {
+			continue
+		}
+		if e, ok := m.get(key); ok {
+			if e.deleted {
+				return zero, errors.New("key not found")
+			}
+			return e.value, nil
+		}
+	}
+	for i := len(l.runs) - 1; i >= 0; i-- {
+		c := l.runs[i].tree.NewCursor()
+		found := c.Seek(key) && c.Key().Equal(key)
+		var e lsmEntry[V]
+		if found {
+			e = c.Value()
+		}
+		if err := c.Close(); err != nil {
+			return zero, err
+		}
+		if !found {
+			continue
+		}
+		if e.deleted {
+			return zero, errors.New("key not found")
+		}
+		return e.value, nil
+	}
+	return zero, errors.New("key not found")
+}
+
+// RangeSearch returns all key-value pairs in the range [startKey, endKey).
+func (l *LSMTree[K, V]) RangeSearch(startKey, endKey K) ([]tree.LeafPair[K, V], error) {
+	var results []tree.LeafPair[K, V]
+	err := l.scan(&startKey, &endKey, func(key K, value V) error {
+		results = append(results, tree.LeafPair[K, V]{K: key, Value: value})
+		return nil
+	})
+	return results, err
+}
+
+// Scan calls fn for every key-value pair in ascending key order. Returning
+// an error from fn stops the scan and returns it.
+func (l *LSMTree[K, V]) Scan(fn func(key K, value V) error) error {
+	return l.scan(nil, nil, fn)
+}
+
+// scan calls fn for the live pairs from start (or the first key) up to end
+// (or the last key).
+func (l *LSMTree[K, V]) scan(start, end *K, fn func(key K, value V) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	srcs := []lsmSource[K, V]{l.mem.iterator()}
+	if l.frozen != nil {
+		srcs = append(srcs, l.frozen.iterator())
+	}
+	for i := len(l.runs) - 1; i >= 0; i-- {
+		srcs = append(srcs, l.runs[i].tree.NewCursor())
+	}
+	return mergeSources(srcs, start, end, func(key K, e lsmEntry[V]) error {
+		if e.deleted {
+			return nil
+		}
+		return fn(key, e.value)
+	})
+}
+
+// mergeSources positions srcs, newest first, at start and calls fn for each
+// key below end in ascending order, with the entry from the newest source
+// holding it. It closes every source.
+func mergeSources[K tree.Key, V any](srcs []lsmSource[K, V], start, end *K, fn func(key K, e lsmEntry[V]) error) (err error) {
+	defer func() {
+		for _, src := range srcs {
+			err = errors.Join(err, src.Close())
+		}
+	}()
+
+	live := make([]bool, len(srcs))
+	for i, src := range srcs {
+		if start != nil {
+			live[i] = src.Seek(*start)
+		} else {
+			live[i] = src.First()
+		}
+	}
+	for {
+		// ties go to the earlier, newer source
+		best := -1
+		for i, src := range srcs {
+			if live[i] && (best < 0 || src.Key().Less(srcs[best].Key())) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil
+		}
+		key, e := srcs[best].Key(), srcs[best].Value()
+		if end != nil && !key.Less(*end) {
+			return nil
+		}
+		for i, src := range srcs {
+			if live[i] && src.Key().Equal(key) {
+				live[i] = src.Next()
+			}
+		}
+		if err := fn(key, e); err != nil {
+			return err
+		}
+	}
+}
+
+// DiskTreeCount returns the number of disk trees behind the memtables.
+func (l *LSMTree[K, V]) DiskTreeCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.runs)
+}
+
+// Close stops the background goroutine and closes the files. The memtables
+// are not written out; their logs are replayed on the next open.
+func (l *LSMTree[K, V]) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.stop)
+	<-l.done
+
+	err := l.wal.Sync()
+	return errors.Join(err, l.closeFiles())
+}
+
+// closeFiles closes the log, the disk trees and the lock.
+func (l *LSMTree[K, V]) closeFiles() error {
+	var err error
+	if l.wal != nil {
+		err = l.wal.Close()
+	}
+	for _, r := range l.runs {
+		err = errors.Join(err, r.tree.Close())
+	}
+	return errors.Join(err, l.lock.Close())
+}
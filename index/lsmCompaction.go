@@ -0,0 +1,317 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"pranavdb/tree"
+)
+
+/*
+LSM manifest and compaction
+
+The manifest at <path> lists the disk trees of an LSMTree, oldest first:
+
+	[0:4]   magic "BPLM"
+	[4:8]   uint32 version
+	[8:12]  uint32 tree order
+	[12:20] uint64 number the next disk tree will get
+	[20:24] uint32 disk tree count n
+	[24:..] n uint64 disk tree numbers
+	then    uint32 CRC32 of everything before it
+
+It is written to <path>.tmp, synced and renamed over <path>, so it is
+always either the old list or the new one. A disk tree file not in the
+manifest is left over from a crash and is overwritten when its number comes
+round again.
+
+A flush writes the frozen memtable's entries in key order into a new disk
+tree, adds it to the manifest and only then removes <path>.wal.old. A merge
+reads every disk tree at once, newest first, keeps the newest entry for each
+key and drops tombstones, since no older version can be left below them.
+The merged tree replaces the old ones in one manifest write; the old files
+are removed afterwards. Readers hold the read lock for a whole read, so
+none is still using an old tree when it is closed.
+*/
+
+var lsmManifestMagic = [4]byte{'B', 'P', 'L', 'M'}
+
+const lsmManifestVersion = 1
+
+// lsmRun is one immutable disk tree of an LSMTree.
+type lsmRun[K tree.Key, V any] struct {
+	seq  uint64
+	tree *DiskTree[K, lsmEntry[V]]
+}
+
+// lsmRunPath returns the file name of disk tree seq.
+func lsmRunPath(base string, seq uint64) string {
+	return fmt.Sprintf("%s.%06d", base, seq)
+}
+
+// readLSMManifest returns the disk tree numbers, tree order and next disk
+// tree number recorded at path.
+func readLSMManifest(path string) (seqs []uint64, order int, nextSeq uint64, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("read LSM manifest: %w", err)
+	}
+	if len(b) < 28 || [4]byte(b[0:4]) != lsmManifestMagic {
+		return nil, 0, 0, errors.New("not an LSM manifest")
+	}
+	body := b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, 0, 0, errors.New("LSM manifest checksum mismatch")
+	}
+	if v := binary.LittleEndian.Uint32(body[4:8]); v != lsmManifestVersion {
+		return nil, 0, 0, fmt.Errorf("unsupported LSM manifest version: %d", v)
+	}
+	order = int(binary.LittleEndian.Uint32(body[8:12]))
+	nextSeq = binary.LittleEndian.Uint64(body[12:20])
+	n := int(binary.LittleEndian.Uint32(body[20:24]))
+	if len(body) != 24+8*n {
+		return nil, 0, 0, errors.New("LSM manifest length mismatch")
+	}
+	for i := 0; i < n; i++ {
+		seqs = append(seqs, binary.LittleEndian.Uint64(body[24+8*i:]))
+	}
+	return seqs, order, nextSeq, nil
+}
+
+// writeManifest replaces the manifest with the current disk tree list.
+// Called with mu held, or before the tree is shared.
+func (l *LSMTree[K, V]) writeManifest() error {
+	b := append([]byte(nil), lsmManifestMagic[:]...)
+	b = binary.LittleEndian.AppendUint32(b, lsmManifestVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(l.order))
+	b = binary.LittleEndian.AppendUint64(b, l.nextSeq)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(l.runs)))
+	for _, r := range l.runs {
+		b = binary.LittleEndian.AppendUint64(b, r.seq)
+	}
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("write LSM manifest: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("write LSM manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("write LSM manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write LSM manifest: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("write LSM manifest: %w", err)
+	}
+	return nil
+}
+
+func (l *LSMTree[K, V]) run() {
+	defer close(l.done)
+	for {
+		select {
+		case <-l.kick:
+		case <-l.stop:
+			return
+		}
+		if err := l.background(); err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.flushed.Broadcast()
+			l.mu.Unlock()
+		}
+	}
+}
+
+// wake asks the background goroutine to flush and merge now.
+func (l *LSMTree[K, V]) wake() {
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+}
+
+// background writes out the frozen memtable, then merges the disk trees if
+// there are CompactAt of them.
+func (l *LSMTree[K, V]) background() error {
+	l.workMu.Lock()
+	defer l.workMu.Unlock()
+	if err := l.flushFrozen(); err != nil {
+		return err
+	}
+	l.mu.RLock()
+	n := len(l.runs)
+	l.mu.RUnlock()
+	if n < l.opts.CompactAt {
+		return nil
+	}
+	return l.compact()
+}
+
+// flushFrozen writes the frozen memtable to a new disk tree. Called with
+// workMu held.
+func (l *LSMTree[K, V]) flushFrozen() error {
+	l.mu.RLock()
+	frozen, seq, bottom := l.frozen, l.nextSeq, len(l.runs) == 0
+	l.mu.RUnlock()
+	if frozen == nil {
+		return nil
+	}
+
+	run, err := l.writeRun(seq, func(emit func(K, lsmEntry[V]) error) error {
+		it := frozen.iterator()
+		for ok := it.First(); ok; ok = it.Next() {
+			// nothing older for a tombstone to hide
+			if bottom && it.Value().deleted {
+				continue
+			}
+			if err := emit(it.Key(), it.Value()); err != nil {
+				return err
+			}
+		}
+		return it.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("flush LSM memtable: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	runs := l.runs
+	if run != nil {
+		l.runs = append(l.runs[:len(l.runs):len(l.runs)], run)
+	}
+	l.nextSeq = seq + 1
+	if err := l.writeManifest(); err != nil {
+		l.runs = runs
+		return fmt.Errorf("flush LSM memtable: %w", errors.Join(err, l.dropRun(run)))
+	}
+	l.frozen = nil
+	l.flushed.Broadcast()
+	if err := os.Remove(l.path + ".wal.old"); err != nil {
+		return fmt.Errorf("flush LSM memtable: %w", err)
+	}
+	return nil
+}
+
+// compact merges every disk tree into one. Called with workMu held, so the
+// disk tree list only changes here.
+func (l *LSMTree[K, V]) compact() error {
+	l.mu.RLock()
+	old, seq := l.runs, l.nextSeq
+	l.mu.RUnlock()
+	if len(old) < 2 {
+		return nil
+	}
+
+	run, err := l.writeRun(seq, func(emit func(K, lsmEntry[V]) error) error {
+		srcs := make([]lsmSource[K, V], 0, len(old))
+		for i := len(old) - 1; i >= 0; i-- {
+			srcs = append(srcs, old[i].tree.NewCursor())
+		}
+		return mergeSources(srcs, nil, nil, func(key K, e lsmEntry[V]) error {
+			if e.deleted {
+				return nil
+			}
+			return emit(key, e)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("merge LSM disk trees: %w", err)
+	}
+
+	l.mu.Lock()
+	l.runs = nil
+	if run != nil {
+		l.runs = []*lsmRun[K, V]{run}
+	}
+	l.nextSeq = seq + 1
+	if err := l.writeManifest(); err != nil {
+		l.runs = old
+		l.mu.Unlock()
+		return fmt.Errorf("merge LSM disk trees: %w", errors.Join(err, l.dropRun(run)))
+	}
+	l.mu.Unlock()
+
+	for _, r := range old {
+		if err := l.dropRun(r); err != nil {
+			return fmt.Errorf("merge LSM disk trees: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeRun writes the entries fill emits, in ascending key order, to disk
+// tree seq and opens it read-only. It returns nil if fill emits nothing.
+func (l *LSMTree[K, V]) writeRun(seq uint64, fill func(emit func(K, lsmEntry[V]) error) error) (*lsmRun[K, V], error) {
+	path := lsmRunPath(l.path, seq)
+	t, err := NewDiskTree[K](path, l.order, l.codec.ValueCodec())
+	if err != nil {
+		return nil, err
+	}
+	err = t.BatchHeaderWrites(func() error {
+		return fill(t.Insert)
+	})
+	empty := t.GetKeyCount() == 0
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || empty {
+		os.Remove(path)
+		return nil, err
+	}
+
+	if t, err = OpenDiskTreeReadOnly[K](path, l.codec.ValueCodec()); err != nil {
+		return nil, err
+	}
+	return &lsmRun[K, V]{seq: seq, tree: t}, nil
+}
+
+// dropRun closes a disk tree no longer in the manifest and removes its file.
+func (l *LSMTree[K, V]) dropRun(r *lsmRun[K, V]) error {
+	if r == nil {
+		return nil
+	}
+	return errors.Join(r.tree.Close(), os.Remove(lsmRunPath(l.path, r.seq)))
+}
+
+// Flush freezes the memtable and waits until it, and any memtable frozen
+// before it, is written to a disk tree.
+func (l *LSMTree[K, V]) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New("LSM tree is closed")
+	}
+	if l.mem.len() > 0 {
+		if err := l.freeze(); err != nil {
+			return err
+		}
+	}
+	for l.frozen != nil && l.err == nil {
+		l.flushed.Wait()
+	}
+	return l.err
+}
+
+// Compact flushes the memtable and merges every disk tree into one now,
+// without waiting for CompactAt disk trees to build up.
+func (l *LSMTree[K, V]) Compact() error {
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	l.workMu.Lock()
+	defer l.workMu.Unlock()
+	return l.compact()
+}
@@ -0,0 +1,139 @@
+package index
+
+import (
+	"math/rand/v2"
+	"pranavdb/tree"
+	"sync/atomic"
+)
+
+/*
+Skip list memtable
+
+A skip list keeps its entries in a linked list in key order, with each
+node also linked into up to skipListMaxLevel sparser express lists above it;
+a node reaches level i+1 with probability 1/4, so a search or insert walks
+O(log n) nodes whatever the size.
+
+Links and entries are atomic pointers and a node is linked in from the
+bottom level up only once its own links are set, so readers need no lock:
+a reader sees a new node in every list it has reached or in none of the
+ones above, and a replaced entry whole. Writers must still come one at a
+time; the LSMTree's lock sees to that.
+*/
+
+const (
+	skipListMaxLevel = 16
+	skipListBranch   = 4
+)
+
+type skipListNode[K tree.Key, V any] struct {
+	key   K
+	entry atomic.Pointer[lsmEntry[V]]
+	next  []atomic.Pointer[skipListNode[K, V]]
+}
+
+// skipListMemtable is a memtable kept in a skip list.
+type skipListMemtable[K tree.Key, V any] struct {
+	head  *skipListNode[K, V] // sentinel with no key, linked at every level
+	level atomic.Int32        // levels in use
+	bytes int
+	count int
+}
+
+func newSkipListMemtable[K tree.Key, V any]() *skipListMemtable[K, V] {
+	m := &skipListMemtable[K, V]{
+		head: &skipListNode[K, V]{next: make([]atomic.Pointer[skipListNode[K, V]], skipListMaxLevel)},
+	}
+	m.level.Store(1)
+	return m
+}
+
+// seek returns the first node with a key >= key, or nil. If prev is not nil
+// it is filled with the last node before key at each level.
+func (m *skipListMemtable[K, V]) seek(key K, prev []*skipListNode[K, V]) *skipListNode[K, V] {
+	x := m.head
+	for i := int(m.level.Load()) - 1; i >= 0; i-- {
+		for next := x.next[i].Load(); next != nil && next.key.Less(key); next = x.next[i].Load() {
+			x = next
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0].Load()
+}
+
+// randomLevel picks the number of lists a new node joins.
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.IntN(skipListBranch) == 0 {
+		level++
+	}
+	return level
+}
+
+func (m *skipListMemtable[K, V]) put(key K, e lsmEntry[V], size int) {
+	m.bytes += size
+	var prev [skipListMaxLevel]*skipListNode[K, V]
+	if x := m.seek(key, prev[:]); x != nil && x.key.Equal(key) {
+		x.entry.Store(&e)
+		return
+	}
+
+	level := randomLevel()
+	if cur := int(m.level.Load()); level > cur {
+		for i := cur; i < level; i++ {
+			prev[i] = m.head
+		}
+		m.level.Store(int32(level))
+	}
+	n := &skipListNode[K, V]{key: key, next: make([]atomic.Pointer[skipListNode[K, V]], level)}
+	n.entry.Store(&e)
+	for i := 0; i < level; i++ {
+		n.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(n)
+	}
+	m.count++
+}
+
+func (m *skipListMemtable[K, V]) get(key K) (lsmEntry[V], bool) {
+	if x := m.seek(key, nil); x != nil && x.key.Equal(key) {
+		return *x.entry.Load(), true
+	}
+	return lsmEntry[V]{}, false
+}
+
+func (m *skipListMemtable[K, V]) size() int { return m.bytes }
+
+func (m *skipListMemtable[K, V]) len() int { return m.count }
+
+func (m *skipListMemtable[K, V]) iterator() lsmSource[K, V] {
+	return &skipListIterator[K, V]{m: m}
+}
+
+// skipListIterator walks the bottom list of a skipListMemtable.
+type skipListIterator[K tree.Key, V any] struct {
+	m *skipListMemtable[K, V]
+	x *skipListNode[K, V]
+}
+
+func (it *skipListIterator[K, V]) First() bool {
+	it.x = it.m.head.next[0].Load()
+	return it.x != nil
+}
+
+func (it *skipListIterator[K, V]) Seek(key K) bool {
+	it.x = it.m.seek(key, nil)
+	return it.x != nil
+}
+
+func (it *skipListIterator[K, V]) Next() bool {
+	it.x = it.x.next[0].Load()
+	return it.x != nil
+}
+
+func (it *skipListIterator[K, V]) Key() K { return it.x.key }
+
+func (it *skipListIterator[K, V]) Value() lsmEntry[V] { return *it.x.entry.Load() }
+
+func (it *skipListIterator[K, V]) Close() error { return nil }
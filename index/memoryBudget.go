@@ -0,0 +1,133 @@
+package index
+
+import (
+	"errors"
+	"pranavdb/page"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Memory budget
+
+A MemoryBudget caps the memory held by the page caches and flusher buffers
+of every index file that shares it, so a process with many trees open can
+say "use at most 128MB" once instead of sizing each cache by hand:
+
+	budget, _ := index.NewMemoryBudget(128 << 20)
+	a.SetPageCache(index.CacheOptions{Budget: budget})
+	b.SetPageCache(index.CacheOptions{Budget: budget})
+	b.StartFlusher(index.FlushOptions{Interval: time.Second, Budget: budget})
+
+Every cached or buffered page is charged page.PageSize. When a charge takes
+the total over the limit, the budget evicts pages from whichever cache
+sharing it holds the most, by that cache's own policy, until the total is
+back under. Buffered pages cannot be dropped before they are written, so if
+the caches run dry first, the flusher whose page went over writes out its
+buffer before the write returns, and the other flushers are woken to write
+theirs; until they do, the total can stay over the limit.
+
+A cache's Pages still caps that cache within the budget; with a budget set,
+Pages of zero leaves it to the budget alone. A database opened with
+db.Options.MemoryBudget shares one budget across every table's trees.
+Rowfiles keep no page buffers of their own and are not charged.
+*/
+
+// MemoryBudget is a memory limit shared by page caches and flushers; see
+// "Memory budget" above. It is safe for concurrent use.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+
+	mu       sync.Mutex // guards caches and flushers; taken before a cache's lock
+	caches   map[*pageCache]struct{}
+	flushers map[*flusher]struct{}
+}
+
+// NewMemoryBudget returns a budget of limit bytes.
+func NewMemoryBudget(limit int64) (*MemoryBudget, error) {
+	if limit < page.PageSize {
+		return nil, errors.New("memory budget must hold at least one page")
+	}
+	return &MemoryBudget{
+		limit:    limit,
+		caches:   make(map[*pageCache]struct{}),
+		flushers: make(map[*flusher]struct{}),
+	}, nil
+}
+
+// Limit returns the budget in bytes.
+func (b *MemoryBudget) Limit() int64 { return b.limit }
+
+// Used returns the bytes currently charged to the budget.
+func (b *MemoryBudget) Used() int64 { return b.used.Load() }
+
+// charge accounts for pages pages being added (or, negative, released).
+func (b *MemoryBudget) charge(pages int) {
+	b.used.Add(int64(pages) * page.PageSize)
+}
+
+func (b *MemoryBudget) addCache(c *pageCache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.caches[c] = struct{}{}
+}
+
+// removeCache releases a cache's pages and stops charging it.
+func (b *MemoryBudget) removeCache(c *pageCache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.caches, c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b.charge(-len(c.pages))
+	c.budget = nil
+}
+
+func (b *MemoryBudget) addFlusher(f *flusher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushers[f] = struct{}{}
+}
+
+// removeFlusher releases whatever a stopped flusher still buffers.
+func (b *MemoryBudget) removeFlusher(f *flusher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.flushers, f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b.charge(-len(f.dirty))
+	f.budget = nil
+}
+
+// enforce evicts cached pages, largest cache first, until the budget is met.
+// If it still is not, it wakes the flushers and returns true. Callers must
+// not hold a cache's or flusher's lock.
+func (b *MemoryBudget) enforce() bool {
+	if b.used.Load() <= b.limit {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		over := b.used.Load() - b.limit
+		if over <= 0 {
+			return false
+		}
+		var largest *pageCache
+		most := 0
+		for c := range b.caches {
+			if n := c.size(); n > most {
+				largest, most = c, n
+			}
+		}
+		if largest == nil || largest.evict(int((over+page.PageSize-1)/page.PageSize)) == 0 {
+			break
+		}
+	}
+	for f := range b.flushers {
+		f.wake()
+	}
+	return true
+}
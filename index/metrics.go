@@ -0,0 +1,69 @@
+package index
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+/*
+Metrics
+
+Metrics returns a snapshot of an index file's storage counters: the page
+reads and writes of CacheStats plus page allocation and free-list gauges.
+It is safe to call from any goroutine, e.g. a monitoring loop that feeds
+its own metrics sink. PublishExpvar registers the snapshot with expvar
+instead, so anything already scraping /debug/vars picks it up:
+
+	idx.PublishExpvar("orders_index")
+
+	"orders_index": {"Reads": 812, "Hits": 640, ..., "PagesAllocated": 97,
+	                 "PagesFreed": 4, "PageCount": 93, "FreeListLength": 4}
+
+The gauges follow the header, so inside a BatchHeaderWrites batch they lag
+until the batch ends.
+*/
+
+// Metrics is a snapshot of an index file's storage counters.
+type Metrics struct {
+	CacheStats
+	PagesAllocated uint64 // pages handed out by allocatePage, new or reused
+	PagesFreed     uint64 // pages returned to the free list
+	PageCount      uint64 // node pages in the file, live and free
+	FreeListLength uint64 // pages on the free list
+}
+
+// Metrics returns the current storage counters; see "Metrics" above.
+func (idx *IndexFile[K, V]) Metrics() Metrics {
+	c := &idx.counters
+	return Metrics{
+		CacheStats:     idx.Stats(),
+		PagesAllocated: c.allocated.Load(),
+		PagesFreed:     c.freed.Load(),
+		PageCount:      c.pageCount.Load(),
+		FreeListLength: c.freePages.Load(),
+	}
+}
+
+// expvarMu makes checking for a name and publishing it one step, as
+// expvar.Publish panics on a name taken in between.
+var expvarMu sync.Mutex
+
+// PublishExpvar publishes Metrics as the expvar variable name. The variable
+// reads the file's counters for as long as the process runs; expvar has no
+// way to remove it, so publish each file once under a name of its own.
+func (idx *IndexFile[K, V]) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("PublishExpvar: %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any { return idx.Metrics() }))
+	return nil
+}
+
+// updateGauges copies the header's page counts into the metrics gauges.
+func (idx *IndexFile[K, V]) updateGauges() {
+	idx.counters.pageCount.Store(idx.pageCount)
+	idx.counters.freePages.Store(idx.freePageCount)
+}
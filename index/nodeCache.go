@@ -0,0 +1,99 @@
+package index
+
+import (
+	"errors"
+	"pranavdb/internal/failpoint"
+	"pranavdb/tree"
+	"sort"
+)
+
+// nodeCache holds every node loaded or written during one tree operation.
+// Nodes are written back once, when the outermost operation ends, no matter
+// how many times the recursion touched them.
+type nodeCache[V any] struct {
+	nodes map[uint64]tree.Node[V]
+	dirty map[uint64]bool
+	depth int
+}
+
+// beginOp opens an operation scope; scopes nest.
+func (idx *IndexFile[K, V]) beginOp() {
+	if idx.ops == nil {
+		idx.ops = &nodeCache[V]{
+			nodes: make(map[uint64]tree.Node[V]),
+			dirty: make(map[uint64]bool),
+		}
+	}
+	idx.ops.depth++
+}
+
+// endOp closes an operation scope. The outermost close writes every dirty
+// node exactly once, in page order, and drops the cache.
+func (idx *IndexFile[K, V]) endOp() error {
+	idx.ops.depth--
+	if idx.ops.depth > 0 {
+		return nil
+	}
+	cache := idx.ops
+	idx.ops = nil
+
+	pageIDs := make([]uint64, 0, len(cache.dirty))
+	for id := range cache.dirty {
+		pageIDs = append(pageIDs, id)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+
+	for _, id := range pageIDs {
+		if err := failpoint.Inject("op-flush-page"); err != nil {
+			return err
+		}
+		if err := idx.writeNodeNow(cache.nodes[id], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withOperation runs one tree operation with node writes and header writes
+// both deferred to the end.
+func (idx *IndexFile[K, V]) withOperation(fn func() error) error {
+	if idx.readOnly {
+		return ErrReadOnly
+	}
+	return idx.withHeaderBatch(func() error {
+		idx.beginOp()
+		err := fn()
+		return errors.Join(err, idx.endOp())
+	})
+}
+
+// cachedNode returns a node loaded or written earlier in the current operation.
+func (idx *IndexFile[K, V]) cachedNode(pageID uint64) (tree.Node[V], bool) {
+	if idx.ops == nil {
+		return nil, false
+	}
+	node, ok := idx.ops.nodes[pageID]
+	return node, ok
+}
+
+// cacheNode records a node in the current operation, marking it dirty if it
+// was written. It reports false when no operation is open.
+func (idx *IndexFile[K, V]) cacheNode(pageID uint64, node tree.Node[V], dirty bool) bool {
+	if idx.ops == nil {
+		return false
+	}
+	idx.ops.nodes[pageID] = node
+	if dirty {
+		idx.ops.dirty[pageID] = true
+	}
+	return true
+}
+
+// evictNode forgets a page, e.g. because it was just freed.
+func (idx *IndexFile[K, V]) evictNode(pageID uint64) {
+	if idx.ops == nil {
+		return
+	}
+	delete(idx.ops.nodes, pageID)
+	delete(idx.ops.dirty, pageID)
+}
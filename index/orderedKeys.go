@@ -0,0 +1,75 @@
+package index
+
+import (
+	"cmp"
+	"pranavdb/page"
+	"pranavdb/tree"
+)
+
+// A DiskTree compares keys through Key.Less and Key.Equal, an interface call
+// and a type assertion per comparison. For the built-in key types the
+// Ordered constructors compare with < instead; the file format is the same,
+// so a tree created either way can be opened either way.
+
+// NewDiskTreeOrdered is NewDiskTree with the fast key comparisons of the
+// built-in key types.
+func NewDiskTreeOrdered[K tree.OrderedKey, V any](filepath string, order int, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	t, err := NewDiskTree[K](filepath, order, values)
+	if err != nil {
+		return nil, err
+	}
+	t.compare = cmp.Compare[K]
+	return t, nil
+}
+
+// OpenDiskTreeOrdered is OpenDiskTree with the fast key comparisons of the
+// built-in key types.
+func OpenDiskTreeOrdered[K tree.OrderedKey, V any](filepath string, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	t, err := OpenDiskTree[K](filepath, values)
+	if err != nil {
+		return nil, err
+	}
+	t.compare = cmp.Compare[K]
+	return t, nil
+}
+
+// NewMemTreeOrdered is NewMemTree with the fast key comparisons of the
+// built-in key types.
+func NewMemTreeOrdered[K tree.OrderedKey, V any](order int, values page.ValueCodec[V]) (*DiskTree[K, V], error) {
+	t, err := NewMemTree[K](order, values)
+	if err != nil {
+		return nil, err
+	}
+	t.compare = cmp.Compare[K]
+	return t, nil
+}
+
+// cmp returns -1, 0 or +1 as a is less than, equal to or greater than b.
+func (t *DiskTree[K, V]) cmp(a, b K) int {
+	if t.compare != nil {
+		return t.compare(a, b)
+	}
+	if a.Less(b) {
+		return -1
+	}
+	if a.Equal(b) {
+		return 0
+	}
+	return 1
+}
+
+// less reports whether a sorts before b.
+func (t *DiskTree[K, V]) less(a, b K) bool {
+	if t.compare != nil {
+		return t.compare(a, b) < 0
+	}
+	return a.Less(b)
+}
+
+// equal reports whether a and b are the same key.
+func (t *DiskTree[K, V]) equal(a, b K) bool {
+	if t.compare != nil {
+		return t.compare(a, b) == 0
+	}
+	return a.Equal(b)
+}
@@ -0,0 +1,523 @@
+package index
+
+import (
+	"container/list"
+	"errors"
+	"pranavdb/page"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Page cache
+
+SetPageCache keeps up to Pages recently read node and free-list pages in
+memory, so a lookup that walks the same upper levels of the tree again
+reads them without touching the file. The cache is write-through: every
+page write updates the cached copy (or goes on to the flusher and the file
+as before), so it never holds a page the file does not already have or is
+about to get.
+
+Which page leaves a full cache is up to its EvictionPolicy:
+
+	LRU    the page used longest ago; the default
+	Clock  second chance: a page used since the hand last passed is skipped
+	       once. Close to LRU at a lower cost per hit
+	LFU    the page used least often, ties broken by age. A long scan
+	       touches each page once and so cannot push out the hot upper
+	       levels of the tree, which it does under LRU
+
+A policy is told about every page the cache admits, hits and drops, and
+chooses the victim. Policies are used under the cache's lock and need not
+be safe for concurrent use, but an instance must not be shared by two
+caches.
+*/
+
+// EvictionPolicy chooses which page a full page cache drops.
+type EvictionPolicy interface {
+	// Admit records a page newly added to the cache.
+	Admit(pageID uint64)
+	// Access records a hit on a cached page.
+	Access(pageID uint64)
+	// Remove forgets a page dropped from the cache for another reason.
+	Remove(pageID uint64)
+	// Evict forgets and returns the page to drop, or false if it tracks none.
+	Evict() (uint64, bool)
+}
+
+// CacheOptions configures the page cache.
+type CacheOptions struct {
+	// Pages is the most pages held in memory. Zero disables the cache,
+	// unless Budget is set.
+	Pages int
+	// Policy chooses the page to evict; nil selects NewLRUPolicy.
+	Policy EvictionPolicy
+	// Budget, if set, is a memory limit shared with other caches; see
+	// "Memory budget" in memoryBudget.go.
+	Budget *MemoryBudget
+	// ReadAhead is how many pages to prefetch once reads turn sequential;
+	// see "Read-ahead" in prefetch.go. Zero disables it.
+	ReadAhead int
+}
+
+// CacheStats counts page reads and writes since the file was opened, to size
+// the page cache by its hit rate.
+type CacheStats struct {
+	Reads      uint64 // page reads
+	Hits       uint64 // reads served from memory: the page cache or the flusher
+	Misses     uint64 // reads that went to the file
+	Evictions  uint64 // pages the eviction policy dropped from the cache, for its size or the budget
+	WriteBacks uint64 // pages written to the file
+	Prefetched uint64 // pages read ahead into the cache
+}
+
+// HitRate returns Hits/Reads, or 0 before the first read.
+func (s CacheStats) HitRate() float64 {
+	if s.Reads == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Reads)
+}
+
+// cacheCounters backs CacheStats; reads may run concurrently on a read-only
+// file.
+type cacheCounters struct {
+	reads, hits, misses, evictions, writeBacks, prefetched atomic.Uint64
+
+	allocated, freed     atomic.Uint64 // see metrics.go
+	pageCount, freePages atomic.Uint64 // header gauges, as of its last write
+}
+
+// Stats returns the page read and write counters.
+func (idx *IndexFile[K, V]) Stats() CacheStats {
+	c := &idx.counters
+	return CacheStats{
+		Reads:      c.reads.Load(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		WriteBacks: c.writeBacks.Load(),
+		Prefetched: c.prefetched.Load(),
+	}
+}
+
+// pageCache holds copies of whole pages, keyed by page ID.
+type pageCache struct {
+	mu        sync.Mutex
+	pages     map[uint64][]byte
+	capacity  int // 0: no limit but the budget
+	policy    EvictionPolicy
+	budget    *MemoryBudget
+	evictions *atomic.Uint64
+
+	// read-ahead state, see prefetch.go
+	readAhead   int
+	last        uint64 // page read last
+	run         int    // consecutive next-page reads ending at last
+	ahead       uint64 // last page prefetched in this run
+	gen         atomic.Uint64
+	prefetching atomic.Bool
+	wg          sync.WaitGroup // the prefetch in flight
+
+	pinned map[uint64]int  // pin counts, see cursor.go
+	held   map[uint64]bool // pinned pages the policy chose to evict
+}
+
+func newPageCache(opts CacheOptions, evictions *atomic.Uint64) *pageCache {
+	policy := opts.Policy
+	if policy == nil {
+		policy = NewLRUPolicy()
+	}
+	c := &pageCache{
+		pages:     make(map[uint64][]byte, opts.Pages),
+		capacity:  opts.Pages,
+		policy:    policy,
+		budget:    opts.Budget,
+		evictions: evictions,
+		readAhead: opts.ReadAhead,
+		pinned:    make(map[uint64]int),
+		held:      make(map[uint64]bool),
+	}
+	if c.budget != nil {
+		c.budget.addCache(c)
+	}
+	return c
+}
+
+// get copies the cached page into buf, if there is one.
+func (c *pageCache) get(pageID uint64, buf []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.pages[pageID]
+	if ok {
+		copy(buf, data)
+		c.policy.Access(pageID)
+	}
+	return ok
+}
+
+// put caches a copy of a full page, evicting others while the cache is full
+// or over its budget.
+func (c *pageCache) put(pageID uint64, buf []byte) {
+	c.mu.Lock()
+	if data, ok := c.pages[pageID]; ok {
+		copy(data, buf)
+		c.policy.Access(pageID)
+		c.mu.Unlock()
+		return
+	}
+	if c.capacity > 0 && len(c.pages) >= c.capacity {
+		c.evictLocked(len(c.pages) - c.capacity + 1)
+	}
+	c.pages[pageID] = append([]byte(nil), buf...)
+	c.policy.Admit(pageID)
+	budget := c.budget
+	if budget != nil {
+		budget.charge(1)
+	}
+	c.mu.Unlock()
+
+	if budget != nil {
+		budget.enforce()
+	}
+}
+
+// evict drops up to n pages chosen by the policy and returns how many it
+// dropped.
+func (c *pageCache) evict(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictLocked(n)
+}
+
+func (c *pageCache) evictLocked(n int) int {
+	evicted := 0
+	for ; evicted < n; evicted++ {
+		victim, ok := c.policy.Evict()
+		if !ok {
+			break
+		}
+		if c.pinned[victim] > 0 {
+			// keep it, out of the policy's sight until unpinned
+			c.held[victim] = true
+			evicted--
+			continue
+		}
+		delete(c.pages, victim)
+	}
+	c.evictions.Add(uint64(evicted))
+	if c.budget != nil {
+		c.budget.charge(-evicted)
+	}
+	return evicted
+}
+
+// size returns the number of cached pages.
+func (c *pageCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pages)
+}
+
+// drop forgets a page whose file copy changed behind the cache.
+func (c *pageCache) drop(pageID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate()
+	if _, ok := c.pages[pageID]; ok {
+		delete(c.pages, pageID)
+		c.forget(pageID)
+		if c.budget != nil {
+			c.budget.charge(-1)
+		}
+	}
+}
+
+// discardFrom forgets pages at or past pageID, like flusher.discardFrom.
+func (c *pageCache) discardFrom(pageID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate()
+	dropped := 0
+	for id := range c.pages {
+		if id >= pageID {
+			delete(c.pages, id)
+			c.forget(id)
+			dropped++
+		}
+	}
+	if c.budget != nil {
+		c.budget.charge(-dropped)
+	}
+}
+
+// forget takes a page that left the cache out of the policy.
+func (c *pageCache) forget(pageID uint64) {
+	if c.held[pageID] {
+		delete(c.held, pageID)
+		return
+	}
+	c.policy.Remove(pageID)
+}
+
+// pin keeps a page from being evicted until unpin.
+func (c *pageCache) pin(pageID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned[pageID]++
+}
+
+// unpin releases a pin, handing the page back to the policy if it was held.
+func (c *pageCache) unpin(pageID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned[pageID]--; c.pinned[pageID] > 0 {
+		return
+	}
+	delete(c.pinned, pageID)
+	if c.held[pageID] {
+		delete(c.held, pageID)
+		c.policy.Admit(pageID)
+	}
+}
+
+// SetPageCache replaces the page cache with an empty one configured by opts;
+// see "Page cache" above. Pages of zero without a Budget turns caching off.
+func (idx *IndexFile[K, V]) SetPageCache(opts CacheOptions) error {
+	if opts.Pages < 0 || opts.ReadAhead < 0 {
+		return errors.New("SetPageCache: negative cache size")
+	}
+	idx.closeCache()
+	if opts.Pages == 0 && opts.Budget == nil {
+		idx.cache = nil
+		return nil
+	}
+	idx.cache = newPageCache(opts, &idx.counters.evictions)
+	idx.pinMu.Lock()
+	for id, n := range idx.pins {
+		idx.cache.pinned[id] = n
+	}
+	idx.pinMu.Unlock()
+	return nil
+}
+
+// closeCache waits out the cache's prefetch and releases its pages from the
+// budget.
+func (idx *IndexFile[K, V]) closeCache() {
+	c := idx.cache
+	if c == nil {
+		return
+	}
+	c.wg.Wait()
+	if c.budget != nil {
+		c.budget.removeCache(c)
+	}
+}
+
+// cachedRead fills buf from the cache, or reads the whole page from the file
+// and caches it.
+func (idx *IndexFile[K, V]) cachedRead(pageID uint64, buf []byte) error {
+	if idx.cache.get(pageID, buf) {
+		idx.counters.hits.Add(1)
+		return nil
+	}
+	idx.counters.misses.Add(1)
+	full := buf
+	if len(full) != page.PageSize {
+		full = make([]byte, page.PageSize)
+	}
+	if _, err := idx.file.ReadAt(full, pageOffset(pageID)); err != nil {
+		return err
+	}
+	idx.cache.put(pageID, full)
+	copy(buf, full)
+	return nil
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used page.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{elems: make(map[uint64]*list.Element)}
+}
+
+type lruPolicy struct {
+	order list.List // front is most recently used
+	elems map[uint64]*list.Element
+}
+
+func (p *lruPolicy) Admit(pageID uint64) {
+	p.elems[pageID] = p.order.PushFront(pageID)
+}
+
+func (p *lruPolicy) Access(pageID uint64) {
+	if e, ok := p.elems[pageID]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(pageID uint64) {
+	if e, ok := p.elems[pageID]; ok {
+		p.order.Remove(e)
+		delete(p.elems, pageID)
+	}
+}
+
+func (p *lruPolicy) Evict() (uint64, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return 0, false
+	}
+	pageID := e.Value.(uint64)
+	p.order.Remove(e)
+	delete(p.elems, pageID)
+	return pageID, true
+}
+
+// NewClockPolicy returns a second-chance (clock) policy.
+func NewClockPolicy() EvictionPolicy {
+	return &clockPolicy{slots: make(map[uint64]int)}
+}
+
+type clockSlot struct {
+	pageID uint64
+	used   bool // slot holds a page
+	ref    bool // page hit since the hand last passed
+}
+
+type clockPolicy struct {
+	ring  []clockSlot
+	slots map[uint64]int // page ID -> index in ring
+	free  []int          // empty ring slots
+	hand  int
+}
+
+func (p *clockPolicy) Admit(pageID uint64) {
+	slot := clockSlot{pageID: pageID, used: true}
+	if n := len(p.free); n > 0 {
+		i := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.ring[i] = slot
+		p.slots[pageID] = i
+		return
+	}
+	p.slots[pageID] = len(p.ring)
+	p.ring = append(p.ring, slot)
+}
+
+func (p *clockPolicy) Access(pageID uint64) {
+	if i, ok := p.slots[pageID]; ok {
+		p.ring[i].ref = true
+	}
+}
+
+func (p *clockPolicy) Remove(pageID uint64) {
+	if i, ok := p.slots[pageID]; ok {
+		p.ring[i] = clockSlot{}
+		p.free = append(p.free, i)
+		delete(p.slots, pageID)
+	}
+}
+
+func (p *clockPolicy) Evict() (uint64, bool) {
+	if len(p.slots) == 0 {
+		return 0, false
+	}
+	for {
+		p.hand %= len(p.ring)
+		s := &p.ring[p.hand]
+		p.hand++
+		if !s.used {
+			continue
+		}
+		if s.ref {
+			s.ref = false
+			continue
+		}
+		pageID := s.pageID
+		p.Remove(pageID)
+		return pageID, true
+	}
+}
+
+// NewLFUPolicy returns a policy that evicts the least frequently used page,
+// the least recently used of those on a tie.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{
+		entries: make(map[uint64]*lfuEntry),
+		buckets: make(map[int]*list.List),
+	}
+}
+
+type lfuEntry struct {
+	count int
+	elem  *list.Element
+}
+
+type lfuPolicy struct {
+	entries map[uint64]*lfuEntry
+	buckets map[int]*list.List // use count -> pages, most recent at the front
+	least   int                // lowest use count, if its bucket is not empty
+}
+
+func (p *lfuPolicy) push(pageID uint64, e *lfuEntry) {
+	b, ok := p.buckets[e.count]
+	if !ok {
+		b = list.New()
+		p.buckets[e.count] = b
+	}
+	e.elem = b.PushFront(pageID)
+}
+
+func (p *lfuPolicy) unlink(e *lfuEntry) {
+	b := p.buckets[e.count]
+	b.Remove(e.elem)
+	if b.Len() == 0 {
+		delete(p.buckets, e.count)
+	}
+}
+
+func (p *lfuPolicy) Admit(pageID uint64) {
+	e := &lfuEntry{count: 1}
+	p.entries[pageID] = e
+	p.push(pageID, e)
+	p.least = 1
+}
+
+func (p *lfuPolicy) Access(pageID uint64) {
+	e, ok := p.entries[pageID]
+	if !ok {
+		return
+	}
+	p.unlink(e)
+	if e.count == p.least && p.buckets[e.count] == nil {
+		p.least++
+	}
+	e.count++
+	p.push(pageID, e)
+}
+
+func (p *lfuPolicy) Remove(pageID uint64) {
+	if e, ok := p.entries[pageID]; ok {
+		p.unlink(e)
+		delete(p.entries, pageID)
+	}
+}
+
+func (p *lfuPolicy) Evict() (uint64, bool) {
+	if len(p.entries) == 0 {
+		return 0, false
+	}
+	b, ok := p.buckets[p.least]
+	if !ok {
+		// Remove emptied the lowest bucket; find the next one
+		p.least = 0
+		for count := range p.buckets {
+			if p.least == 0 || count < p.least {
+				p.least = count
+			}
+		}
+		b = p.buckets[p.least]
+	}
+	pageID := b.Back().Value.(uint64)
+	p.Remove(pageID)
+	return pageID, true
+}
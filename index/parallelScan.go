@@ -0,0 +1,147 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/tree"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Parallel range scans
+
+ParallelRangeScan splits [startKey, endKey) at separator keys taken from
+the internal nodes, so that every partition starts at a subtree boundary,
+and scans the partitions on a pool of goroutines. It walks down the tree a
+level at a time, collecting the separators that fall inside the range,
+until it has about partitionsPerWorker partitions per worker or reaches the
+level above the leaves; if it collected more than that, it keeps an evenly
+spaced subset. Having a few partitions per worker keeps every goroutine
+busy when some partitions turn out larger than others.
+
+Each partition is read with its own Cursor, so the leaves it passes are
+pinned one at a time as in a serial scan.
+*/
+
+const partitionsPerWorker = 4
+
+// ParallelRangeScan calls fn for every pair in [startKey, endKey), scanning
+// on up to workers goroutines. fn is called from several goroutines at once
+// and must be safe for that: pairs of one partition arrive in ascending key
+// order, but partitions interleave. The first error, from fn or a read,
+// stops every worker and is returned. As with the rest of DiskTree, the
+// tree must not be written while the scan runs.
+func (t *DiskTree[K, V]) ParallelRangeScan(startKey, endKey K, workers int, fn func(key K, value V) error) error {
+	if workers < 1 {
+		return errors.New("ParallelRangeScan: workers must be at least 1")
+	}
+	if !t.less(startKey, endKey) || t.indexFile.GetRoot() == 0 {
+		return nil
+	}
+	bounds, err := t.partitionBounds(startKey, endKey, workers*partitionsPerWorker)
+	if err != nil {
+		return fmt.Errorf("ParallelRangeScan: %w", err)
+	}
+
+	parts := make(chan int, len(bounds)+1)
+	for i := 0; i <= len(bounds); i++ {
+		parts <- i
+	}
+	close(parts)
+
+	var (
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		errMu    sync.Mutex
+		firstErr error
+	)
+	for w := 0; w < min(workers, len(bounds)+1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range parts {
+				lo, hi := startKey, endKey
+				if i > 0 {
+					lo = bounds[i-1]
+				}
+				if i < len(bounds) {
+					hi = bounds[i]
+				}
+				if err := t.scanPartition(lo, hi, &stop, fn); err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					stop.Store(true)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// partitionBounds returns up to parts-1 separator keys strictly inside
+// (startKey, endKey), in ascending order; see "Parallel range scans" above.
+func (t *DiskTree[K, V]) partitionBounds(startKey, endKey K, parts int) ([]K, error) {
+	var bounds []K
+	level := []uint64{t.indexFile.GetRoot()}
+	// the last internal level is height-1 levels down from the root
+	for depth := 1; depth < int(t.indexFile.GetHeight()) && len(bounds) < parts-1; depth++ {
+		var children []uint64
+		for _, pageID := range level {
+			node, err := t.indexFile.readNode(pageID)
+			if err != nil {
+				return nil, err
+			}
+			interm, ok := node.(*tree.IntermNode[K, V])
+			if !ok {
+				return nil, fmt.Errorf("page %d: expected an internal node", pageID)
+			}
+			// child i holds keys in [Keys[i-1], Keys[i])
+			for i, child := range interm.Pointers {
+				if i > 0 && !t.less(interm.Keys[i-1], endKey) {
+					break
+				}
+				if i < len(interm.Keys) && !t.less(startKey, interm.Keys[i]) {
+					continue
+				}
+				if i > 0 && t.less(startKey, interm.Keys[i-1]) {
+					bounds = append(bounds, interm.Keys[i-1])
+				}
+				children = append(children, child)
+			}
+		}
+		level = children
+	}
+
+	sort.Slice(bounds, func(i, j int) bool { return t.less(bounds[i], bounds[j]) })
+	if len(bounds) <= parts-1 {
+		return bounds, nil
+	}
+	kept := make([]K, 0, parts-1)
+	for i := 1; i < parts; i++ {
+		kept = append(kept, bounds[i*len(bounds)/parts])
+	}
+	return kept, nil
+}
+
+// scanPartition calls fn for the pairs in [lo, hi), giving up early once
+// stop is set by another partition's failure.
+func (t *DiskTree[K, V]) scanPartition(lo, hi K, stop *atomic.Bool, fn func(key K, value V) error) error {
+	c := t.NewCursor()
+	for ok := c.Seek(lo); ok && t.less(c.Key(), hi); ok = c.Next() {
+		if stop.Load() {
+			return c.Close()
+		}
+		if err := fn(c.Key(), c.Value()); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return c.Close()
+}
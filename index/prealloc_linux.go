@@ -0,0 +1,19 @@
+//go:build linux
+
+package index
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocateFile reserves [offset, offset+length) with fallocate, falling back
+// to writing zeros on filesystems that do not support it.
+func preallocateFile(f *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return zeroFill(f, offset, length)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package index
+
+import "os"
+
+// preallocateFile reserves [offset, offset+length) by writing zeros.
+func preallocateFile(f *os.File, offset, length int64) error {
+	return zeroFill(f, offset, length)
+}
@@ -0,0 +1,118 @@
+package index
+
+import (
+	"pranavdb/page"
+)
+
+/*
+Read-ahead
+
+With CacheOptions.ReadAhead set, the page cache watches the order pages are
+read in. Once sequentialRun reads in a row have each asked for the page
+after the last one, as a scan of a bulk-loaded leaf chain does, it reads
+the next ReadAhead pages into the cache in the background with a single
+ReadAt, and tops the window up whenever the reader is half way through it.
+A read of any other page ends the run.
+
+A prefetch must never cache a page older than the one a writer has since
+written. Every write to a page (to the file, the flusher or the cache) and
+every page dropped bumps the cache's generation, and a prefetch that sees
+the generation change while it read is thrown away. Pages the flusher holds
+are newer than the file and are skipped, and nothing past the last
+allocated page is read.
+*/
+
+// sequentialRun is the number of consecutive next-page reads that start
+// read-ahead.
+const sequentialRun = 2
+
+// readAheadRange records a read of pageID and returns the pages to prefetch,
+// if the reads have turned sequential and the window needs topping up.
+// readAhead moves the window once the prefetch starts.
+func (c *pageCache) readAheadRange(pageID uint64) (from, to uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch pageID {
+	case c.last:
+		// a re-read neither extends nor ends the run
+	case c.last + 1:
+		c.run++
+	default:
+		c.run, c.ahead = 0, 0
+	}
+	c.last = pageID
+	if c.readAhead == 0 || c.run < sequentialRun {
+		return 0, 0, false
+	}
+	if pageID+uint64(c.readAhead)/2 < c.ahead {
+		return 0, 0, false
+	}
+	return max(pageID+1, c.ahead+1), pageID + uint64(c.readAhead), true
+}
+
+// invalidate marks that a page changed, spoiling any prefetch in flight.
+func (c *pageCache) invalidate() {
+	c.gen.Add(1)
+}
+
+// fill caches prefetched pages starting at from, unless a page changed since
+// the prefetch took gen. Pages already cached, or in skip, are left alone.
+func (c *pageCache) fill(from uint64, buf []byte, gen uint64, skip map[uint64]bool) int {
+	c.mu.Lock()
+	if c.gen.Load() != gen {
+		c.mu.Unlock()
+		return 0
+	}
+	added := 0
+	for off := 0; off+page.PageSize <= len(buf); off += page.PageSize {
+		id := from + uint64(off/page.PageSize)
+		if _, ok := c.pages[id]; ok || skip[id] {
+			continue
+		}
+		if c.capacity > 0 && len(c.pages) >= c.capacity {
+			c.evictLocked(len(c.pages) - c.capacity + 1)
+		}
+		c.pages[id] = append([]byte(nil), buf[off:off+page.PageSize]...)
+		c.policy.Admit(id)
+		added++
+	}
+	budget := c.budget
+	if budget != nil {
+		budget.charge(added)
+	}
+	c.mu.Unlock()
+
+	if budget != nil {
+		budget.enforce()
+	}
+	return added
+}
+
+// readAhead starts a background read of pages from..to into the cache, unless
+// one is already running.
+func (idx *IndexFile[K, V]) readAhead(from, to uint64) {
+	c := idx.cache
+	to = min(to, idx.pageCount)
+	if from > to || !c.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+	c.mu.Lock()
+	c.ahead = to
+	c.mu.Unlock()
+	gen := c.gen.Load()
+	fl := idx.flusher
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.prefetching.Store(false)
+
+		buf := make([]byte, (to-from+1)*page.PageSize)
+		n, _ := idx.file.ReadAt(buf, pageOffset(from))
+		var skip map[uint64]bool
+		if fl != nil {
+			skip = fl.buffered(from, to)
+		}
+		added := c.fill(from, buf[:n-n%page.PageSize], gen, skip)
+		idx.counters.prefetched.Add(uint64(added))
+	}()
+}
@@ -0,0 +1,336 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pranavdb/filelock"
+	"pranavdb/page"
+	"pranavdb/tree"
+	"sync"
+)
+
+/*
+Segmented storage
+
+A segmented index spreads the byte space of a single index file over
+segment files "<path>.0001", "<path>.0002", ... of SegmentPages pages each,
+so a tree can outgrow the filesystem's file size limit. Segment 1 also
+holds the header, which records SegmentPages:
+
+	<path>.0001  header, pages 0 .. SegmentPages-1
+	<path>.0002  pages SegmentPages .. 2*SegmentPages-1
+	...
+
+Pages keep their global IDs; page p lives in segment p/SegmentPages + 1.
+Segments past the first are created as the file grows and removed when it
+shrinks below them. Every segment is locked like a single index file.
+*/
+
+// segmentPath returns the name of segment i, counting from 0.
+func segmentPath(base string, i int) string {
+	return fmt.Sprintf("%s.%04d", base, i+1)
+}
+
+// segmentedStorage is storage split over fixed-size segment files.
+type segmentedStorage struct {
+	base     string
+	segBytes int64 // bytes of pages per segment
+	readOnly bool
+
+	mu    sync.RWMutex // guards files; writers hold it to add or drop segments
+	files []*os.File
+}
+
+// start returns the offset of segment i in the combined byte space.
+func (s *segmentedStorage) start(i int) int64 {
+	if i == 0 {
+		return 0
+	}
+	return HeaderSize + int64(i)*s.segBytes
+}
+
+// locate returns the segment holding offset off.
+func (s *segmentedStorage) locate(off int64) int {
+	if off < HeaderSize {
+		return 0
+	}
+	return int((off - HeaderSize) / s.segBytes)
+}
+
+// openSegment opens (or, for a writer, creates) segment i and locks it.
+func (s *segmentedStorage) openSegment(i int, create bool) (*os.File, error) {
+	flag, mode := os.O_RDWR, filelock.Exclusive
+	if s.readOnly {
+		flag, mode = os.O_RDONLY, filelock.Shared
+	}
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(segmentPath(s.base, i), flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := filelock.Lock(f, mode); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock segment %d: %w", i+1, err)
+	}
+	return f, nil
+}
+
+func (s *segmentedStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	read := 0
+	for read < len(p) {
+		i := s.locate(off)
+		if i >= len(s.files) {
+			return read, io.EOF
+		}
+		chunk := p[read:min(len(p), read+int(s.start(i+1)-off))]
+		n, err := s.files[i].ReadAt(chunk, off-s.start(i))
+		read += n
+		off += int64(n)
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (s *segmentedStorage) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); len(p) > 0 && s.locate(end-1) >= s.count() {
+		if err := s.grow(s.locate(end-1) + 1); err != nil {
+			return 0, err
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	written := 0
+	for written < len(p) {
+		i := s.locate(off)
+		chunk := p[written:min(len(p), written+int(s.start(i+1)-off))]
+		n, err := s.files[i].WriteAt(chunk, off-s.start(i))
+		written += n
+		off += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *segmentedStorage) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.files)
+}
+
+// grow creates segments up to n, filling out the ones before the last so
+// every offset below the new end reads back.
+func (s *segmentedStorage) grow(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.files) < n {
+		last := len(s.files) - 1
+		if err := s.files[last].Truncate(s.start(last+1) - s.start(last)); err != nil {
+			return err
+		}
+		f, err := s.openSegment(len(s.files), true)
+		if err != nil {
+			return err
+		}
+		// clear a stray file left by some other index
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return err
+		}
+		s.files = append(s.files, f)
+	}
+	return nil
+}
+
+func (s *segmentedStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	last := len(s.files) - 1
+	info, err := s.files[last].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return s.start(last) + info.Size(), nil
+}
+
+func (s *segmentedStorage) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate sets the combined size, adding or removing whole segments.
+func (s *segmentedStorage) Truncate(size int64) error {
+	n := 1
+	if size > s.start(1) {
+		n = s.locate(size-1) + 1
+	}
+	if n > s.count() {
+		if err := s.grow(n); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.files) > n {
+		last := len(s.files) - 1
+		f := s.files[last]
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+		s.files = s.files[:last]
+	}
+	return s.files[n-1].Truncate(size - s.start(n-1))
+}
+
+func (s *segmentedStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.Close())
+	}
+	s.files = nil
+	return errors.Join(errs...)
+}
+
+// NewSegmentedIndexFile creates (or truncates) a segmented index at path,
+// with segmentPages pages per segment file; see "Segmented storage" above.
+func NewSegmentedIndexFile[K tree.Key, V any](path string, order int, segmentPages uint32, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	if segmentPages < 2 {
+		return nil, errors.New("segmentPages must be >= 2")
+	}
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segmentedStorage{base: path, segBytes: int64(segmentPages) * page.PageSize}
+	first, err := s.openSegment(0, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index file: %w", err)
+	}
+	s.files = []*os.File{first}
+	// Truncate also removes the segments of an earlier index at path
+	for i := 1; ; i++ {
+		if _, err := os.Stat(segmentPath(path, i)); err != nil {
+			break
+		}
+		f, err := s.openSegment(i, false)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open old segment: %w", err)
+		}
+		s.files = append(s.files, f)
+	}
+	if err := s.Truncate(0); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to truncate index file: %w", err)
+	}
+
+	indexFile := &IndexFile[K, V]{
+		file:         s,
+		order:        order,
+		codec:        codec,
+		segmentPages: segmentPages,
+	}
+	if err := indexFile.writeHeader(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+	return indexFile, nil
+}
+
+// OpenSegmentedIndexFile opens an existing segmented index for reading and
+// writing. Every segment is locked exclusively until Close.
+func OpenSegmentedIndexFile[K tree.Key, V any](path string, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	indexFile, err := openSegmentedIndexFile[K](path, false, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finish any page write that was interrupted by a crash.
+	if err := indexFile.recoverDoubleWrite(); err != nil {
+		indexFile.file.Close()
+		return nil, fmt.Errorf("failed to recover double-write buffer: %w", err)
+	}
+
+	return indexFile, nil
+}
+
+// OpenSegmentedIndexFileReadOnly opens a segmented index under shared locks,
+// like OpenIndexFileReadOnly.
+func OpenSegmentedIndexFileReadOnly[K tree.Key, V any](path string, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	indexFile, err := openSegmentedIndexFile[K](path, true, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending, _, err := indexFile.pendingDoubleWrite(); err != nil || pending != 0 {
+		indexFile.file.Close()
+		if err == nil {
+			err = fmt.Errorf("page %d needs double-write recovery; open read-write first", pending)
+		}
+		return nil, err
+	}
+
+	return indexFile, nil
+}
+
+func openSegmentedIndexFile[K tree.Key, V any](path string, readOnly bool, values page.ValueCodec[V]) (*IndexFile[K, V], error) {
+	codec, err := newPageCodec[K](values)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segmentedStorage{base: path, readOnly: readOnly}
+	for i := 0; ; i++ {
+		f, err := s.openSegment(i, false)
+		if errors.Is(err, os.ErrNotExist) && i > 0 {
+			break
+		}
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open index file: %w", err)
+		}
+		s.files = append(s.files, f)
+	}
+
+	// the segment size is needed to read anything past the header
+	block := make([]byte, HeaderSize)
+	if _, err := s.files[0].ReadAt(block, 0); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	fields, _, err := chooseHeader(block)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	segmentPages := int64(binary.LittleEndian.Uint32(fields[56:60]))
+	if segmentPages == 0 {
+		s.Close()
+		return nil, fmt.Errorf("%s is not a segmented index; use OpenIndexFile", segmentPath(path, 0))
+	}
+	s.segBytes = segmentPages * page.PageSize
+
+	return loadIndexFile[K](s, codec, readOnly)
+}
@@ -0,0 +1,93 @@
+package index
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// storage is the byte-addressable space an IndexFile lives in: a real file
+// for on-disk trees or a growable slice for in-memory ones.
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// fileStorage is storage backed by an *os.File.
+type fileStorage struct {
+	*os.File
+}
+
+func (f fileStorage) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// memStorage is storage backed by memory. It behaves like a sparse file:
+// writes past the end grow it and the gap reads back as zeros.
+type memStorage struct {
+	mu  sync.RWMutex
+	buf []byte
+}
+
+func (m *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.buf)) {
+		m.grow(end)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memStorage) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.buf)), nil
+}
+
+func (m *memStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size > int64(len(m.buf)) {
+		m.grow(size)
+		return nil
+	}
+	clear(m.buf[size:])
+	m.buf = m.buf[:size]
+	return nil
+}
+
+// grow extends buf to size bytes, zero filled.
+func (m *memStorage) grow(size int64) {
+	if size <= int64(cap(m.buf)) {
+		m.buf = m.buf[:size]
+		return
+	}
+	grown := make([]byte, size, max(size, 2*int64(cap(m.buf))))
+	copy(grown, m.buf)
+	m.buf = grown
+}
+
+func (m *memStorage) Sync() error { return nil }
+
+func (m *memStorage) Close() error { return nil }
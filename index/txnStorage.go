@@ -0,0 +1,247 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"pranavdb/tree"
+	"pranavdb/txn"
+	"sync"
+)
+
+/*
+Transactions
+
+An IndexFile joins a txn.Txn by swapping its storage for a txnStorage,
+which keeps every write and truncation in memory, in order, with the bytes
+it replaces, and lays them over the file on reads. Node, free-list and
+header writes all go through the storage, so the tree behaves as usual
+inside the transaction while the file is left untouched.
+
+BeginTxn flushes buffered pages first, so the flusher only ever holds
+pages of the transaction; TxnWrites flushes again so none is left out.
+ApplyTxn, and EndTxn on commit, write the held changes to the file without
+syncing it: the transaction log makes them durable. EndTxn on rollback
+drops them along with any buffered or cached page they produced and
+reloads the header. Only single-file indexes can join: the log names each
+write by its file, and a segmented or in-memory index has none.
+*/
+
+var _ txn.Participant = (*DiskTree[tree.IntKey, uint64])(nil)
+
+// txnStorage holds back the writes made to a storage during a transaction.
+type txnStorage struct {
+	storage
+	path  string
+	views *viewSet // the file's open views, see txnView.go
+
+	mu      sync.RWMutex
+	writes  []txn.Write
+	applied []txn.Write // writes apply has made, kept for views
+}
+
+func (s *txnStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readAt(p, off)
+}
+
+// readAt reads from the storage as the held writes leave it. Called with mu
+// held.
+func (s *txnStorage) readAt(p []byte, off int64) (int, error) {
+	n, err := s.storage.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if len(s.writes) == 0 {
+		return n, err
+	}
+	clear(p[n:])
+	for _, w := range s.writes {
+		if w.Truncate {
+			n = min(n, int(max(w.Off-off, 0)))
+			clear(p[n:])
+			continue
+		}
+		lo, hi := max(off, w.Off), min(off+int64(len(p)), w.Off+int64(len(w.Data)))
+		if lo >= hi {
+			continue
+		}
+		copy(p[lo-off:hi-off], w.Data[lo-w.Off:])
+		n = max(n, int(hi-off))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// hold records a write or truncation along with the bytes it replaces.
+// Called with mu held.
+func (s *txnStorage) hold(w txn.Write) error {
+	size, err := s.size()
+	if err != nil {
+		return err
+	}
+	end := w.Off + int64(len(w.Data))
+	if w.Truncate {
+		end = size
+	}
+	if end = min(end, size); end > w.Off {
+		w.Before = make([]byte, end-w.Off)
+		if _, err := s.readAt(w.Before, w.Off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	w.Path, w.OldSize = s.path, size
+	s.writes = append(s.writes, w)
+	return nil
+}
+
+func (s *txnStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.hold(txn.Write{Off: off, Data: append([]byte(nil), p...)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *txnStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size()
+}
+
+func (s *txnStorage) size() (int64, error) {
+	size, err := s.storage.Size()
+	if err != nil {
+		return 0, err
+	}
+	for _, w := range s.writes {
+		if w.Truncate {
+			size = w.Off
+		} else {
+			size = max(size, w.Off+int64(len(w.Data)))
+		}
+	}
+	return size, nil
+}
+
+func (s *txnStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hold(txn.Write{Off: size, Truncate: true})
+}
+
+// Sync does nothing: the held writes are made durable by the transaction
+// log.
+func (s *txnStorage) Sync() error { return nil }
+
+// apply writes the held changes to the underlying storage and forgets them.
+func (s *txnStorage) apply() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.views.mu.Lock()
+	defer s.views.mu.Unlock()
+	for _, w := range s.writes {
+		s.views.keep(w)
+		s.applied = append(s.applied, w)
+		var err error
+		if w.Truncate {
+			err = s.storage.Truncate(w.Off)
+		} else {
+			_, err = s.storage.WriteAt(w.Data, w.Off)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.writes = nil
+	return nil
+}
+
+// BeginTxn starts holding the file's writes back for a txn.Txn; see
+// "Transactions" above.
+func (idx *IndexFile[K, V]) BeginTxn() error {
+	if idx.readOnly {
+		return ErrReadOnly
+	}
+	if _, ok := idx.file.(*txnStorage); ok {
+		return errors.New("index file is already in a transaction")
+	}
+	if idx.ops != nil || idx.headerBatch > 0 {
+		return errors.New("index file is in the middle of an operation")
+	}
+	var path string
+	switch f := idx.file.(type) {
+	case fileStorage:
+		path = f.Name()
+	case *directStorage:
+		path = f.Name()
+	default:
+		return errors.New("only single-file indexes can join a transaction")
+	}
+	if err := idx.Flush(); err != nil {
+		return fmt.Errorf("BeginTxn: %w", err)
+	}
+	idx.file = &txnStorage{storage: idx.file, path: path, views: &idx.views}
+	return nil
+}
+
+// TxnWrites returns the writes held since BeginTxn.
+func (idx *IndexFile[K, V]) TxnWrites() ([]txn.Write, error) {
+	s, ok := idx.file.(*txnStorage)
+	if !ok {
+		return nil, errors.New("index file is not in a transaction")
+	}
+	if err := idx.Flush(); err != nil {
+		return nil, fmt.Errorf("TxnWrites: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]txn.Write(nil), s.writes...), nil
+}
+
+// ApplyTxn writes the held changes to the file, keeping the transaction
+// open.
+func (idx *IndexFile[K, V]) ApplyTxn() error {
+	s, ok := idx.file.(*txnStorage)
+	if !ok {
+		return errors.New("index file is not in a transaction")
+	}
+	if err := s.apply(); err != nil {
+		return fmt.Errorf("ApplyTxn: %w", err)
+	}
+	return nil
+}
+
+// EndTxn stops holding writes back, applying them if commit is set and
+// otherwise dropping them and reloading the header.
+func (idx *IndexFile[K, V]) EndTxn(commit bool) error {
+	s, ok := idx.file.(*txnStorage)
+	if !ok {
+		return errors.New("index file is not in a transaction")
+	}
+	if commit {
+		idx.file = s.storage
+		if err := s.apply(); err != nil {
+			return fmt.Errorf("EndTxn: %w", err)
+		}
+		return nil
+	}
+
+	if idx.flusher != nil {
+		idx.flusher.discardFrom(0)
+	}
+	if idx.cache != nil {
+		idx.cache.discardFrom(0)
+	}
+	idx.file = s.storage
+	idx.shrinkPending = false
+	if err := idx.readHeader(); err != nil {
+		return fmt.Errorf("EndTxn: reload header: %w", err)
+	}
+	idx.updateGauges()
+	return nil
+}
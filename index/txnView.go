@@ -0,0 +1,135 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"pranavdb/tree"
+	"pranavdb/txn"
+	"sync"
+)
+
+/*
+Read-only transactions
+
+A DiskTree's ViewTxn (see "Read-only transactions" in the txn package)
+opens a second, read-only IndexFile over a viewStorage: the file as the
+last commit left it. The view reads the file itself, then undoes on top of
+what it read every write applied since it opened, newest first, from the
+writes' before images, exactly as rollback would undo them on disk.
+
+So a view needs each applied write's before image, and txnStorage keeps
+them: apply hands every write to the file's open views before making it,
+with the views' lock held so no read sees the file half way. Writes a
+transaction has spilled but not committed are kept too, and a view opened
+while they are in the file starts out undoing them.
+
+Views have no page cache and take no file lock, and writes made outside a
+transaction never reach them, which is one more reason the files of txn
+participants must be written only through transactions.
+*/
+
+var _ txn.Viewer = (*DiskTree[tree.IntKey, uint64])(nil)
+
+// viewSet is the open views of an IndexFile.
+type viewSet struct {
+	mu    sync.RWMutex
+	views map[*viewStorage]bool
+}
+
+// keep hands w, about to be applied, to every open view. Called with mu
+// held.
+func (vs *viewSet) keep(w txn.Write) {
+	for v := range vs.views {
+		v.undo = append(v.undo, w)
+	}
+}
+
+// viewStorage is a read-only storage showing a file as it was when the view
+// opened.
+type viewStorage struct {
+	base storage
+	set  *viewSet
+	undo []txn.Write // writes applied since, oldest first; guarded by set.mu
+}
+
+func (v *viewStorage) ReadAt(p []byte, off int64) (int, error) {
+	v.set.mu.RLock()
+	defer v.set.mu.RUnlock()
+	n, err := v.base.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for i := len(v.undo) - 1; i >= 0; i-- {
+		w := v.undo[i]
+		if w.Truncate || w.Off+int64(len(w.Data)) > w.OldSize {
+			end := int(min(max(w.OldSize-off, 0), int64(len(p))))
+			if end > n {
+				clear(p[n:end])
+			}
+			n = end
+		}
+		lo, hi := max(off, w.Off), min(off+int64(n), w.Off+int64(len(w.Before)))
+		if lo < hi {
+			copy(p[lo-off:hi-off], w.Before[lo-w.Off:])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *viewStorage) Size() (int64, error) {
+	v.set.mu.RLock()
+	defer v.set.mu.RUnlock()
+	if len(v.undo) > 0 {
+		return v.undo[0].OldSize, nil
+	}
+	return v.base.Size()
+}
+
+func (v *viewStorage) WriteAt(p []byte, off int64) (int, error) { return 0, ErrReadOnly }
+func (v *viewStorage) Truncate(size int64) error                { return ErrReadOnly }
+func (v *viewStorage) Sync() error                              { return nil }
+
+// Close closes the view, leaving the file open.
+func (v *viewStorage) Close() error {
+	v.set.mu.Lock()
+	defer v.set.mu.Unlock()
+	delete(v.set.views, v)
+	v.undo = nil
+	return nil
+}
+
+// ViewTxn opens a read-only copy of the file as of its last commit; see
+// "Read-only transactions" above.
+func (idx *IndexFile[K, V]) ViewTxn() (*IndexFile[K, V], error) {
+	base := idx.file
+	var spilled []txn.Write
+	if s, ok := base.(*txnStorage); ok {
+		base = s.storage
+		spilled = s.applied
+	}
+	switch base.(type) {
+	case fileStorage, *directStorage:
+	default:
+		return nil, errors.New("only single-file indexes can be viewed in a transaction")
+	}
+	v := &viewStorage{base: base, set: &idx.views}
+	idx.views.mu.Lock()
+	if idx.views.views == nil {
+		idx.views.views = make(map[*viewStorage]bool)
+	}
+	idx.views.views[v] = true
+	v.undo = append([]txn.Write(nil), spilled...)
+	idx.views.mu.Unlock()
+
+	view, err := loadIndexFile[K](v, idx.codec, true)
+	if err != nil {
+		// stop keeping writes for a view nobody can close
+		v.Close()
+		return nil, fmt.Errorf("ViewTxn: %w", err)
+	}
+	return view, nil
+}
@@ -0,0 +1,199 @@
+package index
+
+import (
+	"fmt"
+	"pranavdb/page"
+	"pranavdb/tree"
+)
+
+// PageProblem describes a single issue found on a page during verification.
+type PageProblem struct {
+	PageID  uint64
+	Message string
+}
+
+// VerifyReport is the result of VerifyFile. It is meant to be consumed by
+// ops tooling, so every list is sorted by page ID.
+type VerifyReport struct {
+	Path       string
+	RootPageID uint64
+	TreeOrder  int
+	TotalPages uint64 // number of page slots in the file, excluding the header
+	KeyCount   uint64 // keys found in reachable leaves
+
+	ReservedPages uint64 // preallocated slots past the allocation high-water mark
+
+	// PendingDoubleWrite is the page a crashed write left staged in the
+	// double-write slot (0 if none). OpenIndexFile will re-apply it.
+	PendingDoubleWrite uint64
+
+	ReachablePages []uint64 // pages reachable from the root
+	FreePages      []uint64 // pages on the free list
+	OrphanPages    []uint64 // pages that are neither reachable nor free
+
+	Problems []PageProblem
+}
+
+// OK reports whether the file passed every check.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0 && len(r.OrphanPages) == 0
+}
+
+func (r *VerifyReport) addProblem(pageID uint64, format string, args ...any) {
+	r.Problems = append(r.Problems, PageProblem{PageID: pageID, Message: fmt.Sprintf(format, args...)})
+}
+
+// VerifyFile opens the index file at path read-only under a shared lock,
+// checks the header, walks every page reachable from the root, walks
+// the free list, and reports pages that are neither. An error is returned only
+// when the file cannot be opened or its header is invalid; structural damage
+// is reported through VerifyReport.Problems. values must be the codec the
+// file was written with (nil for the built-in one).
+func VerifyFile[K tree.Key, V any](path string, values page.ValueCodec[V]) (*VerifyReport, error) {
+	idx, err := openIndexFile[K](path, values, Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	size, err := idx.file.Size()
+	if err != nil {
+		return nil, fmt.Errorf("VerifyFile: stat failed: %w", err)
+	}
+
+	report := &VerifyReport{
+		Path:       path,
+		RootPageID: idx.rootPageID,
+		TreeOrder:  idx.order,
+	}
+	if report.PendingDoubleWrite, _, err = idx.pendingDoubleWrite(); err != nil {
+		return nil, fmt.Errorf("VerifyFile: read double-write record: %w", err)
+	}
+	if size > HeaderSize {
+		report.TotalPages = uint64((size - HeaderSize) / page.PageSize)
+	}
+	if (size-HeaderSize)%page.PageSize != 0 {
+		report.addProblem(0, "file size %d is not header + a whole number of pages", size)
+	}
+
+	inRange := func(pageID uint64) bool {
+		return pageID != 0 && pageID < report.TotalPages
+	}
+
+	// Walk the tree breadth-first from the root.
+	reachable := make(map[uint64]bool)
+	if idx.rootPageID != 0 {
+		if !inRange(idx.rootPageID) {
+			report.addProblem(idx.rootPageID, "root page is outside the file")
+		} else {
+			queue := []uint64{idx.rootPageID}
+			reachable[idx.rootPageID] = true
+			for len(queue) > 0 {
+				pageID := queue[0]
+				queue = queue[1:]
+
+				node, err := idx.readNode(pageID)
+				if err != nil {
+					report.addProblem(pageID, "%v", err)
+					continue
+				}
+
+				switch n := node.(type) {
+				case *tree.LeafNode[K, V]:
+					verifyLeaf(report, pageID, n)
+					report.KeyCount += uint64(len(n.Pairs))
+					for _, link := range []uint64{n.GetNextPage(), n.GetPrevPage()} {
+						if link != 0 && !inRange(link) {
+							report.addProblem(pageID, "leaf sibling link %d is outside the file", link)
+						}
+					}
+				case *tree.IntermNode[K, V]:
+					verifyInterm(report, pageID, n)
+					for _, child := range n.Pointers {
+						if !inRange(child) {
+							report.addProblem(pageID, "child pointer %d is outside the file", child)
+							continue
+						}
+						if reachable[child] {
+							report.addProblem(child, "page is referenced more than once")
+							continue
+						}
+						reachable[child] = true
+						queue = append(queue, child)
+					}
+				}
+			}
+		}
+	}
+
+	if report.KeyCount != idx.keyCount {
+		report.addProblem(0, "header key count %d does not match %d keys found in leaves", idx.keyCount, report.KeyCount)
+	}
+
+	// Walk the free list, guarding against cycles.
+	free := make(map[uint64]bool)
+	for pageID := idx.firstFreePage; pageID != 0; {
+		if !inRange(pageID) {
+			report.addProblem(pageID, "free list entry is outside the file")
+			break
+		}
+		if free[pageID] {
+			report.addProblem(pageID, "free list contains a cycle")
+			break
+		}
+		free[pageID] = true
+		if reachable[pageID] {
+			report.addProblem(pageID, "page is both reachable and on the free list")
+		}
+
+		next, err := idx.readFreeListPointer(pageID)
+		if err != nil {
+			report.addProblem(pageID, "%v", err)
+			break
+		}
+		pageID = next
+	}
+
+	// Page 0 is never handed out by allocatePage, so slots start at 1.
+	// Anything past the high-water mark was preallocated and never used.
+	var lastAllocated uint64
+	if report.TotalPages > 0 {
+		lastAllocated = min(idx.pageCount, report.TotalPages-1)
+		report.ReservedPages = report.TotalPages - 1 - lastAllocated
+	}
+	for pageID := uint64(1); pageID <= lastAllocated; pageID++ {
+		switch {
+		case reachable[pageID]:
+			report.ReachablePages = append(report.ReachablePages, pageID)
+		case free[pageID]:
+			report.FreePages = append(report.FreePages, pageID)
+		default:
+			report.OrphanPages = append(report.OrphanPages, pageID)
+		}
+	}
+
+	return report, nil
+}
+
+// verifyLeaf checks that leaf keys are strictly increasing.
+func verifyLeaf[K tree.Key, V any](report *VerifyReport, pageID uint64, leaf *tree.LeafNode[K, V]) {
+	for i := 1; i < len(leaf.Pairs); i++ {
+		if !leaf.Pairs[i-1].K.Less(leaf.Pairs[i].K) {
+			report.addProblem(pageID, "leaf keys out of order at position %d", i)
+			return
+		}
+	}
+}
+
+// verifyInterm checks pointer count and key ordering of an internal node.
+func verifyInterm[K tree.Key, V any](report *VerifyReport, pageID uint64, interm *tree.IntermNode[K, V]) {
+	if len(interm.Pointers) != len(interm.Keys)+1 {
+		report.addProblem(pageID, "internal node has %d keys but %d pointers", len(interm.Keys), len(interm.Pointers))
+	}
+	for i := 1; i < len(interm.Keys); i++ {
+		if !interm.Keys[i-1].Less(interm.Keys[i]) {
+			report.addProblem(pageID, "internal keys out of order at position %d", i)
+			return
+		}
+	}
+}
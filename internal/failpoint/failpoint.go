@@ -0,0 +1,125 @@
+// Package failpoint lets tests make the storage code fail at named points,
+// to drive crash recovery deterministically.
+package failpoint
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Failpoints
+
+Code that writes to disk calls Inject at the points where a crash would be
+interesting, such as between the two halves of a node split:
+
+	if err := failpoint.Inject("after-split-left-write"); err != nil {
+		return nil, 0, err
+	}
+
+Inject does nothing, at the cost of one atomic load, until a test calls Set
+for that name. From then on it either fails with an error wrapping
+ErrInjected, which the caller returns like any I/O error, or panics with a
+*Panic, which stops the operation in its tracks as a crash would; the test
+recovers it, closes what it had open and reopens the files to check
+recovery. After skips the first hits, so a point inside a loop can fail on
+a given pass.
+
+The points, by package:
+
+	index  after-split-left-write, after-split-internal-left-write,
+	       before-new-root, op-flush-page, after-free-page-write,
+	       after-allocate-page
+	data   after-wal-sync
+	txn    after-commit-force, after-spill-force, rollback-undo
+
+Each package's failpoint_test.go crashes at its points with CrashCopy,
+which returns a copy of the files as the crash left them, and checks what
+recovery makes of the copy.
+*/
+
+// ErrInjected is wrapped by the errors failpoints return.
+var ErrInjected = errors.New("failpoint: injected failure")
+
+// Action is what an armed failpoint does.
+type Action int
+
+const (
+	Error Action = iota // Inject returns an error wrapping ErrInjected
+	Crash               // Inject panics with a *Panic
+)
+
+// Panic is the value a Crash failpoint panics with.
+type Panic struct {
+	Name string
+}
+
+func (p *Panic) Error() string { return "failpoint: crash at " + p.Name }
+
+type point struct {
+	action Action
+	skip   int // hits to let pass before firing
+}
+
+var (
+	armed  atomic.Int32 // number of points set, for the fast path
+	mu     sync.Mutex
+	points = make(map[string]*point)
+)
+
+// Set arms the failpoint name to act on its next hit.
+func Set(name string, action Action) {
+	After(name, action, 0)
+}
+
+// After arms the failpoint name to act once it has been hit skip times.
+func After(name string, action Action, skip int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := points[name]; !ok {
+		armed.Add(1)
+	}
+	points[name] = &point{action: action, skip: skip}
+}
+
+// Clear disarms the failpoint name.
+func Clear(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := points[name]; ok {
+		delete(points, name)
+		armed.Add(-1)
+	}
+}
+
+// Reset disarms every failpoint.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	clear(points)
+	armed.Store(0)
+}
+
+// Inject acts on the failpoint name if it is armed; see "Failpoints" above.
+// An armed point stays armed, firing on every hit, until cleared.
+func Inject(name string) error {
+	if armed.Load() == 0 {
+		return nil
+	}
+	mu.Lock()
+	p, ok := points[name]
+	if ok && p.skip > 0 {
+		p.skip--
+		ok = false
+	}
+	mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if p.action == Crash {
+		panic(&Panic{Name: name})
+	}
+	return fmt.Errorf("%w at %s", ErrInjected, name)
+}
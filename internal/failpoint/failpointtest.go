@@ -0,0 +1,52 @@
+package failpoint
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// TB is the part of testing.TB CrashCopy uses, so that this package need
+// not import testing.
+type TB interface {
+	Helper()
+	Fatal(args ...any)
+	Fatalf(format string, args ...any)
+	TempDir() string
+}
+
+// CrashCopy runs fn, which must arm the failpoint name and then panic at
+// it, and returns a copy of dir holding the files as the crash left them.
+// Every failpoint is disarmed again. The files of dir stay open, as a
+// crashed process would not have closed them, so the test recovers the
+// copy.
+func CrashCopy(t TB, dir, name string, fn func()) string {
+	t.Helper()
+	defer Reset()
+	func() {
+		defer func() {
+			var p *Panic
+			r := recover()
+			if err, ok := r.(error); !ok || !errors.As(err, &p) || p.Name != name {
+				t.Fatalf("want a crash at %s, got %v", name, r)
+			}
+		}()
+		fn()
+	}()
+
+	copied := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(copied, e.Name()), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return copied
+}
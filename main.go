@@ -5,8 +5,11 @@ import (
 	"log"
 	"os"
 	"pranavdb/index"
+	"pranavdb/page"
 	"pranavdb/tree"
 	"pranavdb/data"
+	"pranavdb/db"
+	"time"
 )
 
 func main() {
@@ -20,7 +23,7 @@ func main() {
 	fmt.Println("Creating new disk-based B+ tree...")
 
 	// Create a new disk-based B+ tree with order 3
-	diskTree, err := index.NewDiskTree[tree.IntKey, string](testFile, 5)
+	diskTree, err := index.NewDiskTree[tree.IntKey, string](testFile, 5, page.StringCodec{})
 	if err != nil {
 		log.Fatalf("Failed to create disk tree: %v", err)
 	}
@@ -150,7 +153,7 @@ func main() {
 
 	// Try to open the existing tree
 	fmt.Println("Opening existing tree...")
-	existingTree, err := index.OpenDiskTree[tree.IntKey, string](testFile)
+	existingTree, err := index.OpenDiskTree[tree.IntKey, string](testFile, page.StringCodec{})
 	if err != nil {
 		log.Fatalf("Failed to open existing tree: %v", err)
 	}
@@ -244,8 +247,8 @@ func main() {
 
 //fmt.Printf("Before insertion, firstFreePage = %d\n", rf.GetFirstFreePage())
 	// ✅ INSERT a new row (should reuse the freed slot)
-	//// keep in mind the row to be inserted should be shorter than the row deleted  ///////////////////////////////////////////////////////
-	newRow := []any{99, "r", 1.0}
+	//// keep in mind the row to be inserted should be the same size as the row deleted, or smaller by enough to split the slot  ////////////
+	newRow := []any{99, "reuse", 1.0}
 	newOff, err := rf.WriteRow(newRow)
 	if err != nil {
 		log.Fatalf("WriteRow (after delete) failed: %v", err)
@@ -290,6 +293,48 @@ func main() {
 	}
 
 	fmt.Println("\nAll tests completed successfully.")
+
+	//////////////////////////////////////////////////////////////////////////////////////////////////db
+
+	// a database opens, recovers and closes all of its files itself
+	const dbDir = "test_db"
+	_ = os.RemoveAll(dbDir)
+
+	fmt.Println("\n=== Testing Database ===")
+	database, err := db.Open(dbDir, db.Options{CheckpointInterval: time.Second, VacuumInterval: time.Minute})
+	if err != nil {
+		log.Fatalf("db.Open failed: %v", err)
+	}
+	people, err := database.CreateTable("people", db.Schema{Columns: []db.Column{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "string"},
+	}}, db.TableOptions{})
+	if err != nil {
+		log.Fatalf("CreateTable failed: %v", err)
+	}
+	for i, name := range []string{"ada", "grace", "linus"} {
+		if err := people.Insert([]any{i + 1, name}); err != nil {
+			log.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := database.Close(); err != nil {
+		log.Fatalf("db.Close failed: %v", err)
+	}
+
+	database, err = db.Open(dbDir, db.Options{})
+	if err != nil {
+		log.Fatalf("db.Open (reopen) failed: %v", err)
+	}
+	defer database.Close()
+	people, err = database.OpenTable("people")
+	if err != nil {
+		log.Fatalf("OpenTable failed: %v", err)
+	}
+	row, err := people.Get(2)
+	if err != nil {
+		log.Fatalf("Get failed: %v", err)
+	}
+	fmt.Printf("Table %q has %d rows; id 2 -> %v\n", "people", people.Len(), row)
 }
 
 func getFileSize(filename string) int64 {
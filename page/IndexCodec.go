@@ -3,17 +3,55 @@ package page
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"math"
 	"pranavdb/tree"
+	"strings"
+	"sync"
 )
 
-// Key type constants for encoding/decoding
+// Key type constants for encoding/decoding. A node records its key type once
+// in its header; the keys themselves are stored untagged.
 const (
 	KeyTypeInt    = 1
 	KeyTypeFloat  = 2
 	KeyTypeString = 3
 )
 
+// NodeFormat is the node format version every encoded node starts with,
+// followed by a crc32 (IEEE) of the body and then a SlottedPage body (see
+// slottedPage.go). Decode rejects any other version, so a later layout can
+// take a new one without pages of this one being misread.
+const NodeFormat = 1
+
+// nodeBodyOffset is where the node body starts in a payload.
+const nodeBodyOffset = 1 + 4
+
+// Node type byte at the start of a slotted body
+const (
+	nodeTypeInternal = 0
+	nodeTypeLeaf     = 1
+
+	// nodeFlagGrouped marks a leaf holding runs of equal keys (multi-map or
+	// secondary-index use): each cell is one key, a varint count, then that
+	// many values, instead of one key-value pair.
+	nodeFlagGrouped = 0x80
+)
+
+// ErrChecksumMismatch is returned by Decode when a node's body does not match
+// its stored checksum, e.g. after a truncated or partially overwritten page.
+var ErrChecksumMismatch = errors.New("node checksum mismatch")
+
+// verifyBody checks a node payload's checksum.
+func verifyBody(payload []byte) error {
+	stored := binary.LittleEndian.Uint32(payload[1:5])
+	if computed := crc32.ChecksumIEEE(payload[5:]); computed != stored {
+		return fmt.Errorf("%w: stored %08x, computed %08x", ErrChecksumMismatch, stored, computed)
+	}
+	return nil
+}
+
 // Codec encodes/decodes objects into/from a raw page *payload* (no header).
 // Not all codecs have to implement this; it's here if you need polymorphism.
 type Codec interface {
@@ -22,11 +60,47 @@ type Codec interface {
 }
 
 type IndexPageCodec[K tree.Key, V any] struct {
+	keyType   byte // KeyType* for K, 0 if K has no key encoding
+	values    ValueCodec[V]
+	valueSize int // > 0 when values is a FixedSizeCodec
 }
 
-// NewIndexPageCodec creates a new IndexPageCodec instance
+// NewIndexPageCodec creates a new IndexPageCodec instance that uses the
+// built-in value codec for V (see DefaultValueCodec)
 func NewIndexPageCodec[K tree.Key, V any]() *IndexPageCodec[K, V] {
-	return &IndexPageCodec[K, V]{}
+	return NewIndexPageCodecWithValues[K](DefaultValueCodec[V]())
+}
+
+// NewIndexPageCodecWithValues creates an IndexPageCodec that encodes leaf
+// values with the given codec. A nil codec falls back to DefaultValueCodec.
+func NewIndexPageCodecWithValues[K tree.Key, V any](values ValueCodec[V]) *IndexPageCodec[K, V] {
+	if values == nil {
+		values = DefaultValueCodec[V]()
+	}
+	codec := &IndexPageCodec[K, V]{keyType: keyTypeOf[K](), values: values}
+	if fixed, ok := values.(FixedSizeCodec); ok && fixed.FixedSize() > 0 {
+		codec.valueSize = fixed.FixedSize()
+	}
+	return codec
+}
+
+// keyTypeOf returns the KeyType* constant for K, or 0 if K has no encoding.
+func keyTypeOf[K tree.Key]() byte {
+	var zero K
+	switch any(zero).(type) {
+	case tree.IntKey:
+		return KeyTypeInt
+	case tree.FloatKey:
+		return KeyTypeFloat
+	case tree.StringKey:
+		return KeyTypeString
+	}
+	return 0
+}
+
+// ValueCodec returns the codec used for leaf values, or nil if V has none.
+func (p *IndexPageCodec[K, V]) ValueCodec() ValueCodec[V] {
+	return p.values
 }
 
 // Encode implements the Codec interface for IndexPageCodec
@@ -40,139 +114,336 @@ func (p *IndexPageCodec[K, V]) Encode(obj interface{}) ([]byte, error) {
 
 // encodeNode encodes a specific tree node (internal method)
 func (p *IndexPageCodec[K, V]) encodeNode(n tree.Node[V]) ([]byte, error) {
+	if n == nil {
+		return nil, nil
+	}
+	buf := make([]byte, PayloadSize)
+	if err := p.EncodeInto(buf, n); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// cellPool holds scratch buffers that cells are built in before being copied
+// into the page.
+var cellPool = sync.Pool{New: func() any {
+	b := make([]byte, 0, PayloadSize)
+	return &b
+}}
+
+// EncodeInto encodes n into dst, which must be exactly PayloadSize bytes
+// (e.g. the payload of a buffer from GetPageBuffer). Fields are written in
+// place and cells are built in pooled scratch space, so encoding a node with
+// built-in key and value types does not allocate.
+//
+// Nodes are laid out as a SlottedPage filling the whole page payload: one
+// self-contained cell per leaf pair (key + value) or per internal separator
+// (key + varint right child). String keys are stored without the prefix all
+// keys in the node share, which is kept once in the page.
+func (p *IndexPageCodec[K, V]) EncodeInto(dst []byte, n tree.Node[V]) error {
 	// check whether it's internal node or leaf node then accordingly encode the data
 	// we also need to decode it so keep format consistent
 
-	if n == nil {
-		return nil, nil
+	if len(dst) != PayloadSize {
+		return fmt.Errorf("encode buffer is %d bytes, want %d", len(dst), PayloadSize)
 	}
 
-	// First byte indicates node type: 0 for internal node, 1 for leaf node
-	var buf []byte
+	// Format version byte, body checksum, then the slotted body
+	dst[0] = NodeFormat
+	body := dst[nodeBodyOffset:]
+
+	scratch := cellPool.Get().(*[]byte)
+	defer cellPool.Put(scratch)
+	cell := (*scratch)[:0]
+
+	var sp SlottedPage
+	var err error
 
 	// Try to cast to leaf node first
 	if leaf, ok := n.(*tree.LeafNode[K, V]); ok {
-		// Encode leaf node
-		// Node type (1 byte)
-		buf = append(buf, 1)
-
-		// Page ID (4 bytes)
-		pageIDBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(pageIDBytes, leaf.GetPageID())
-		buf = append(buf, pageIDBytes...)
-
-		// Number of pairs (2 bytes)
-		numPairs := uint16(len(leaf.Pairs))
-		pairCountBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(pairCountBytes, numPairs)
-		buf = append(buf, pairCountBytes...)
-
-		// Encode each key-value pair
-		for _, pair := range leaf.Pairs {
-			// Encode key with type identification
-			keyBytes, err := p.encodeKey(pair.K)
+		// Leaf node type, flagged when it holds duplicate keys; aux words
+		// hold the sibling links
+		grouped := hasDuplicateKeys(leaf.Pairs)
+		nodeType := byte(nodeTypeLeaf)
+		if grouped {
+			nodeType |= nodeFlagGrouped
+		}
+		if err := sp.init(body, nodeType, leaf.GetPageID()); err != nil {
+			return err
+		}
+		sp.SetKeyType(p.keyType)
+		sp.SetAux(0, leaf.GetNextPage())
+		sp.SetAux(1, leaf.GetPrevPage())
+
+		prefix := sharedKeyPrefix(len(leaf.Pairs), func(i int) K { return leaf.Pairs[i].K })
+		if err := sp.SetPrefix(prefix); err != nil {
+			return fmt.Errorf("leaf %d: %w", leaf.GetPageID(), err)
+		}
+
+		// One cell per key-value pair, or per run of equal keys
+		for i, slot := 0, 0; i < len(leaf.Pairs); slot++ {
+			if grouped {
+				cell, i, err = p.appendGroup(cell[:0], leaf.Pairs, i, prefix)
+			} else {
+				cell, err = p.appendPair(cell[:0], leaf.Pairs[i].K, leaf.Pairs[i].Value, prefix)
+				i++
+			}
 			if err != nil {
-				return nil, err
+				return err
 			}
-			buf = append(buf, keyBytes...)
-
-			// Encode value - currently assuming string values
-			if strValue, ok := any(pair.Value).(string); ok {
-				valueLen := uint16(len(strValue))
-				valueLenBytes := make([]byte, 2)
-				binary.LittleEndian.PutUint16(valueLenBytes, valueLen)
-				buf = append(buf, valueLenBytes...)
-				buf = append(buf, []byte(strValue)...)
-			} else {
-				// For other value types, implement encoding later
-				return nil, errors.New("unsupported value type for encoding")
+			if err := sp.InsertCell(slot, cell); err != nil {
+				return fmt.Errorf("leaf %d: %w", leaf.GetPageID(), err)
 			}
 		}
 
-		// Next and prev page IDs (4 bytes each)
-		nextPageID := leaf.GetNextPage()
-		prevPageID := leaf.GetPrevPage()
+	} else if interm, ok := n.(*tree.IntermNode[K, V]); ok {
+		if len(interm.Pointers) != len(interm.Keys)+1 {
+			return fmt.Errorf("internal node %d has %d keys but %d pointers", interm.GetPageID(), len(interm.Keys), len(interm.Pointers))
+		}
 
-		nextBytes := make([]byte, 4)
-		prevBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(nextBytes, nextPageID)
-		binary.LittleEndian.PutUint32(prevBytes, prevPageID)
-		buf = append(buf, nextBytes...)
-		buf = append(buf, prevBytes...)
+		// Node type 0 for internal, first aux word holds the leftmost child
+		if err := sp.init(body, nodeTypeInternal, interm.GetPageID()); err != nil {
+			return err
+		}
+		sp.SetKeyType(p.keyType)
+		sp.SetAux(0, interm.Pointers[0])
 
-	} else if interm, ok := n.(*tree.IntermNode[K, V]); ok {
-		// Encode internal node
-		// Node type (1 byte)
-		buf = append(buf, 0)
-
-		// Page ID (4 bytes)
-		pageIDBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(pageIDBytes, interm.GetPageID())
-		buf = append(buf, pageIDBytes...)
-
-		// Number of keys (2 bytes)
-		numKeys := uint16(len(interm.Keys))
-		keyCountBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(keyCountBytes, numKeys)
-		buf = append(buf, keyCountBytes...)
-
-		// Encode each key
-		for _, key := range interm.Keys {
-			keyBytes, err := p.encodeKey(key)
-			if err != nil {
-				return nil, err
+		prefix := sharedKeyPrefix(len(interm.Keys), func(i int) K { return interm.Keys[i] })
+		if err := sp.SetPrefix(prefix); err != nil {
+			return fmt.Errorf("internal node %d: %w", interm.GetPageID(), err)
+		}
+
+		// One cell per separator key and the child to its right
+		for i, key := range interm.Keys {
+			if cell, err = p.appendKey(cell[:0], key, prefix); err != nil {
+				return err
 			}
-			buf = append(buf, keyBytes...)
+			cell = binary.AppendUvarint(cell, interm.Pointers[i+1])
+			if err := sp.InsertCell(i, cell); err != nil {
+				return fmt.Errorf("internal node %d: %w", interm.GetPageID(), err)
+			}
+		}
+	} else {
+		return errors.New("unknown node type")
+	}
+
+	// keep any growth of the scratch buffer for the next caller
+	*scratch = cell[:0]
+
+	binary.LittleEndian.PutUint32(dst[1:5], crc32.ChecksumIEEE(body))
+	return nil
+}
+
+// sharedKeyPrefix returns the longest prefix common to the n keys returned by
+// key when they are StringKeys, and "" otherwise.
+func sharedKeyPrefix[K tree.Key](n int, key func(int) K) string {
+	if n < 2 {
+		return ""
+	}
+	// assert through pointers so the keys are not boxed
+	first := key(0)
+	firstString, ok := any(&first).(*tree.StringKey)
+	if !ok {
+		return ""
+	}
+	prefix := *firstString
+	for i := 1; i < n; i++ {
+		k := key(i)
+		s := *any(&k).(*tree.StringKey)
+		n := 0
+		for n < len(prefix) && n < len(s) && prefix[n] == s[n] {
+			n++
 		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// EncodePair encodes one leaf key-value pair exactly as it is laid out on a
+// leaf page: the key, untagged (see appendKey), followed by the value.
+func (p *IndexPageCodec[K, V]) EncodePair(key K, value V) ([]byte, error) {
+	return p.encodePair(key, value, "")
+}
+
+// encodePair encodes a pair as a leaf cell whose string key omits prefix.
+func (p *IndexPageCodec[K, V]) encodePair(key K, value V, prefix string) ([]byte, error) {
+	return p.appendPair(nil, key, value, prefix)
+}
 
-		// Number of pointers (2 bytes)
-		numPointers := uint16(len(interm.Pointers))
-		ptrCountBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(ptrCountBytes, numPointers)
-		buf = append(buf, ptrCountBytes...)
+// appendPair appends the leaf cell for key and value to buf.
+func (p *IndexPageCodec[K, V]) appendPair(buf []byte, key K, value V, prefix string) ([]byte, error) {
+	// Encode key
+	buf, err := p.appendKey(buf, key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return p.appendValue(buf, value)
+}
+
+// appendGroup appends the run of pairs starting at pairs[i] that share its
+// key to buf as one grouped cell, and returns the index just past the run.
+func (p *IndexPageCodec[K, V]) appendGroup(buf []byte, pairs []tree.LeafPair[K, V], i int, prefix string) ([]byte, int, error) {
+	end := i + 1
+	for end < len(pairs) && keysEqual(pairs[end].K, pairs[i].K) {
+		end++
+	}
 
-		// Encode page IDs for each pointer (4 bytes each)
-		for _, ptr := range interm.Pointers {
-			ptrBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(ptrBytes, ptr)
-			buf = append(buf, ptrBytes...)
+	buf, err := p.appendKey(buf, pairs[i].K, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(end-i))
+	for _, pair := range pairs[i:end] {
+		if buf, err = p.appendValue(buf, pair.Value); err != nil {
+			return nil, 0, err
+		}
+	}
+	return buf, end, nil
+}
+
+// hasDuplicateKeys reports whether sorted pairs contain a run of equal keys.
+func hasDuplicateKeys[K tree.Key, V any](pairs []tree.LeafPair[K, V]) bool {
+	for i := 1; i < len(pairs); i++ {
+		if keysEqual(pairs[i].K, pairs[i-1].K) {
+			return true
+		}
+	}
+	return false
+}
+
+// keysEqual is a.Equal(b) without boxing b for the built-in key types, which
+// keeps the encode path allocation-free.
+func keysEqual[K tree.Key](a, b K) bool {
+	switch x := any(&a).(type) {
+	case *tree.IntKey:
+		return *x == *any(&b).(*tree.IntKey)
+	case *tree.FloatKey:
+		return *x == *any(&b).(*tree.FloatKey)
+	case *tree.StringKey:
+		return *x == *any(&b).(*tree.StringKey)
+	}
+	return a.Equal(b)
+}
+
+// appendValue encodes value with the value codec, behind a varint length
+// unless the codec is fixed-size.
+func (p *IndexPageCodec[K, V]) appendValue(buf []byte, value V) ([]byte, error) {
+	if p.values == nil {
+		return nil, fmt.Errorf("unsupported value type %T for encoding: no ValueCodec", value)
+	}
+	if appender, ok := p.values.(AppendCodec[V]); ok {
+		return p.appendValueInPlace(buf, appender, value)
+	}
+	valueBytes, err := p.values.Encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("encode value: %w", err)
+	}
+	if p.valueSize > 0 {
+		if len(valueBytes) != p.valueSize {
+			return nil, fmt.Errorf("encode value: fixed-size codec produced %d bytes, want %d", len(valueBytes), p.valueSize)
 		}
 	} else {
-		return nil, errors.New("unknown node type")
+		buf = binary.AppendUvarint(buf, uint64(len(valueBytes)))
+	}
+	buf = append(buf, valueBytes...)
+	return buf, nil
+}
+
+// DecodePair decodes a pair written by EncodePair and returns the number of
+// bytes consumed.
+func (p *IndexPageCodec[K, V]) DecodePair(data []byte) (K, V, int, error) {
+	return p.decodePair(data, "")
+}
+
+// decodePair decodes a leaf cell whose string key omits prefix.
+func (p *IndexPageCodec[K, V]) decodePair(data []byte, prefix string) (K, V, int, error) {
+	var zeroK K
+	var zeroV V
+
+	// Decode key
+	key, offset, err := p.decodeKey(data, prefix)
+	if err != nil {
+		return zeroK, zeroV, 0, err
+	}
+
+	value, offset, err := p.readValue(data, offset)
+	if err != nil {
+		return zeroK, zeroV, 0, err
+	}
+	return key, value, offset, nil
+}
+
+// appendValueInPlace is appendValue for codecs that append to buf: the value
+// is encoded first and then shifted right to make room for its length.
+func (p *IndexPageCodec[K, V]) appendValueInPlace(buf []byte, appender AppendCodec[V], value V) ([]byte, error) {
+	start := len(buf)
+	buf, err := appender.AppendEncode(buf, value)
+	if err != nil {
+		return nil, fmt.Errorf("encode value: %w", err)
+	}
+	valueLen := len(buf) - start
+	if p.valueSize > 0 {
+		if valueLen != p.valueSize {
+			return nil, fmt.Errorf("encode value: fixed-size codec produced %d bytes, want %d", valueLen, p.valueSize)
+		}
+		return buf, nil
 	}
 
+	var lenBytes [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBytes[:], uint64(valueLen))
+	buf = append(buf, lenBytes[:n]...)
+	copy(buf[start+n:], buf[start:start+valueLen])
+	copy(buf[start:], lenBytes[:n])
 	return buf, nil
 }
 
-// encodeKey encodes a key with type identification
-func (p *IndexPageCodec[K, V]) encodeKey(key K) ([]byte, error) {
-	var buf []byte
+// readValue decodes the value at data[offset:] written by appendValue and
+// returns the offset just past it.
+func (p *IndexPageCodec[K, V]) readValue(data []byte, offset int) (V, int, error) {
+	var zeroV V
+	if p.values == nil {
+		return zeroV, 0, fmt.Errorf("unsupported value type %T for decoding: no ValueCodec", zeroV)
+	}
+	valueLen := uint64(p.valueSize)
+	if p.valueSize == 0 {
+		var n int
+		valueLen, n = binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return zeroV, 0, errors.New("insufficient data for value length")
+		}
+		offset += n
+	}
+
+	if valueLen > uint64(len(data)-offset) {
+		return zeroV, 0, errors.New("insufficient data for value")
+	}
+	value, err := p.values.Decode(data[offset : offset+int(valueLen)])
+	if err != nil {
+		return zeroV, 0, fmt.Errorf("decode value: %w", err)
+	}
+	return value, offset + int(valueLen), nil
+}
 
-	// Try to identify the key type and encode accordingly
+// appendKey appends a key to buf without a type tag; the key type is
+// recorded once per node. String keys are written without prefix, the part
+// shared by every key of their node.
+func (p *IndexPageCodec[K, V]) appendKey(buf []byte, key K, prefix string) ([]byte, error) {
+	// Encode according to the tree's key type
 	if intKey, ok := any(key).(tree.IntKey); ok {
-		// Key type: 1 for IntKey (1 byte)
-		buf = append(buf, KeyTypeInt)
-		// Key value (4 bytes)
-		keyBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(keyBytes, uint32(intKey))
-		buf = append(buf, keyBytes...)
+		// Key value (zigzag varint)
+		buf = binary.AppendVarint(buf, int64(intKey))
 	} else if floatKey, ok := any(key).(tree.FloatKey); ok {
-		// Key type: 2 for FloatKey (1 byte)
-		buf = append(buf, KeyTypeFloat)
 		// Key value (8 bytes for float64)
-		keyBytes := make([]byte, 8)
-		binary.LittleEndian.PutUint64(keyBytes, math.Float64bits(float64(floatKey)))
-		buf = append(buf, keyBytes...)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(floatKey)))
 	} else if stringKey, ok := any(key).(tree.StringKey); ok {
-		// Key type: 3 for StringKey (1 byte)
-		buf = append(buf, KeyTypeString)
-		// String length (2 bytes)
-		strLen := uint16(len(string(stringKey)))
-		lenBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(lenBytes, strLen)
-		buf = append(buf, lenBytes...)
-		// String bytes
-		buf = append(buf, []byte(string(stringKey))...)
+		if len(prefix) > len(stringKey) || string(stringKey[:len(prefix)]) != prefix {
+			return nil, fmt.Errorf("string key %q does not start with node prefix %q", stringKey, prefix)
+		}
+		suffix := stringKey[len(prefix):]
+		// Suffix length (varint)
+		buf = binary.AppendUvarint(buf, uint64(len(suffix)))
+		// Suffix bytes
+		buf = append(buf, suffix...)
 	} else {
 		return nil, errors.New("unsupported key type for encoding")
 	}
@@ -180,219 +451,443 @@ func (p *IndexPageCodec[K, V]) encodeKey(key K) ([]byte, error) {
 	return buf, nil
 }
 
-// getEncodedKeySize returns the size in bytes of an encoded key
-func (p *IndexPageCodec[K, V]) getEncodedKeySize(key K) (int, error) {
-	if _, ok := any(key).(tree.IntKey); ok {
-		return 1 + 4, nil // 1 byte type + 4 bytes value
-	} else if _, ok := any(key).(tree.FloatKey); ok {
-		return 1 + 8, nil // 1 byte type + 8 bytes value
-	} else if stringKey, ok := any(key).(tree.StringKey); ok {
-		return 1 + 2 + len(string(stringKey)), nil // 1 byte type + 2 bytes length + string bytes
-	}
-	return 0, errors.New("unsupported key type")
-}
-
 // Decode implements the Codec interface for IndexPageCodec
 func (p *IndexPageCodec[K, V]) Decode(data []byte) (interface{}, error) {
-	if len(data) == 0 {
-		return nil, errors.New("empty data")
+	var sp SlottedPage
+	if err := p.loadNode(&sp, data); err != nil {
+		return nil, err
 	}
 
-	// First byte indicates node type
-	nodeType := data[0]
-	offset := 1
-
-	switch nodeType {
-	case 1: // Leaf node
-		return p.decodeLeafNode(data[offset:])
-	case 0: // Internal node
-		return p.decodeInternalNode(data[offset:])
+	// Node type is the first byte of the body
+	switch sp.NodeType() &^ nodeFlagGrouped {
+	case nodeTypeLeaf:
+		return p.decodeLeafNode(&sp)
+	case nodeTypeInternal:
+		return p.decodeInternalNode(&sp)
 	default:
 		return nil, errors.New("unknown node type")
 	}
 }
 
-// decodeLeafNode decodes a leaf node from byte data
-func (p *IndexPageCodec[K, V]) decodeLeafNode(data []byte) (*tree.LeafNode[K, V], error) {
-	// data passed in already skips the node type byte
-	// need at least: pageID(4) + numPairs(2)
-	if len(data) < 6 {
-		return nil, errors.New("insufficient data for leaf node")
+// DecodeLeafInto decodes a leaf node payload into leaf, reusing the backing
+// array of leaf.Pairs instead of allocating a new one. The pairs that were in
+// leaf are overwritten, so a caller that handed them out must be done with
+// them. The decoded pairs do not refer to data, which can be reused as soon
+// as DecodeLeafInto returns.
+func (p *IndexPageCodec[K, V]) DecodeLeafInto(data []byte, leaf *tree.LeafNode[K, V]) error {
+	var sp SlottedPage
+	if err := p.loadNode(&sp, data); err != nil {
+		return err
+	}
+	if sp.NodeType()&^nodeFlagGrouped != nodeTypeLeaf {
+		return errors.New("expected leaf node")
 	}
+	return p.decodeLeafInto(&sp, leaf)
+}
 
-	offset := 0
+// loadNode checks a node payload's format byte and checksum and loads its
+// slotted body into sp.
+func (p *IndexPageCodec[K, V]) loadNode(sp *SlottedPage, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty data")
+	}
 
-	// Read page ID (4 bytes)
-	pageID := binary.LittleEndian.Uint32(data[offset : offset+4])
-	offset += 4
+	// First byte is the node format version
+	if data[0] != NodeFormat {
+		return fmt.Errorf("unsupported node format version %d", data[0])
+	}
+	if len(data) != PayloadSize {
+		return fmt.Errorf("node payload is %d bytes, want %d", len(data), PayloadSize)
+	}
+	if err := verifyBody(data); err != nil {
+		return err
+	}
 
-	// Read number of pairs (2 bytes)
-	numPairs := binary.LittleEndian.Uint16(data[offset : offset+2])
-	offset += 2
+	if err := sp.load(data[nodeBodyOffset:]); err != nil {
+		return err
+	}
+	if sp.KeyType() != p.keyType {
+		var zero K
+		return fmt.Errorf("node key type %d does not match tree key type %T", sp.KeyType(), zero)
+	}
+	return nil
+}
 
+// readUvarint reads one unsigned varint at data[offset:] and returns it with
+// the offset just past it.
+func readUvarint(data []byte, offset int, what string) (uint64, int, error) {
+	if offset >= len(data) {
+		return 0, 0, fmt.Errorf("insufficient data for %s", what)
+	}
+	v, n := binary.Uvarint(data[offset:])
+	if n <= 0 {
+		return 0, 0, fmt.Errorf("invalid varint for %s", what)
+	}
+	return v, offset + n, nil
+}
+
+// readPageID reads a varint page ID.
+func readPageID(data []byte, offset int, what string) (uint64, int, error) {
+	return readUvarint(data, offset, what)
+}
+
+// decodeLeafNode decodes a leaf node from a slotted page
+func (p *IndexPageCodec[K, V]) decodeLeafNode(sp *SlottedPage) (*tree.LeafNode[K, V], error) {
 	leaf := &tree.LeafNode[K, V]{
-		Pairs: make([]tree.LeafPair[K, V], 0, numPairs),
+		Pairs: make([]tree.LeafPair[K, V], 0, sp.NumSlots()),
+	}
+	if err := p.decodeLeafInto(sp, leaf); err != nil {
+		return nil, err
 	}
-	leaf.SetPageID(pageID)
+	return leaf, nil
+}
+
+// decodeLeafInto decodes a leaf from a slotted page into leaf, appending to
+// leaf.Pairs[:0].
+func (p *IndexPageCodec[K, V]) decodeLeafInto(sp *SlottedPage, leaf *tree.LeafNode[K, V]) error {
+	prefix := string(sp.Prefix())
+
+	leaf.Pairs = leaf.Pairs[:0]
+	leaf.SetPageID(sp.PageID())
 
 	// Decode each key-value pair
-	for i := uint16(0); i < numPairs; i++ {
-		if offset >= len(data) {
-			return nil, errors.New("insufficient data for key-value pair")
+	grouped := sp.NodeType()&nodeFlagGrouped != 0
+	for i := 0; i < sp.NumSlots(); i++ {
+		cell := sp.Cell(i)
+		if grouped {
+			pairs, err := p.decodeGroup(leaf.Pairs, cell, prefix)
+			if err != nil {
+				return fmt.Errorf("cell %d: %w", i, err)
+			}
+			leaf.Pairs = pairs
+			continue
 		}
-
-		// Decode key
-		key, keySize, err := p.decodeKey(data[offset:])
+		key, value, used, err := p.decodePair(cell, prefix)
 		if err != nil {
-			return nil, err
-		}
-		offset += keySize
-
-		// Decode value (assuming string for now)
-		if offset+2 > len(data) {
-			return nil, errors.New("insufficient data for value length")
+			return fmt.Errorf("cell %d: %w", i, err)
 		}
-		valueLen := binary.LittleEndian.Uint16(data[offset : offset+2])
-		offset += 2
-
-		if offset+int(valueLen) > len(data) {
-			return nil, errors.New("insufficient data for value")
+		if used != len(cell) {
+			return fmt.Errorf("cell %d: %d trailing bytes", i, len(cell)-used)
 		}
-		value := string(data[offset : offset+int(valueLen)])
-		offset += int(valueLen)
 
 		// Create the pair
 		pair := tree.LeafPair[K, V]{
 			K:     key,
-			Value: any(value).(V),
+			Value: value,
 		}
 		leaf.Pairs = append(leaf.Pairs, pair)
 	}
 
-	// Read next/prev page IDs (8 bytes total)
-	if offset+8 > len(data) {
-		return nil, errors.New("insufficient data for next/prev page IDs")
-	}
-	nextPageID := binary.LittleEndian.Uint32(data[offset : offset+4])
-	prevPageID := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
-	offset += 8
-
 	// Set the next/prev page IDs
-	leaf.SetNextPage(nextPageID)
-	leaf.SetPrevPage(prevPageID)
+	leaf.SetNextPage(sp.Aux(0))
+	leaf.SetPrevPage(sp.Aux(1))
 
-	return leaf, nil
+	return nil
 }
 
-// decodeInternalNode decodes an internal node from byte data
-func (p *IndexPageCodec[K, V]) decodeInternalNode(data []byte) (*tree.IntermNode[K, V], error) {
-	// data passed in already skips the node type byte
-	// need at least: pageID(4) + numKeys(2)
-	if len(data) < 6 {
-		return nil, errors.New("insufficient data for internal node")
+// decodeGroup decodes a grouped leaf cell into one pair per value, appended
+// to dst.
+func (p *IndexPageCodec[K, V]) decodeGroup(dst []tree.LeafPair[K, V], cell []byte, prefix string) ([]tree.LeafPair[K, V], error) {
+	key, offset, err := p.decodeKey(cell, prefix)
+	if err != nil {
+		return nil, err
+	}
+	count, offset, err := readUvarint(cell, offset, "value count")
+	if err != nil {
+		return nil, err
+	}
+	// every value takes at least one byte
+	if count == 0 || count > uint64(len(cell)-offset) {
+		return nil, fmt.Errorf("value count %d out of range", count)
 	}
 
-	offset := 0
-
-	// Read page ID (4 bytes)
-	pageID := binary.LittleEndian.Uint32(data[offset : offset+4])
-	offset += 4
+	for j := uint64(0); j < count; j++ {
+		var value V
+		if value, offset, err = p.readValue(cell, offset); err != nil {
+			return nil, err
+		}
+		dst = append(dst, tree.LeafPair[K, V]{K: key, Value: value})
+	}
+	if offset != len(cell) {
+		return nil, fmt.Errorf("%d trailing bytes", len(cell)-offset)
+	}
+	return dst, nil
+}
 
-	// Read number of keys (2 bytes)
-	numKeys := binary.LittleEndian.Uint16(data[offset : offset+2])
-	offset += 2
+// decodeInternalNode decodes an internal node from a slotted page
+func (p *IndexPageCodec[K, V]) decodeInternalNode(sp *SlottedPage) (*tree.IntermNode[K, V], error) {
+	prefix := string(sp.Prefix())
+	numKeys := sp.NumSlots()
 
 	interm := &tree.IntermNode[K, V]{
 		Keys:     make([]K, 0, numKeys),
-		Pointers: make([]uint32, 0, numKeys+1),
+		Pointers: make([]uint64, 0, numKeys+1),
 	}
-	interm.SetPageID(pageID)
+	interm.SetPageID(sp.PageID())
+	interm.Pointers = append(interm.Pointers, sp.Aux(0))
 
-	// Decode each key
-	for i := uint16(0); i < numKeys; i++ {
-		if offset >= len(data) {
-			return nil, errors.New("insufficient data for key")
+	// Decode each separator key and its right child
+	for i := 0; i < numKeys; i++ {
+		cell := sp.Cell(i)
+		key, offset, err := p.decodeKey(cell, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %w", i, err)
 		}
-
-		key, keySize, err := p.decodeKey(data[offset:])
+		child, offset, err := readPageID(cell, offset, "child page ID")
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("cell %d: %w", i, err)
+		}
+		if offset != len(cell) {
+			return nil, fmt.Errorf("cell %d: %d trailing bytes", i, len(cell)-offset)
 		}
-		offset += keySize
 
 		interm.Keys = append(interm.Keys, key)
+		interm.Pointers = append(interm.Pointers, child)
 	}
 
-	// Read number of pointers (2 bytes)
-	if offset+2 > len(data) {
-		return nil, errors.New("insufficient data for pointer count")
-	}
-	numPointers := binary.LittleEndian.Uint16(data[offset : offset+2])
-	offset += 2
+	return interm, nil
+}
 
-	// Read page IDs for each pointer (4 bytes each)
-	if offset+int(numPointers)*4 > len(data) {
-		return nil, errors.New("insufficient data for pointer page IDs")
+// decodeKey decodes an untagged key of the tree's key type from byte data and
+// returns the key, size consumed, and any error. String keys get prefix prepended.
+func (p *IndexPageCodec[K, V]) decodeKey(data []byte, prefix string) (K, int, error) {
+	var key K
+	// decode straight into key for the built-in types; going through
+	// decodeRawKey boxes every key in a tree.Key
+	switch x := any(&key).(type) {
+	case *tree.IntKey:
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			return key, 0, errors.New("insufficient data for int key")
+		}
+		*x = tree.IntKey(v)
+		return key, n, nil
+	case *tree.FloatKey:
+		if len(data) < 8 {
+			return key, 0, errors.New("insufficient data for float key")
+		}
+		*x = tree.FloatKey(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		return key, 8, nil
+	case *tree.StringKey:
+		strLen, offset, err := readUvarint(data, 0, "string key length")
+		if err != nil {
+			return key, 0, err
+		}
+		if strLen > uint64(len(data)-offset) {
+			return key, 0, errors.New("insufficient data for string key")
+		}
+		*x = tree.StringKey(prefix + string(data[offset:offset+int(strLen)]))
+		return key, offset + int(strLen), nil
 	}
 
-	// Read page IDs for each pointer
-	for i := uint16(0); i < numPointers; i++ {
-		ptrPageID := binary.LittleEndian.Uint32(data[offset : offset+4])
-		offset += 4
-		interm.Pointers = append(interm.Pointers, ptrPageID)
+	raw, offset, err := decodeRawKey(p.keyType, data, prefix)
+	if err != nil {
+		if p.keyType == 0 {
+			return key, 0, fmt.Errorf("unsupported key type %T for decoding", key)
+		}
+		return key, 0, err
 	}
 
-	return interm, nil
+	typed, ok := raw.(K)
+	if !ok {
+		return key, 0, fmt.Errorf("key type %T does not match tree key type %T", raw, key)
+	}
+	return typed, offset, nil
 }
 
-// decodeKey decodes a key from byte data and returns the key, size consumed, and any error
-func (p *IndexPageCodec[K, V]) decodeKey(data []byte) (K, int, error) {
+// decodeRawKey decodes an untagged key of the given KeyType* constant.
+func decodeRawKey(keyType byte, data []byte, prefix string) (tree.Key, int, error) {
 	if len(data) == 0 {
-		var zero K
-		return zero, 0, errors.New("empty data for key")
+		return nil, 0, errors.New("empty data for key")
 	}
 
-	keyType := data[0]
-	offset := 1
+	offset := 0
 
+	var key tree.Key
 	switch keyType {
 	case KeyTypeInt:
-		if offset+4 > len(data) {
-			var zero K
-			return zero, 0, errors.New("insufficient data for int key")
+		intValue, n := binary.Varint(data[offset:])
+		if n <= 0 {
+			return nil, 0, errors.New("insufficient data for int key")
 		}
-		intValue := int32(binary.LittleEndian.Uint32(data[offset : offset+4]))
-		key := tree.IntKey(intValue)
-		return any(key).(K), 5, nil // 1 byte type + 4 bytes value
+		key = tree.IntKey(intValue)
+		offset += n
 
 	case KeyTypeFloat:
 		if offset+8 > len(data) {
-			var zero K
-			return zero, 0, errors.New("insufficient data for float key")
+			return nil, 0, errors.New("insufficient data for float key")
 		}
 		uintValue := binary.LittleEndian.Uint64(data[offset : offset+8])
-		floatValue := math.Float64frombits(uintValue)
-		key := tree.FloatKey(floatValue)
-		return any(key).(K), 9, nil // 1 byte type + 8 bytes value
+		key = tree.FloatKey(math.Float64frombits(uintValue))
+		offset += 8
 
 	case KeyTypeString:
-		if offset+2 > len(data) {
-			var zero K
-			return zero, 0, errors.New("insufficient data for string key length")
+		strLen, next, err := readUvarint(data, offset, "string key length")
+		if err != nil {
+			return nil, 0, err
 		}
-		strLen := binary.LittleEndian.Uint16(data[offset : offset+2])
-		offset += 2
+		offset = next
 
-		if offset+int(strLen) > len(data) {
-			var zero K
-			return zero, 0, errors.New("insufficient data for string key")
+		if strLen > uint64(len(data)-offset) {
+			return nil, 0, errors.New("insufficient data for string key")
 		}
-		strValue := string(data[offset : offset+int(strLen)])
-		key := tree.StringKey(strValue)
-		return any(key).(K), 3 + int(strLen), nil // 1 byte type + 2 bytes length + string bytes
+		key = tree.StringKey(prefix + string(data[offset:offset+int(strLen)]))
+		offset += int(strLen)
 
 	default:
-		var zero K
-		return zero, 0, errors.New("unknown key type")
+		return nil, 0, fmt.Errorf("unknown key type %d", keyType)
+	}
+
+	return key, offset, nil
+}
+
+// ErrPrefixMismatch is returned by InsertPair when a key does not start with
+// the prefix shared by the node's keys; the node has to be re-encoded instead.
+var ErrPrefixMismatch = errors.New("key does not share the node's key prefix")
+
+// InsertPair adds key/value to an encoded leaf payload in place, replacing
+// the pair if key is already present. It returns the span [lo, hi) of payload
+// bytes that changed, so only that part of the page needs writing back.
+// ErrPageFull and ErrPrefixMismatch leave the payload untouched and mean the
+// node must be split or re-encoded.
+func (p *IndexPageCodec[K, V]) InsertPair(payload []byte, key K, value V) (lo, hi int, err error) {
+	sp, err := p.loadLeaf(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	prefix := string(sp.Prefix())
+	if s, ok := any(key).(tree.StringKey); ok && !strings.HasPrefix(string(s), prefix) {
+		return 0, 0, ErrPrefixMismatch
+	}
+	cell, err := p.encodePair(key, value, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	i, found, err := p.searchLeaf(sp, key, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	free := sp.FreeSpace()
+	if found {
+		free += len(sp.Cell(i)) + slotSize
+	}
+	if len(cell)+slotSize > free {
+		return 0, 0, ErrPageFull
+	}
+
+	sp.ClearDirty()
+	if found {
+		if err := sp.DeleteCell(i); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := sp.InsertCell(i, cell); err != nil {
+		return 0, 0, err
+	}
+	lo, hi = finishEdit(payload, sp)
+	return lo, hi, nil
+}
+
+// DeletePair removes key from an encoded leaf payload in place and returns
+// the span of payload bytes that changed. found is false if key is absent.
+func (p *IndexPageCodec[K, V]) DeletePair(payload []byte, key K) (lo, hi int, found bool, err error) {
+	sp, err := p.loadLeaf(payload)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	i, found, err := p.searchLeaf(sp, key, string(sp.Prefix()))
+	if err != nil || !found {
+		return 0, 0, false, err
+	}
+
+	sp.ClearDirty()
+	if err := sp.DeleteCell(i); err != nil {
+		return 0, 0, false, err
+	}
+	lo, hi = finishEdit(payload, sp)
+	return lo, hi, true, nil
+}
+
+// finishEdit refreshes the checksum after an in-place edit and returns the
+// changed span of the payload.
+func finishEdit(payload []byte, sp *SlottedPage) (lo, hi int) {
+	lo, hi = sp.Dirty()
+	hi += nodeBodyOffset
+	binary.LittleEndian.PutUint32(payload[1:5], crc32.ChecksumIEEE(payload[nodeBodyOffset:]))
+	return 1, hi
+}
+
+func (p *IndexPageCodec[K, V]) loadLeaf(payload []byte) (*SlottedPage, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty payload")
+	}
+	if payload[0] != NodeFormat {
+		return nil, errors.New("payload is not a slotted node")
+	}
+	if len(payload) != PayloadSize {
+		return nil, fmt.Errorf("node payload is %d bytes, want %d", len(payload), PayloadSize)
+	}
+	if err := verifyBody(payload); err != nil {
+		return nil, err
+	}
+	sp, err := LoadSlottedPage(payload[nodeBodyOffset:])
+	if err != nil {
+		return nil, err
+	}
+	if sp.NodeType()&^nodeFlagGrouped != nodeTypeLeaf {
+		return nil, errors.New("payload is not a leaf node")
+	}
+	if sp.NodeType()&nodeFlagGrouped != 0 {
+		return nil, errors.New("leaf holds duplicate-key groups; re-encode it instead")
+	}
+	return sp, nil
+}
+
+// searchLeaf binary-searches the leaf's cells for key, returning its slot or
+// the slot it would be inserted at.
+func (p *IndexPageCodec[K, V]) searchLeaf(sp *SlottedPage, key K, prefix string) (int, bool, error) {
+	lo, hi := 0, sp.NumSlots()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		k, _, err := p.decodeKey(sp.Cell(mid), prefix)
+		if err != nil {
+			return 0, false, fmt.Errorf("cell %d: %w", mid, err)
+		}
+		if k.Equal(key) {
+			return mid, true, nil
+		}
+		if k.Less(key) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, false, nil
+}
+
+// MaxCellSize returns the largest cell for which a node of the given order
+// is guaranteed to fit in a page: order-1 cells of that size, their slots
+// and the node header together fill at most the node body.
+func MaxCellSize(order int) int {
+	if order < 2 {
+		return 0
+	}
+	return (PayloadSize-nodeBodyOffset-slotHeaderSize)/(order-1) - slotSize
+}
+
+// MaxKeySize returns the largest encoded key that fits in an internal-node
+// cell of the given order alongside its child pointer.
+func MaxKeySize(order int) int {
+	return MaxCellSize(order) - binary.MaxVarintLen64
+}
+
+// EncodedKeySize returns the number of bytes key takes in a node that has
+// no shared key prefix.
+func (p *IndexPageCodec[K, V]) EncodedKeySize(key K) (int, error) {
+	buf, err := p.appendKey(nil, key, "")
+	if err != nil {
+		return 0, err
 	}
+	return len(buf), nil
 }
@@ -0,0 +1,82 @@
+package page
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// FallbackFormat selects the generic serializer used for value types that
+// have no dedicated codec. The format is written as the first byte of every
+// encoded value, so a FallbackCodec can read values written in either format.
+type FallbackFormat byte
+
+const (
+	FallbackNone FallbackFormat = 0
+	FallbackGob  FallbackFormat = 1
+	FallbackJSON FallbackFormat = 2
+)
+
+var defaultFallback atomic.Uint32
+
+// SetDefaultFallback makes DefaultValueCodec return a FallbackCodec in the
+// given format for value types with no built-in codec. FallbackNone (the
+// default) turns this off, so such trees fail to open instead.
+func SetDefaultFallback(format FallbackFormat) {
+	defaultFallback.Store(uint32(format))
+}
+
+// FallbackCodec serializes arbitrary values with encoding/gob or
+// encoding/json. It is meant for prototypes; a hand-written ValueCodec is
+// smaller and faster.
+type FallbackCodec[V any] struct {
+	Format FallbackFormat
+}
+
+// NewFallbackCodec returns a FallbackCodec that writes values in format.
+func NewFallbackCodec[V any](format FallbackFormat) FallbackCodec[V] {
+	return FallbackCodec[V]{Format: format}
+}
+
+func (c FallbackCodec[V]) Encode(value V) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(c.Format))
+
+	switch c.Format {
+	case FallbackGob:
+		if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+			return nil, fmt.Errorf("gob encode: %w", err)
+		}
+	case FallbackJSON:
+		if err := json.NewEncoder(&buf).Encode(value); err != nil {
+			return nil, fmt.Errorf("json encode: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fallback format %d", c.Format)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c FallbackCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	if len(data) == 0 {
+		return value, errors.New("empty fallback value")
+	}
+
+	switch FallbackFormat(data[0]) {
+	case FallbackGob:
+		if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&value); err != nil {
+			return value, fmt.Errorf("gob decode: %w", err)
+		}
+	case FallbackJSON:
+		if err := json.Unmarshal(data[1:], &value); err != nil {
+			return value, fmt.Errorf("json decode: %w", err)
+		}
+	default:
+		return value, fmt.Errorf("unknown fallback format %d", data[0])
+	}
+	return value, nil
+}
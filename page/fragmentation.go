@@ -0,0 +1,21 @@
+package page
+
+// FragmentationReport summarizes how much of a file holds live data, as
+// returned by the rowfile's and the index file's FragmentationReport. All
+// sizes are in bytes.
+type FragmentationReport struct {
+	FileBytes   int64 // current file size
+	LiveBytes   int64 // live rows or live node pages
+	FreeBytes   int64 // space on the free list, reused before the file grows
+	LargestFree int64 // largest free block; for page files, the longest run of free pages
+
+	// Reclaimable estimates how much smaller a rewrite of only the live
+	// data (Compact, or rebuilding an index) would make the file.
+	Reclaimable int64
+}
+
+// Worthwhile reports whether a rewrite would give back at least fraction
+// (0 to 1) of the file.
+func (r FragmentationReport) Worthwhile(fraction float64) bool {
+	return r.FileBytes > 0 && float64(r.Reclaimable) >= fraction*float64(r.FileBytes)
+}
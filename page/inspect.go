@@ -0,0 +1,253 @@
+package page
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PageInfo is a structured description of one raw page, as returned by
+// Inspect. Fields that do not apply to the page's kind are left zero.
+type PageInfo struct {
+	Deleted  bool   // page is on the free list
+	NextFree uint64 // free pages: next page in the free list
+
+	Format    byte   // node format version
+	Checksum  uint32 // stored body checksum, for formats that have one
+	Leaf      bool   // node type
+	Grouped   bool   // leaf cells hold a key, a count and that many values
+	PageID    uint64 // page ID recorded in the node
+	KeyType   byte   // KeyType* constant
+	Prefix    string // key prefix shared by the node's keys
+	FreeSpace int    // bytes available for new cells
+
+	Keys     []any    // decoded keys (tree.IntKey, tree.FloatKey or tree.StringKey)
+	Values   [][]byte // leaves: value bytes as stored, including any length prefix (and count, if Grouped)
+	Pointers []uint64 // internal nodes: child page IDs
+	Next     uint64   // leaves: next sibling
+	Prev     uint64   // leaves: previous sibling
+
+	// Problems lists everything that could not be decoded. Inspect keeps
+	// going past damage so as much of the page as possible is described.
+	Problems []string
+
+	// Hexdump is the raw page, one line per field, each annotated with what
+	// the bytes hold.
+	Hexdump string
+}
+
+// region is one annotated span of the hexdump.
+type region struct {
+	off, len int
+	label    string
+}
+
+// Inspect decodes a raw page (PageSize bytes, including the deleted flag)
+// without knowing the tree's key or value types. It is meant for debugging
+// damaged files, so decoding problems are reported in PageInfo.Problems
+// rather than as an error; an error is returned only for a wrong-sized page.
+func Inspect(raw []byte) (*PageInfo, error) {
+	if len(raw) != PageSize {
+		return nil, fmt.Errorf("page is %d bytes, want %d", len(raw), PageSize)
+	}
+
+	info := &PageInfo{Deleted: raw[0] != 0}
+	regions := []region{{0, 1, "deleted flag"}}
+
+	if info.Deleted {
+		info.NextFree = binary.LittleEndian.Uint64(raw[1:9])
+		regions = append(regions, region{1, 8, "next free page"})
+		info.Hexdump = hexdump(raw, regions)
+		return info, nil
+	}
+
+	payload := raw[1:]
+	info.Format = payload[0]
+	regions = append(regions, region{1, 1, "node format version"})
+	if info.Format != NodeFormat {
+		info.problem("unsupported node format version %d", info.Format)
+		info.Hexdump = hexdump(raw, regions)
+		return info, nil
+	}
+	info.Checksum = binary.LittleEndian.Uint32(payload[1:5])
+	regions = append(regions, region{2, 4, "body checksum"})
+	if err := verifyBody(payload); err != nil {
+		info.problem("%v", err)
+	}
+
+	base := 1 + nodeBodyOffset // body offset within the raw page
+	regions = append(regions, inspectSlotted(info, raw[base:], base)...)
+	info.Hexdump = hexdump(raw, regions)
+	return info, nil
+}
+
+// inspectSlotted fills info from a slotted node body and returns the
+// annotated regions, offset by base.
+func inspectSlotted(info *PageInfo, body []byte, base int) []region {
+	at := func(off, n int, format string, args ...any) region {
+		return region{base + off, n, fmt.Sprintf(format, args...)}
+	}
+	regions := []region{
+		at(0, 1, "node type"),
+		at(slotPageID, 8, "page ID"),
+		at(slotNumSlots, 2, "slot count"),
+		at(slotCellStart, 2, "cell area start"),
+		at(slotPrefixLen, 2, "key prefix length"),
+		at(slotPrefixOff, 2, "key prefix offset"),
+		at(slotKeyType, 1, "key type"),
+	}
+
+	// The fixed header is readable even when the slots are not
+	header := &SlottedPage{buf: body}
+	info.Leaf = header.NodeType()&^nodeFlagGrouped == nodeTypeLeaf
+	info.Grouped = info.Leaf && header.NodeType()&nodeFlagGrouped != 0
+	info.PageID = header.PageID()
+	info.KeyType = header.KeyType()
+	if info.Leaf {
+		info.Next, info.Prev = header.Aux(0), header.Aux(1)
+		regions = append(regions, at(slotAux, 8, "next leaf"), at(slotAux+8, 8, "prev leaf"))
+	} else {
+		info.Pointers = append(info.Pointers, header.Aux(0))
+		regions = append(regions, at(slotAux, 8, "first child"), at(slotAux+8, 8, "unused"))
+	}
+
+	sp, err := LoadSlottedPage(body)
+	if err != nil {
+		info.problem("%v", err)
+		return regions
+	}
+	info.Prefix = string(sp.Prefix())
+	info.FreeSpace = sp.FreeSpace()
+	if n := len(info.Prefix); n > 0 {
+		regions = append(regions, at(sp.prefixOff(), n, "key prefix %q", info.Prefix))
+	}
+
+	for i := 0; i < sp.NumSlots(); i++ {
+		regions = append(regions, at(sp.dirEnd(i), slotSize, "slot %d", i))
+
+		off, _ := sp.slot(i)
+		cell := sp.Cell(i)
+		key, used, err := decodeRawKey(info.KeyType, cell, info.Prefix)
+		if err != nil {
+			info.problem("cell %d: %v", i, err)
+			regions = append(regions, at(off, len(cell), "cell %d (undecodable)", i))
+			continue
+		}
+		info.Keys = append(info.Keys, key)
+		regions = append(regions, at(off, used, "cell %d key %v", i, key))
+
+		if info.Leaf {
+			info.Values = append(info.Values, cell[used:])
+			if used < len(cell) {
+				label := "value"
+				if info.Grouped {
+					label = "value count and values"
+				}
+				regions = append(regions, at(off+used, len(cell)-used, "cell %d %s", i, label))
+			}
+			continue
+		}
+		child, next, err := readPageID(cell, used, "child page ID")
+		if err != nil {
+			info.problem("cell %d: %v", i, err)
+			continue
+		}
+		info.Pointers = append(info.Pointers, child)
+		regions = append(regions, at(off+used, next-used, "cell %d child %d", i, child))
+	}
+	return regions
+}
+
+func (info *PageInfo) problem(format string, args ...any) {
+	info.Problems = append(info.Problems, fmt.Sprintf(format, args...))
+}
+
+// String summarises the page on a few lines, without the hexdump.
+func (info *PageInfo) String() string {
+	var b strings.Builder
+	switch {
+	case info.Deleted:
+		fmt.Fprintf(&b, "free page, next free %d\n", info.NextFree)
+	case info.Leaf:
+		fmt.Fprintf(&b, "leaf %d (format %d, key type %d), %d keys, next %d, prev %d, %d bytes free\n",
+			info.PageID, info.Format, info.KeyType, len(info.Keys), info.Next, info.Prev, info.FreeSpace)
+	default:
+		fmt.Fprintf(&b, "internal %d (format %d, key type %d), %d keys, %d bytes free\n",
+			info.PageID, info.Format, info.KeyType, len(info.Keys), info.FreeSpace)
+	}
+	if info.Prefix != "" {
+		fmt.Fprintf(&b, "key prefix %q\n", info.Prefix)
+	}
+	if len(info.Keys) > 0 {
+		fmt.Fprintf(&b, "keys %v\n", info.Keys)
+	}
+	if len(info.Pointers) > 0 {
+		fmt.Fprintf(&b, "children %v\n", info.Pointers)
+	}
+	for _, p := range info.Problems {
+		fmt.Fprintf(&b, "problem: %s\n", p)
+	}
+	return b.String()
+}
+
+// hexdump prints raw one region per line in offset order. Bytes no region
+// claims are shown as unused, and long runs of zeros are collapsed.
+func hexdump(raw []byte, regions []region) string {
+	sort.Slice(regions, func(i, j int) bool { return regions[i].off < regions[j].off })
+
+	var b strings.Builder
+	pos := 0
+	for _, r := range regions {
+		if r.off < pos || r.off+r.len > len(raw) {
+			continue // overlapping or out of range; already reported as a problem
+		}
+		if r.off > pos {
+			dumpRegion(&b, raw, region{pos, r.off - pos, "unused"})
+		}
+		dumpRegion(&b, raw, r)
+		pos = r.off + r.len
+	}
+	if pos < len(raw) {
+		dumpRegion(&b, raw, region{pos, len(raw) - pos, "unused"})
+	}
+	return b.String()
+}
+
+func dumpRegion(b *strings.Builder, raw []byte, r region) {
+	data := raw[r.off : r.off+r.len]
+	if len(data) > 16 && isZero(data) {
+		fmt.Fprintf(b, "%04x  %-47s  %s\n", r.off, fmt.Sprintf("00 x %d", len(data)), r.label)
+		return
+	}
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		label := r.label
+		if i > 0 {
+			label = ""
+		}
+		fmt.Fprintf(b, "%04x  %-47s  %s\n", r.off+i, spacedHex(line), label)
+	}
+}
+
+func spacedHex(data []byte) string {
+	s := hex.EncodeToString(data)
+	var b strings.Builder
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(s[i : i+2])
+	}
+	return b.String()
+}
+
+func isZero(data []byte) bool {
+	for _, c := range data {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
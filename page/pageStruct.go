@@ -1,6 +1,8 @@
 // page/page.go
 package page
 
+import "sync"
+
 const (
 	// PageSize is the fixed size of every on-disk index page.
 	PageSize = 4096
@@ -27,3 +29,16 @@ func (p *IndexPage) GetData() []byte {
 func (p *IndexPage) SetData(data []byte) {
 	copy(p.Data[:], data)
 }
+
+var pagePool = sync.Pool{New: func() any { return new([PageSize]byte) }}
+
+// GetPageBuffer returns a page-sized buffer from a shared pool. Its contents
+// are undefined; hand it back with PutPageBuffer once nothing refers to it.
+func GetPageBuffer() *[PageSize]byte {
+	return pagePool.Get().(*[PageSize]byte)
+}
+
+// PutPageBuffer returns a buffer obtained from GetPageBuffer to the pool.
+func PutPageBuffer(buf *[PageSize]byte) {
+	pagePool.Put(buf)
+}
@@ -0,0 +1,305 @@
+package page
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// PayloadSize is the part of a page available to a node; the first byte of
+// every page is its deleted flag.
+const PayloadSize = PageSize - 1
+
+// Slotted node layout. Offsets are within the node body, which follows the
+// node format version byte and the body checksum (see NodeFormat):
+//
+//	0   nodeType  uint8     1 = leaf, 0 = internal
+//	1   pageID    uint64
+//	9   numSlots  uint16
+//	11  cellStart uint16    start of the cell area, which grows down from the end
+//	13  aux       [16]byte  leaf: next and prev page IDs; internal: first child
+//	29  prefixLen uint16    key prefix shared by every key in the node
+//	31  prefixOff uint16    where the prefix bytes live in the cell area
+//	33  keyType   uint8     KeyType* of every key in the node; cells are untagged
+//	34  slots     numSlots × (offset uint16, length uint16), in key order
+//	    free space
+//	    cells
+//
+// Cells are self-contained, so a cell can be inserted or removed by moving
+// slot entries and writing the cell bytes, without re-encoding the node.
+const (
+	slotPageID     = 1
+	slotNumSlots   = 9
+	slotCellStart  = 11
+	slotAux        = 13
+	slotPrefixLen  = 29
+	slotPrefixOff  = 31
+	slotKeyType    = 33
+	slotHeaderSize = 34
+	slotSize       = 4
+)
+
+// ErrPageFull is returned when a cell does not fit in the page's free space.
+var ErrPageFull = errors.New("page is full")
+
+// SlottedPage edits a slotted node payload in place. It records the span of
+// bytes it has changed so a caller can write back only that part of the page.
+type SlottedPage struct {
+	buf              []byte
+	dirtyLo, dirtyHi int
+}
+
+// NewSlottedPage initialises buf as an empty node of the given type.
+func NewSlottedPage(buf []byte, nodeType byte, pageID uint64) (*SlottedPage, error) {
+	sp := &SlottedPage{}
+	if err := sp.init(buf, nodeType, pageID); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func (sp *SlottedPage) init(buf []byte, nodeType byte, pageID uint64) error {
+	if len(buf) < slotHeaderSize || len(buf) > 0xFFFF {
+		return fmt.Errorf("slotted page size %d out of range", len(buf))
+	}
+	clear(buf)
+	*sp = SlottedPage{buf: buf}
+	buf[0] = nodeType
+	binary.LittleEndian.PutUint64(buf[slotPageID:], pageID)
+	sp.setCellStart(len(buf))
+	sp.markDirty(0, len(buf))
+	return nil
+}
+
+// LoadSlottedPage wraps an encoded payload, checking that its header and
+// slot directory are consistent.
+func LoadSlottedPage(buf []byte) (*SlottedPage, error) {
+	sp := &SlottedPage{}
+	if err := sp.load(buf); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// load is LoadSlottedPage into an existing SlottedPage, so decoders can keep
+// it on the stack.
+func (sp *SlottedPage) load(buf []byte) error {
+	if len(buf) < slotHeaderSize || len(buf) > 0xFFFF {
+		return fmt.Errorf("slotted page size %d out of range", len(buf))
+	}
+	*sp = SlottedPage{buf: buf}
+	dirEnd := sp.dirEnd(sp.NumSlots())
+	if cs := sp.cellStart(); cs < dirEnd || cs > len(buf) {
+		return fmt.Errorf("cell area start %d outside [%d, %d]", cs, dirEnd, len(buf))
+	}
+	for i := 0; i < sp.NumSlots(); i++ {
+		off, n := sp.slot(i)
+		if off < sp.cellStart() || off+n > len(buf) {
+			return fmt.Errorf("slot %d cell [%d, %d) outside cell area", i, off, off+n)
+		}
+	}
+	if n := sp.prefixLen(); n > 0 {
+		if off := sp.prefixOff(); off < sp.cellStart() || off+n > len(buf) {
+			return fmt.Errorf("key prefix [%d, %d) outside cell area", off, off+n)
+		}
+	}
+	return nil
+}
+
+func (sp *SlottedPage) NodeType() byte { return sp.buf[0] }
+
+func (sp *SlottedPage) PageID() uint64 { return binary.LittleEndian.Uint64(sp.buf[slotPageID:]) }
+
+func (sp *SlottedPage) NumSlots() int {
+	return int(binary.LittleEndian.Uint16(sp.buf[slotNumSlots:]))
+}
+
+// Aux returns one of the two header words kept outside the cells.
+func (sp *SlottedPage) Aux(i int) uint64 {
+	return binary.LittleEndian.Uint64(sp.buf[slotAux+8*i:])
+}
+
+func (sp *SlottedPage) SetAux(i int, v uint64) {
+	at := slotAux + 8*i
+	binary.LittleEndian.PutUint64(sp.buf[at:], v)
+	sp.markDirty(at, at+8)
+}
+
+// KeyType returns the KeyType* constant shared by every key in the node.
+func (sp *SlottedPage) KeyType() byte { return sp.buf[slotKeyType] }
+
+func (sp *SlottedPage) SetKeyType(keyType byte) {
+	sp.buf[slotKeyType] = keyType
+	sp.markDirty(slotKeyType, slotKeyType+1)
+}
+
+// Prefix returns the key prefix shared by every key in the node.
+func (sp *SlottedPage) Prefix() []byte {
+	off := sp.prefixOff()
+	return sp.buf[off : off+sp.prefixLen()]
+}
+
+// SetPrefix stores the node's key prefix. It must be called before any cell
+// is inserted.
+func (sp *SlottedPage) SetPrefix(prefix string) error {
+	if sp.NumSlots() != 0 || sp.prefixLen() != 0 {
+		return errors.New("key prefix must be set on an empty page")
+	}
+	if len(prefix) == 0 {
+		return nil
+	}
+	if len(prefix) > sp.contiguousFree() {
+		return ErrPageFull
+	}
+	off := sp.cellStart() - len(prefix)
+	copy(sp.buf[off:], prefix)
+	sp.setCellStart(off)
+	binary.LittleEndian.PutUint16(sp.buf[slotPrefixLen:], uint16(len(prefix)))
+	binary.LittleEndian.PutUint16(sp.buf[slotPrefixOff:], uint16(off))
+	sp.markDirty(slotPrefixLen, slotPrefixOff+2)
+	sp.markDirty(off, off+len(prefix))
+	return nil
+}
+
+// Cell returns the bytes of the i-th cell in key order.
+func (sp *SlottedPage) Cell(i int) []byte {
+	off, n := sp.slot(i)
+	return sp.buf[off : off+n]
+}
+
+// FreeSpace returns the bytes available for new cells and their slots,
+// counting holes left by deleted cells.
+func (sp *SlottedPage) FreeSpace() int {
+	used := sp.prefixLen()
+	for i := 0; i < sp.NumSlots(); i++ {
+		_, n := sp.slot(i)
+		used += n
+	}
+	return len(sp.buf) - sp.dirEnd(sp.NumSlots()) - used
+}
+
+// InsertCell inserts cell so that it becomes the i-th cell, compacting the
+// page first if deleted cells left the free space fragmented.
+func (sp *SlottedPage) InsertCell(i int, cell []byte) error {
+	n := sp.NumSlots()
+	if i < 0 || i > n {
+		return fmt.Errorf("slot %d out of range [0, %d]", i, n)
+	}
+	if len(cell)+slotSize > sp.FreeSpace() {
+		return ErrPageFull
+	}
+	if len(cell)+slotSize > sp.contiguousFree() {
+		sp.Compact()
+	}
+
+	off := sp.cellStart() - len(cell)
+	copy(sp.buf[off:], cell)
+	sp.setCellStart(off)
+	sp.markDirty(off, off+len(cell))
+
+	// shift the slots after i up by one entry
+	at := sp.dirEnd(i)
+	end := sp.dirEnd(n)
+	copy(sp.buf[at+slotSize:end+slotSize], sp.buf[at:end])
+	binary.LittleEndian.PutUint16(sp.buf[at:], uint16(off))
+	binary.LittleEndian.PutUint16(sp.buf[at+2:], uint16(len(cell)))
+	sp.setNumSlots(n + 1)
+	sp.markDirty(at, end+slotSize)
+	return nil
+}
+
+// DeleteCell removes the i-th cell. Its bytes become a hole that the next
+// Compact reclaims.
+func (sp *SlottedPage) DeleteCell(i int) error {
+	n := sp.NumSlots()
+	if i < 0 || i >= n {
+		return fmt.Errorf("slot %d out of range [0, %d)", i, n)
+	}
+	at := sp.dirEnd(i)
+	end := sp.dirEnd(n)
+	copy(sp.buf[at:], sp.buf[at+slotSize:end])
+	clear(sp.buf[end-slotSize : end])
+	sp.setNumSlots(n - 1)
+	sp.markDirty(at, end)
+
+	// the lowest cell going away just moves the cell area start up
+	if n == 1 && sp.prefixLen() == 0 {
+		sp.setCellStart(len(sp.buf))
+	}
+	return nil
+}
+
+// Compact rewrites the cell area so all free space is contiguous.
+func (sp *SlottedPage) Compact() {
+	n := sp.NumSlots()
+	cells := make([][]byte, n)
+	for i := range cells {
+		cells[i] = append([]byte(nil), sp.Cell(i)...)
+	}
+	prefix := string(sp.Prefix())
+
+	end := len(sp.buf)
+	if len(prefix) > 0 {
+		end -= len(prefix)
+		copy(sp.buf[end:], prefix)
+		binary.LittleEndian.PutUint16(sp.buf[slotPrefixOff:], uint16(end))
+	}
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(sp.buf[end:], cell)
+		binary.LittleEndian.PutUint16(sp.buf[sp.dirEnd(i):], uint16(end))
+	}
+	clear(sp.buf[sp.dirEnd(n):end])
+	sp.setCellStart(end)
+	sp.markDirty(0, len(sp.buf))
+}
+
+// Dirty returns the span [lo, hi) of bytes changed since the page was loaded
+// or the last ClearDirty; lo == hi when nothing changed.
+func (sp *SlottedPage) Dirty() (lo, hi int) {
+	return sp.dirtyLo, sp.dirtyHi
+}
+
+func (sp *SlottedPage) ClearDirty() {
+	sp.dirtyLo, sp.dirtyHi = 0, 0
+}
+
+func (sp *SlottedPage) markDirty(lo, hi int) {
+	if sp.dirtyLo == sp.dirtyHi {
+		sp.dirtyLo, sp.dirtyHi = lo, hi
+		return
+	}
+	sp.dirtyLo = min(sp.dirtyLo, lo)
+	sp.dirtyHi = max(sp.dirtyHi, hi)
+}
+
+func (sp *SlottedPage) slot(i int) (off, n int) {
+	at := sp.dirEnd(i)
+	return int(binary.LittleEndian.Uint16(sp.buf[at:])), int(binary.LittleEndian.Uint16(sp.buf[at+2:]))
+}
+
+func (sp *SlottedPage) dirEnd(n int) int { return slotHeaderSize + n*slotSize }
+
+func (sp *SlottedPage) contiguousFree() int { return sp.cellStart() - sp.dirEnd(sp.NumSlots()) }
+
+func (sp *SlottedPage) cellStart() int {
+	return int(binary.LittleEndian.Uint16(sp.buf[slotCellStart:]))
+}
+
+func (sp *SlottedPage) prefixLen() int {
+	return int(binary.LittleEndian.Uint16(sp.buf[slotPrefixLen:]))
+}
+
+func (sp *SlottedPage) prefixOff() int {
+	return int(binary.LittleEndian.Uint16(sp.buf[slotPrefixOff:]))
+}
+
+func (sp *SlottedPage) setNumSlots(n int) {
+	binary.LittleEndian.PutUint16(sp.buf[slotNumSlots:], uint16(n))
+	sp.markDirty(slotNumSlots, slotNumSlots+2)
+}
+
+func (sp *SlottedPage) setCellStart(off int) {
+	binary.LittleEndian.PutUint16(sp.buf[slotCellStart:], uint16(off))
+	sp.markDirty(slotCellStart, slotCellStart+2)
+}
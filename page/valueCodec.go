@@ -0,0 +1,100 @@
+package page
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ValueCodec converts leaf values to and from bytes. The page codec stores
+// the encoded value behind its own length prefix, so implementations do not
+// need to delimit their output. Decode must not keep data or return values
+// that alias it: data points into a pooled page buffer that is reused as
+// soon as the node is decoded.
+type ValueCodec[V any] interface {
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// AppendCodec is implemented by value codecs that can encode by appending to
+// a caller's buffer, which lets the page codec encode without allocating.
+type AppendCodec[V any] interface {
+	AppendEncode(dst []byte, value V) ([]byte, error)
+}
+
+// FixedSizeCodec is implemented by value codecs whose encoding always has
+// the same length. The page codec stores such values without a length prefix.
+type FixedSizeCodec interface {
+	FixedSize() int
+}
+
+// StringCodec stores string values as their raw bytes.
+type StringCodec struct{}
+
+func (StringCodec) Encode(value string) ([]byte, error) { return []byte(value), nil }
+
+func (StringCodec) AppendEncode(dst []byte, value string) ([]byte, error) {
+	return append(dst, value...), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) { return string(data), nil }
+
+// BytesCodec stores []byte values as-is, for callers that hand the tree
+// pre-serialized blobs. Decode returns a copy, so values never alias the page
+// buffer they were read from.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(value []byte) ([]byte, error) { return value, nil }
+
+func (BytesCodec) AppendEncode(dst []byte, value []byte) ([]byte, error) {
+	return append(dst, value...), nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return append([]byte(nil), data...), nil
+}
+
+// Uint64Codec stores uint64 values (e.g. row offsets) as 8 little-endian bytes.
+// It is fixed-size, so leaves of a uint64 tree carry no value length prefixes.
+type Uint64Codec struct{}
+
+func (Uint64Codec) FixedSize() int { return 8 }
+
+func (Uint64Codec) Encode(value uint64) ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(nil, value), nil
+}
+
+func (Uint64Codec) AppendEncode(dst []byte, value uint64) ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(dst, value), nil
+}
+
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("uint64 value must be 8 bytes, got %d", len(data))
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// DefaultValueCodec returns the built-in codec for V. Other types get the
+// codec registered with RegisterValueType, then a FallbackCodec if
+// SetDefaultFallback enabled one, and nil otherwise.
+func DefaultValueCodec[V any]() ValueCodec[V] {
+	var zero V
+	var codec any
+	switch any(zero).(type) {
+	case string:
+		codec = StringCodec{}
+	case []byte:
+		codec = BytesCodec{}
+	case uint64:
+		codec = Uint64Codec{}
+	default:
+		if registered := registeredCodec[V](); registered != nil {
+			return registered
+		}
+		if format := FallbackFormat(defaultFallback.Load()); format != FallbackNone {
+			return NewFallbackCodec[V](format)
+		}
+		return nil
+	}
+	return codec.(ValueCodec[V])
+}
@@ -0,0 +1,65 @@
+package page
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[reflect.Type]any) // reflect.Type -> ValueCodec[T]
+)
+
+// funcCodec adapts a pair of functions to ValueCodec.
+type funcCodec[T any] struct {
+	enc func(T) ([]byte, error)
+	dec func([]byte) (T, error)
+}
+
+func (c funcCodec[T]) Encode(value T) ([]byte, error) { return c.enc(value) }
+
+func (c funcCodec[T]) Decode(data []byte) (T, error) { return c.dec(data) }
+
+// RegisterValueType makes enc and dec the default codec for values of type
+// T, so trees over T can be created and opened with a nil ValueCodec. It is
+// meant to be called from an init function; registering T again replaces the
+// earlier codec.
+func RegisterValueType[T any](enc func(T) ([]byte, error), dec func([]byte) (T, error)) {
+	if enc == nil || dec == nil {
+		panic(fmt.Sprintf("page: RegisterValueType[%v] with nil encoder or decoder", reflect.TypeFor[T]()))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[reflect.TypeFor[T]()] = funcCodec[T]{enc: enc, dec: dec}
+}
+
+// registeredCodec returns the codec registered for V, or nil.
+func registeredCodec[V any]() ValueCodec[V] {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	codec, ok := registry[reflect.TypeFor[V]()]
+	if !ok {
+		return nil
+	}
+	return codec.(ValueCodec[V])
+}
+
+// ValueTypeTag identifies the value type V. Index files record it in their
+// header so a file cannot be reopened as a tree of a different value type.
+// The tag is a hash of the type's package path and name, so it is stable
+// across builds as long as the type is not renamed or moved.
+func ValueTypeTag[V any]() uint32 {
+	t := reflect.TypeFor[V]()
+	name := t.String()
+	if t.Name() != "" && t.PkgPath() != "" {
+		name = t.PkgPath() + "." + t.Name()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	if tag := h.Sum32(); tag != 0 {
+		return tag
+	}
+	return 1 // 0 means "not recorded"
+}
@@ -0,0 +1,38 @@
+package query
+
+import "fmt"
+
+// Delete is a parsed "DELETE FROM Table WHERE Where".
+type Delete struct {
+	Table string
+	Where []Cond
+}
+
+// Delete runs q, deleting every row it matches or, if any cannot be
+// deleted, none. The rows are found as Select finds them; see "Access
+// paths" in plan.go.
+func (s *Session) Delete(q *Delete) (Result, error) {
+	t, err := s.DB.OpenTable(q.Table)
+	if err != nil {
+		return Result{}, fmt.Errorf("Delete: %w", err)
+	}
+	schema := t.Schema()
+	where, err := bindConds(&schema, q.Where)
+	if err != nil {
+		return Result{}, fmt.Errorf("Delete: %w", err)
+	}
+	p, err := s.plan(t, &schema, where, nil, 0, 0)
+	if err != nil {
+		return Result{}, fmt.Errorf("Delete: %w", err)
+	}
+	n, err := t.DeleteWhere(p.index, p.rng, func(row []any) (bool, error) {
+		if len(row) != len(schema.Columns) {
+			return false, errSchemaChanged
+		}
+		return match(row, where)
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("Delete: %w", err)
+	}
+	return Result{RowsAffected: n}, nil
+}
@@ -0,0 +1,61 @@
+package query
+
+import "fmt"
+
+// Insert is a parsed "INSERT INTO Table (Columns) VALUES Values...". A
+// column left out of Columns takes its default, or for an auto-increment
+// column the next number; nil Columns names every column in order.
+type Insert struct {
+	Table   string
+	Columns []string
+	Values  [][]any
+}
+
+// Insert runs q, adding all of its rows or, if any cannot be added, none.
+func (s *Session) Insert(q *Insert) (Result, error) {
+	t, err := s.DB.OpenTable(q.Table)
+	if err != nil {
+		return Result{}, fmt.Errorf("Insert: %w", err)
+	}
+	schema := t.Schema()
+	var pos []int
+	if q.Columns == nil {
+		for i := range schema.Columns {
+			pos = append(pos, i)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, name := range q.Columns {
+		col := schema.Column(name)
+		switch {
+		case col < 0:
+			return Result{}, fmt.Errorf("Insert: no column %q", name)
+		case seen[col]:
+			return Result{}, fmt.Errorf("Insert: column %q given twice", name)
+		}
+		seen[col] = true
+		pos = append(pos, col)
+	}
+	if len(q.Values) == 0 {
+		return Result{}, nil
+	}
+	rows := make([][]any, len(q.Values))
+	for i, values := range q.Values {
+		if len(values) != len(pos) {
+			return Result{}, fmt.Errorf("Insert: row %d has %d values for %d columns", i+1, len(values), len(pos))
+		}
+		row := make([]any, len(schema.Columns))
+		for j, c := range schema.Columns {
+			row[j] = c.Default
+		}
+		for j, col := range pos {
+			row[col] = values[j]
+		}
+		rows[i] = row
+	}
+	ids, err := t.InsertRows(rows)
+	if err != nil {
+		return Result{}, fmt.Errorf("Insert: %w", err)
+	}
+	return Result{RowsAffected: len(rows), GeneratedKeys: ids}, nil
+}
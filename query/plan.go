@@ -0,0 +1,495 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"pranavdb/data"
+	"pranavdb/db"
+	"slices"
+	"strings"
+)
+
+/*
+Access paths
+
+A statement reads its table through one index, scanning a range of it
+that the WHERE clause bounds (see "Index scans" in db/rows.go):
+
+  - the primary key index. Conditions are taken on the key's columns in
+    order: equalities on the leading columns fix a prefix, and range
+    conditions (<, <=, >, >=, BETWEEN) on the column after them bound it,
+    the tightest of each side winning. So "pk = ?" reads one row and
+    "pk BETWEEN ? AND ?" the rows in between.
+  - a secondary index, bounded by the conditions on its column.
+  - the whole primary key index, a full scan, when nothing bounds it.
+
+Every row the scan returns is checked against every condition, including
+the ones the bounds already guarantee, which is cheap and keeps the plan
+from having to be exact. A condition comparing with NULL bounds nothing,
+as it matches no row.
+
+The index keys hold values of their columns' types, while a condition's
+constant may be any number (see "Statements" in query.go), so bounds are
+converted first. A number bounds a float column as a float64. On an int or
+bigint column a non-integral bound is rounded into its range, "id > 7.5"
+bounding as "id >= 8" and "id < 7.5" as "id <= 7", which takes in the same
+keys; an equality with one, like a number out of range, bounds nothing.
+
+A scan also serves an ORDER BY when the index's order is the one asked
+for, so the rows need not be sorted. The primary key index serves an
+ascending order on its columns in turn, from the first column the WHERE
+prefix leaves free; a secondary index serves an ascending order on its
+column. A column an equality fixes is left out of the order, as it is the
+same in every row. Cursors only step forwards, so a descending order is
+always sorted.
+
+Choosing a plan
+
+Each access path is costed and the cheapest taken, the primary key's on a
+tie. A path's cost is the rows it reads, each weighted by what reading it
+takes, plus the cost of sorting the rows that match if it does not serve
+the ORDER BY:
+
+	rows read   table rows × selectivity of the conditions bounding it,
+	            or, for a scan in order with a LIMIT, only as many as it
+	            takes to find OFFSET + LIMIT matching rows
+	read cost   1 per row through the primary key, secondaryRowCost per
+	            row through a secondary index, which reads an entry and
+	            then the row
+	sort cost   sortRowCost × n log2 n for n matching rows
+
+Selectivities come from the table's statistics (see Table.Analyze): an
+equality selects the share of a column's non-NULL values one distinct
+value has, and a range the share of the histogram's bounds within it.
+Without statistics, an equality on a single-column primary key selects
+one row and other conditions take fixed guesses. Conditions are taken to
+be independent.
+
+Session.ForceIndex forces one path, for debugging plans, and
+Session.Explain shows the plan chosen.
+*/
+
+// Cost weights; see "Choosing a plan" above.
+const (
+	secondaryRowCost = 1.5
+	sortRowCost      = 0.05
+)
+
+// Selectivities guessed for conditions on columns without statistics.
+const (
+	guessEq    = 0.05
+	guessRange = 1.0 / 3
+	guessTwo   = 0.25 // a range bounded on both sides
+)
+
+// Values of Session.ForceIndex that name no column.
+const (
+	ForcePrimaryKey = "(primary key)"
+	ForceFullScan   = "(full scan)"
+)
+
+// plan is the way a statement reads its table: the index to scan and the
+// range of it; see "Access paths" above.
+type plan struct {
+	index   string // "" for the primary key
+	rng     db.Range
+	ordered bool    // the scan returns the rows in the order asked for
+	sel     float64 // share of the table the scan reads
+	rows    float64 // estimated rows read
+	cost    float64
+}
+
+// String describes p, for Explain.
+func (p *plan) String() string {
+	var b strings.Builder
+	switch {
+	case p.index != "":
+		fmt.Fprintf(&b, "index %s", p.index)
+	case p.rng.Low == nil && p.rng.High == nil:
+		b.WriteString("full scan")
+	default:
+		b.WriteString("primary key")
+	}
+	if p.rng.Low != nil || p.rng.High != nil {
+		open, close := "[", "]"
+		if p.rng.LowOpen || p.rng.Low == nil {
+			open = "("
+		}
+		if p.rng.HighOpen || p.rng.High == nil {
+			close = ")"
+		}
+		fmt.Fprintf(&b, " %s%s, %s%s", open, boundString(p.rng.Low, "-inf"), boundString(p.rng.High, "+inf"), close)
+	}
+	if !p.ordered {
+		b.WriteString(", then sort")
+	}
+	fmt.Fprintf(&b, "; about %.0f rows read, cost %.1f", p.rows, p.cost)
+	return b.String()
+}
+
+func boundString(v any, none string) string {
+	if v == nil {
+		return none
+	}
+	return fmt.Sprint(v)
+}
+
+// planner chooses a statement's plan; see "Choosing a plan" above.
+type planner struct {
+	schema *db.Schema
+	stats  db.TableStats
+	where  []boundCond
+	n      float64 // rows in the table
+	all    float64 // selectivity of the whole WHERE clause
+}
+
+// plan picks the way to read t for a statement with the given WHERE
+// clause, ORDER BY and LIMIT, as the session forces or at the least cost.
+func (s *Session) plan(t *db.Table, schema *db.Schema, where []boundCond, order []sortKey, limit, offset int) (plan, error) {
+	pl := &planner{schema: schema, where: keyConds(schema, where), n: float64(t.Len()), all: 1}
+	pl.stats, _ = t.Stats()
+	for i := range where {
+		c := &where[i]
+		switch c.Op {
+		case Eq:
+			pl.all *= pl.eqSel(c)
+		case Between:
+			pl.all *= pl.rangeSel(c.col, c, c)
+		case Gt, Ge:
+			pl.all *= pl.rangeSel(c.col, c, nil)
+		default:
+			pl.all *= pl.rangeSel(c.col, nil, c)
+		}
+	}
+
+	// the columns the order asks for, less those an equality fixes
+	var want []int
+	desc := false
+	for _, o := range order {
+		desc = desc || o.desc
+		if findEq(where, o.col) == nil {
+			want = append(want, o.col)
+		}
+	}
+	serves := func(cols []int) bool {
+		return !desc && len(want) <= len(cols) && slices.Equal(want, cols[:len(want)])
+	}
+
+	key := schema.PrimaryKey
+	if len(key) == 0 {
+		key = []int{0}
+	}
+	var plans []plan
+	force := s.ForceIndex
+	if force == "" || force == ForcePrimaryKey {
+		p, free := pl.planKey(key)
+		p.ordered = serves(free)
+		plans = append(plans, p)
+	}
+	if force == ForceFullScan {
+		plans = append(plans, plan{sel: 1, ordered: serves(key)})
+	}
+	for _, name := range schema.Indexes {
+		col := schema.Column(name)
+		if force == "" || schema.Column(force) == col {
+			p := pl.planIndex(name, col)
+			p.ordered = serves([]int{col})
+			plans = append(plans, p)
+		}
+	}
+	if len(plans) == 0 {
+		return plan{}, fmt.Errorf("forced index %q: no such index", force)
+	}
+	best := -1
+	for i := range plans {
+		p := &plans[i]
+		pl.cost(p, limit, offset)
+		if best < 0 || p.cost < plans[best].cost {
+			best = i
+		}
+	}
+	return plans[best], nil
+}
+
+// planKey plans a scan of the primary key index, whose columns are key,
+// and returns the key columns after the prefix equalities fix.
+func (pl *planner) planKey(key []int) (plan, []int) {
+	var prefix []any
+	var lo, hi *boundCond
+	sel := 1.0
+	for _, col := range key {
+		if eq := findEq(pl.where, col); eq != nil {
+			prefix = append(prefix, eq.Value)
+			sel *= pl.eqSel(eq)
+			continue
+		}
+		lo, hi = rangeOn(pl.where, col)
+		if lo != nil || hi != nil {
+			sel *= pl.rangeSel(col, lo, hi)
+		}
+		break
+	}
+	bound := func(c *boundCond, v any) any {
+		values := prefix
+		if c != nil {
+			values = append(values[:len(values):len(values)], v)
+		}
+		switch {
+		case len(values) == 0:
+			return nil
+		case len(key) == 1:
+			return values[0]
+		}
+		return values
+	}
+	return plan{rng: bounds(lo, hi, bound), sel: sel}, key[len(prefix):]
+}
+
+// planIndex plans a scan of the secondary index on column col, called
+// name, bounded by the conditions on it.
+func (pl *planner) planIndex(name string, col int) plan {
+	lo, hi := rangeOn(pl.where, col)
+	sel := 1.0
+	if eq := findEq(pl.where, col); eq != nil {
+		lo, hi = eq, eq
+		sel = pl.eqSel(eq)
+	} else if lo != nil || hi != nil {
+		sel = pl.rangeSel(col, lo, hi)
+	}
+	return plan{index: name, sel: sel, rng: bounds(lo, hi, func(c *boundCond, v any) any { return v })}
+}
+
+// cost fills in the rows p reads and its cost; see "Choosing a plan".
+func (pl *planner) cost(p *plan, limit, offset int) {
+	rows := pl.n * p.sel
+	matches := min(pl.n*pl.all, rows)
+	if p.ordered && limit > 0 && matches > 0 {
+		rows = min(rows, float64(offset+limit)*rows/matches)
+	}
+	p.rows = rows
+	p.cost = rows
+	if p.index != "" {
+		p.cost *= secondaryRowCost
+	}
+	if !p.ordered && matches > 1 {
+		p.cost += sortRowCost * matches * math.Log2(matches)
+	}
+}
+
+// column returns the statistics of column col, if the table has been
+// analyzed since it had its current type.
+func (pl *planner) column(col int) *db.ColumnStats {
+	c := pl.schema.Columns[col]
+	cs := pl.stats.Column(c.Name)
+	if cs == nil || cs.Type != c.Type {
+		return nil
+	}
+	return cs
+}
+
+// eqSel returns the selectivity of equality c.
+func (pl *planner) eqSel(c *boundCond) float64 {
+	if cs := pl.column(c.col); cs != nil && pl.stats.Rows > 0 {
+		nonNull := 1 - float64(cs.Nulls)/float64(pl.stats.Rows)
+		// the statistics may be older than the rows
+		return max(nonNull/float64(max(cs.Distinct, 1)), 1/max(pl.n, 1))
+	}
+	if key := pl.schema.PrimaryKey; len(key) == 1 && key[0] == c.col && pl.n > 0 {
+		return 1 / pl.n
+	}
+	return guessEq
+}
+
+// rangeSel returns the selectivity of the range lo and hi bound on column
+// col, either of which may be nil; a Between bounds both sides.
+func (pl *planner) rangeSel(col int, lo, hi *boundCond) float64 {
+	loV, hiV := any(nil), any(nil)
+	if lo != nil {
+		loV = lo.Value
+	}
+	if hi != nil {
+		hiV = hi.Value
+		if hi.Op == Between {
+			hiV = hi.High
+		}
+	}
+	cs := pl.column(col)
+	if cs == nil || len(cs.Histogram) == 0 {
+		if lo != nil && hi != nil {
+			return guessTwo
+		}
+		return guessRange
+	}
+	in := 0
+	for _, b := range cs.Histogram {
+		if loV != nil {
+			if n, ok, _ := compare(b, loV); !ok || n < 0 {
+				continue
+			}
+		}
+		if hiV != nil {
+			if n, ok, _ := compare(b, hiV); !ok || n > 0 {
+				continue
+			}
+		}
+		in++
+	}
+	buckets := float64(len(cs.Histogram))
+	// a range falling inside one bucket still takes some of it
+	return max(float64(in), 0.5) / buckets
+}
+
+// bounds returns the range lo and hi bound, making each bound's value into
+// a bound with bound, which is also given a nil condition for a missing
+// one.
+func bounds(lo, hi *boundCond, bound func(c *boundCond, v any) any) db.Range {
+	var r db.Range
+	if lo != nil {
+		r.Low, r.LowOpen = bound(lo, lo.Value), lo.Op == Gt
+	} else {
+		r.Low = bound(nil, nil)
+	}
+	switch {
+	case hi == nil:
+		r.High = bound(nil, nil)
+	case hi.Op == Between:
+		r.High = bound(hi, hi.High)
+	default:
+		r.High, r.HighOpen = bound(hi, hi.Value), hi.Op == Lt
+	}
+	return r
+}
+
+// keyConds returns the conditions of where that can bound a scan, with
+// their constants converted to their columns' types; see "Access paths"
+// above.
+func keyConds(schema *db.Schema, where []boundCond) []boundCond {
+	var conds []boundCond
+	for _, c := range where {
+		codes, err := data.ParseSchema(schema.Columns[c.col].Type)
+		if err != nil || c.Value == nil {
+			continue
+		}
+		ok := true
+		switch codes[0] &^ (data.TypeFlagNullable | data.TypeFlagCompressed) {
+		case data.TypeCodeInt, data.TypeCodeBigInt:
+			var rounded bool
+			switch c.Op {
+			case Eq:
+				c.Value, rounded, ok = intKey(c.Value, 0)
+				ok = ok && !rounded
+			case Gt, Ge:
+				if c.Value, rounded, ok = intKey(c.Value, 1); rounded {
+					c.Op = Ge
+				}
+			case Lt, Le:
+				if c.Value, rounded, ok = intKey(c.Value, -1); rounded {
+					c.Op = Le
+				}
+			case Between:
+				var okHigh bool
+				c.Value, _, ok = intKey(c.Value, 1)
+				c.High, _, okHigh = intKey(c.High, -1)
+				ok = ok && okHigh
+			}
+		case data.TypeCodeFloat:
+			c.Value = floatKey(c.Value)
+			if c.Op == Between {
+				c.High = floatKey(c.High)
+			}
+		}
+		if ok {
+			conds = append(conds, c)
+		}
+	}
+	return conds
+}
+
+// intKey converts v, a number bounding an integer column from below (dir
+// 1) or above (-1), or equal to it (0), to an int64 key, rounding a
+// non-integral v into the range and reporting that it did. It reports
+// false if v is not a number or is out of range.
+func intKey(v any, dir int) (any, bool, bool) {
+	if n, ok := intValue(v); ok {
+		return n, false, true
+	}
+	f, ok := floatValue(v)
+	if !ok || math.IsNaN(f) {
+		return nil, false, false
+	}
+	r := math.Trunc(f)
+	switch dir {
+	case 1:
+		r = math.Ceil(f)
+	case -1:
+		r = math.Floor(f)
+	}
+	if r < math.MinInt64 || r >= math.MaxInt64 {
+		return nil, false, false
+	}
+	return int64(r), r != f, true
+}
+
+// floatKey converts v, if it is a number, to a float64 key.
+func floatKey(v any) any {
+	if f, ok := floatValue(v); ok {
+		return f
+	}
+	return v
+}
+
+// findEq returns an equality with a value on column col, if there is one.
+func findEq(where []boundCond, col int) *boundCond {
+	for i := range where {
+		if c := &where[i]; c.col == col && c.Op == Eq && c.Value != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// rangeOn returns the tightest lower and upper bounds on column col, if
+// any. A Between is both.
+func rangeOn(where []boundCond, col int) (lo, hi *boundCond) {
+	for i := range where {
+		c := &where[i]
+		if c.col != col || c.Value == nil {
+			continue
+		}
+		switch c.Op {
+		case Gt, Ge:
+			lo = tighter(lo, c, c.Value, 1)
+		case Lt, Le:
+			hi = tighter(hi, c, c.Value, -1)
+		case Between:
+			if c.High != nil {
+				lo = tighter(lo, c, c.Value, 1)
+				hi = tighter(hi, c, c.High, -1)
+			}
+		}
+	}
+	return lo, hi
+}
+
+// tighter returns whichever of bound and c, bounding at v, admits less: the
+// greater lower bound for dir 1, the smaller upper bound for -1. On a tie
+// the open bound wins. Values that cannot be compared keep bound.
+func tighter(bound, c *boundCond, v any, dir int) *boundCond {
+	if bound == nil {
+		return c
+	}
+	cur := bound.Value
+	if dir < 0 && bound.Op == Between {
+		cur = bound.High
+	}
+	n, ok, _ := compare(v, cur)
+	switch {
+	case !ok:
+		return bound
+	case n*dir > 0:
+		return c
+	case n == 0 && (c.Op == Gt || c.Op == Lt):
+		return c
+	}
+	return bound
+}
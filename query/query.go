@@ -0,0 +1,279 @@
+// Package query runs SQL statements, as a parser would hand them over, on
+// the tables of a db.DB.
+package query
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"pranavdb/data"
+	"pranavdb/db"
+	"strings"
+	"time"
+)
+
+/*
+Statements
+
+There is no SQL parser yet, so a statement is given as the struct one
+would produce: Select for "SELECT cols FROM table WHERE ...", Insert for
+"INSERT INTO table (cols) VALUES (...), ...", and so on, with a WHERE
+clause as a list of conditions that must all hold. A condition
+compares one column with constants, which stand in for the statement's
+"?" parameters already bound.
+
+A Session runs statements on a database. Comparisons follow SQL: a NULL on
+either side makes a condition false, so "col = NULL" matches no row.
+Values compare by their Go types as the rowfile decodes them, except that
+numbers compare by value whatever their types, so any Go integer will do
+for an int column, as it does for Insert.
+*/
+
+// Op is the comparison a Cond makes.
+type Op int
+
+const (
+	Eq      Op = iota // column = Value
+	Lt                // column < Value
+	Le                // column <= Value
+	Gt                // column > Value
+	Ge                // column >= Value
+	Between           // column BETWEEN Value AND High
+)
+
+func (op Op) String() string {
+	switch op {
+	case Eq:
+		return "="
+	case Lt:
+		return "<"
+	case Le:
+		return "<="
+	case Gt:
+		return ">"
+	case Ge:
+		return ">="
+	case Between:
+		return "BETWEEN"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Cond is one condition of a WHERE clause.
+type Cond struct {
+	Column string
+	Op     Op
+	Value  any
+	High   any // the upper bound of Between
+}
+
+// Session runs statements on a database; see "Statements" above.
+type Session struct {
+	DB *db.DB
+
+	// ForceIndex, if set, makes every statement read its table through
+	// the secondary index on the column it names, or through the primary
+	// key for ForcePrimaryKey or ForceFullScan, whatever it costs; see
+	// "Choosing a plan" in plan.go. A statement on a table without that
+	// index fails.
+	ForceIndex string
+}
+
+// Result reports what a statement that writes did.
+type Result struct {
+	RowsAffected int
+
+	// GeneratedKeys holds, for an Insert into a table with an
+	// auto-increment column, the number each row holds in it, in order.
+	GeneratedKeys []int64
+}
+
+// boundCond is a Cond with its column looked up.
+type boundCond struct {
+	Cond
+	col int
+}
+
+// bindConds looks up the columns of conds in schema.
+func bindConds(schema *db.Schema, conds []Cond) ([]boundCond, error) {
+	bound := make([]boundCond, len(conds))
+	for i, c := range conds {
+		col := schema.Column(c.Column)
+		if col < 0 {
+			return nil, fmt.Errorf("no column %q", c.Column)
+		}
+		if c.Op < Eq || c.Op > Between {
+			return nil, fmt.Errorf("column %q: unknown operator %v", c.Column, c.Op)
+		}
+		bound[i] = boundCond{c, col}
+	}
+	return bound, nil
+}
+
+// match reports whether row meets every condition.
+func match(row []any, conds []boundCond) (bool, error) {
+	for _, c := range conds {
+		ok, err := c.match(row[c.col])
+		if err != nil {
+			return false, fmt.Errorf("column %q: %w", c.Column, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// match reports whether v meets the condition.
+func (c *boundCond) match(v any) (bool, error) {
+	n, ok, err := compare(v, c.Value)
+	if !ok || err != nil {
+		return false, err
+	}
+	switch c.Op {
+	case Eq:
+		return n == 0, nil
+	case Lt:
+		return n < 0, nil
+	case Le:
+		return n <= 0, nil
+	case Gt:
+		return n > 0, nil
+	case Ge:
+		return n >= 0, nil
+	}
+	if n < 0 {
+		return false, nil
+	}
+	n, ok, err = compare(v, c.High)
+	return ok && n <= 0, err
+}
+
+// errMismatch is returned for values of types that cannot be compared.
+var errMismatch = errors.New("mismatched types")
+
+// compare orders a and b, or reports false if either is NULL.
+func compare(a, b any) (int, bool, error) {
+	if a == nil || b == nil {
+		return 0, false, nil
+	}
+	if x, ok := intValue(a); ok {
+		if y, ok := intValue(b); ok {
+			return cmp.Compare(x, y), true, nil
+		}
+	}
+	if x, ok := floatValue(a); ok {
+		if y, ok := floatValue(b); ok {
+			return cmp.Compare(x, y), true, nil
+		}
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true, nil
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y), true, nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return cmp.Compare(boolInt(x), boolInt(y)), true, nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), true, nil
+		}
+	case data.UUID:
+		if y, ok := b.(data.UUID); ok {
+			return bytes.Compare(x[:], y[:]), true, nil
+		}
+	case data.Decimal:
+		if y, ok := b.(data.Decimal); ok {
+			return compareDecimal(x, y), true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%w: %T and %T", errMismatch, a, b)
+}
+
+// compareNullsFirst orders a and b as an index would, with NULL first.
+// Values of one column always compare.
+func compareNullsFirst(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	n, _, _ := compare(a, b)
+	return n
+}
+
+// intValue converts any Go integer to int64, as far as it fits.
+func intValue(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// floatValue converts a Go float, or integer, to float64.
+func floatValue(v any) (float64, bool) {
+	switch f := v.(type) {
+	case float64:
+		return f, true
+	case float32:
+		return float64(f), true
+	case uint:
+		return float64(f), true
+	case uint64:
+		return float64(f), true
+	}
+	n, ok := intValue(v)
+	return float64(n), ok
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compareDecimal orders two decimals of any scales.
+func compareDecimal(a, b data.Decimal) int {
+	x, y := a.Unscaled, b.Unscaled
+	for s := a.Scale; s < b.Scale; s++ {
+		x = new(big.Int).Mul(x, ten)
+	}
+	for s := b.Scale; s < a.Scale; s++ {
+		y = new(big.Int).Mul(y, ten)
+	}
+	return x.Cmp(y)
+}
+
+var ten = big.NewInt(10)
@@ -0,0 +1,274 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"pranavdb/db"
+	"slices"
+)
+
+/*
+Results
+
+Select reads its table as its plan says (see "Access paths" in plan.go)
+and returns the rows as the scan meets them if the plan serves the ORDER
+BY. Otherwise it reads them all first and sorts them in memory, NULLs
+first as in an index.
+
+A LIMIT stops the scan once it has returned enough rows, after skipping
+the OFFSET's, and closes it, so a query served in order reads only the
+index leaves and rows it returns or skips. A sort keeps only the first
+OFFSET + LIMIT rows as it goes, trimming the rest whenever it has twice
+that many.
+*/
+
+// Select is a parsed "SELECT Columns FROM Table WHERE Where ORDER BY
+// OrderBy LIMIT Limit OFFSET Offset".
+type Select struct {
+	Table   string
+	Columns []string // nil for "*"
+	Where   []Cond
+	OrderBy []Order
+	Limit   int // if positive, the most rows returned
+	Offset  int // rows skipped before the first returned
+}
+
+// Order is one column of an ORDER BY.
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// sortKey is an Order with its column looked up.
+type sortKey struct {
+	col  int
+	desc bool
+}
+
+// Rows iterates over the result of a Select, in the order of the index it
+// reads; see db.Rows for the pattern of use.
+type Rows struct {
+	columns []string
+	proj    []int // column of each result value
+	width   int   // columns in the table's rows
+	src     *db.Rows
+	where   []boundCond
+	order   []sortKey // to sort by, unless the scan is in order
+	sorted  [][]any   // the rows, once read and sorted
+	limit   int       // rows left to return, if positive
+	skip    int       // rows left to skip
+	row     []any
+	err     error
+}
+
+// Select runs q and returns its rows.
+func (s *Session) Select(q *Select) (*Rows, error) {
+	t, err := s.DB.OpenTable(q.Table)
+	if err != nil {
+		return nil, fmt.Errorf("Select: %w", err)
+	}
+	schema := t.Schema()
+	where, err := bindConds(&schema, q.Where)
+	if err != nil {
+		return nil, fmt.Errorf("Select: %w", err)
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return nil, errors.New("Select: negative LIMIT or OFFSET")
+	}
+	r := &Rows{width: len(schema.Columns), where: where, limit: q.Limit, skip: q.Offset}
+	if q.Columns == nil {
+		for i, c := range schema.Columns {
+			r.columns, r.proj = append(r.columns, c.Name), append(r.proj, i)
+		}
+	}
+	for _, name := range q.Columns {
+		col := schema.Column(name)
+		if col < 0 {
+			return nil, fmt.Errorf("Select: no column %q", name)
+		}
+		r.columns, r.proj = append(r.columns, schema.Columns[col].Name), append(r.proj, col)
+	}
+	order, err := sortKeys(&schema, q.OrderBy)
+	if err != nil {
+		return nil, fmt.Errorf("Select: %w", err)
+	}
+	p, err := s.plan(t, &schema, where, order, q.Limit, q.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("Select: %w", err)
+	}
+	if !p.ordered {
+		r.order = order
+	}
+	if r.src, err = t.ScanIndex(p.index, p.rng); err != nil {
+		return nil, fmt.Errorf("Select: %w", err)
+	}
+	return r, nil
+}
+
+// sortKeys looks up the columns of an ORDER BY in schema.
+func sortKeys(schema *db.Schema, order []Order) ([]sortKey, error) {
+	var keys []sortKey
+	for _, o := range order {
+		col := schema.Column(o.Column)
+		if col < 0 {
+			return nil, fmt.Errorf("no column %q", o.Column)
+		}
+		keys = append(keys, sortKey{col, o.Desc})
+	}
+	return keys, nil
+}
+
+// Explain returns the plan Select would run q with, such as "index email
+// [a@b, a@b]; about 1 rows read, cost 1.5".
+func (s *Session) Explain(q *Select) (string, error) {
+	t, err := s.DB.OpenTable(q.Table)
+	if err != nil {
+		return "", fmt.Errorf("Explain: %w", err)
+	}
+	schema := t.Schema()
+	where, err := bindConds(&schema, q.Where)
+	if err != nil {
+		return "", fmt.Errorf("Explain: %w", err)
+	}
+	order, err := sortKeys(&schema, q.OrderBy)
+	if err != nil {
+		return "", fmt.Errorf("Explain: %w", err)
+	}
+	p, err := s.plan(t, &schema, where, order, q.Limit, q.Offset)
+	if err != nil {
+		return "", fmt.Errorf("Explain: %w", err)
+	}
+	return p.String(), nil
+}
+
+// Columns returns the names of the result's columns.
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// Next moves to the next row of the result and reports whether there is
+// one.
+func (r *Rows) Next() bool {
+	var row []any
+	ok := r.limit >= 0
+	for ok {
+		if r.order != nil {
+			row, ok = r.nextSorted()
+		} else {
+			row, ok = r.nextMatch()
+		}
+		if !ok || r.skip == 0 {
+			break
+		}
+		r.skip--
+	}
+	if ok && r.limit > 0 {
+		if r.limit--; r.limit == 0 {
+			// the last row: end the scan now rather than at the next call
+			r.limit = -1
+			if err := r.src.Close(); err != nil {
+				r.err, ok = err, false
+			}
+		}
+	}
+	if !ok {
+		r.row = nil
+		return false
+	}
+	r.row = make([]any, len(r.proj))
+	for i, col := range r.proj {
+		r.row[i] = row[col]
+	}
+	return true
+}
+
+// nextMatch returns the next row the scan finds that meets the WHERE
+// clause.
+func (r *Rows) nextMatch() ([]any, bool) {
+	for r.err == nil && r.src.Next() {
+		row := r.src.Row()
+		if len(row) != r.width {
+			r.fail(errSchemaChanged)
+			break
+		}
+		ok, err := match(row, r.where)
+		if err != nil {
+			r.fail(err)
+			break
+		}
+		if ok {
+			return row, true
+		}
+	}
+	if r.err == nil {
+		r.err = r.src.Err()
+	}
+	return nil, false
+}
+
+// nextSorted returns the next row in the order asked for, reading and
+// sorting them all first.
+func (r *Rows) nextSorted() ([]any, bool) {
+	if r.sorted == nil {
+		// with a LIMIT, only the first keep rows can be returned
+		keep := 0
+		if r.limit > 0 {
+			keep = r.skip + r.limit
+		}
+		r.sorted = [][]any{}
+		for row, ok := r.nextMatch(); ok; row, ok = r.nextMatch() {
+			if r.sorted = append(r.sorted, row); keep > 0 && len(r.sorted) >= 2*keep {
+				r.sort()
+				r.sorted = r.sorted[:keep]
+			}
+		}
+		if r.err != nil {
+			r.sorted = nil
+			return nil, false
+		}
+		r.sort()
+	}
+	if len(r.sorted) == 0 {
+		return nil, false
+	}
+	row := r.sorted[0]
+	r.sorted = r.sorted[1:]
+	return row, true
+}
+
+// sort sorts r.sorted in the order asked for. It is stable, so rows a
+// trim keeps stay ahead of equal rows read after them, as they would in
+// one sort.
+func (r *Rows) sort() {
+	slices.SortStableFunc(r.sorted, func(a, b []any) int {
+		for _, o := range r.order {
+			if n := compareNullsFirst(a[o.col], b[o.col]); n != 0 {
+				if o.desc {
+					return -n
+				}
+				return n
+			}
+		}
+		return 0
+	})
+}
+
+// fail ends the scan with err.
+func (r *Rows) fail(err error) {
+	r.err = errors.Join(err, r.src.Close())
+}
+
+// Row returns the current row's values, in the order of Columns.
+func (r *Rows) Row() []any {
+	return r.row
+}
+
+// Err returns the error that ended the rows, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close ends the rows early. It is safe to call after Next returns false.
+func (r *Rows) Close() error {
+	return r.src.Close()
+}
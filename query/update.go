@@ -0,0 +1,64 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Update is a parsed "UPDATE Table SET Set... WHERE Where".
+type Update struct {
+	Table string
+	Set   []Assignment
+	Where []Cond
+}
+
+// Assignment is one "Column = Value" of a SET clause.
+type Assignment struct {
+	Column string
+	Value  any
+}
+
+// Update runs q, changing every row it matches or, if any cannot be
+// changed, none. The rows are found as Select finds them; see "Access
+// paths" in plan.go.
+func (s *Session) Update(q *Update) (Result, error) {
+	t, err := s.DB.OpenTable(q.Table)
+	if err != nil {
+		return Result{}, fmt.Errorf("Update: %w", err)
+	}
+	schema := t.Schema()
+	where, err := bindConds(&schema, q.Where)
+	if err != nil {
+		return Result{}, fmt.Errorf("Update: %w", err)
+	}
+	set := make([]int, len(q.Set))
+	for i, a := range q.Set {
+		if set[i] = schema.Column(a.Column); set[i] < 0 {
+			return Result{}, fmt.Errorf("Update: no column %q", a.Column)
+		}
+	}
+	p, err := s.plan(t, &schema, where, nil, 0, 0)
+	if err != nil {
+		return Result{}, fmt.Errorf("Update: %w", err)
+	}
+	n, err := t.UpdateWhere(p.index, p.rng, func(row []any) ([]any, error) {
+		if len(row) != len(schema.Columns) {
+			return nil, errSchemaChanged
+		}
+		if ok, err := match(row, where); !ok || err != nil {
+			return nil, err
+		}
+		for i, a := range q.Set {
+			row[set[i]] = a.Value
+		}
+		return row, nil
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("Update: %w", err)
+	}
+	return Result{RowsAffected: n}, nil
+}
+
+// errSchemaChanged is returned for a table whose columns change while a
+// statement runs on it.
+var errSchemaChanged = errors.New("table schema changed during the statement")
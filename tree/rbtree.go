@@ -0,0 +1,248 @@
+package tree
+
+import "errors"
+
+// Tree is the ordered-map interface shared by the tree implementations: the
+// disk-backed B+ tree in package index and RBTree here.
+type Tree[K Key, V any] interface {
+	Insert(key K, value V) error
+	Search(key K) (V, error)
+	Delete(key K) error
+	RangeSearch(startKey, endKey K) ([]LeafPair[K, V], error)
+	Scan(fn func(key K, value V) error) error
+}
+
+// RBTree is an in-memory left-leaning red-black tree. It has none of the
+// page encoding and node splitting of a B+ tree, which makes it the cheaper
+// choice for small sets of keys that never need to reach disk.
+type RBTree[K Key, V any] struct {
+	root *rbNode[K, V]
+	n    int
+}
+
+type rbNode[K Key, V any] struct {
+	key         K
+	value       V
+	left, right *rbNode[K, V]
+	red         bool // color of the link from the parent
+}
+
+// NewRBTree returns an empty red-black tree.
+func NewRBTree[K Key, V any]() *RBTree[K, V] {
+	return &RBTree[K, V]{}
+}
+
+// Len returns the number of keys in the tree.
+func (t *RBTree[K, V]) Len() int { return t.n }
+
+// Insert adds a key-value pair; inserting a key already present fails.
+func (t *RBTree[K, V]) Insert(key K, value V) error {
+	if t.find(key) != nil {
+		return errors.New("duplicate key")
+	}
+	t.root = rbInsert(t.root, key, value)
+	t.root.red = false
+	t.n++
+	return nil
+}
+
+// Search returns the value stored for key.
+func (t *RBTree[K, V]) Search(key K) (V, error) {
+	if n := t.find(key); n != nil {
+		return n.value, nil
+	}
+	var zero V
+	return zero, errors.New("key not found")
+}
+
+// Delete removes key from the tree.
+func (t *RBTree[K, V]) Delete(key K) error {
+	if t.find(key) == nil {
+		return errors.New("key not found")
+	}
+	if !isRed(t.root.left) && !isRed(t.root.right) {
+		t.root.red = true
+	}
+	t.root = rbDelete(t.root, key)
+	if t.root != nil {
+		t.root.red = false
+	}
+	t.n--
+	return nil
+}
+
+// RangeSearch returns all key-value pairs in the range [startKey, endKey).
+func (t *RBTree[K, V]) RangeSearch(startKey, endKey K) ([]LeafPair[K, V], error) {
+	var results []LeafPair[K, V]
+	rbRange(t.root, startKey, endKey, &results)
+	return results, nil
+}
+
+// Scan calls fn for every key-value pair in ascending key order. Returning
+// an error from fn stops the scan and returns it.
+func (t *RBTree[K, V]) Scan(fn func(key K, value V) error) error {
+	var stack []*rbNode[K, V]
+	for n := t.root; n != nil || len(stack) > 0; {
+		for ; n != nil; n = n.left {
+			stack = append(stack, n)
+		}
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if err := fn(n.key, n.value); err != nil {
+			return err
+		}
+		n = n.right
+	}
+	return nil
+}
+
+func (t *RBTree[K, V]) find(key K) *rbNode[K, V] {
+	for n := t.root; n != nil; {
+		switch {
+		case key.Less(n.key):
+			n = n.left
+		case n.key.Less(key):
+			n = n.right
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+func rbRange[K Key, V any](n *rbNode[K, V], startKey, endKey K, out *[]LeafPair[K, V]) {
+	if n == nil {
+		return
+	}
+	if startKey.Less(n.key) {
+		rbRange(n.left, startKey, endKey, out)
+	}
+	if !n.key.Less(startKey) && n.key.Less(endKey) {
+		*out = append(*out, LeafPair[K, V]{K: n.key, Value: n.value})
+	}
+	if n.key.Less(endKey) {
+		rbRange(n.right, startKey, endKey, out)
+	}
+}
+
+func isRed[K Key, V any](n *rbNode[K, V]) bool {
+	return n != nil && n.red
+}
+
+func rotateLeft[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	x := h.right
+	h.right = x.left
+	x.left = h
+	x.red = h.red
+	h.red = true
+	return x
+}
+
+func rotateRight[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	x := h.left
+	h.left = x.right
+	x.right = h
+	x.red = h.red
+	h.red = true
+	return x
+}
+
+func flipColors[K Key, V any](h *rbNode[K, V]) {
+	h.red = !h.red
+	h.left.red = !h.left.red
+	h.right.red = !h.right.red
+}
+
+// rbBalance restores the left-leaning invariants at h on the way back up.
+func rbBalance[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	if isRed(h.right) && !isRed(h.left) {
+		h = rotateLeft(h)
+	}
+	if isRed(h.left) && isRed(h.left.left) {
+		h = rotateRight(h)
+	}
+	if isRed(h.left) && isRed(h.right) {
+		flipColors(h)
+	}
+	return h
+}
+
+func rbInsert[K Key, V any](h *rbNode[K, V], key K, value V) *rbNode[K, V] {
+	if h == nil {
+		return &rbNode[K, V]{key: key, value: value, red: true}
+	}
+	switch {
+	case key.Less(h.key):
+		h.left = rbInsert(h.left, key, value)
+	case h.key.Less(key):
+		h.right = rbInsert(h.right, key, value)
+	default:
+		h.value = value
+	}
+	return rbBalance(h)
+}
+
+// moveRedLeft makes h.left or one of its children red, assuming h is red
+// and both h.left and h.left.left are black.
+func moveRedLeft[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	flipColors(h)
+	if isRed(h.right.left) {
+		h.right = rotateRight(h.right)
+		h = rotateLeft(h)
+		flipColors(h)
+	}
+	return h
+}
+
+// moveRedRight makes h.right or one of its children red, assuming h is red
+// and both h.right and h.right.left are black.
+func moveRedRight[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	flipColors(h)
+	if isRed(h.left.left) {
+		h = rotateRight(h)
+		flipColors(h)
+	}
+	return h
+}
+
+func rbDeleteMin[K Key, V any](h *rbNode[K, V]) *rbNode[K, V] {
+	if h.left == nil {
+		return nil
+	}
+	if !isRed(h.left) && !isRed(h.left.left) {
+		h = moveRedLeft(h)
+	}
+	h.left = rbDeleteMin(h.left)
+	return rbBalance(h)
+}
+
+// rbDelete removes key, which must be in the subtree at h.
+func rbDelete[K Key, V any](h *rbNode[K, V], key K) *rbNode[K, V] {
+	if key.Less(h.key) {
+		if !isRed(h.left) && !isRed(h.left.left) {
+			h = moveRedLeft(h)
+		}
+		h.left = rbDelete(h.left, key)
+		return rbBalance(h)
+	}
+	if isRed(h.left) {
+		h = rotateRight(h)
+	}
+	if key.Equal(h.key) && h.right == nil {
+		return nil
+	}
+	if !isRed(h.right) && !isRed(h.right.left) {
+		h = moveRedRight(h)
+	}
+	if key.Equal(h.key) {
+		m := h.right
+		for m.left != nil {
+			m = m.left
+		}
+		h.key, h.value = m.key, m.value
+		h.right = rbDeleteMin(h.right)
+	} else {
+		h.right = rbDelete(h.right, key)
+	}
+	return rbBalance(h)
+}
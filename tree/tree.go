@@ -7,6 +7,14 @@ type Key interface {
 	Equal(other Key) bool
 }
 
+// OrderedKey is satisfied by the built-in key types. Their values can be
+// compared with < directly, skipping the interface call and type assertion
+// of Less and Equal.
+type OrderedKey interface {
+	Key
+	IntKey | FloatKey | StringKey
+}
+
 // IntKey is a sample implementation of Key for integers.
 type IntKey int
 
@@ -67,22 +75,22 @@ func (k StringKey) Equal(other Key) bool {
 // Node is the interface for all B+ tree nodes.
 type Node[V any] interface {
 	isLeaf() bool
-	GetPageID() uint32
-	SetPageID(pageID uint32)
+	GetPageID() uint64
+	SetPageID(pageID uint64)
 }
 
 // IntermNode is an internal node in the B+ tree.
 type IntermNode[K Key, V any] struct {
-	Pointers []uint32 // Page IDs of child nodes, len = len(Keys)+1
+	Pointers []uint64 // Page IDs of child nodes, len = len(Keys)+1
 	Keys     []K
-	pageID   uint32
+	pageID   uint64
 }
 
 func (n *IntermNode[K, V]) isLeaf() bool { return false }
 
-func (n *IntermNode[K, V]) GetPageID() uint32 { return n.pageID }
+func (n *IntermNode[K, V]) GetPageID() uint64 { return n.pageID }
 
-func (n *IntermNode[K, V]) SetPageID(pageID uint32) { n.pageID = pageID }
+func (n *IntermNode[K, V]) SetPageID(pageID uint64) { n.pageID = pageID }
 
 
 
@@ -95,22 +103,22 @@ type LeafPair[K Key, V any] struct {
 // LeafNode is a leaf node in the B+ tree.
 type LeafNode[K Key, V any] struct {
 	Pairs    []LeafPair[K, V]
-	nextPage uint32 // Page ID of next leaf node
-	prevPage uint32 // Page ID of previous leaf node
-	pageID   uint32
+	nextPage uint64 // Page ID of next leaf node
+	prevPage uint64 // Page ID of previous leaf node
+	pageID   uint64
 }
 
 func (l *LeafNode[K, V]) isLeaf() bool { return true }
 
-func (l *LeafNode[K, V]) GetPageID() uint32 { return l.pageID }
+func (l *LeafNode[K, V]) GetPageID() uint64 { return l.pageID }
 
-func (l *LeafNode[K, V]) SetPageID(pageID uint32) { l.pageID = pageID }
+func (l *LeafNode[K, V]) SetPageID(pageID uint64) { l.pageID = pageID }
 
-func (l *LeafNode[K, V]) GetNextPage() uint32 { return l.nextPage }
+func (l *LeafNode[K, V]) GetNextPage() uint64 { return l.nextPage }
 
-func (l *LeafNode[K, V]) GetPrevPage() uint32 { return l.prevPage }
+func (l *LeafNode[K, V]) GetPrevPage() uint64 { return l.prevPage }
 
-func (l *LeafNode[K, V]) SetNextPage(nextPage uint32) { l.nextPage = nextPage }
+func (l *LeafNode[K, V]) SetNextPage(nextPage uint64) { l.nextPage = nextPage }
 
-func (l *LeafNode[K, V]) SetPrevPage(prevPage uint32) { l.prevPage = prevPage }
+func (l *LeafNode[K, V]) SetPrevPage(prevPage uint64) { l.prevPage = prevPage }
 
@@ -0,0 +1,79 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/*
+Write batches
+
+A WriteBatch collects writes to trees and rowfiles without touching them,
+then makes them all at once: Commit runs them in a Txn over every store
+they name and commits it, so either every write in the batch lands or none
+does. Until Commit nothing is held open, so a batch can be built up at
+leisure, even while another transaction runs.
+
+Writes are recorded as functions along with the participants they write;
+DiskTree.BatchInsert and BatchDelete and the rowfile's BatchInsertRow,
+BatchUpdateRow and BatchDeleteRow record the common ones. A write that
+fails at Commit, such as an insert of a duplicate key, rolls back the
+whole batch.
+*/
+
+// WriteBatch is a list of writes applied atomically by Commit; see "Write
+// batches" above.
+type WriteBatch struct {
+	log   *Log
+	parts []Participant
+	ops   []func() error
+}
+
+// NewWriteBatch returns an empty batch committed through l.
+func (l *Log) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{log: l}
+}
+
+// Add records op, a write to parts, to run at Commit.
+func (b *WriteBatch) Add(op func() error, parts ...Participant) {
+	for _, p := range parts {
+		if !slices.Contains(b.parts, p) {
+			b.parts = append(b.parts, p)
+		}
+	}
+	b.ops = append(b.ops, op)
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch.
+func (b *WriteBatch) Reset() {
+	b.parts, b.ops = nil, nil
+}
+
+// Commit runs the batch's writes in order in one transaction and commits
+// it. If any write fails none of them take effect. The batch is emptied
+// either way.
+func (b *WriteBatch) Commit() error {
+	defer b.Reset()
+	if len(b.ops) == 0 {
+		return nil
+	}
+	tx, err := b.log.Begin(b.parts...)
+	if err != nil {
+		return fmt.Errorf("WriteBatch: %w", err)
+	}
+	for i, op := range b.ops {
+		if err := op(); err != nil {
+			return errors.Join(fmt.Errorf("WriteBatch: write %d: %w", i, err), tx.Rollback())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("WriteBatch: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Checkpoints
+
+A checkpoint syncs every file written through the log since the last one
+and, once they are on disk, empties the log: no record in it is needed any
+more, so recovery has nothing to replay. The header then records the
+checkpoint's LSN as the base the next records count from, which
+CheckpointLSN reports.
+
+Commit takes a checkpoint itself once the log passes logCheckpointSize,
+which under a light write load can take a long time. StartCheckpointer adds
+a goroutine that takes one every interval as well, and Checkpoint takes one
+on demand. No checkpoint is taken while a transaction is open, as it may
+still need its records to roll back: Checkpoint fails then, and the
+background checkpointer waits for its next tick. Either does nothing while
+the log is empty.
+*/
+
+// Checkpoint syncs the files written through the log and empties it; see
+// "Checkpoints" above. It fails while a transaction is open.
+func (l *Log) Checkpoint() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tx != nil {
+		return errors.New("Checkpoint: a transaction is open")
+	}
+	if l.err != nil {
+		return l.err
+	}
+	if err := l.checkpoint(); err != nil {
+		return fmt.Errorf("Checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpoint syncs the files written since the last checkpoint and starts
+// the log afresh from the next LSN. Called with mu held and no transaction
+// open.
+func (l *Log) checkpoint() error {
+	if l.size() == 0 {
+		return nil
+	}
+	if err := l.force(); err != nil {
+		return err
+	}
+	files := make(fileSet)
+	defer files.close()
+	for path := range l.paths {
+		if _, err := files.open(path, false); err != nil {
+			return err
+		}
+	}
+	if err := files.sync(); err != nil {
+		return err
+	}
+	if err := l.reset(l.next); err != nil {
+		return err
+	}
+	clear(l.paths)
+	return nil
+}
+
+// CheckpointLSN returns the LSN of the last checkpoint: every record before
+// it has reached the files and is gone from the log.
+func (l *Log) CheckpointLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.base
+}
+
+// checkpointer runs checkpoints on a timer.
+type checkpointer struct {
+	err  error // first error hit by a background checkpoint
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (c *checkpointer) run(l *Log, interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		l.mu.Lock()
+		var err error
+		if l.tx == nil && l.err == nil {
+			err = l.checkpoint()
+		}
+		l.mu.Unlock()
+		if err != nil && c.err == nil {
+			c.err = fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+}
+
+// StartCheckpointer checkpoints the log every interval from a background
+// goroutine until StopCheckpointer or Close.
+func (l *Log) StartCheckpointer(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("StartCheckpointer: interval must be positive")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ckpt != nil {
+		return errors.New("checkpointer already running")
+	}
+	c := &checkpointer{stop: make(chan struct{}), done: make(chan struct{})}
+	l.ckpt = c
+	go c.run(l, interval)
+	return nil
+}
+
+// StopCheckpointer stops the background checkpoints and returns the first
+// error any of them hit.
+func (l *Log) StopCheckpointer() error {
+	l.mu.Lock()
+	c := l.ckpt
+	l.ckpt = nil
+	l.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.done
+	return c.err
+}
@@ -0,0 +1,201 @@
+package txn
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"pranavdb/internal/failpoint"
+	"testing"
+)
+
+const numSlots = 10
+
+// slots is a participant over a file of numSlots uint64 values.
+type slots struct {
+	path  string
+	f     *os.File
+	held  []Write
+	inTxn bool
+}
+
+func createSlots(t *testing.T, path string) *slots {
+	t.Helper()
+	if err := os.WriteFile(path, make([]byte, numSlots*8), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &slots{path: path, f: f}
+}
+
+// get returns slot i as the transaction sees it.
+func (s *slots) get(t *testing.T, i int) []byte {
+	t.Helper()
+	for j := len(s.held) - 1; j >= 0; j-- {
+		if s.held[j].Off == int64(i)*8 {
+			return s.held[j].Data
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := s.f.ReadAt(b, int64(i)*8); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// set holds a write of v to slots [lo, hi).
+func (s *slots) set(t *testing.T, lo, hi int, v uint64) {
+	t.Helper()
+	if !s.inTxn {
+		t.Fatal("slots written outside a transaction")
+	}
+	for i := lo; i < hi; i++ {
+		s.held = append(s.held, Write{
+			Path:    s.path,
+			Off:     int64(i) * 8,
+			Data:    binary.LittleEndian.AppendUint64(nil, v),
+			Before:  s.get(t, i),
+			OldSize: numSlots * 8,
+		})
+	}
+}
+
+func (s *slots) BeginTxn() error {
+	s.inTxn = true
+	return nil
+}
+
+func (s *slots) TxnWrites() ([]Write, error) { return s.held, nil }
+
+func (s *slots) ApplyTxn() error {
+	for _, w := range s.held {
+		if _, err := s.f.WriteAt(w.Data, w.Off); err != nil {
+			return err
+		}
+	}
+	s.held = nil
+	return nil
+}
+
+func (s *slots) EndTxn(commit bool) error {
+	var err error
+	if commit {
+		err = s.ApplyTxn()
+	}
+	s.held, s.inTxn = nil, false
+	return err
+}
+
+// setup commits 1 to every slot of a new file in dir.
+func setup(t *testing.T, dir string) (*Log, *slots) {
+	t.Helper()
+	l, err := Open(filepath.Join(dir, "t.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := createSlots(t, filepath.Join(dir, "t.slots"))
+	tx, err := l.Begin(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.set(t, 0, numSlots, 1)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return l, s
+}
+
+// checkSlots recovers the log in dir, twice to check recovery can be
+// repeated, and checks every slot then holds want.
+func checkSlots(t *testing.T, dir string, want uint64) {
+	t.Helper()
+	for range 2 {
+		l, err := Open(filepath.Join(dir, "t.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "t.slots"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != numSlots*8 {
+			t.Fatalf("slot file is %d bytes", len(b))
+		}
+		for i := range numSlots {
+			if v := binary.LittleEndian.Uint64(b[i*8:]); v != want {
+				t.Fatalf("slot %d: %d, want %d", i, v, want)
+			}
+		}
+	}
+}
+
+// A crash after the commit record is synced, before the writes are
+// applied, is redone by recovery.
+func TestCrashAfterCommitForce(t *testing.T) {
+	dir := t.TempDir()
+	l, s := setup(t, dir)
+	copied := failpoint.CrashCopy(t, dir, "after-commit-force", func() {
+		tx, err := l.Begin(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, 0, numSlots/2, 2)
+		if err := tx.Spill(); err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, numSlots/2, numSlots, 2)
+		failpoint.Set("after-commit-force", failpoint.Crash)
+		tx.Commit()
+	})
+	checkSlots(t, copied, 2)
+}
+
+// A crash after a spill is logged, with an earlier spill already applied,
+// undoes both.
+func TestCrashAfterSpillForce(t *testing.T) {
+	dir := t.TempDir()
+	l, s := setup(t, dir)
+	copied := failpoint.CrashCopy(t, dir, "after-spill-force", func() {
+		tx, err := l.Begin(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, 0, numSlots/2, 2)
+		if err := tx.Spill(); err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, 0, numSlots, 3)
+		failpoint.Set("after-spill-force", failpoint.Crash)
+		tx.Spill()
+	})
+	checkSlots(t, copied, 1)
+}
+
+// A crash partway through a rollback, after some spilled writes are undone,
+// leaves recovery to finish it.
+func TestCrashDuringRollback(t *testing.T) {
+	dir := t.TempDir()
+	l, s := setup(t, dir)
+	copied := failpoint.CrashCopy(t, dir, "rollback-undo", func() {
+		tx, err := l.Begin(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, 0, numSlots, 2)
+		if err := tx.Spill(); err != nil {
+			t.Fatal(err)
+		}
+		s.set(t, 0, numSlots, 3)
+		if err := tx.Spill(); err != nil {
+			t.Fatal(err)
+		}
+		failpoint.After("rollback-undo", failpoint.Crash, numSlots+numSlots/2)
+		tx.Rollback()
+	})
+	checkSlots(t, copied, 1)
+}
@@ -0,0 +1,241 @@
+package txn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"pranavdb/filelock"
+	"sync"
+)
+
+/*
+Log format
+
+	[0:4]   magic "BPTL"
+	[4:8]   uint32 version
+	[8:16]  uint64 LSN of the first record
+	[16:..] records
+
+A record's LSN is its position in the log, counted from the LSN in the
+header, so LSNs keep growing when a checkpoint empties the log. Each record
+is framed as
+
+	[0:4]  uint32 body length
+	[4:8]  uint32 CRC32 of the body
+	[8:..] body: uint64 LSN, uint8 kind, uint64 transaction (the LSN of its
+	       begin record), uint64 LSN of the transaction's previous record,
+	       then for updates and CLRs the write and for CLRs the LSN of the
+	       next record to undo
+
+A write names its file by its path relative to the log's directory, so the
+log recovers its files whatever the working directory, and after the
+directory holding them all has moved.
+
+Records are buffered and written when a transaction spills or commits. A
+torn last record fails its checksum and is cut off on Open.
+
+Checkpoints, which empty the log, are described in checkpoint.go.
+*/
+
+var logMagic = [4]byte{'B', 'P', 'T', 'L'}
+
+const (
+	logVersion        = 2 // 2: paths relative to the log's directory
+	logHeaderSize     = 16
+	logCheckpointSize = 4 << 20
+
+	recBegin  byte = 1
+	recUpdate byte = 2
+	recCLR    byte = 3
+	recCommit byte = 4
+	recAbort  byte = 5
+	recEnd    byte = 6
+)
+
+// record is one log record; w is set in updates and CLRs, where it is the
+// write being undone.
+type record struct {
+	lsn, tx, prev uint64
+	kind          byte
+	w             Write
+	undoNext      uint64
+}
+
+// Log is the transaction log shared by the transactions over a set of files.
+type Log struct {
+	mu    sync.Mutex
+	file  *os.File
+	dir   string          // the log's directory, absolute
+	base  uint64          // LSN of the first record in the file
+	next  uint64          // LSN of the next record
+	buf   []byte          // records not yet written
+	paths map[string]bool // files written since the last checkpoint
+	tx    *Txn            // the open transaction, if any
+	err   error           // a commit or rollback left for recovery to finish
+	ckpt  *checkpointer   // background checkpoints, if started
+
+	// optimistic transactions, see optimistic.go
+	optMu      sync.Mutex
+	seq        uint64            // optimistic commits so far
+	versions   map[string]uint64 // by key, the commit that last wrote it
+	optimistic map[*Optimistic]bool
+}
+
+// Open opens or creates the transaction log at path and recovers the files
+// it names; see "Transactions" in txn.go. The log is locked until Close.
+func Open(path string) (*Log, error) {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("open transaction log: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open transaction log: %w", err)
+	}
+	if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock transaction log: %w", err)
+	}
+	l := &Log{file: f, dir: dir, base: 1, next: 1, paths: make(map[string]bool)}
+	if err := l.recover(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("recover transaction log: %w", err)
+	}
+	return l, nil
+}
+
+// Close closes the log. An open transaction is rolled back first.
+func (l *Log) Close() error {
+	ckptErr := l.StopCheckpointer()
+	l.mu.Lock()
+	tx := l.tx
+	l.mu.Unlock()
+	var err error
+	if tx != nil {
+		err = tx.Rollback()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Join(ckptErr, err, l.force(), l.file.Close())
+}
+
+// reset empties the log, numbering the next record base.
+func (l *Log) reset(base uint64) error {
+	header := append([]byte(nil), logMagic[:]...)
+	header = binary.LittleEndian.AppendUint32(header, logVersion)
+	header = binary.LittleEndian.AppendUint64(header, base)
+	if err := l.file.Truncate(logHeaderSize); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.base, l.next, l.buf = base, base, nil
+	return nil
+}
+
+// size returns the bytes of records in the log, written or not.
+func (l *Log) size() uint64 {
+	return l.next - l.base
+}
+
+// append buffers rec and returns its LSN.
+func (l *Log) append(rec record) uint64 {
+	rec.lsn = l.next
+	body := binary.LittleEndian.AppendUint64(nil, rec.lsn)
+	body = append(body, rec.kind)
+	body = binary.LittleEndian.AppendUint64(body, rec.tx)
+	body = binary.LittleEndian.AppendUint64(body, rec.prev)
+	if rec.kind == recUpdate || rec.kind == recCLR {
+		w := rec.w
+		w.Path = l.relPath(w.Path)
+		body = appendWrite(body, w)
+	}
+	if rec.kind == recCLR {
+		body = binary.LittleEndian.AppendUint64(body, rec.undoNext)
+	}
+	l.buf = binary.LittleEndian.AppendUint32(l.buf, uint32(len(body)))
+	l.buf = binary.LittleEndian.AppendUint32(l.buf, crc32.ChecksumIEEE(body))
+	l.buf = append(l.buf, body...)
+	l.next += uint64(8 + len(body))
+	return rec.lsn
+}
+
+// relPath returns path as a record names it, relative to the log's
+// directory.
+func (l *Log) relPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(l.dir, abs); err == nil {
+		return rel
+	}
+	return abs
+}
+
+// absPath returns the path of the file a record names as path.
+func (l *Log) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(l.dir, path)
+}
+
+// force writes the buffered records and syncs the log.
+func (l *Log) force() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	off := logHeaderSize + int64(l.next-l.base) - int64(len(l.buf))
+	if _, err := l.file.WriteAt(l.buf, off); err != nil {
+		return fmt.Errorf("write transaction log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("sync transaction log: %w", err)
+	}
+	l.buf = l.buf[:0]
+	return nil
+}
+
+// parseRecord decodes the record framed at the start of b and returns its
+// framed length, or 0 if b starts with a torn record.
+func parseRecord(b []byte) (record, int, error) {
+	if len(b) < 8 {
+		return record{}, 0, nil
+	}
+	n := int(binary.LittleEndian.Uint32(b[0:4]))
+	if 8+n > len(b) || crc32.ChecksumIEEE(b[8:8+n]) != binary.LittleEndian.Uint32(b[4:8]) {
+		return record{}, 0, nil
+	}
+	body := b[8 : 8+n]
+	if len(body) < 25 {
+		return record{}, 0, errors.New("transaction log record truncated")
+	}
+	rec := record{
+		lsn:  binary.LittleEndian.Uint64(body[0:8]),
+		kind: body[8],
+		tx:   binary.LittleEndian.Uint64(body[9:17]),
+		prev: binary.LittleEndian.Uint64(body[17:25]),
+	}
+	rest := body[25:]
+	if rec.kind == recUpdate || rec.kind == recCLR {
+		var err error
+		if rec.w, rest, err = parseWrite(rest); err != nil {
+			return record{}, 0, err
+		}
+	}
+	if rec.kind == recCLR {
+		if len(rest) < 8 {
+			return record{}, 0, errors.New("transaction log record truncated")
+		}
+		rec.undoNext = binary.LittleEndian.Uint64(rest[0:8])
+	}
+	return rec, 8 + n, nil
+}
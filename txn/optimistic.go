@@ -0,0 +1,157 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Optimistic transactions
+
+An Optimistic transaction takes no lock while it runs. It notes the keys it
+reads and keeps its writes as functions, to be run at Commit; any number can
+be open at once, alongside each other and a Txn. Commit checks that no key
+it read has been written by another optimistic commit since, and if so
+runs the writes in a Txn over its participants; otherwise it fails with
+ErrConflict and the caller retries. Under low contention that almost never
+happens, and no reader ever waits on a writer.
+
+Keys are strings the caller chooses, such as a table name and a primary
+key. Each key's version is the sequence number of the optimistic commit
+that last wrote it, and a read records the sequence number current as it
+is taken: the read conflicts if the key's version has since passed it.
+Commits are serialized, validate and apply together, and take versions
+from one counter, so a version never goes backwards. Versions live in
+memory only and are dropped once no open transaction began before them.
+Writes made through a plain Txn are not versioned, so a key should be
+written one way or the other, not both.
+*/
+
+// ErrConflict is returned by Optimistic.Commit when a key the transaction
+// read was written since; the transaction is rolled back.
+var ErrConflict = errors.New("transaction conflicts with a later commit")
+
+// Optimistic is an open optimistic transaction; see "Optimistic
+// transactions" above.
+type Optimistic struct {
+	log    *Log
+	parts  []Participant
+	start  uint64            // sequence number when it began
+	reads  map[string]uint64 // sequence number when each key was first read
+	writes []string
+	ops    []func() error
+	done   bool
+}
+
+// BeginOptimistic starts an optimistic transaction whose writes go to
+// parts.
+func (l *Log) BeginOptimistic(parts ...Participant) *Optimistic {
+	l.optMu.Lock()
+	defer l.optMu.Unlock()
+	o := &Optimistic{log: l, parts: parts, start: l.seq, reads: make(map[string]uint64)}
+	if l.optimistic == nil {
+		l.optimistic = make(map[*Optimistic]bool)
+	}
+	l.optimistic[o] = true
+	return o
+}
+
+// Read records a read of key and calls fn to make it. The read is recorded
+// first, so a commit that lands while fn runs is never missed.
+func (o *Optimistic) Read(key string, fn func() error) error {
+	l := o.log
+	l.optMu.Lock()
+	if o.done {
+		l.optMu.Unlock()
+		return ErrTxnDone
+	}
+	if _, ok := o.reads[key]; !ok {
+		o.reads[key] = l.seq
+	}
+	l.optMu.Unlock()
+	return fn()
+}
+
+// Write records that fn writes key; fn runs at Commit, inside a Txn.
+func (o *Optimistic) Write(key string, fn func() error) error {
+	l := o.log
+	l.optMu.Lock()
+	defer l.optMu.Unlock()
+	if o.done {
+		return ErrTxnDone
+	}
+	o.writes = append(o.writes, key)
+	o.ops = append(o.ops, fn)
+	return nil
+}
+
+// Commit validates the transaction's reads and, if none conflicts, runs its
+// writes in a Txn and commits it. It returns ErrConflict, wrapped, if a key
+// read was written since.
+func (o *Optimistic) Commit() error {
+	l := o.log
+	l.optMu.Lock()
+	defer l.optMu.Unlock()
+	if o.done {
+		return ErrTxnDone
+	}
+	defer o.end()
+	for key, seen := range o.reads {
+		if l.versions[key] > seen {
+			return fmt.Errorf("Commit: %w: %q", ErrConflict, key)
+		}
+	}
+	if len(o.ops) == 0 {
+		return nil
+	}
+
+	tx, err := l.Begin(o.parts...)
+	if err != nil {
+		return fmt.Errorf("Commit: %w", err)
+	}
+	for _, op := range o.ops {
+		if err := op(); err != nil {
+			return errors.Join(fmt.Errorf("Commit: %w", err), tx.Rollback())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	l.seq++
+	if l.versions == nil {
+		l.versions = make(map[string]uint64)
+	}
+	for _, key := range o.writes {
+		l.versions[key] = l.seq
+	}
+	return nil
+}
+
+// Rollback drops the transaction's writes.
+func (o *Optimistic) Rollback() error {
+	l := o.log
+	l.optMu.Lock()
+	defer l.optMu.Unlock()
+	if o.done {
+		return ErrTxnDone
+	}
+	o.end()
+	return nil
+}
+
+// end closes the transaction and drops the versions no open transaction
+// can conflict with. Called with optMu held.
+func (o *Optimistic) end() {
+	l := o.log
+	o.done = true
+	delete(l.optimistic, o)
+	oldest := l.seq
+	for open := range l.optimistic {
+		oldest = min(oldest, open.start)
+	}
+	for key, v := range l.versions {
+		if v <= oldest {
+			delete(l.versions, key)
+		}
+	}
+}
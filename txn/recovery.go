@@ -0,0 +1,161 @@
+package txn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+/*
+Recovery
+
+Open reads the log and recovers in the three ARIES passes:
+
+ 1. Analysis reads every record up to the first torn one, which is cut
+    off, and finds each transaction's last record and whether it committed
+    or ended.
+ 2. Redo repeats history: every update's write and every CLR's undo is made
+    again, in log order, whether or not it reached the file before the
+    crash. This includes the writes of transactions that will be undone.
+ 3. Undo rolls back every transaction that neither committed nor ended,
+    newest record first across all of them, following each transaction's
+    prev chain. An update is undone and a CLR logged for it; a CLR from an
+    earlier rollback sends the walk straight to its undoNext, so nothing is
+    undone twice even if recovery itself crashed. An end record closes each
+    transaction once its chain is exhausted.
+
+Finally the files are synced and the log emptied, as at a checkpoint. The
+files are locked while recovery writes them, so a participant another
+process still has open makes Open fail rather than change under it.
+*/
+
+// txnState is what analysis learns of one transaction.
+type txnState struct {
+	last      uint64
+	committed bool
+	ended     bool
+}
+
+// recover runs analysis, redo and undo over the records in the log.
+func (l *Log) recover() error {
+	buf, err := io.ReadAll(io.NewSectionReader(l.file, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if len(buf) < logHeaderSize {
+		return l.reset(1)
+	}
+	if [4]byte(buf[0:4]) != logMagic {
+		return errors.New("not a transaction log")
+	}
+	if v := binary.LittleEndian.Uint32(buf[4:8]); v != logVersion {
+		return fmt.Errorf("unsupported transaction log version: %d", v)
+	}
+	l.base = binary.LittleEndian.Uint64(buf[8:16])
+	l.next = l.base
+
+	// analysis
+	recs := make(map[uint64]record)
+	var order []record
+	txns := make(map[uint64]*txnState)
+	for rest := buf[logHeaderSize:]; ; {
+		rec, n, err := parseRecord(rest)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		rest = rest[n:]
+		l.next += uint64(n)
+		if rec.kind == recUpdate || rec.kind == recCLR {
+			rec.w.Path = l.absPath(rec.w.Path)
+		}
+		recs[rec.lsn] = rec
+		order = append(order, rec)
+		st := txns[rec.tx]
+		if st == nil {
+			st = &txnState{}
+			txns[rec.tx] = st
+		}
+		st.last = rec.lsn
+		switch rec.kind {
+		case recCommit:
+			st.committed = true
+		case recEnd:
+			st.ended = true
+		}
+	}
+	if err := l.file.Truncate(logHeaderSize + int64(l.next-l.base)); err != nil {
+		return err
+	}
+
+	files := make(fileSet)
+	defer files.close()
+	for _, rec := range order {
+		if rec.kind == recUpdate || rec.kind == recCLR {
+			if _, err := files.open(rec.w.Path, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	// redo
+	for _, rec := range order {
+		switch rec.kind {
+		case recUpdate:
+			err = files.redo(rec.w)
+		case recCLR:
+			err = files.undo(rec.w)
+		}
+		if err != nil {
+			return fmt.Errorf("redo LSN %d: %w", rec.lsn, err)
+		}
+	}
+
+	// undo
+	undo := make(map[uint64]uint64) // next LSN to undo by transaction
+	for tx, st := range txns {
+		if !st.committed && !st.ended {
+			undo[tx] = st.last
+		}
+	}
+	for len(undo) > 0 {
+		losers := make([]uint64, 0, len(undo))
+		for tx := range undo {
+			losers = append(losers, tx)
+		}
+		sort.Slice(losers, func(i, j int) bool { return undo[losers[i]] > undo[losers[j]] })
+		tx := losers[0]
+		rec, ok := recs[undo[tx]]
+		if !ok {
+			return fmt.Errorf("undo: LSN %d is not in the log", undo[tx])
+		}
+		next := rec.prev
+		switch rec.kind {
+		case recUpdate:
+			if err := files.undo(rec.w); err != nil {
+				return fmt.Errorf("undo LSN %d: %w", rec.lsn, err)
+			}
+			txns[tx].last = l.append(record{kind: recCLR, tx: tx, prev: txns[tx].last, w: rec.w, undoNext: rec.prev})
+		case recCLR:
+			next = rec.undoNext
+		}
+		if next == 0 || rec.kind == recBegin {
+			l.append(record{kind: recEnd, tx: tx, prev: txns[tx].last})
+			delete(undo, tx)
+		} else {
+			undo[tx] = next
+		}
+	}
+	if err := l.force(); err != nil {
+		return err
+	}
+
+	if err := files.sync(); err != nil {
+		return err
+	}
+	return l.reset(l.next)
+}
@@ -0,0 +1,390 @@
+// Package txn groups writes to several index and row files into atomic
+// transactions, recovered ARIES-style after a crash.
+package txn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pranavdb/filelock"
+	"pranavdb/internal/failpoint"
+)
+
+/*
+Transactions
+
+A Txn makes the writes of several participants - DiskTrees and rowfiles -
+take effect all together or not at all, so a crash can never leave an index
+entry naming a row that was never written, or a row no index entry names.
+Between Begin and Commit each participant holds its writes in memory
+instead of applying them; its own reads see them. Every write comes with
+the bytes it replaces (its before image) and the file size before it.
+
+The log (see log.go) records each write as an update record carrying both
+images, chained to the transaction's previous record. The usual write-ahead
+rule holds: a write reaches its file only once its record is synced.
+
+  - Spill logs the writes held so far, syncs the log and has the
+    participants apply them, so a long transaction need not keep them all
+    in memory (ARIES' "steal").
+  - Commit logs the writes still held and a commit record, syncs the log,
+    and applies them without syncing the files ("no force"); the log redoes
+    them after a crash.
+  - Rollback undoes the spilled writes from their before images, newest
+    first, logging a compensation record (CLR) for each, then drops the
+    held writes; each participant reloads its in-memory state.
+
+Open recovers in three passes (see recovery.go): analysis finds the
+transactions without a commit, redo repeats every update and CLR in log
+order, and undo rolls the unfinished transactions back. Records hold full
+byte images rather than page operations, so redo repeats each one
+unconditionally instead of comparing it with an LSN stamped in the page:
+applying an image twice is harmless, and neither file format has to change.
+
+One transaction runs at a time per log. The files of its participants must
+be written only through its transactions, and be closed or not yet opened
+while Open recovers them. Begin fails rather than waits while another
+transaction is open, and optimistic transactions (see optimistic.go) take
+no locks at all, so no transaction ever waits for another and none can
+deadlock.
+*/
+
+// ErrTxnDone is returned by Commit, Rollback and Spill on a transaction that
+// has already ended.
+var ErrTxnDone = errors.New("transaction has already ended")
+
+// Write is one change a participant held back during a transaction: Data
+// written at Off in the file at Path or, if Truncate is set, the file cut
+// to Off bytes. Before holds the bytes the change replaced, up to OldSize,
+// the size of the file before it.
+type Write struct {
+	Path     string
+	Off      int64
+	Data     []byte
+	Truncate bool
+	Before   []byte
+	OldSize  int64
+}
+
+// Participant is a store whose writes a Txn can hold back and commit.
+type Participant interface {
+	// BeginTxn starts holding writes back.
+	BeginTxn() error
+	// TxnWrites returns the writes held, in the order they must be applied.
+	TxnWrites() ([]Write, error)
+	// ApplyTxn applies the held writes, which are logged, and stops holding
+	// them; the transaction stays open.
+	ApplyTxn() error
+	// EndTxn ends the transaction. With commit set the writes still held
+	// are applied; otherwise they are dropped and the in-memory state is
+	// reloaded from the files, from which the log has already undone any
+	// applied write.
+	EndTxn(commit bool) error
+}
+
+// Txn is an open transaction; see "Transactions" above.
+type Txn struct {
+	log     *Log
+	parts   []Participant
+	id      uint64   // LSN of its begin record
+	last    uint64   // LSN of its latest record
+	spilled []record // update records applied to the files, oldest first
+	done    bool
+
+	views map[Viewer]io.Closer // set in read-only transactions, see view.go
+}
+
+// Begin starts a transaction over parts. It fails while another transaction
+// on the log is open.
+func (l *Log) Begin(parts ...Participant) (*Txn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.tx != nil {
+		return nil, errors.New("Begin: a transaction is already open")
+	}
+	for i, p := range parts {
+		if err := p.BeginTxn(); err != nil {
+			for _, begun := range parts[:i] {
+				err = errors.Join(err, begun.EndTxn(false))
+			}
+			return nil, fmt.Errorf("Begin: %w", err)
+		}
+	}
+	tx := &Txn{log: l, parts: parts}
+	tx.id = l.append(record{kind: recBegin, tx: l.next})
+	tx.last = tx.id
+	l.tx = tx
+	return tx, nil
+}
+
+// logWrites appends an update record for every write the participants
+// hold.
+func (tx *Txn) logWrites() ([]record, error) {
+	var recs []record
+	for _, p := range tx.parts {
+		writes, err := p.TxnWrites()
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range writes {
+			tx.log.paths[w.Path] = true
+			rec := record{kind: recUpdate, tx: tx.id, prev: tx.last, w: w}
+			rec.lsn = tx.log.append(rec)
+			tx.last = rec.lsn
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// Spill logs and applies the writes held so far, keeping the transaction
+// open. A failure rolls the transaction back.
+func (tx *Txn) Spill() error {
+	l := tx.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if tx.views != nil {
+		return ErrTxnReadOnly
+	}
+	if tx.done {
+		return ErrTxnDone
+	}
+	recs, err := tx.logWrites()
+	if err == nil {
+		err = l.force()
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("Spill: %w", err), tx.rollback())
+	}
+	if err := failpoint.Inject("after-spill-force"); err != nil {
+		return errors.Join(fmt.Errorf("Spill: %w", err), tx.rollback())
+	}
+	for _, p := range tx.parts {
+		if err := p.ApplyTxn(); err != nil {
+			// some of recs may have reached the files
+			tx.spilled = append(tx.spilled, recs...)
+			return errors.Join(fmt.Errorf("Spill: %w", err), tx.rollback())
+		}
+	}
+	tx.spilled = append(tx.spilled, recs...)
+	return nil
+}
+
+// Commit makes the transaction durable and applies its writes. If it fails
+// before the commit record is synced, the transaction is rolled back. If it
+// fails after, the log refuses new transactions until it is reopened, which
+// redoes the commit.
+func (tx *Txn) Commit() error {
+	l := tx.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if tx.views != nil {
+		return ErrTxnReadOnly
+	}
+	if tx.done {
+		return ErrTxnDone
+	}
+	if _, err := tx.logWrites(); err != nil {
+		return errors.Join(fmt.Errorf("Commit: %w", err), tx.rollback())
+	}
+	tx.last = l.append(record{kind: recCommit, tx: tx.id, prev: tx.last})
+	tx.done, l.tx = true, nil
+	err := l.force()
+	if err != nil {
+		// the commit record may or may not be on disk; recovery finds out
+		l.err = fmt.Errorf("transaction log: commit unsure; reopen to recover: %w", err)
+		for _, p := range tx.parts {
+			err = errors.Join(err, p.EndTxn(false))
+		}
+		return errors.Join(l.err, err)
+	}
+
+	// an injected failure drops the writes as a crash would; recovery redoes
+	// them
+	err = failpoint.Inject("after-commit-force")
+	apply := err == nil
+	for _, p := range tx.parts {
+		err = errors.Join(err, p.EndTxn(apply))
+	}
+	if err != nil {
+		l.err = fmt.Errorf("transaction log: commit not applied; reopen to recover: %w", err)
+		return l.err
+	}
+	l.append(record{kind: recEnd, tx: tx.id, prev: tx.last})
+	if l.size() >= logCheckpointSize {
+		if err := l.checkpoint(); err != nil {
+			return fmt.Errorf("Commit: %w", err)
+		}
+	}
+	return nil
+}
+
+// Rollback undoes the transaction's writes.
+func (tx *Txn) Rollback() error {
+	l := tx.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if tx.views != nil {
+		return ErrTxnReadOnly
+	}
+	if tx.done {
+		return ErrTxnDone
+	}
+	if err := tx.rollback(); err != nil {
+		return fmt.Errorf("Rollback: %w", err)
+	}
+	return nil
+}
+
+// rollback undoes the spilled writes, newest first, drops the held ones and
+// ends the transaction. Called with l.mu held.
+func (tx *Txn) rollback() error {
+	l := tx.log
+	tx.done, l.tx = true, nil
+	tx.last = l.append(record{kind: recAbort, tx: tx.id, prev: tx.last})
+
+	files := make(fileSet)
+	defer files.close()
+	var err error
+	for i := len(tx.spilled) - 1; i >= 0; i-- {
+		rec := tx.spilled[i]
+		if err = failpoint.Inject("rollback-undo"); err != nil {
+			break
+		}
+		if err = files.undo(rec.w); err != nil {
+			break
+		}
+		tx.last = l.append(record{kind: recCLR, tx: tx.id, prev: tx.last, w: rec.w, undoNext: rec.prev})
+	}
+	if err != nil {
+		// recovery finishes the undo from the log
+		l.err = fmt.Errorf("transaction log: rollback not finished; reopen to recover: %w", err)
+	} else {
+		l.append(record{kind: recEnd, tx: tx.id, prev: tx.last})
+	}
+	for _, p := range tx.parts {
+		err = errors.Join(err, p.EndTxn(false))
+	}
+	return err
+}
+
+// fileSet holds the files recovery and rollback write to by path, each
+// opened once.
+type fileSet map[string]*os.File
+
+// open returns the file at path, opening it on first use. With lock set the
+// file is locked exclusively, which fails while its owner has it open.
+func (fs fileSet) open(path string, lock bool) (*os.File, error) {
+	if f, ok := fs[path]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if lock {
+		if err := filelock.Lock(f, filelock.Exclusive); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	fs[path] = f
+	return f, nil
+}
+
+// redo makes w again.
+func (fs fileSet) redo(w Write) error {
+	f, err := fs.open(w.Path, false)
+	if err != nil {
+		return err
+	}
+	if w.Truncate {
+		return f.Truncate(w.Off)
+	}
+	_, err = f.WriteAt(w.Data, w.Off)
+	return err
+}
+
+// undo puts back what w replaced, assuming every later write is already
+// undone.
+func (fs fileSet) undo(w Write) error {
+	f, err := fs.open(w.Path, false)
+	if err != nil {
+		return err
+	}
+	if w.Truncate || w.Off+int64(len(w.Data)) > w.OldSize {
+		if err := f.Truncate(w.OldSize); err != nil {
+			return err
+		}
+	}
+	if len(w.Before) == 0 {
+		return nil
+	}
+	_, err = f.WriteAt(w.Before, w.Off)
+	return err
+}
+
+// sync syncs every file in the set.
+func (fs fileSet) sync() error {
+	for _, f := range fs {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs fileSet) close() {
+	for _, f := range fs {
+		f.Close()
+	}
+}
+
+func appendWrite(b []byte, w Write) []byte {
+	var op byte
+	if w.Truncate {
+		op = 1
+	}
+	b = append(b, op)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(w.Path)))
+	b = append(b, w.Path...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(w.Off))
+	b = binary.LittleEndian.AppendUint64(b, uint64(w.OldSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(w.Before)))
+	b = append(b, w.Before...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(w.Data)))
+	return append(b, w.Data...)
+}
+
+func parseWrite(b []byte) (Write, []byte, error) {
+	errTrunc := errors.New("transaction log record truncated")
+	if len(b) < 3 {
+		return Write{}, nil, errTrunc
+	}
+	w := Write{Truncate: b[0] == 1}
+	n := int(binary.LittleEndian.Uint16(b[1:3]))
+	if len(b) < 3+n+20 {
+		return Write{}, nil, errTrunc
+	}
+	w.Path = string(b[3 : 3+n])
+	b = b[3+n:]
+	w.Off = int64(binary.LittleEndian.Uint64(b[0:8]))
+	w.OldSize = int64(binary.LittleEndian.Uint64(b[8:16]))
+	n = int(binary.LittleEndian.Uint32(b[16:20]))
+	if len(b) < 20+n+4 {
+		return Write{}, nil, errTrunc
+	}
+	w.Before = b[20 : 20+n]
+	b = b[20+n:]
+	n = int(binary.LittleEndian.Uint32(b[0:4]))
+	if len(b) < 4+n {
+		return Write{}, nil, errTrunc
+	}
+	w.Data = b[4 : 4+n]
+	return w, b[4+n:], nil
+}
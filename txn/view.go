@@ -0,0 +1,78 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+Read-only transactions
+
+View runs a callback in a read-only transaction, as bbolt's DB.View does:
+everything it reads through the transaction is as of the last commit before
+View began, however many transactions commit while it runs. Each store
+taking part is a Viewer, which opens a read-only copy of itself: a DiskTree
+over its file with the later writes' before images laid on top, or a
+versioned rowfile's Snapshot. The views are opened under the log's lock, so
+no commit lands between two of them.
+
+Views read the files directly, so they neither wait for a writer's
+transaction nor hold one up, except while a commit applies its writes.
+*/
+
+// ErrTxnReadOnly is returned by Commit, Rollback and Spill on a transaction
+// View opened.
+var ErrTxnReadOnly = errors.New("transaction is read-only")
+
+// Viewer is a store a read-only transaction can read.
+type Viewer interface {
+	// ViewTxn returns a read-only copy of the store as of its last commit,
+	// which stays that way until it is closed.
+	ViewTxn() (io.Closer, error)
+}
+
+// View calls fn in a read-only transaction over parts; see "Read-only
+// transactions" above. The views are closed when fn returns, and fn's error
+// is returned.
+func (l *Log) View(fn func(tx *Txn) error, parts ...Viewer) error {
+	tx := &Txn{log: l, views: make(map[Viewer]io.Closer, len(parts))}
+	defer tx.closeViews()
+	if err := tx.openViews(parts); err != nil {
+		return fmt.Errorf("View: %w", err)
+	}
+	return fn(tx)
+}
+
+// openViews opens a view of each part with no commit in progress.
+func (tx *Txn) openViews(parts []Viewer) error {
+	l := tx.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	for _, p := range parts {
+		v, err := p.ViewTxn()
+		if err != nil {
+			return err
+		}
+		tx.views[p] = v
+	}
+	return nil
+}
+
+func (tx *Txn) closeViews() {
+	for _, v := range tx.views {
+		v.Close()
+	}
+	tx.done = true
+}
+
+// View returns the read-only copy of p a transaction View opened, for the
+// caller to assert to its type: an *index.DiskTree for a DiskTree, a
+// *data.Snapshot for a rowfile. It returns nil if p is not part of the
+// transaction.
+func (tx *Txn) View(p Viewer) io.Closer {
+	return tx.views[p]
+}